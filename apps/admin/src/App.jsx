@@ -4,10 +4,16 @@ const CORE_API = import.meta.env.VITE_CORE_API || 'http://localhost:8081'
 const BOOKING_API = import.meta.env.VITE_BOOKING_API || 'http://localhost:8082'
 const BOOKING_ADMIN_SECRET = import.meta.env.VITE_BOOKING_ADMIN_SECRET || ''
 
+const emptyVoucherForm = { code: '', title: '', discount_type: 'flat', discount_value: 0, min_spend: 0, max_discount: 0, max_uses: 0, per_user_limit: 0, product_ids: '', category_ids: '', tiers: '', first_order_only: false, stacking: 'stack', starts_at: '', expires_at: '', active: true }
+const splitList = (v) => (v || '').split(',').map(x => x.trim()).filter(Boolean)
+
 export default function App() {
   const [tab, setTab] = useState('produk')
   const [adminToken, setAdminToken] = useState(localStorage.getItem('admin_token') || '')
-  const [loginForm, setLoginForm] = useState({ email: '', password: '' })
+  const [loginForm, setLoginForm] = useState({ email: '', password: '', totp_code: '' })
+  const [loginMessage, setLoginMessage] = useState('')
+  const [totpNeeded, setTotpNeeded] = useState(false)
+  const [totpSetup, setTotpSetup] = useState({ required: false, secret: '', uri: '', code: '', recoveryCodes: [], message: '' })
   const [products, setProducts] = useState([])
   const [schedules, setSchedules] = useState([])
   const [members, setMembers] = useState([])
@@ -26,7 +32,7 @@ export default function App() {
   const [productFile, setProductFile] = useState(null)
   const [scheduleForm, setScheduleForm] = useState({ doctor_name: '', day_of_week: 'Senin', start_time: '09:00', end_time: '16:00', location: 'Petshop Bento - Cikande' })
   const [scheduleEditId, setScheduleEditId] = useState('')
-  const [voucherForm, setVoucherForm] = useState({ code: '', title: '', discount_type: 'flat', discount_value: 0, min_spend: 0, max_uses: 0, expires_at: '', active: true })
+  const [voucherForm, setVoucherForm] = useState(emptyVoucherForm)
   const [voucherEditCode, setVoucherEditCode] = useState('')
   const [staffForm, setStaffForm] = useState({ name: '', email: '', phone: '', password: '', role: 'staff' })
   const [staffEditId, setStaffEditId] = useState('')
@@ -63,7 +69,7 @@ export default function App() {
   }
 
   const load = () => {
-    fetch(`${CORE_API}/products`, { headers: adminHeaders }).then(r => r.json()).then(setProducts).catch(() => setProducts([]))
+    fetch(`${CORE_API}/products?limit=100`, { headers: adminHeaders }).then(r => r.json()).then(data => setProducts(data.items || [])).catch(() => setProducts([]))
     fetch(`${BOOKING_API}/schedules`).then(r => r.json()).then(setSchedules).catch(() => setSchedules([]))
     fetch(`${CORE_API}/admin/members`, { headers: adminHeaders }).then(r => r.json()).then(setMembers).catch(() => setMembers([]))
     fetch(`${CORE_API}/admin/orders`, { headers: adminHeaders }).then(r => r.json()).then(setOrders).catch(() => setOrders([]))
@@ -135,9 +141,14 @@ export default function App() {
     fetch(voucherEditCode ? `${CORE_API}/admin/vouchers/${targetCode}` : `${CORE_API}/admin/vouchers`, {
       method: voucherEditCode ? 'PUT' : 'POST',
       headers: { 'Content-Type': 'application/json', ...adminHeaders },
-      body: JSON.stringify(voucherForm)
+      body: JSON.stringify({
+        ...voucherForm,
+        product_ids: splitList(voucherForm.product_ids),
+        category_ids: splitList(voucherForm.category_ids),
+        tiers: splitList(voucherForm.tiers)
+      })
     }).then(() => {
-      setVoucherForm({ code: '', title: '', discount_type: 'flat', discount_value: 0, min_spend: 0, max_uses: 0, expires_at: '', active: true })
+      setVoucherForm(emptyVoucherForm)
       setVoucherEditCode('')
       load()
     })
@@ -184,7 +195,7 @@ export default function App() {
   }
 
   const editProduct = (p) => {
-    setProductForm({ name: p.name || '', description: p.description || '', price: p.price || 0, stock: p.stock || 0, category: p.category || '' })
+    setProductForm({ name: p.name || '', description: p.description || '', price: p.price || 0, stock: p.on_hand ?? p.stock ?? 0, category: p.category || '' })
     setProductEditId(p.id)
   }
 
@@ -208,7 +219,15 @@ export default function App() {
       discount_type: v.discount_type || 'flat',
       discount_value: v.discount_value || 0,
       min_spend: v.min_spend || 0,
+      max_discount: v.max_discount || 0,
       max_uses: v.max_uses || 0,
+      per_user_limit: v.per_user_limit || 0,
+      product_ids: (v.product_ids || []).join(', '),
+      category_ids: (v.category_ids || []).join(', '),
+      tiers: (v.tiers || []).join(', '),
+      first_order_only: !!v.first_order_only,
+      stacking: v.stacking || 'stack',
+      starts_at: v.starts_at || '',
       expires_at: v.expires_at || '',
       active: v.active ?? true
     })
@@ -287,15 +306,59 @@ export default function App() {
 
   const submitLogin = (e) => {
     e.preventDefault()
+    const { totp_code, ...credentials } = loginForm
+    const code = totp_code.trim()
+    // recovery codes look like abcde-fghjk; authenticator codes are 6 digits
+    const secondFactor = !code ? {} : (code.includes('-') || code.length > 6 ? { recovery_code: code } : { totp_code: code })
     fetch(`${CORE_API}/admin/login`, {
       method: 'POST',
       headers: { 'Content-Type': 'application/json' },
-      body: JSON.stringify(loginForm)
+      body: JSON.stringify({ ...credentials, ...secondFactor })
     }).then(r => r.json()).then(data => {
       if (data.token) {
         localStorage.setItem('admin_token', data.token)
         setAdminToken(data.token)
+        setTotpNeeded(false)
+        setLoginMessage('')
+        setLoginForm({ email: loginForm.email, password: '', totp_code: '' })
+        setTotpSetup(prev => ({ ...prev, required: !!data.totp_setup_required }))
+        return
+      }
+      if (data.totp_required) {
+        setTotpNeeded(true)
       }
+      setLoginMessage(data.error || 'Login gagal')
+    })
+  }
+
+  useEffect(() => {
+    if (!adminToken) return
+    fetch(`${CORE_API}/me/2fa`, { headers: { 'X-Auth-Token': adminToken } })
+      .then(r => r.ok ? r.json() : null)
+      .then(data => {
+        if (data) setTotpSetup(prev => ({ ...prev, required: data.required && !data.enabled }))
+      })
+      .catch(() => {})
+  }, [adminToken])
+
+  const startTotpSetup = () => {
+    fetch(`${CORE_API}/me/2fa/setup`, { method: 'POST', headers: adminHeaders })
+      .then(r => r.json())
+      .then(data => setTotpSetup(prev => ({ ...prev, secret: data.secret || '', uri: data.otpauth_uri || '', message: data.error || '' })))
+  }
+
+  const confirmTotpSetup = (e) => {
+    e.preventDefault()
+    fetch(`${CORE_API}/me/2fa/enable`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json', ...adminHeaders },
+      body: JSON.stringify({ code: totpSetup.code })
+    }).then(r => r.json()).then(data => {
+      if (data.recovery_codes) {
+        setTotpSetup(prev => ({ ...prev, recoveryCodes: data.recovery_codes, code: '', message: '' }))
+        return
+      }
+      setTotpSetup(prev => ({ ...prev, message: data.error || 'Kode salah' }))
     })
   }
 
@@ -305,6 +368,7 @@ export default function App() {
     }
     localStorage.removeItem('admin_token')
     setAdminToken('')
+    setTotpSetup({ required: false, secret: '', uri: '', code: '', recoveryCodes: [], message: '' })
   }
 
   if (!adminToken) {
@@ -315,14 +379,50 @@ export default function App() {
           <form className="form-grid" onSubmit={submitLogin}>
             <input placeholder="Email" value={loginForm.email} onChange={(e) => setLoginForm({ ...loginForm, email: e.target.value })} />
             <input placeholder="Password" type="password" value={loginForm.password} onChange={(e) => setLoginForm({ ...loginForm, password: e.target.value })} />
+            {totpNeeded && (
+              <input placeholder="Kode 2FA atau kode pemulihan" value={loginForm.totp_code} onChange={(e) => setLoginForm({ ...loginForm, totp_code: e.target.value })} />
+            )}
             <button className="btn" type="submit">Masuk</button>
           </form>
+          {loginMessage && <p>{loginMessage}</p>}
           <p>Gunakan endpoint /admin/bootstrap untuk buat admin pertama.</p>
         </div>
       </div>
     )
   }
 
+  if (totpSetup.required) {
+    return (
+      <div className="login-wrap">
+        <div className="card">
+          <h3>Aktifkan Verifikasi 2 Langkah</h3>
+          {totpSetup.recoveryCodes.length > 0 ? (
+            <>
+              <p>Simpan kode pemulihan ini di tempat aman. Setiap kode hanya bisa dipakai sekali dan tidak akan ditampilkan lagi.</p>
+              <pre>{totpSetup.recoveryCodes.join('\n')}</pre>
+              <button className="btn" onClick={() => setTotpSetup(prev => ({ ...prev, required: false, recoveryCodes: [], secret: '', uri: '' }))}>Lanjut ke Dashboard</button>
+            </>
+          ) : !totpSetup.secret ? (
+            <>
+              <p>Akun owner dan admin wajib memakai aplikasi authenticator (Google Authenticator, Authy, dll).</p>
+              <button className="btn" onClick={startTotpSetup}>Mulai</button>
+            </>
+          ) : (
+            <form className="form-grid" onSubmit={confirmTotpSetup}>
+              <p>Tambahkan akun ke aplikasi authenticator dengan kunci berikut, lalu masukkan kode 6 digit.</p>
+              <code>{totpSetup.secret}</code>
+              <a href={totpSetup.uri}>Buka di aplikasi authenticator</a>
+              <input placeholder="Kode 6 digit" value={totpSetup.code} onChange={(e) => setTotpSetup({ ...totpSetup, code: e.target.value })} />
+              <button className="btn" type="submit">Aktifkan</button>
+            </form>
+          )}
+          {totpSetup.message && <p>{totpSetup.message}</p>}
+          <button className="btn" onClick={logout}>Keluar</button>
+        </div>
+      </div>
+    )
+  }
+
   return (
     <div>
       <header className="header">
@@ -619,7 +719,22 @@ export default function App() {
                   </select>
                   <input placeholder="Nilai" type="number" value={voucherForm.discount_value} onChange={(e) => setVoucherForm({ ...voucherForm, discount_value: Number(e.target.value) })} />
                   <input placeholder="Min belanja" type="number" value={voucherForm.min_spend} onChange={(e) => setVoucherForm({ ...voucherForm, min_spend: Number(e.target.value) })} />
+                  <input placeholder="Max diskon (0 = tanpa batas)" type="number" value={voucherForm.max_discount} onChange={(e) => setVoucherForm({ ...voucherForm, max_discount: Number(e.target.value) })} />
                   <input placeholder="Max use (0 = unlimited)" type="number" value={voucherForm.max_uses} onChange={(e) => setVoucherForm({ ...voucherForm, max_uses: Number(e.target.value) })} />
+                  <input placeholder="Max per member (0 = unlimited)" type="number" value={voucherForm.per_user_limit} onChange={(e) => setVoucherForm({ ...voucherForm, per_user_limit: Number(e.target.value) })} />
+                  <input placeholder="ID produk (pisahkan koma)" value={voucherForm.product_ids} onChange={(e) => setVoucherForm({ ...voucherForm, product_ids: e.target.value })} />
+                  <input placeholder="ID kategori (pisahkan koma)" value={voucherForm.category_ids} onChange={(e) => setVoucherForm({ ...voucherForm, category_ids: e.target.value })} />
+                  <input placeholder="Tier (mis. Gold, Platinum)" value={voucherForm.tiers} onChange={(e) => setVoucherForm({ ...voucherForm, tiers: e.target.value })} />
+                  <select value={voucherForm.stacking} onChange={(e) => setVoucherForm({ ...voucherForm, stacking: e.target.value })}>
+                    <option value="stack">Gabung diskon tier</option>
+                    <option value="exclusive">Ganti diskon tier</option>
+                    <option value="best">Pakai yang terbesar</option>
+                  </select>
+                  <select value={voucherForm.first_order_only ? 'true' : 'false'} onChange={(e) => setVoucherForm({ ...voucherForm, first_order_only: e.target.value === 'true' })}>
+                    <option value="false">Semua order</option>
+                    <option value="true">Order pertama saja</option>
+                  </select>
+                  <input placeholder="Mulai (YYYY-MM-DD)" value={voucherForm.starts_at} onChange={(e) => setVoucherForm({ ...voucherForm, starts_at: e.target.value })} />
                   <input placeholder="Expire date (YYYY-MM-DD)" value={voucherForm.expires_at} onChange={(e) => setVoucherForm({ ...voucherForm, expires_at: e.target.value })} />
                   <select value={voucherForm.active ? 'true' : 'false'} onChange={(e) => setVoucherForm({ ...voucherForm, active: e.target.value === 'true' })}>
                     <option value="true">Active</option>
@@ -627,7 +742,7 @@ export default function App() {
                   </select>
                   <button className="btn" type="submit">{voucherEditCode ? 'Update' : 'Simpan'}</button>
                   {voucherEditCode && (
-                    <button className="btn" type="button" onClick={() => { setVoucherForm({ code: '', title: '', discount_type: 'flat', discount_value: 0, min_spend: 0, max_uses: 0, expires_at: '', active: true }); setVoucherEditCode('') }}>
+                    <button className="btn" type="button" onClick={() => { setVoucherForm(emptyVoucherForm); setVoucherEditCode('') }}>
                       Batal
                     </button>
                   )}
@@ -681,9 +796,13 @@ export default function App() {
                       <td>
                         <select onChange={(e) => updateOrderStatus(o.id, e.target.value)} defaultValue="">
                           <option value="" disabled>Pilih</option>
-                          <option value="PENDING">PENDING</option>
                           <option value="PAID">PAID</option>
+                          <option value="PACKED">PACKED</option>
+                          <option value="SHIPPED">SHIPPED</option>
+                          <option value="DELIVERED">DELIVERED</option>
+                          <option value="CANCELLED">CANCELLED</option>
                           <option value="FAILED">FAILED</option>
+                          <option value="REFUNDED">REFUNDED</option>
                         </select>
                       </td>
                       <td>{o.member_name}</td>
@@ -100,6 +100,7 @@ export default function App() {
   const [sessionId, setSessionId] = useState('')
   const [recommendations, setRecommendations] = useState([])
   const [cartId, setCartId] = useState(localStorage.getItem('cart_id') || '')
+  const [cartToken, setCartToken] = useState(localStorage.getItem('cart_token') || '')
   const [cartItems, setCartItems] = useState([])
   const [cartOpen, setCartOpen] = useState(false)
   const [productQuery, setProductQuery] = useState('')
@@ -112,7 +113,8 @@ export default function App() {
   const [myOrders, setMyOrders] = useState([])
   const [myAppointments, setMyAppointments] = useState([])
   const [myServices, setMyServices] = useState([])
-  const [loginForm, setLoginForm] = useState({ email: '', password: '' })
+  const [loginForm, setLoginForm] = useState({ email: '', password: '', totp_code: '' })
+  const [loginTotpNeeded, setLoginTotpNeeded] = useState(false)
   const [registerForm, setRegisterForm] = useState({ name: '', username: '', email: '', phone: '', password: '', avatar_url: '' })
   const [registerMethod, setRegisterMethod] = useState('email')
   const [avatarStatus, setAvatarStatus] = useState('')
@@ -184,10 +186,11 @@ export default function App() {
   const carouselRef = useRef(null)
   const touchStart = useRef(null)
   const driverWatchId = useRef(null)
+  const checkoutKeyRef = useRef('')
   const driverLastSent = useRef(0)
 
   useEffect(() => {
-    fetch(`${CORE_API}/products`).then(r => r.json()).then(setProducts).catch(() => setProducts([]))
+    fetch(`${CORE_API}/products?limit=100`).then(r => r.json()).then(data => setProducts(data.items || [])).catch(() => setProducts([]))
     fetch(`${BOOKING_API}/schedules`).then(r => r.json()).then(setSchedules).catch(() => setSchedules([]))
     fetch(`${CORE_API}/delivery/zones`).then(r => r.json()).then(setZones).catch(() => setZones([]))
   }, [])
@@ -515,9 +518,16 @@ export default function App() {
 
   useEffect(() => {
     if (!cartId) return
-    fetch(`${CORE_API}/cart?cart_id=${cartId}`)
+    fetch(`${CORE_API}/cart?cart_id=${cartId}`, { headers: cartHeaders() })
       .then(r => r.json())
       .then(data => {
+        if (data.error) {
+          setCartId('')
+          setCartToken('')
+          localStorage.removeItem('cart_id')
+          localStorage.removeItem('cart_token')
+          return
+        }
         if (Array.isArray(data)) {
           setCartItems(data.map(i => ({
             id: i.id,
@@ -529,7 +539,7 @@ export default function App() {
         }
       })
       .catch(() => {})
-  }, [cartId])
+  }, [cartId, token])
 
   useEffect(() => {
     if (!token) return
@@ -688,19 +698,33 @@ export default function App() {
     return `https://wa.me/?text=${encodeURIComponent(text)}`
   }, [trackingShareUrl])
 
+  const cartHeaders = (extra = {}) => ({
+    ...extra,
+    ...(cartToken ? { 'X-Cart-Token': cartToken } : {}),
+    ...(token ? { 'X-Auth-Token': token } : {})
+  })
+
   const addToCart = async (product) => {
     const body = { cart_id: cartId, product_id: product.id, qty: 1 }
     const resp = await fetch(`${CORE_API}/cart/items`, {
       method: 'POST',
-      headers: { 'Content-Type': 'application/json' },
+      headers: cartHeaders({ 'Content-Type': 'application/json' }),
       body: JSON.stringify(body)
     })
     const data = await resp.json()
+    if (data.error) {
+      showToast(data.error, 'error')
+      return
+    }
     const nextCartId = data.cart_id || cartId
     setCartId(nextCartId)
     if (nextCartId) {
       localStorage.setItem('cart_id', nextCartId)
     }
+    if (data.cart_token) {
+      setCartToken(data.cart_token)
+      localStorage.setItem('cart_token', data.cart_token)
+    }
     setCartItems(prev => {
       const existing = prev.find(i => i.product_id === product.id)
       if (existing) {
@@ -717,7 +741,7 @@ export default function App() {
     if (!cartId) return
     const resp = await fetch(`${CORE_API}/cart/items`, {
       method: 'PUT',
-      headers: { 'Content-Type': 'application/json' },
+      headers: cartHeaders({ 'Content-Type': 'application/json' }),
       body: JSON.stringify({ cart_id: cartId, product_id: productId, qty })
     })
     if (resp.ok) {
@@ -729,7 +753,7 @@ export default function App() {
     if (!cartId) return
     const resp = await fetch(`${CORE_API}/cart/items`, {
       method: 'DELETE',
-      headers: { 'Content-Type': 'application/json' },
+      headers: cartHeaders({ 'Content-Type': 'application/json' }),
       body: JSON.stringify({ cart_id: cartId, product_id: productId })
     })
     if (resp.ok) {
@@ -742,16 +766,34 @@ export default function App() {
 
   const submitLogin = async (e) => {
     e.preventDefault()
+    const { totp_code, ...credentials } = loginForm
+    const code = totp_code.trim()
+    // recovery codes look like abcde-fghjk; authenticator codes are 6 digits
+    const secondFactor = !code ? {} : (code.includes('-') || code.length > 6 ? { recovery_code: code } : { totp_code: code })
     const resp = await fetch(`${CORE_API}/auth/login`, {
       method: 'POST',
       headers: { 'Content-Type': 'application/json' },
-      body: JSON.stringify(loginForm)
+      body: JSON.stringify({ ...credentials, ...secondFactor, cart_id: cartId, cart_token: cartToken })
     })
     const data = await resp.json()
+    if (data.totp_required) {
+      setLoginTotpNeeded(true)
+      return
+    }
     if (data.token) {
+      setLoginTotpNeeded(false)
+      setLoginForm({ email: loginForm.email, password: '', totp_code: '' })
       localStorage.setItem('auth_token', data.token)
       setToken(data.token)
       setUser(data.user)
+      setCartToken('')
+      localStorage.removeItem('cart_token')
+      setCartId(data.cart_id || '')
+      if (data.cart_id) {
+        localStorage.setItem('cart_id', data.cart_id)
+      } else {
+        localStorage.removeItem('cart_id')
+      }
     }
   }
 
@@ -984,10 +1026,17 @@ export default function App() {
         return
       }
     }
+    if (!checkoutKeyRef.current) {
+      checkoutKeyRef.current = typeof crypto !== 'undefined' && crypto.randomUUID
+        ? crypto.randomUUID()
+        : `${cartId}-${Date.now()}-${Math.random().toString(36).slice(2)}`
+    }
     const resp = await fetch(`${CORE_API}/orders`, {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
+        'Idempotency-Key': checkoutKeyRef.current,
+        ...(cartToken ? { 'X-Cart-Token': cartToken } : {}),
         ...(token ? { 'X-Auth-Token': token } : {})
       },
       body: JSON.stringify({
@@ -1010,6 +1059,7 @@ export default function App() {
       return
     }
     if (!data.error) {
+      checkoutKeyRef.current = ''
       setOrderInfo(data)
       setTrackingInfo(null)
       setTrackingTrail([])
@@ -1221,8 +1271,13 @@ export default function App() {
       fetch(`${CORE_API}/auth/logout`, { method: 'POST', headers: { 'X-Auth-Token': token } }).catch(() => {})
     }
     localStorage.removeItem('auth_token')
+    localStorage.removeItem('cart_id')
+    localStorage.removeItem('cart_token')
     setToken('')
     setUser(null)
+    setCartId('')
+    setCartToken('')
+    setCartItems([])
   }
 
   const driverPanel = (
@@ -2016,6 +2071,7 @@ export default function App() {
                 {user.avatar_url && <img className="avatar" src={user.avatar_url} alt="Avatar" />}
                 <p>Total belanja: {rupiah(user.total_spend)}</p>
                 <p>Saldo cashback: {rupiah(user.wallet_balance)}</p>
+                {user.wallet_pending > 0 && <p>Cashback tertunda: {rupiah(user.wallet_pending)} (cair setelah pesanan selesai)</p>}
                 {myVouchers.length > 0 && (
                   <div className="voucher-list">
                     <p>Voucher kamu:</p>
@@ -2071,6 +2127,9 @@ export default function App() {
               <form className="form-grid" onSubmit={submitLogin}>
                 <input placeholder="Email atau No. WhatsApp" value={loginForm.email} onChange={(e) => setLoginForm({ ...loginForm, email: e.target.value })} />
                 <input placeholder="Password" type="password" value={loginForm.password} onChange={(e) => setLoginForm({ ...loginForm, password: e.target.value })} />
+                {loginTotpNeeded && (
+                  <input placeholder="Kode 2FA atau kode pemulihan" value={loginForm.totp_code} onChange={(e) => setLoginForm({ ...loginForm, totp_code: e.target.value })} />
+                )}
                 <button className="btn">Masuk</button>
               </form>
             </div>
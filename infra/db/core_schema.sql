@@ -3,9 +3,14 @@ CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
 CREATE TABLE categories (
   id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
   name TEXT NOT NULL,
+  slug TEXT UNIQUE NOT NULL,
+  parent_id UUID REFERENCES categories(id) ON DELETE RESTRICT,
+  sort_order INT NOT NULL DEFAULT 0,
   created_at TIMESTAMP DEFAULT NOW()
 );
 
+CREATE INDEX categories_parent_id_idx ON categories(parent_id, sort_order);
+
 CREATE TABLE products (
   id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
   category_id UUID REFERENCES categories(id),
@@ -14,20 +19,31 @@ CREATE TABLE products (
   price INT NOT NULL,
   stock INT NOT NULL,
   image_url TEXT,
+  sold_count INT NOT NULL DEFAULT 0,
+  reorder_threshold INT NOT NULL DEFAULT 0,
+  search_vector TSVECTOR GENERATED ALWAYS AS (
+    to_tsvector('simple', COALESCE(name, '') || ' ' || COALESCE(description, ''))
+  ) STORED,
   created_at TIMESTAMP DEFAULT NOW()
 );
 
-CREATE TABLE carts (
+CREATE INDEX products_search_idx ON products USING GIN (search_vector);
+CREATE INDEX products_created_at_idx ON products(created_at DESC, id DESC);
+CREATE INDEX products_price_idx ON products(price, id);
+CREATE INDEX products_sold_count_idx ON products(sold_count DESC, id DESC);
+
+CREATE TABLE product_variants (
   id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+  sku TEXT UNIQUE NOT NULL,
+  options JSONB NOT NULL DEFAULT '{}'::jsonb,
+  price INT NOT NULL,
+  stock INT NOT NULL DEFAULT 0,
+  image_url TEXT,
   created_at TIMESTAMP DEFAULT NOW()
 );
 
-CREATE TABLE cart_items (
-  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
-  cart_id UUID REFERENCES carts(id) ON DELETE CASCADE,
-  product_id UUID REFERENCES products(id),
-  qty INT NOT NULL
-);
+CREATE INDEX product_variants_product_id_idx ON product_variants(product_id);
 
 CREATE TABLE users (
   id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
@@ -46,16 +62,74 @@ CREATE TABLE users (
   wallet_balance INT NOT NULL DEFAULT 0,
   email_verified_at TIMESTAMP,
   phone_verified_at TIMESTAMP,
+  login_locked_until TIMESTAMP,
+  login_failures INT NOT NULL DEFAULT 0,
+  login_failed_at TIMESTAMP,
+  totp_secret TEXT,
+  totp_enabled_at TIMESTAMP,
+  totp_last_step BIGINT NOT NULL DEFAULT 0,
   created_at TIMESTAMP DEFAULT NOW()
 );
 
+CREATE TABLE totp_recovery_codes (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  code_hash TEXT NOT NULL,
+  used_at TIMESTAMP,
+  created_at TIMESTAMP DEFAULT NOW(),
+  UNIQUE (user_id, code_hash)
+);
+
 CREATE TABLE sessions (
-  token TEXT PRIMARY KEY,
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  token_hash TEXT UNIQUE NOT NULL,
   user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+  device TEXT,
+  ip TEXT,
+  user_agent TEXT,
   expires_at TIMESTAMP NOT NULL,
+  last_seen_at TIMESTAMP NOT NULL DEFAULT NOW(),
   created_at TIMESTAMP DEFAULT NOW()
 );
 
+CREATE INDEX sessions_user_idx ON sessions(user_id, last_seen_at DESC);
+CREATE INDEX sessions_expires_at_idx ON sessions(expires_at);
+
+CREATE TABLE login_attempts (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  scope TEXT NOT NULL CHECK (scope IN ('member','admin')),
+  account_key TEXT NOT NULL,
+  identifier TEXT NOT NULL,
+  user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+  ip TEXT,
+  success BOOLEAN NOT NULL,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX login_attempts_account_idx ON login_attempts(account_key, created_at DESC);
+CREATE INDEX login_attempts_ip_idx ON login_attempts(ip, created_at DESC);
+CREATE INDEX login_attempts_created_at_idx ON login_attempts(created_at DESC);
+
+CREATE TABLE carts (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+  secret TEXT,
+  updated_at TIMESTAMP DEFAULT NOW(),
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX carts_user_id_idx ON carts(user_id) WHERE user_id IS NOT NULL;
+CREATE INDEX carts_updated_at_idx ON carts(updated_at);
+
+CREATE TABLE cart_items (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  cart_id UUID REFERENCES carts(id) ON DELETE CASCADE,
+  product_id UUID REFERENCES products(id),
+  variant_id UUID REFERENCES product_variants(id) ON DELETE CASCADE,
+  qty INT NOT NULL,
+  price_at_add INT
+);
+
 CREATE TABLE otp_requests (
   id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
   destination TEXT NOT NULL,
@@ -64,9 +138,16 @@ CREATE TABLE otp_requests (
   code TEXT NOT NULL,
   expires_at TIMESTAMP NOT NULL,
   verified_at TIMESTAMP,
+  attempts INT NOT NULL DEFAULT 0,
+  locked_at TIMESTAMP,
+  invalidated_at TIMESTAMP,
+  request_ip TEXT,
   created_at TIMESTAMP DEFAULT NOW()
 );
 
+CREATE INDEX otp_requests_destination_idx ON otp_requests(destination, channel, purpose, created_at DESC);
+CREATE INDEX otp_requests_ip_idx ON otp_requests(request_ip, created_at);
+
 CREATE TABLE otp_tokens (
   token TEXT PRIMARY KEY,
   destination TEXT NOT NULL,
@@ -79,19 +160,41 @@ CREATE TABLE otp_tokens (
 
 CREATE TABLE loyalty_tiers (
   name TEXT PRIMARY KEY,
-  min_spend INT NOT NULL,
+  min_spend INT NOT NULL UNIQUE,
   discount_pct INT NOT NULL,
-  cashback_pct INT NOT NULL
+  cashback_pct INT NOT NULL,
+  reward_voucher_code TEXT
 );
 
+CREATE TABLE user_tier_history (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  from_tier TEXT NOT NULL,
+  to_tier TEXT NOT NULL,
+  qualifying_spend INT NOT NULL,
+  reason TEXT NOT NULL,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX user_tier_history_user_idx ON user_tier_history(user_id, created_at DESC);
+
 CREATE TABLE vouchers (
   code TEXT PRIMARY KEY,
   title TEXT NOT NULL,
   discount_type TEXT NOT NULL,
   discount_value INT NOT NULL,
   min_spend INT NOT NULL DEFAULT 0,
+  max_discount INT NOT NULL DEFAULT 0,
   max_uses INT NOT NULL DEFAULT 0,
   uses INT NOT NULL DEFAULT 0,
+  per_user_limit INT NOT NULL DEFAULT 0,
+  product_ids UUID[] NOT NULL DEFAULT '{}',
+  category_ids UUID[] NOT NULL DEFAULT '{}',
+  tiers TEXT[] NOT NULL DEFAULT '{}',
+  first_order_only BOOLEAN NOT NULL DEFAULT FALSE,
+  stacking TEXT NOT NULL DEFAULT 'stack' CHECK (stacking IN ('stack','exclusive','best')),
+  batch_only BOOLEAN NOT NULL DEFAULT FALSE,
+  starts_at DATE,
   expires_at DATE,
   active BOOLEAN NOT NULL DEFAULT TRUE
 );
@@ -106,16 +209,21 @@ CREATE TABLE user_vouchers (
 
 CREATE TABLE orders (
   id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
-  cart_id UUID REFERENCES carts(id),
+  cart_id UUID REFERENCES carts(id) ON DELETE SET NULL,
   user_id UUID REFERENCES users(id),
   customer_name TEXT NOT NULL,
   phone TEXT NOT NULL,
   address TEXT NOT NULL,
   status TEXT NOT NULL DEFAULT 'PENDING',
+  oversold BOOLEAN NOT NULL DEFAULT FALSE,
   subtotal INT NOT NULL DEFAULT 0,
+  tier_discount INT NOT NULL DEFAULT 0,
+  voucher_discount INT NOT NULL DEFAULT 0,
   discount INT NOT NULL DEFAULT 0,
   voucher_code TEXT,
   cashback INT NOT NULL DEFAULT 0,
+  cashback_status TEXT NOT NULL DEFAULT 'NONE' CHECK (cashback_status IN ('NONE','PENDING','CREDITED','FORFEITED')),
+  cashback_released_at TIMESTAMP,
   wallet_used INT NOT NULL DEFAULT 0,
   shipping_fee INT NOT NULL DEFAULT 0,
   total INT NOT NULL DEFAULT 0,
@@ -124,6 +232,143 @@ CREATE TABLE orders (
 );
 
 CREATE UNIQUE INDEX IF NOT EXISTS orders_tracking_token_idx ON orders(tracking_token);
+CREATE INDEX orders_pending_cashback_idx ON orders(user_id) WHERE cashback_status = 'PENDING';
+
+CREATE TABLE voucher_redemptions (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  voucher_code TEXT NOT NULL REFERENCES vouchers(code) ON DELETE CASCADE,
+  child_code TEXT,
+  user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+  order_id UUID NOT NULL UNIQUE REFERENCES orders(id) ON DELETE CASCADE,
+  amount INT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'ACTIVE' CHECK (status IN ('ACTIVE','RELEASED')),
+  created_at TIMESTAMP DEFAULT NOW(),
+  released_at TIMESTAMP
+);
+
+CREATE INDEX voucher_redemptions_code_idx ON voucher_redemptions(voucher_code, created_at DESC);
+CREATE INDEX voucher_redemptions_user_idx ON voucher_redemptions(user_id, voucher_code) WHERE status = 'ACTIVE';
+
+CREATE TABLE voucher_code_batches (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  parent_code TEXT NOT NULL REFERENCES vouchers(code) ON DELETE CASCADE,
+  prefix TEXT NOT NULL,
+  size INT NOT NULL,
+  created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE TABLE voucher_codes (
+  code TEXT PRIMARY KEY,
+  parent_code TEXT NOT NULL REFERENCES vouchers(code) ON DELETE CASCADE,
+  batch_id UUID REFERENCES voucher_code_batches(id) ON DELETE CASCADE,
+  used_at TIMESTAMP,
+  order_id UUID REFERENCES orders(id) ON DELETE SET NULL,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX voucher_codes_batch_idx ON voucher_codes(batch_id, code);
+
+CREATE TABLE order_items (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+  product_id UUID REFERENCES products(id) ON DELETE SET NULL,
+  variant_id UUID REFERENCES product_variants(id) ON DELETE SET NULL,
+  product_name TEXT NOT NULL,
+  variant_sku TEXT,
+  options JSONB,
+  unit_price INT NOT NULL,
+  qty INT NOT NULL,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX order_items_order_id_idx ON order_items(order_id);
+
+CREATE TABLE order_status_history (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+  from_status TEXT,
+  to_status TEXT NOT NULL,
+  actor_type TEXT NOT NULL,
+  actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+  note TEXT,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX order_status_history_order_id_idx ON order_status_history(order_id, created_at);
+
+CREATE TABLE stock_reservations (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+  product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+  variant_id UUID REFERENCES product_variants(id) ON DELETE RESTRICT,
+  qty INT NOT NULL CHECK (qty > 0),
+  status TEXT NOT NULL DEFAULT 'ACTIVE',
+  expires_at TIMESTAMP NOT NULL,
+  resolved_at TIMESTAMP,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX stock_reservations_order_id_idx ON stock_reservations(order_id);
+CREATE INDEX stock_reservations_product_active_idx ON stock_reservations(product_id) WHERE status = 'ACTIVE';
+CREATE INDEX stock_reservations_variant_active_idx ON stock_reservations(variant_id) WHERE status = 'ACTIVE';
+CREATE INDEX stock_reservations_expiry_idx ON stock_reservations(expires_at) WHERE status = 'ACTIVE';
+
+CREATE TABLE inventory_movements (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+  variant_id UUID REFERENCES product_variants(id) ON DELETE SET NULL,
+  kind TEXT NOT NULL,
+  qty_delta INT NOT NULL,
+  stock_after INT NOT NULL,
+  order_id UUID REFERENCES orders(id) ON DELETE SET NULL,
+  actor_type TEXT NOT NULL,
+  actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+  reason TEXT,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX inventory_movements_product_idx ON inventory_movements(product_id, created_at DESC);
+CREATE INDEX inventory_movements_variant_idx ON inventory_movements(variant_id);
+
+CREATE TABLE wallet_transactions (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  kind TEXT NOT NULL,
+  direction TEXT NOT NULL CHECK (direction IN ('CREDIT','DEBIT')),
+  amount INT NOT NULL CHECK (amount > 0),
+  balance_after INT NOT NULL,
+  order_id UUID REFERENCES orders(id) ON DELETE SET NULL,
+  actor_type TEXT NOT NULL,
+  actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+  reason TEXT,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX wallet_transactions_user_idx ON wallet_transactions(user_id, created_at DESC);
+CREATE INDEX wallet_transactions_order_idx ON wallet_transactions(order_id);
+
+CREATE TABLE low_stock_alerts (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+  available INT NOT NULL,
+  threshold INT NOT NULL,
+  attempts INT NOT NULL DEFAULT 0,
+  last_error TEXT,
+  sent_at TIMESTAMP,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX low_stock_alerts_pending_idx ON low_stock_alerts(created_at) WHERE sent_at IS NULL;
+
+CREATE TABLE idempotency_keys (
+  key TEXT PRIMARY KEY,
+  user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+  request_hash TEXT NOT NULL,
+  order_id UUID REFERENCES orders(id) ON DELETE SET NULL,
+  response JSONB,
+  created_at TIMESTAMP DEFAULT NOW()
+);
 
 CREATE TABLE delivery_tracking (
   id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
@@ -178,6 +423,30 @@ CREATE TABLE delivery_zones (
   created_at TIMESTAMP DEFAULT NOW()
 );
 
+CREATE TABLE user_addresses (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  label TEXT NOT NULL,
+  recipient TEXT NOT NULL,
+  phone TEXT NOT NULL,
+  address TEXT NOT NULL,
+  notes TEXT,
+  lat DOUBLE PRECISION,
+  lng DOUBLE PRECISION,
+  zone_id UUID REFERENCES delivery_zones(id) ON DELETE SET NULL,
+  geocoded_address TEXT,
+  locality TEXT,
+  geocode_source TEXT,
+  is_default BOOLEAN NOT NULL DEFAULT FALSE,
+  created_at TIMESTAMP DEFAULT NOW(),
+  updated_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX user_addresses_user_idx ON user_addresses(user_id);
+CREATE UNIQUE INDEX user_addresses_default_idx ON user_addresses(user_id) WHERE is_default;
+
+ALTER TABLE orders ADD COLUMN address_id UUID REFERENCES user_addresses(id) ON DELETE SET NULL;
+
 CREATE TABLE delivery_settings (
   id INT PRIMARY KEY,
   base_lat DOUBLE PRECISION NOT NULL DEFAULT -6.2216339332113595,
@@ -186,26 +455,29 @@ CREATE TABLE delivery_settings (
   min_fee INT NOT NULL DEFAULT 8000
 );
 
-INSERT INTO loyalty_tiers (name, min_spend, discount_pct, cashback_pct) VALUES
-('Bronze', 0, 0, 0),
-('Silver', 1000000, 2, 1),
-('Gold', 3000000, 4, 2),
-('Platinum', 6000000, 7, 3);
+INSERT INTO loyalty_tiers (name, min_spend, discount_pct, cashback_pct, reward_voucher_code) VALUES
+('Bronze', 0, 0, 0, NULL),
+('Silver', 1000000, 2, 1, 'SILVER100'),
+('Gold', 3000000, 4, 2, 'GOLD200'),
+('Platinum', 6000000, 7, 3, 'PLAT300');
 
-INSERT INTO categories (name) VALUES
-('Makanan Kucing'),
-('Obat & Vitamin'),
-('Minuman'),
-('Peralatan Kucing');
+INSERT INTO categories (name, slug, sort_order) VALUES
+('Makanan Kucing', 'makanan-kucing', 1),
+('Obat & Vitamin', 'obat-vitamin', 2),
+('Minuman', 'minuman', 3),
+('Peralatan Kucing', 'peralatan-kucing', 4);
 
-INSERT INTO products (category_id, name, description, price, stock, image_url)
-SELECT c.id, 'Whiskas Adult 1.2kg', 'Makanan kucing dewasa rasa tuna', 68000, 25, ''
+INSERT INTO products (category_id, name, description, price, stock, image_url, reorder_threshold)
+SELECT c.id, 'Whiskas Adult 1.2kg', 'Makanan kucing dewasa rasa tuna', 68000, 25, '', 10
 FROM categories c WHERE c.name='Makanan Kucing';
 
-INSERT INTO products (category_id, name, description, price, stock, image_url)
-SELECT c.id, 'Cat Cage Medium', 'Kandang kucing ukuran sedang', 350000, 5, ''
+INSERT INTO products (category_id, name, description, price, stock, image_url, reorder_threshold)
+SELECT c.id, 'Cat Cage Medium', 'Kandang kucing ukuran sedang', 350000, 5, '', 2
 FROM categories c WHERE c.name='Peralatan Kucing';
 
+INSERT INTO inventory_movements (product_id, kind, qty_delta, stock_after, actor_type, reason)
+SELECT id, 'ADJUSTMENT', stock, stock, 'system', 'opening balance' FROM products WHERE stock <> 0;
+
 INSERT INTO vouchers (code, title, discount_type, discount_value, min_spend, max_uses, expires_at, active)
 VALUES
 ('WELCOME50', 'Voucher Member Baru', 'flat', 50000, 200000, 0, NULL, TRUE),
@@ -0,0 +1,9 @@
+ALTER TABLE products ADD COLUMN IF NOT EXISTS sold_count INT NOT NULL DEFAULT 0;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS search_vector TSVECTOR GENERATED ALWAYS AS (
+  to_tsvector('simple', COALESCE(name, '') || ' ' || COALESCE(description, ''))
+) STORED;
+
+CREATE INDEX IF NOT EXISTS products_search_idx ON products USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS products_created_at_idx ON products(created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS products_price_idx ON products(price, id);
+CREATE INDEX IF NOT EXISTS products_sold_count_idx ON products(sold_count DESC, id DESC);
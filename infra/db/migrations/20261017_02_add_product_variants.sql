@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS product_variants (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+  sku TEXT UNIQUE NOT NULL,
+  options JSONB NOT NULL DEFAULT '{}'::jsonb,
+  price INT NOT NULL,
+  stock INT NOT NULL DEFAULT 0,
+  image_url TEXT,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS product_variants_product_id_idx ON product_variants(product_id);
+
+ALTER TABLE cart_items ADD COLUMN IF NOT EXISTS variant_id UUID REFERENCES product_variants(id) ON DELETE CASCADE;
@@ -0,0 +1,16 @@
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS slug TEXT;
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS parent_id UUID REFERENCES categories(id) ON DELETE RESTRICT;
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS sort_order INT NOT NULL DEFAULT 0;
+
+UPDATE categories
+   SET slug = TRIM(BOTH '-' FROM REGEXP_REPLACE(LOWER(name), '[^a-z0-9]+', '-', 'g'))
+ WHERE slug IS NULL;
+
+UPDATE categories c
+   SET slug = c.slug || '-' || SUBSTRING(c.id::text, 1, 4)
+  FROM categories d
+ WHERE d.slug = c.slug AND d.id < c.id;
+
+ALTER TABLE categories ALTER COLUMN slug SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS categories_slug_idx ON categories(slug);
+CREATE INDEX IF NOT EXISTS categories_parent_id_idx ON categories(parent_id, sort_order);
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS order_status_history (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+  from_status TEXT,
+  to_status TEXT NOT NULL,
+  actor_type TEXT NOT NULL,
+  actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+  note TEXT,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS order_status_history_order_id_idx ON order_status_history(order_id, created_at);
+
+INSERT INTO order_status_history (order_id, from_status, to_status, actor_type, created_at)
+SELECT o.id, NULL, o.status, 'system', o.created_at
+  FROM orders o
+ WHERE NOT EXISTS (SELECT 1 FROM order_status_history h WHERE h.order_id = o.id);
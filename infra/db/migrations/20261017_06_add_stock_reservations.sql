@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS stock_reservations (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+  product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+  variant_id UUID REFERENCES product_variants(id) ON DELETE CASCADE,
+  qty INT NOT NULL CHECK (qty > 0),
+  status TEXT NOT NULL DEFAULT 'ACTIVE',
+  expires_at TIMESTAMP NOT NULL,
+  resolved_at TIMESTAMP,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS stock_reservations_order_id_idx ON stock_reservations(order_id);
+CREATE INDEX IF NOT EXISTS stock_reservations_product_active_idx ON stock_reservations(product_id) WHERE status = 'ACTIVE';
+CREATE INDEX IF NOT EXISTS stock_reservations_variant_active_idx ON stock_reservations(variant_id) WHERE status = 'ACTIVE';
+CREATE INDEX IF NOT EXISTS stock_reservations_expiry_idx ON stock_reservations(expires_at) WHERE status = 'ACTIVE';
@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS inventory_movements (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+  variant_id UUID REFERENCES product_variants(id) ON DELETE SET NULL,
+  kind TEXT NOT NULL,
+  qty_delta INT NOT NULL,
+  stock_after INT NOT NULL,
+  order_id UUID REFERENCES orders(id) ON DELETE SET NULL,
+  actor_type TEXT NOT NULL,
+  actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+  reason TEXT,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS inventory_movements_product_idx ON inventory_movements(product_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS inventory_movements_variant_idx ON inventory_movements(variant_id);
+
+-- opening balances so the ledger sums to the current stock
+INSERT INTO inventory_movements (product_id, variant_id, kind, qty_delta, stock_after, actor_type, reason)
+SELECT v.product_id, v.id, 'ADJUSTMENT', v.stock, v.stock, 'system', 'opening balance'
+  FROM product_variants v
+ WHERE v.stock <> 0
+   AND NOT EXISTS (SELECT 1 FROM inventory_movements m WHERE m.product_id = v.product_id);
+
+INSERT INTO inventory_movements (product_id, kind, qty_delta, stock_after, actor_type, reason)
+SELECT p.id, 'ADJUSTMENT', p.stock - COALESCE((SELECT SUM(m.qty_delta) FROM inventory_movements m WHERE m.product_id = p.id), 0), p.stock, 'system', 'opening balance'
+  FROM products p
+ WHERE p.stock <> COALESCE((SELECT SUM(m.qty_delta) FROM inventory_movements m WHERE m.product_id = p.id), 0);
@@ -0,0 +1,13 @@
+ALTER TABLE carts ADD COLUMN IF NOT EXISTS user_id UUID REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE carts ADD COLUMN IF NOT EXISTS secret TEXT;
+ALTER TABLE carts ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT NOW();
+
+CREATE UNIQUE INDEX IF NOT EXISTS carts_user_id_idx ON carts(user_id) WHERE user_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS carts_updated_at_idx ON carts(updated_at);
+
+-- purged carts must not take their orders with them
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_cart_id_fkey;
+ALTER TABLE orders ADD CONSTRAINT orders_cart_id_fkey FOREIGN KEY (cart_id) REFERENCES carts(id) ON DELETE SET NULL;
+
+-- legacy guest carts have no cart token and can no longer be opened; let the purge job age them from creation
+UPDATE carts SET updated_at = created_at WHERE user_id IS NULL AND secret IS NULL;
@@ -0,0 +1 @@
+ALTER TABLE cart_items ADD COLUMN IF NOT EXISTS price_at_add INT;
@@ -0,0 +1,15 @@
+ALTER TABLE vouchers ADD COLUMN IF NOT EXISTS max_discount INT NOT NULL DEFAULT 0;
+ALTER TABLE vouchers ADD COLUMN IF NOT EXISTS per_user_limit INT NOT NULL DEFAULT 0;
+ALTER TABLE vouchers ADD COLUMN IF NOT EXISTS product_ids UUID[] NOT NULL DEFAULT '{}';
+ALTER TABLE vouchers ADD COLUMN IF NOT EXISTS category_ids UUID[] NOT NULL DEFAULT '{}';
+ALTER TABLE vouchers ADD COLUMN IF NOT EXISTS tiers TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE vouchers ADD COLUMN IF NOT EXISTS first_order_only BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE vouchers ADD COLUMN IF NOT EXISTS stacking TEXT NOT NULL DEFAULT 'stack';
+ALTER TABLE vouchers ADD COLUMN IF NOT EXISTS starts_at DATE;
+
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'vouchers_stacking_check') THEN
+    ALTER TABLE vouchers ADD CONSTRAINT vouchers_stacking_check CHECK (stacking IN ('stack','exclusive','best'));
+  END IF;
+END $$;
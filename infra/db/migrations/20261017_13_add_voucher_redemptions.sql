@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS voucher_redemptions (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  voucher_code TEXT NOT NULL REFERENCES vouchers(code) ON DELETE CASCADE,
+  user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+  order_id UUID NOT NULL UNIQUE REFERENCES orders(id) ON DELETE CASCADE,
+  amount INT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'ACTIVE' CHECK (status IN ('ACTIVE','RELEASED')),
+  created_at TIMESTAMP DEFAULT NOW(),
+  released_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS voucher_redemptions_code_idx ON voucher_redemptions(voucher_code, created_at DESC);
+CREATE INDEX IF NOT EXISTS voucher_redemptions_user_idx ON voucher_redemptions(user_id, voucher_code) WHERE status = 'ACTIVE';
+
+-- earlier orders only stored the combined discount, so the backfilled amount includes any tier discount
+INSERT INTO voucher_redemptions (voucher_code, user_id, order_id, amount, status, created_at, released_at)
+SELECT v.code, o.user_id, o.id, o.discount,
+       CASE WHEN o.status IN ('CANCELLED','FAILED') THEN 'RELEASED' ELSE 'ACTIVE' END,
+       o.created_at,
+       CASE WHEN o.status IN ('CANCELLED','FAILED') THEN o.created_at END
+FROM orders o JOIN vouchers v ON v.code = UPPER(o.voucher_code)
+ON CONFLICT (order_id) DO NOTHING;
@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS voucher_code_batches (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  parent_code TEXT NOT NULL REFERENCES vouchers(code) ON DELETE CASCADE,
+  prefix TEXT NOT NULL,
+  size INT NOT NULL,
+  created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS voucher_codes (
+  code TEXT PRIMARY KEY,
+  parent_code TEXT NOT NULL REFERENCES vouchers(code) ON DELETE CASCADE,
+  batch_id UUID REFERENCES voucher_code_batches(id) ON DELETE CASCADE,
+  used_at TIMESTAMP,
+  order_id UUID REFERENCES orders(id) ON DELETE SET NULL,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS voucher_codes_batch_idx ON voucher_codes(batch_id, code);
+
+ALTER TABLE voucher_redemptions ADD COLUMN IF NOT EXISTS child_code TEXT;
+ALTER TABLE vouchers ADD COLUMN IF NOT EXISTS batch_only BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- tier rewards (still the hard-coded codes at this point) and codes already handed to
+-- members keep working directly
+UPDATE vouchers v SET batch_only = TRUE
+WHERE EXISTS (SELECT 1 FROM voucher_codes c WHERE c.parent_code = v.code)
+  AND v.code NOT IN ('SILVER100', 'GOLD200', 'PLAT300')
+  AND NOT EXISTS (SELECT 1 FROM user_vouchers uv WHERE uv.code = v.code);
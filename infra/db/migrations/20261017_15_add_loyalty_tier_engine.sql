@@ -0,0 +1,21 @@
+ALTER TABLE loyalty_tiers ADD COLUMN IF NOT EXISTS reward_voucher_code TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS loyalty_tiers_min_spend_key ON loyalty_tiers(min_spend);
+
+-- the reward codes used to be hard-coded per tier name
+UPDATE loyalty_tiers t SET reward_voucher_code = r.code
+FROM (VALUES ('silver', 'SILVER100'), ('gold', 'GOLD200'), ('platinum', 'PLAT300')) AS r(tier, code)
+WHERE LOWER(t.name) = r.tier AND t.reward_voucher_code IS NULL
+  AND EXISTS (SELECT 1 FROM vouchers v WHERE v.code = r.code);
+
+CREATE TABLE IF NOT EXISTS user_tier_history (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  from_tier TEXT NOT NULL,
+  to_tier TEXT NOT NULL,
+  qualifying_spend INT NOT NULL,
+  reason TEXT NOT NULL,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS user_tier_history_user_idx ON user_tier_history(user_id, created_at DESC);
@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS wallet_transactions (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  kind TEXT NOT NULL,
+  direction TEXT NOT NULL CHECK (direction IN ('CREDIT','DEBIT')),
+  amount INT NOT NULL CHECK (amount > 0),
+  balance_after INT NOT NULL,
+  order_id UUID REFERENCES orders(id) ON DELETE SET NULL,
+  actor_type TEXT NOT NULL,
+  actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+  reason TEXT,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS wallet_transactions_user_idx ON wallet_transactions(user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS wallet_transactions_order_idx ON wallet_transactions(order_id);
+
+-- balances changed before the ledger existed are carried over as one opening entry
+INSERT INTO wallet_transactions (user_id, kind, direction, amount, balance_after, actor_type, reason)
+SELECT u.id, 'OPENING_BALANCE', CASE WHEN u.wallet_balance > 0 THEN 'CREDIT' ELSE 'DEBIT' END, ABS(u.wallet_balance), u.wallet_balance, 'system', 'balance before wallet ledger'
+FROM users u
+WHERE u.wallet_balance <> 0 AND NOT EXISTS (SELECT 1 FROM wallet_transactions t WHERE t.user_id = u.id);
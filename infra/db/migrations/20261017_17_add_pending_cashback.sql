@@ -0,0 +1,16 @@
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS cashback_status TEXT NOT NULL DEFAULT 'NONE';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS cashback_released_at TIMESTAMP;
+
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'orders_cashback_status_check') THEN
+    ALTER TABLE orders ADD CONSTRAINT orders_cashback_status_check CHECK (cashback_status IN ('NONE','PENDING','CREDITED','FORFEITED'));
+  END IF;
+END $$;
+
+-- cashback on earlier orders was credited at checkout (and taken back on cancellation)
+UPDATE orders SET cashback_status = CASE WHEN status IN ('CANCELLED','FAILED') THEN 'FORFEITED' ELSE 'CREDITED' END,
+  cashback_released_at = created_at
+WHERE cashback > 0 AND user_id IS NOT NULL AND cashback_status = 'NONE';
+
+CREATE INDEX IF NOT EXISTS orders_pending_cashback_idx ON orders(user_id) WHERE cashback_status = 'PENDING';
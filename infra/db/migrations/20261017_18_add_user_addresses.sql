@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS user_addresses (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  label TEXT NOT NULL,
+  recipient TEXT NOT NULL,
+  phone TEXT NOT NULL,
+  address TEXT NOT NULL,
+  notes TEXT,
+  lat DOUBLE PRECISION,
+  lng DOUBLE PRECISION,
+  zone_id UUID REFERENCES delivery_zones(id) ON DELETE SET NULL,
+  geocoded_address TEXT,
+  locality TEXT,
+  geocode_source TEXT,
+  is_default BOOLEAN NOT NULL DEFAULT FALSE,
+  created_at TIMESTAMP DEFAULT NOW(),
+  updated_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS user_addresses_user_idx ON user_addresses(user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS user_addresses_default_idx ON user_addresses(user_id) WHERE is_default;
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS address_id UUID REFERENCES user_addresses(id) ON DELETE SET NULL;
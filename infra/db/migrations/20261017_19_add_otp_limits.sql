@@ -0,0 +1,7 @@
+ALTER TABLE otp_requests ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
+ALTER TABLE otp_requests ADD COLUMN IF NOT EXISTS locked_at TIMESTAMP;
+ALTER TABLE otp_requests ADD COLUMN IF NOT EXISTS invalidated_at TIMESTAMP;
+ALTER TABLE otp_requests ADD COLUMN IF NOT EXISTS request_ip TEXT;
+
+CREATE INDEX IF NOT EXISTS otp_requests_destination_idx ON otp_requests(destination, channel, purpose, created_at DESC);
+CREATE INDEX IF NOT EXISTS otp_requests_ip_idx ON otp_requests(request_ip, created_at);
@@ -0,0 +1,16 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS login_locked_until TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  scope TEXT NOT NULL CHECK (scope IN ('member','admin')),
+  account_key TEXT NOT NULL,
+  identifier TEXT NOT NULL,
+  user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+  ip TEXT,
+  success BOOLEAN NOT NULL,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS login_attempts_account_idx ON login_attempts(account_key, created_at DESC);
+CREATE INDEX IF NOT EXISTS login_attempts_ip_idx ON login_attempts(ip, created_at DESC);
+CREATE INDEX IF NOT EXISTS login_attempts_created_at_idx ON login_attempts(created_at DESC);
@@ -0,0 +1,26 @@
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS id UUID NOT NULL DEFAULT uuid_generate_v4();
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS token_hash TEXT;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS device TEXT;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS ip TEXT;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS user_agent TEXT;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMP NOT NULL DEFAULT NOW();
+
+-- existing logins keep working: their tokens are hashed the same way the service does (sha256, hex)
+DO $$
+BEGIN
+  IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'sessions' AND column_name = 'token') THEN
+    DELETE FROM sessions WHERE expires_at <= NOW();
+    UPDATE sessions SET token_hash = encode(sha256(convert_to(token, 'UTF8')), 'hex') WHERE token_hash IS NULL;
+    ALTER TABLE sessions DROP CONSTRAINT IF EXISTS sessions_pkey;
+    ALTER TABLE sessions DROP COLUMN token;
+    ALTER TABLE sessions ADD PRIMARY KEY (id);
+  END IF;
+  IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'sessions_token_hash_key') THEN
+    ALTER TABLE sessions ADD CONSTRAINT sessions_token_hash_key UNIQUE (token_hash);
+  END IF;
+END $$;
+
+ALTER TABLE sessions ALTER COLUMN token_hash SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS sessions_user_idx ON sessions(user_id, last_seen_at DESC);
+CREATE INDEX IF NOT EXISTS sessions_expires_at_idx ON sessions(expires_at);
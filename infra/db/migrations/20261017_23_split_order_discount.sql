@@ -0,0 +1,7 @@
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS tier_discount INT NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS voucher_discount INT NOT NULL DEFAULT 0;
+
+UPDATE orders
+SET voucher_discount = CASE WHEN voucher_code IS NOT NULL THEN discount ELSE 0 END,
+    tier_discount = CASE WHEN voucher_code IS NULL THEN discount ELSE 0 END
+WHERE discount > 0 AND tier_discount = 0 AND voucher_discount = 0;
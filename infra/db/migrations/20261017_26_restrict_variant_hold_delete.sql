@@ -0,0 +1,3 @@
+ALTER TABLE stock_reservations DROP CONSTRAINT IF EXISTS stock_reservations_variant_id_fkey;
+ALTER TABLE stock_reservations ADD CONSTRAINT stock_reservations_variant_id_fkey
+  FOREIGN KEY (variant_id) REFERENCES product_variants(id) ON DELETE RESTRICT;
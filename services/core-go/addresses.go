@@ -0,0 +1,412 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "net/http"
+  "strings"
+)
+
+const maxSavedAddresses = 20
+
+type AddressRequest struct {
+  Label     string  `json:"label"`
+  Recipient string  `json:"recipient"`
+  Phone     string  `json:"phone"`
+  Address   string  `json:"address"`
+  Notes     string  `json:"notes"`
+  Lat       float64 `json:"lat"`
+  Lng       float64 `json:"lng"`
+  ZoneID    string  `json:"zone_id"`
+  IsDefault bool    `json:"is_default"`
+}
+
+type savedAddress struct {
+  ID               string
+  Label            string
+  Recipient        string
+  Phone            string
+  Address          string
+  Notes            string
+  Lat              sql.NullFloat64
+  Lng              sql.NullFloat64
+  ZoneID           string
+  ZoneName         string
+  GeocodedAddress  string
+  Locality         string
+  GeocodeSource    string
+  IsDefault        bool
+}
+
+const savedAddressSelectSQL = `SELECT a.id, a.label, a.recipient, a.phone, a.address, a.notes, a.lat, a.lng, a.zone_id, z.name,
+    a.geocoded_address, a.locality, a.geocode_source, a.is_default
+  FROM user_addresses a LEFT JOIN delivery_zones z ON a.zone_id = z.id`
+
+func scanSavedAddress(row interface{ Scan(...any) error }) (savedAddress, error) {
+  var a savedAddress
+  var notes, zoneID, zoneName, geocoded, locality, source sql.NullString
+  err := row.Scan(&a.ID, &a.Label, &a.Recipient, &a.Phone, &a.Address, &notes, &a.Lat, &a.Lng, &zoneID, &zoneName,
+    &geocoded, &locality, &source, &a.IsDefault)
+  a.Notes = notes.String
+  a.ZoneID = zoneID.String
+  a.ZoneName = zoneName.String
+  a.GeocodedAddress = geocoded.String
+  a.Locality = locality.String
+  a.GeocodeSource = source.String
+  return a, err
+}
+
+func (a savedAddress) hasCoordinates() bool {
+  return a.Lat.Valid && a.Lng.Valid
+}
+
+func (a savedAddress) toMap() map[string]any {
+  out := map[string]any{
+    "id": a.ID,
+    "label": a.Label,
+    "recipient": a.Recipient,
+    "phone": a.Phone,
+    "address": a.Address,
+    "notes": a.Notes,
+    "lat": nil,
+    "lng": nil,
+    "zone_id": a.ZoneID,
+    "zone_name": a.ZoneName,
+    "geocoded_address": a.GeocodedAddress,
+    "locality": a.Locality,
+    "geocode_source": a.GeocodeSource,
+    "is_default": a.IsDefault,
+  }
+  if a.hasCoordinates() {
+    out["lat"] = a.Lat.Float64
+    out["lng"] = a.Lng.Float64
+  }
+  return out
+}
+
+func validateAddressRequest(req *AddressRequest) error {
+  req.Label = strings.TrimSpace(req.Label)
+  req.Recipient = strings.TrimSpace(req.Recipient)
+  req.Phone = strings.TrimSpace(req.Phone)
+  req.Address = strings.TrimSpace(req.Address)
+  req.Notes = strings.TrimSpace(req.Notes)
+  req.ZoneID = strings.TrimSpace(req.ZoneID)
+  if req.Label == "" || req.Recipient == "" || req.Phone == "" {
+    return errInvalid("label, recipient, phone required")
+  }
+  if (req.Lat == 0) != (req.Lng == 0) {
+    return errInvalid("lat and lng must be given together")
+  }
+  if req.Lat < -90 || req.Lat > 90 || req.Lng < -180 || req.Lng > 180 {
+    return errInvalid("invalid coordinates")
+  }
+  if req.Address == "" && req.Lat == 0 {
+    return errInvalid("address or lat/lng required")
+  }
+  return nil
+}
+
+// looks the coordinates up before any transaction is opened; a failed lookup only
+// matters when there is no address text to fall back on
+func geocodeAddress(req AddressRequest) (reverseGeoResponse, error) {
+  if req.Lat == 0 && req.Lng == 0 {
+    return reverseGeoResponse{}, nil
+  }
+  geo, err := reverseGeocode(req.Lat, req.Lng)
+  if err != nil || geo.Address == "" {
+    if req.Address == "" {
+      return geo, errInvalid("address could not be found for these coordinates")
+    }
+    return reverseGeoResponse{}, nil
+  }
+  return geo, nil
+}
+
+func checkAddressZone(db queryRower, zoneID string) error {
+  if zoneID == "" {
+    return nil
+  }
+  var ok bool
+  if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM delivery_zones WHERE id::text = $1 AND active = TRUE)`, zoneID).Scan(&ok); err != nil {
+    return err
+  }
+  if !ok {
+    return errInvalid("zone not found")
+  }
+  return nil
+}
+
+func nullIfZero(v float64) any {
+  if v == 0 {
+    return nil
+  }
+  return v
+}
+
+func meAddressesHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    userID, err := getUserIDFromToken(db, r)
+    if err != nil {
+      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+      return
+    }
+    switch r.Method {
+    case http.MethodGet:
+      rows, err := db.Query(savedAddressSelectSQL+` WHERE a.user_id = $1 ORDER BY a.is_default DESC, a.created_at DESC`, userID)
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      defer rows.Close()
+      out := []map[string]any{}
+      for rows.Next() {
+        a, err := scanSavedAddress(rows)
+        if err != nil {
+          writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+          return
+        }
+        out = append(out, a.toMap())
+      }
+      writeJSON(w, http.StatusOK, out)
+    case http.MethodPost:
+      var req AddressRequest
+      if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
+        return
+      }
+      if err := validateAddressRequest(&req); err != nil {
+        writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+        return
+      }
+      if err := checkAddressZone(db, req.ZoneID); err != nil {
+        writeAddressError(w, err)
+        return
+      }
+      geo, err := geocodeAddress(req)
+      if err != nil {
+        writeAddressError(w, err)
+        return
+      }
+      if req.Address == "" {
+        req.Address = geo.Address
+      }
+      tx, err := db.Begin()
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg("db error"))
+        return
+      }
+      defer tx.Rollback()
+      // the user row lock serialises default changes and the address limit
+      if _, err := tx.Exec(`SELECT 1 FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      var count int
+      if err := tx.QueryRow(`SELECT COUNT(*) FROM user_addresses WHERE user_id = $1`, userID).Scan(&count); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      if count >= maxSavedAddresses {
+        writeJSON(w, http.StatusBadRequest, errMsg("address book is full"))
+        return
+      }
+      isDefault := req.IsDefault || count == 0
+      if isDefault {
+        if _, err := tx.Exec(`UPDATE user_addresses SET is_default = FALSE WHERE user_id = $1 AND is_default`, userID); err != nil {
+          writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+          return
+        }
+      }
+      var id string
+      err = tx.QueryRow(`INSERT INTO user_addresses (user_id, label, recipient, phone, address, notes, lat, lng, zone_id, geocoded_address, locality, geocode_source, is_default)
+        VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13) RETURNING id`,
+        userID, req.Label, req.Recipient, req.Phone, req.Address, nullIfEmpty(req.Notes), nullIfZero(req.Lat), nullIfZero(req.Lng), nullIfEmpty(req.ZoneID),
+        nullIfEmpty(geo.Address), nullIfEmpty(geo.Locality), nullIfEmpty(geo.Source), isDefault).Scan(&id)
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      if err := tx.Commit(); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg("db commit failed"))
+        return
+      }
+      writeJSON(w, http.StatusCreated, map[string]any{"id": id, "address": req.Address, "locality": geo.Locality, "is_default": isDefault})
+    default:
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+    }
+  }
+}
+
+func meAddressItemHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    userID, err := getUserIDFromToken(db, r)
+    if err != nil {
+      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+      return
+    }
+    id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/me/addresses/"), "/")
+    if id == "" {
+      writeJSON(w, http.StatusBadRequest, errMsg("missing id"))
+      return
+    }
+    switch r.Method {
+    case http.MethodGet:
+      a, err := scanSavedAddress(db.QueryRow(savedAddressSelectSQL+` WHERE a.id::text = $1 AND a.user_id = $2`, id, userID))
+      if err == sql.ErrNoRows {
+        writeJSON(w, http.StatusNotFound, errMsg("address not found"))
+        return
+      }
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      writeJSON(w, http.StatusOK, a.toMap())
+    case http.MethodPut:
+      var req AddressRequest
+      if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
+        return
+      }
+      if err := validateAddressRequest(&req); err != nil {
+        writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+        return
+      }
+      if err := checkAddressZone(db, req.ZoneID); err != nil {
+        writeAddressError(w, err)
+        return
+      }
+      geo, err := geocodeAddress(req)
+      if err != nil {
+        writeAddressError(w, err)
+        return
+      }
+      if req.Address == "" {
+        req.Address = geo.Address
+      }
+      tx, err := db.Begin()
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg("db error"))
+        return
+      }
+      defer tx.Rollback()
+      if _, err := tx.Exec(`SELECT 1 FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      if req.IsDefault {
+        if _, err := tx.Exec(`UPDATE user_addresses SET is_default = FALSE WHERE user_id = $1 AND is_default AND id::text <> $2`, userID, id); err != nil {
+          writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+          return
+        }
+      }
+      // unsetting the default is ignored; another address has to be made default instead
+      res, err := tx.Exec(`UPDATE user_addresses SET label = $1, recipient = $2, phone = $3, address = $4, notes = $5, lat = $6, lng = $7, zone_id = $8,
+          geocoded_address = $9, locality = $10, geocode_source = $11, is_default = is_default OR $12, updated_at = NOW()
+        WHERE id::text = $13 AND user_id = $14`,
+        req.Label, req.Recipient, req.Phone, req.Address, nullIfEmpty(req.Notes), nullIfZero(req.Lat), nullIfZero(req.Lng), nullIfEmpty(req.ZoneID),
+        nullIfEmpty(geo.Address), nullIfEmpty(geo.Locality), nullIfEmpty(geo.Source), req.IsDefault, id, userID)
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      if n, _ := res.RowsAffected(); n == 0 {
+        writeJSON(w, http.StatusNotFound, errMsg("address not found"))
+        return
+      }
+      if err := tx.Commit(); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg("db commit failed"))
+        return
+      }
+      writeJSON(w, http.StatusOK, map[string]string{"status": "updated"})
+    case http.MethodDelete:
+      tx, err := db.Begin()
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg("db error"))
+        return
+      }
+      defer tx.Rollback()
+      if _, err := tx.Exec(`SELECT 1 FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      var wasDefault bool
+      err = tx.QueryRow(`DELETE FROM user_addresses WHERE id::text = $1 AND user_id = $2 RETURNING is_default`, id, userID).Scan(&wasDefault)
+      if err == sql.ErrNoRows {
+        writeJSON(w, http.StatusNotFound, errMsg("address not found"))
+        return
+      }
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      if wasDefault {
+        _, err := tx.Exec(`UPDATE user_addresses SET is_default = TRUE WHERE id = (
+          SELECT id FROM user_addresses WHERE user_id = $1 ORDER BY updated_at DESC LIMIT 1)`, userID)
+        if err != nil {
+          writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+          return
+        }
+      }
+      if err := tx.Commit(); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg("db commit failed"))
+        return
+      }
+      writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+    default:
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+    }
+  }
+}
+
+func writeAddressError(w http.ResponseWriter, err error) {
+  if isInvalid(err) {
+    writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+    return
+  }
+  writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+}
+
+// fills the order's recipient, address and delivery fields from a saved address. Fields
+// sent with the order win, so a checkout can still override the phone or delivery type.
+func applySavedAddressTx(tx *sql.Tx, userID string, req *OrderRequest) error {
+  if req.AddressID == "" {
+    return nil
+  }
+  if userID == "" {
+    return errInvalid("login required to use a saved address")
+  }
+  a, err := scanSavedAddress(tx.QueryRow(savedAddressSelectSQL+` WHERE a.id::text = $1 AND a.user_id = $2`, req.AddressID, userID))
+  if err == sql.ErrNoRows {
+    return errInvalid("address not found")
+  }
+  if err != nil {
+    return err
+  }
+  if req.CustomerName == "" {
+    req.CustomerName = a.Recipient
+  }
+  if req.Phone == "" {
+    req.Phone = a.Phone
+  }
+  if req.Address == "" {
+    req.Address = a.Address
+    if a.Notes != "" {
+      req.Address += " (" + a.Notes + ")"
+    }
+  }
+  if req.ZoneID == "" {
+    req.ZoneID = a.ZoneID
+  }
+  if req.Lat == 0 && req.Lng == 0 && a.hasCoordinates() {
+    req.Lat, req.Lng = a.Lat.Float64, a.Lng.Float64
+  }
+  if req.DeliveryType == "" {
+    switch {
+    case a.ZoneID != "":
+      req.DeliveryType = "zone"
+    case a.hasCoordinates():
+      req.DeliveryType = "per_km"
+    }
+  }
+  return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+  "errors"
+  "testing"
+
+  "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestValidateAddressRequest(t *testing.T) {
+  cases := []struct {
+    name    string
+    req     AddressRequest
+    invalid bool
+  }{
+    {"text only", AddressRequest{Label: "Rumah", Recipient: "Sari", Phone: "0812", Address: "Jl. Melati 3"}, false},
+    {"pin only", AddressRequest{Label: "Kantor", Recipient: "Sari", Phone: "0812", Lat: -6.2, Lng: 106.8}, false},
+    {"missing recipient", AddressRequest{Label: "Rumah", Phone: "0812", Address: "Jl. Melati 3"}, true},
+    {"nothing to deliver to", AddressRequest{Label: "Rumah", Recipient: "Sari", Phone: "0812"}, true},
+    {"half a pin", AddressRequest{Label: "Rumah", Recipient: "Sari", Phone: "0812", Address: "x", Lat: -6.2}, true},
+    {"out of range", AddressRequest{Label: "Rumah", Recipient: "Sari", Phone: "0812", Lat: -95, Lng: 106.8}, true},
+  }
+  for _, tc := range cases {
+    req := tc.req
+    err := validateAddressRequest(&req)
+    if tc.invalid != isInvalid(err) {
+      t.Fatalf("%s: invalid=%v, got %v", tc.name, tc.invalid, err)
+    }
+  }
+}
+
+func TestGeocodeAddressFallsBackToText(t *testing.T) {
+  orig := reverseGeocode
+  defer func() { reverseGeocode = orig }()
+
+  reverseGeocode = func(lat, lng float64) (reverseGeoResponse, error) {
+    return reverseGeoResponse{Address: "Jl. Melati 3, Tangerang", Locality: "Tangerang", Source: "nominatim"}, nil
+  }
+  geo, err := geocodeAddress(AddressRequest{Lat: -6.2, Lng: 106.3})
+  if err != nil || geo.Locality != "Tangerang" {
+    t.Fatalf("expected geocoded locality, got %+v (%v)", geo, err)
+  }
+
+  reverseGeocode = func(lat, lng float64) (reverseGeoResponse, error) {
+    return reverseGeoResponse{}, errors.New("timeout")
+  }
+  if _, err := geocodeAddress(AddressRequest{Address: "Jl. Melati 3", Lat: -6.2, Lng: 106.3}); err != nil {
+    t.Fatalf("lookup failure should not block an address with text: %v", err)
+  }
+  if _, err := geocodeAddress(AddressRequest{Lat: -6.2, Lng: 106.3}); !isInvalid(err) {
+    t.Fatalf("expected invalid error without address text, got %v", err)
+  }
+}
+
+func TestApplySavedAddressFillsOrder(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`FROM user_addresses a LEFT JOIN delivery_zones z ON a.zone_id = z.id WHERE a.id::text = \$1 AND a.user_id = \$2`).
+    WithArgs("addr-1", "user-1").
+    WillReturnRows(sqlmock.NewRows([]string{"id", "label", "recipient", "phone", "address", "notes", "lat", "lng", "zone_id", "zone_name", "geocoded_address", "locality", "geocode_source", "is_default"}).
+      AddRow("addr-1", "Rumah", "Sari", "0812", "Jl. Melati 3", "pagar hijau", -6.2, 106.3, nil, nil, "Jl. Melati 3, Tangerang", "Tangerang", "google", true))
+
+  tx, _ := db.Begin()
+  req := OrderRequest{CartID: "cart-1", AddressID: "addr-1", Phone: "0899"}
+  if err := applySavedAddressTx(tx, "user-1", &req); err != nil {
+    t.Fatalf("apply: %v", err)
+  }
+  if req.CustomerName != "Sari" || req.Phone != "0899" || req.Address != "Jl. Melati 3 (pagar hijau)" {
+    t.Fatalf("unexpected recipient fields: %+v", req)
+  }
+  if req.DeliveryType != "per_km" || req.Lat != -6.2 || req.Lng != 106.3 {
+    t.Fatalf("expected per_km delivery from the pin, got %+v", req)
+  }
+
+  guest := OrderRequest{AddressID: "addr-1"}
+  if err := applySavedAddressTx(tx, "", &guest); !isInvalid(err) {
+    t.Fatalf("expected guests to be refused, got %v", err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("unmet expectations: %v", err)
+  }
+}
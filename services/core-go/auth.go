@@ -7,6 +7,7 @@ import (
   "encoding/json"
   "fmt"
   "io"
+  "log"
   "net/http"
   "net/url"
   "os"
@@ -14,6 +15,7 @@ import (
   "strings"
   "time"
 
+  "github.com/lib/pq"
   "golang.org/x/crypto/bcrypt"
 )
 
@@ -121,23 +123,23 @@ func loginHandler(db *sql.DB) http.HandlerFunc {
       email, phone).
       Scan(&id, &hash, &name, &dbPhone, &tier, &totalSpend, &wallet, &isAdmin, &role, &dbEmail, &username, &avatar)
     if err != nil {
-      writeJSON(w, http.StatusUnauthorized, errMsg("invalid credentials"))
-      return
+      id, hash = "", ""
     }
-    if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)); err != nil {
-      writeJSON(w, http.StatusUnauthorized, errMsg("invalid credentials"))
+    var totpOn bool
+    if !guardLogin(db, w, r, "member", identifier, id, passwordAndTotp(db, id, hash, req.Password, req.TotpCode, req.RecoveryCode, &totpOn)) {
       return
     }
 
-    token := generateToken()
-    _, err = db.Exec(`INSERT INTO sessions (token, user_id, expires_at) VALUES ($1,$2,$3)`, token, id, sessionExpiry())
+    token, err := createSession(db, id, r)
     if err != nil {
       writeJSON(w, http.StatusInternalServerError, errMsg("login failed"))
       return
     }
+    cartID := loginCart(db, id, req.CartID, req.CartToken)
 
     writeJSON(w, http.StatusOK, map[string]any{
       "token": token,
+      "cart_id": nullIfEmpty(cartID),
       "user": map[string]any{
         "id": id,
         "name": name,
@@ -168,12 +170,9 @@ func otpRequestHandler(db *sql.DB) http.HandlerFunc {
     }
     email := strings.ToLower(strings.TrimSpace(req.Email))
     phone := normalizePhone(req.Phone)
-    purpose := strings.ToLower(strings.TrimSpace(req.Purpose))
-    if purpose == "" {
-      purpose = "register"
-    }
-    if purpose != "register" {
-      writeJSON(w, http.StatusBadRequest, errMsg("invalid purpose"))
+    purpose, perr := otpPurpose(req.Purpose)
+    if perr != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg(perr.Error()))
       return
     }
     dest, channel, derr := otpDestination(email, phone, req.Channel)
@@ -181,15 +180,42 @@ func otpRequestHandler(db *sql.DB) http.HandlerFunc {
       writeJSON(w, http.StatusBadRequest, errMsg(derr.Error()))
       return
     }
+    // the same answer whether or not the account exists, so resets cannot probe for members.
+    // Unknown accounts still go through the limits so a 429 does not give them away either.
+    deliver := true
+    if purpose == "reset_password" {
+      if _, err := userIDForOtpDestination(db, dest, channel); err != nil {
+        if err != sql.ErrNoRows {
+          writeJSON(w, http.StatusInternalServerError, errMsg("otp request failed"))
+          return
+        }
+        deliver = false
+      }
+    }
 
-    code := generateOTPCode()
-    expiresAt := time.Now().Add(5 * time.Minute)
-    _, err := db.Exec(`INSERT INTO otp_requests (destination, channel, purpose, code, expires_at) VALUES ($1,$2,$3,$4,$5)`,
-      dest, channel, purpose, code, expiresAt)
+    tx, err := db.Begin()
     if err != nil {
       writeJSON(w, http.StatusInternalServerError, errMsg("otp request failed"))
       return
     }
+    defer tx.Rollback()
+    code, err := issueOtpTx(tx, loadOtpLimits(), dest, channel, purpose, clientIP(r))
+    if err != nil {
+      if te, ok := err.(otpThrottledError); ok {
+        writeOtpThrottled(w, te)
+        return
+      }
+      writeJSON(w, http.StatusInternalServerError, errMsg("otp request failed"))
+      return
+    }
+    if err := tx.Commit(); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("otp request failed"))
+      return
+    }
+    if !deliver {
+      writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+      return
+    }
 
     if err := deliverOtp(channel, dest, code); err == nil {
       writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
@@ -221,13 +247,10 @@ func otpVerifyHandler(db *sql.DB) http.HandlerFunc {
     }
     email := strings.ToLower(strings.TrimSpace(req.Email))
     phone := normalizePhone(req.Phone)
-    purpose := strings.ToLower(strings.TrimSpace(req.Purpose))
     code := strings.TrimSpace(req.Code)
-    if purpose == "" {
-      purpose = "register"
-    }
-    if purpose != "register" {
-      writeJSON(w, http.StatusBadRequest, errMsg("invalid purpose"))
+    purpose, perr := otpPurpose(req.Purpose)
+    if perr != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg(perr.Error()))
       return
     }
     dest, channel, derr := otpDestination(email, phone, req.Channel)
@@ -240,22 +263,46 @@ func otpVerifyHandler(db *sql.DB) http.HandlerFunc {
       return
     }
 
-    var reqID string
-    err := db.QueryRow(`SELECT id FROM otp_requests WHERE destination = $1 AND channel = $2 AND purpose = $3 AND code = $4 AND verified_at IS NULL AND expires_at > NOW() ORDER BY created_at DESC LIMIT 1`,
-      dest, channel, purpose, code).Scan(&reqID)
+    tx, err := db.Begin()
     if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("otp verify failed"))
+      return
+    }
+    defer tx.Rollback()
+    left, err := verifyOtpCodeTx(tx, loadOtpLimits(), dest, channel, purpose, code)
+    if err == errOtpInvalid || err == errOtpLocked {
+      // wrong guesses are counted even though the request fails
+      if cerr := tx.Commit(); cerr != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg("otp verify failed"))
+        return
+      }
+      if err == errOtpLocked {
+        writeJSON(w, http.StatusTooManyRequests, errMsg(err.Error()))
+        return
+      }
+      if left > 0 {
+        writeJSON(w, http.StatusUnauthorized, map[string]any{"error": "invalid otp", "attempts_left": left})
+        return
+      }
       writeJSON(w, http.StatusUnauthorized, errMsg("invalid otp"))
       return
     }
-    _, _ = db.Exec(`UPDATE otp_requests SET verified_at = NOW() WHERE id = $1`, reqID)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("otp verify failed"))
+      return
+    }
 
     token := generateToken()
-    _, err = db.Exec(`INSERT INTO otp_tokens (token, destination, channel, purpose, expires_at) VALUES ($1,$2,$3,$4,$5)`,
+    _, err = tx.Exec(`INSERT INTO otp_tokens (token, destination, channel, purpose, expires_at) VALUES ($1,$2,$3,$4,$5)`,
       token, dest, channel, purpose, time.Now().Add(10*time.Minute))
     if err != nil {
       writeJSON(w, http.StatusInternalServerError, errMsg("otp verify failed"))
       return
     }
+    if err := tx.Commit(); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("otp verify failed"))
+      return
+    }
     writeJSON(w, http.StatusOK, map[string]any{"otp_token": token})
   }
 }
@@ -293,7 +340,7 @@ func googleLoginHandler(db *sql.DB) http.HandlerFunc {
     var dbPhone, avatar sql.NullString
     var isAdmin bool
     var totalSpend, wallet int
-    err := db.QueryRow(`SELECT id, name, email, phone, tier, total_spend, wallet_balance, is_admin, role, username, avatar_url FROM users WHERE email = $1 OR google_id = $2`,
+    err = db.QueryRow(`SELECT id, name, email, phone, tier, total_spend, wallet_balance, is_admin, role, username, avatar_url FROM users WHERE email = $1 OR google_id = $2`,
       email, googleID).Scan(&id, &dbName, &dbEmail, &dbPhone, &tier, &totalSpend, &wallet, &isAdmin, &role, &username, &avatar)
     if err == sql.ErrNoRows {
       if name == "" {
@@ -331,9 +378,14 @@ func googleLoginHandler(db *sql.DB) http.HandlerFunc {
       writeJSON(w, http.StatusInternalServerError, errMsg("login failed"))
       return
     }
+    if !guardLogin(db, w, r, "member", email, id, func() error {
+      _, err := checkLoginTotp(db, id, req.TotpCode, req.RecoveryCode)
+      return err
+    }) {
+      return
+    }
 
-    token := generateToken()
-    _, err = db.Exec(`INSERT INTO sessions (token, user_id, expires_at) VALUES ($1,$2,$3)`, token, id, sessionExpiry())
+    token, err := createSession(db, id, r)
     if err != nil {
       writeJSON(w, http.StatusInternalServerError, errMsg("login failed"))
       return
@@ -410,22 +462,22 @@ func adminLoginHandler(db *sql.DB) http.HandlerFunc {
     err := db.QueryRow(`SELECT id, password_hash, name, email, is_admin, role FROM users WHERE email = $1`, email).
       Scan(&id, &hash, &name, &email, &isAdmin, &role)
     if err != nil || !isAdmin {
-      writeJSON(w, http.StatusUnauthorized, errMsg("invalid credentials"))
-      return
+      id, hash = "", ""
     }
-    if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)); err != nil {
-      writeJSON(w, http.StatusUnauthorized, errMsg("invalid credentials"))
+    var totpOn bool
+    if !guardLogin(db, w, r, "admin", req.Email, id, passwordAndTotp(db, id, hash, req.Password, req.TotpCode, req.RecoveryCode, &totpOn)) {
       return
     }
 
-    token := generateToken()
-    _, err = db.Exec(`INSERT INTO sessions (token, user_id, expires_at) VALUES ($1,$2,$3)`, token, id, sessionExpiry())
+    token, err := createSession(db, id, r)
     if err != nil {
       writeJSON(w, http.StatusInternalServerError, errMsg("login failed"))
       return
     }
     writeJSON(w, http.StatusOK, map[string]any{
       "token": token,
+      // owner/admin accounts without TOTP can only reach /me/2fa until they turn it on
+      "totp_setup_required": totpRequiredRole(isAdmin, role) && !totpOn,
       "admin": map[string]any{
         "id": id,
         "name": name,
@@ -499,7 +551,7 @@ func logoutHandler(db *sql.DB) http.HandlerFunc {
       writeJSON(w, http.StatusBadRequest, errMsg("missing token"))
       return
     }
-    _, _ = db.Exec(`DELETE FROM sessions WHERE token = $1`, token)
+    _, _ = db.Exec(`DELETE FROM sessions WHERE token_hash = $1`, hashSessionToken(token))
     writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
   }
 }
@@ -524,6 +576,11 @@ func meHandler(db *sql.DB) http.HandlerFunc {
       writeJSON(w, http.StatusInternalServerError, errMsg("not found"))
       return
     }
+    pending, err := pendingCashback(db, userID)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
     writeJSON(w, http.StatusOK, map[string]any{
       "id": userID,
       "name": name,
@@ -534,6 +591,8 @@ func meHandler(db *sql.DB) http.HandlerFunc {
       "tier": tier,
       "total_spend": totalSpend,
       "wallet_balance": wallet,
+      "wallet_available": wallet,
+      "wallet_pending": pending,
     })
   }
 }
@@ -669,6 +728,10 @@ func meOrdersHandler(db *sql.DB) http.HandlerFunc {
         "created_at": createdAt,
       })
     }
+    if err := attachOrderItems(db, out); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
     writeJSON(w, http.StatusOK, out)
   }
 }
@@ -768,7 +831,7 @@ func meVouchersHandler(db *sql.DB) http.HandlerFunc {
       writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
       return
     }
-    rows, err := db.Query(`SELECT uv.code, uv.used, v.title, v.discount_type, v.discount_value, v.min_spend, v.expires_at FROM user_vouchers uv JOIN vouchers v ON uv.code = v.code WHERE uv.user_id = $1`, userID)
+    rows, err := db.Query(`SELECT uv.code, uv.used, v.title, v.discount_type, v.discount_value, v.min_spend, v.max_discount, v.starts_at, v.expires_at FROM user_vouchers uv JOIN vouchers v ON uv.code = v.code WHERE uv.user_id = $1`, userID)
     if err != nil {
       writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
       return
@@ -779,9 +842,9 @@ func meVouchersHandler(db *sql.DB) http.HandlerFunc {
     for rows.Next() {
       var code, title, dtype string
       var used bool
-      var dval, minSpend int
-      var expiresAt sql.NullString
-      if err := rows.Scan(&code, &used, &title, &dtype, &dval, &minSpend, &expiresAt); err != nil {
+      var dval, minSpend, maxDiscount int
+      var startsAt, expiresAt sql.NullString
+      if err := rows.Scan(&code, &used, &title, &dtype, &dval, &minSpend, &maxDiscount, &startsAt, &expiresAt); err != nil {
         writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
         return
       }
@@ -792,7 +855,9 @@ func meVouchersHandler(db *sql.DB) http.HandlerFunc {
         "discount_type": dtype,
         "discount_value": dval,
         "min_spend": minSpend,
-        "expires_at": expiresAt.String,
+        "max_discount": maxDiscount,
+        "starts_at": dateOnly(startsAt.String),
+        "expires_at": dateOnly(expiresAt.String),
       })
     }
     writeJSON(w, http.StatusOK, out)
@@ -806,7 +871,7 @@ func membersHandler(db *sql.DB) http.HandlerFunc {
       return
     }
     if _, err := requireRoles(db, r, "owner", "admin", "staff"); err != nil {
-      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+      writeRoleError(w, err)
       return
     }
     rows, err := db.Query(`SELECT id, name, email, phone, tier, total_spend, wallet_balance, created_at FROM users ORDER BY total_spend DESC`)
@@ -840,13 +905,36 @@ func membersHandler(db *sql.DB) http.HandlerFunc {
   }
 }
 
+func adminMemberItemHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if _, err := requireRoles(db, r, "owner", "admin", "staff"); err != nil {
+      writeRoleError(w, err)
+      return
+    }
+    path := strings.TrimPrefix(r.URL.Path, "/admin/members/")
+    userID, sub, _ := strings.Cut(path, "/")
+    if userID == "" {
+      writeJSON(w, http.StatusBadRequest, errMsg("missing id"))
+      return
+    }
+    switch sub {
+    case "tier-history":
+      adminMemberTierHistoryHandler(db, userID, w, r)
+    case "wallet":
+      adminMemberWalletHandler(db, userID, w, r)
+    default:
+      writeJSON(w, http.StatusNotFound, errMsg("not found"))
+    }
+  }
+}
+
 func vouchersHandler(db *sql.DB) http.HandlerFunc {
   return func(w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodGet {
       writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
       return
     }
-    rows, err := db.Query(`SELECT code, title, discount_type, discount_value, min_spend, max_uses, uses, expires_at, active FROM vouchers WHERE active = TRUE`)
+    rows, err := db.Query(voucherSelectSQL + ` WHERE active = TRUE AND batch_only = FALSE AND (starts_at IS NULL OR starts_at <= CURRENT_DATE) ORDER BY code`)
     if err != nil {
       writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
       return
@@ -855,25 +943,12 @@ func vouchersHandler(db *sql.DB) http.HandlerFunc {
 
     out := []map[string]any{}
     for rows.Next() {
-      var code, title, dtype string
-      var minSpend, maxUses, uses, dval int
-      var expiresAt sql.NullString
-      var active bool
-      if err := rows.Scan(&code, &title, &dtype, &dval, &minSpend, &maxUses, &uses, &expiresAt, &active); err != nil {
+      v, err := scanVoucherRow(rows)
+      if err != nil {
         writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
         return
       }
-      out = append(out, map[string]any{
-        "code": code,
-        "title": title,
-        "discount_type": dtype,
-        "discount_value": dval,
-        "min_spend": minSpend,
-        "max_uses": maxUses,
-        "uses": uses,
-        "expires_at": expiresAt.String,
-        "active": active,
-      })
+      out = append(out, v)
     }
     writeJSON(w, http.StatusOK, out)
   }
@@ -884,10 +959,10 @@ func adminVouchersHandler(db *sql.DB) http.HandlerFunc {
     switch r.Method {
     case http.MethodGet:
       if _, err := requireRoles(db, r, "owner", "admin", "staff"); err != nil {
-        writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+        writeRoleError(w, err)
         return
       }
-      rows, err := db.Query(`SELECT code, title, discount_type, discount_value, min_spend, max_uses, uses, expires_at, active FROM vouchers ORDER BY code`)
+      rows, err := db.Query(voucherSelectSQL + ` ORDER BY code`)
       if err != nil {
         writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
         return
@@ -896,30 +971,17 @@ func adminVouchersHandler(db *sql.DB) http.HandlerFunc {
 
       out := []map[string]any{}
       for rows.Next() {
-        var code, title, dtype string
-        var minSpend, maxUses, uses, dval int
-        var expiresAt sql.NullString
-        var active bool
-        if err := rows.Scan(&code, &title, &dtype, &dval, &minSpend, &maxUses, &uses, &expiresAt, &active); err != nil {
+        v, err := scanVoucherRow(rows)
+        if err != nil {
           writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
           return
         }
-        out = append(out, map[string]any{
-          "code": code,
-          "title": title,
-          "discount_type": dtype,
-          "discount_value": dval,
-          "min_spend": minSpend,
-          "max_uses": maxUses,
-          "uses": uses,
-          "expires_at": expiresAt.String,
-          "active": active,
-        })
+        out = append(out, v)
       }
       writeJSON(w, http.StatusOK, out)
     case http.MethodPost:
       if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
-        writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+        writeRoleError(w, err)
         return
       }
       var req VoucherCreateRequest
@@ -927,12 +989,35 @@ func adminVouchersHandler(db *sql.DB) http.HandlerFunc {
         writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
         return
       }
-      if req.Code == "" || req.Title == "" || req.DiscountType == "" || req.DiscountValue <= 0 {
+      if strings.TrimSpace(req.Code) == "" {
         writeJSON(w, http.StatusBadRequest, errMsg("code, title, discount_type, discount_value required"))
         return
       }
-      _, err := db.Exec(`INSERT INTO vouchers (code, title, discount_type, discount_value, min_spend, max_uses, expires_at, active) VALUES ($1,$2,$3,$4,$5,$6,$7,$8)` ,
-        strings.ToUpper(req.Code), req.Title, req.DiscountType, req.DiscountValue, req.MinSpend, req.MaxUses, nullIfEmpty(req.ExpiresAt), req.Active)
+      if err := validateVoucherRequest(&req); err != nil {
+        writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+        return
+      }
+      if err := checkVoucherReferences(db, req); err != nil {
+        if isInvalid(err) {
+          writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+          return
+        }
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      var batchCode bool
+      if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM voucher_codes WHERE code = $1)`, strings.ToUpper(strings.TrimSpace(req.Code))).Scan(&batchCode); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      if batchCode {
+        writeJSON(w, http.StatusConflict, errMsg("code already used by a voucher batch"))
+        return
+      }
+      _, err := db.Exec(`INSERT INTO vouchers (code, title, discount_type, discount_value, min_spend, max_discount, max_uses, per_user_limit, product_ids, category_ids, tiers, first_order_only, stacking, batch_only, starts_at, expires_at, active)
+        VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17)`,
+        strings.ToUpper(strings.TrimSpace(req.Code)), req.Title, req.DiscountType, req.DiscountValue, req.MinSpend, req.MaxDiscount, req.MaxUses, req.PerUserLimit,
+        pq.Array(req.ProductIDs), pq.Array(req.CategoryIDs), pq.Array(req.Tiers), req.FirstOrderOnly, req.Stacking, req.BatchOnly, nullIfEmpty(req.StartsAt), nullIfEmpty(req.ExpiresAt), req.Active)
       if err != nil {
         writeJSON(w, http.StatusBadRequest, errMsg("create voucher failed"))
         return
@@ -946,8 +1031,9 @@ func adminVouchersHandler(db *sql.DB) http.HandlerFunc {
 
 func adminVoucherItemHandler(db *sql.DB) http.HandlerFunc {
   return func(w http.ResponseWriter, r *http.Request) {
-    if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
-      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+    adminID, err := requireRoles(db, r, "owner", "admin")
+    if err != nil {
+      writeRoleError(w, err)
       return
     }
     code := strings.TrimPrefix(r.URL.Path, "/admin/vouchers/")
@@ -956,6 +1042,14 @@ func adminVoucherItemHandler(db *sql.DB) http.HandlerFunc {
       writeJSON(w, http.StatusBadRequest, errMsg("missing code"))
       return
     }
+    if strings.HasSuffix(code, "/redemptions") {
+      adminVoucherRedemptionsHandler(db, strings.TrimSuffix(code, "/redemptions"), w, r)
+      return
+    }
+    if strings.HasSuffix(code, "/batch") {
+      adminVoucherBatchHandler(db, strings.TrimSuffix(code, "/batch"), adminID, w, r)
+      return
+    }
     switch r.Method {
     case http.MethodPut:
       var req VoucherCreateRequest
@@ -963,12 +1057,23 @@ func adminVoucherItemHandler(db *sql.DB) http.HandlerFunc {
         writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
         return
       }
-      if req.Title == "" || req.DiscountType == "" || req.DiscountValue <= 0 {
-        writeJSON(w, http.StatusBadRequest, errMsg("title, discount_type, discount_value required"))
+      if err := validateVoucherRequest(&req); err != nil {
+        writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
         return
       }
-      _, err := db.Exec(`UPDATE vouchers SET title = $1, discount_type = $2, discount_value = $3, min_spend = $4, max_uses = $5, expires_at = $6, active = $7 WHERE code = $8`,
-        req.Title, req.DiscountType, req.DiscountValue, req.MinSpend, req.MaxUses, nullIfEmpty(req.ExpiresAt), req.Active, strings.ToUpper(code))
+      if err := checkVoucherReferences(db, req); err != nil {
+        if isInvalid(err) {
+          writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+          return
+        }
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      _, err := db.Exec(`UPDATE vouchers SET title = $1, discount_type = $2, discount_value = $3, min_spend = $4, max_discount = $5, max_uses = $6, per_user_limit = $7,
+          product_ids = $8, category_ids = $9, tiers = $10, first_order_only = $11, stacking = $12, batch_only = $13, starts_at = $14, expires_at = $15, active = $16
+        WHERE code = $17`,
+        req.Title, req.DiscountType, req.DiscountValue, req.MinSpend, req.MaxDiscount, req.MaxUses, req.PerUserLimit,
+        pq.Array(req.ProductIDs), pq.Array(req.CategoryIDs), pq.Array(req.Tiers), req.FirstOrderOnly, req.Stacking, req.BatchOnly, nullIfEmpty(req.StartsAt), nullIfEmpty(req.ExpiresAt), req.Active, strings.ToUpper(code))
       if err != nil {
         writeJSON(w, http.StatusBadRequest, errMsg("update voucher failed"))
         return
@@ -994,10 +1099,10 @@ func adminOrdersHandler(db *sql.DB) http.HandlerFunc {
       return
     }
     if _, err := requireRoles(db, r, "owner", "admin", "staff"); err != nil {
-      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+      writeRoleError(w, err)
       return
     }
-    rows, err := db.Query(`SELECT o.id, o.customer_name, o.phone, o.total, o.status, o.voucher_code, o.created_at, u.name, u.tier FROM orders o LEFT JOIN users u ON o.user_id = u.id ORDER BY o.created_at DESC`)
+    rows, err := db.Query(`SELECT o.id, o.customer_name, o.phone, o.subtotal, o.tier_discount, o.voucher_discount, o.discount, o.shipping_fee, o.wallet_used, o.cashback, o.total, o.status, o.oversold, o.voucher_code, o.created_at, u.name, u.tier FROM orders o LEFT JOIN users u ON o.user_id = u.id ORDER BY o.created_at DESC`)
     if err != nil {
       writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
       return
@@ -1005,48 +1110,88 @@ func adminOrdersHandler(db *sql.DB) http.HandlerFunc {
     defer rows.Close()
 
     out := []map[string]any{}
+    totals := map[string]orderTotals{}
     for rows.Next() {
       var id, cname, phone, status, createdAt string
       var voucher sql.NullString
-      var total int
+      var t orderTotals
+      var oversold bool
       var userName, tier sql.NullString
-      if err := rows.Scan(&id, &cname, &phone, &total, &status, &voucher, &createdAt, &userName, &tier); err != nil {
+      if err := rows.Scan(&id, &cname, &phone, &t.Subtotal, &t.TierDiscount, &t.VoucherDiscount, &t.Discount, &t.ShippingFee, &t.WalletUsed, &t.Cashback, &t.Total, &status, &oversold, &voucher, &createdAt, &userName, &tier); err != nil {
         writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
         return
       }
+      t.VoucherCode = voucher.String
+      totals[id] = t
       out = append(out, map[string]any{
         "id": id,
         "customer_name": cname,
         "phone": phone,
-        "total": total,
+        "subtotal": t.Subtotal,
+        "tier_discount": t.TierDiscount,
+        "voucher_discount": t.VoucherDiscount,
+        "discount": t.Discount,
+        "shipping_fee": t.ShippingFee,
+        "wallet_used": t.WalletUsed,
+        "cashback": t.Cashback,
+        "total": t.Total,
         "status": status,
+        "oversold": oversold,
         "voucher_code": voucher.String,
         "created_at": createdAt,
         "member_name": userName.String,
         "member_tier": tier.String,
       })
     }
+    if err := attachOrderItems(db, out); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    for _, o := range out {
+      t := totals[o["id"].(string)]
+      b := storedOrderBreakdown(o["items"].([]OrderItem), t)
+      o["breakdown"] = b
+      o["totals_consistent"] = totalsConsistent(b, t)
+    }
     writeJSON(w, http.StatusOK, out)
   }
 }
 
-func getUserIDFromToken(db *sql.DB, r *http.Request) (string, error) {
+// finds the live session behind X-Auth-Token; stale is true once last_seen_at is more than
+// five minutes old and the session is due to be slid forward
+func lookupSession(db queryRower, r *http.Request) (string, string, bool, error) {
   token := r.Header.Get("X-Auth-Token")
   if token == "" {
-    return "", sql.ErrNoRows
+    return "", "", false, sql.ErrNoRows
   }
-  var userID string
-  err := db.QueryRow(`SELECT user_id FROM sessions WHERE token = $1 AND expires_at > NOW()`, token).Scan(&userID)
-  return userID, err
+  var userID, sessionID string
+  var stale bool
+  err := db.QueryRow(`SELECT user_id, id, last_seen_at < NOW() - interval '5 minutes' FROM sessions WHERE token_hash = $1 AND expires_at > NOW()`,
+    hashSessionToken(token)).Scan(&userID, &sessionID, &stale)
+  return userID, sessionID, stale, err
 }
 
-func getUserIDFromTokenTx(tx *sql.Tx, r *http.Request) (string, error) {
-  token := r.Header.Get("X-Auth-Token")
-  if token == "" {
-    return "", sql.ErrNoRows
+// authenticated requests push the session expiry out to a full SESSION_TTL_HOURS again, but
+// the row is written at most every five minutes so most requests only read it
+func getUserIDFromToken(db *sql.DB, r *http.Request) (string, error) {
+  userID, sessionID, stale, err := lookupSession(db, r)
+  if err != nil {
+    return "", err
+  }
+  if stale {
+    _, err := db.Exec(`UPDATE sessions SET last_seen_at = NOW(), expires_at = GREATEST(expires_at, $2)
+      WHERE id = $1 AND last_seen_at < NOW() - interval '5 minutes'`, sessionID, sessionExpiry())
+    if err != nil {
+      log.Printf("session slide %s: %v", sessionID, err)
+    }
   }
-  var userID string
-  err := tx.QueryRow(`SELECT user_id FROM sessions WHERE token = $1 AND expires_at > NOW()`, token).Scan(&userID)
+  return userID, nil
+}
+
+// only reads the session: writing it here would hold the row lock until the caller's
+// transaction commits, so the slide is left to the next request made outside one
+func getUserIDFromTokenTx(tx *sql.Tx, r *http.Request) (string, error) {
+  userID, _, _, err := lookupSession(tx, r)
   return userID, err
 }
 
@@ -1055,12 +1200,15 @@ func requireRoles(db *sql.DB, r *http.Request, roles ...string) (string, error)
   if err != nil {
     return "", err
   }
-  var isAdmin bool
+  var isAdmin, totpOn bool
   var role string
-  err = db.QueryRow(`SELECT is_admin, role FROM users WHERE id = $1`, userID).Scan(&isAdmin, &role)
+  err = db.QueryRow(`SELECT is_admin, role, totp_enabled_at IS NOT NULL FROM users WHERE id = $1`, userID).Scan(&isAdmin, &role, &totpOn)
   if err != nil || !isAdmin {
     return "", sql.ErrNoRows
   }
+  if totpRequiredRole(isAdmin, role) && !totpOn {
+    return "", errTotpSetupRequired
+  }
   for _, r := range roles {
     if strings.EqualFold(role, r) {
       return userID, nil
@@ -1072,12 +1220,22 @@ func requireRoles(db *sql.DB, r *http.Request, roles ...string) (string, error)
   return "", sql.ErrNoRows
 }
 
+// an owner or admin without two-factor gets a 403 the admin UI can act on (send them to
+// /me/2fa/setup) instead of the 401 that means the session is gone
+func writeRoleError(w http.ResponseWriter, err error) {
+  if err == errTotpSetupRequired {
+    writeJSON(w, http.StatusForbidden, errMsg(err.Error()))
+    return
+  }
+  writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+}
+
 func adminStaffHandler(db *sql.DB) http.HandlerFunc {
   return func(w http.ResponseWriter, r *http.Request) {
     switch r.Method {
     case http.MethodGet:
       if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
-        writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+        writeRoleError(w, err)
         return
       }
       rows, err := db.Query(`SELECT id, name, email, phone, role, created_at FROM users WHERE is_admin = TRUE ORDER BY created_at DESC`)
@@ -1105,7 +1263,7 @@ func adminStaffHandler(db *sql.DB) http.HandlerFunc {
       writeJSON(w, http.StatusOK, out)
     case http.MethodPost:
       if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
-        writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+        writeRoleError(w, err)
         return
       }
       var req AdminUserCreateRequest
@@ -1149,7 +1307,7 @@ func adminStaffHandler(db *sql.DB) http.HandlerFunc {
 func adminStaffItemHandler(db *sql.DB) http.HandlerFunc {
   return func(w http.ResponseWriter, r *http.Request) {
     if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
-      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+      writeRoleError(w, err)
       return
     }
     id := strings.TrimPrefix(r.URL.Path, "/admin/staff/")
@@ -1211,7 +1369,7 @@ func adminStaffItemHandler(db *sql.DB) http.HandlerFunc {
 func adminDeliveryZoneItemHandler(db *sql.DB) http.HandlerFunc {
   return func(w http.ResponseWriter, r *http.Request) {
     if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
-      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+      writeRoleError(w, err)
       return
     }
     id := strings.TrimPrefix(r.URL.Path, "/admin/delivery/zones/")
@@ -1260,8 +1418,9 @@ func adminProductsHandler(db *sql.DB) http.HandlerFunc {
       uploadHandler(w, r)
       return
     }
-    if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
-      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+    adminID, err := requireRoles(db, r, "owner", "admin")
+    if err != nil {
+      writeRoleError(w, err)
       return
     }
     id := strings.TrimPrefix(r.URL.Path, "/admin/products/")
@@ -1270,6 +1429,10 @@ func adminProductsHandler(db *sql.DB) http.HandlerFunc {
       writeJSON(w, http.StatusBadRequest, errMsg("missing id"))
       return
     }
+    if parts := strings.SplitN(id, "/variants", 2); len(parts) == 2 {
+      adminProductVariantsHandler(db, w, r, parts[0], strings.Trim(parts[1], "/"), adminID)
+      return
+    }
     switch r.Method {
     case http.MethodPut:
       var req ProductCreateRequest
@@ -1277,7 +1440,7 @@ func adminProductsHandler(db *sql.DB) http.HandlerFunc {
         writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
         return
       }
-      if req.Name == "" || req.Price <= 0 || req.Stock < 0 {
+      if req.Name == "" || req.Price <= 0 || req.Stock < 0 || (req.ReorderThreshold != nil && *req.ReorderThreshold < 0) {
         writeJSON(w, http.StatusBadRequest, errMsg("name, price, stock required"))
         return
       }
@@ -1290,12 +1453,46 @@ func adminProductsHandler(db *sql.DB) http.HandlerFunc {
         }
         categoryID = sql.NullString{String: cid, Valid: true}
       }
-      _, err := db.Exec(`UPDATE products SET category_id = $1, name = $2, description = $3, price = $4, stock = $5 WHERE id = $6`,
-        categoryID, req.Name, req.Description, req.Price, req.Stock, id)
+      tx, err := db.Begin()
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      defer tx.Rollback()
+      res, err := tx.Exec(`UPDATE products SET category_id = $1, name = $2, description = $3, price = $4, reorder_threshold = COALESCE($5, reorder_threshold) WHERE id = $6`,
+        categoryID, req.Name, req.Description, req.Price, req.ReorderThreshold, id)
       if err != nil {
         writeJSON(w, http.StatusBadRequest, errMsg("update product failed"))
         return
       }
+      if n, _ := res.RowsAffected(); n == 0 {
+        writeJSON(w, http.StatusNotFound, errMsg("not found"))
+        return
+      }
+      // stock on variant products is the sum of its variants and only moves through them
+      var hasVariants bool
+      if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM product_variants WHERE product_id = $1)`, id).Scan(&hasVariants); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      if !hasVariants {
+        current, err := currentStockTx(tx, id, "")
+        if err != nil {
+          writeInventoryError(w, err)
+          return
+        }
+        if req.Stock != current {
+          _, _, err = applyStockMovementTx(tx, inventoryMovement{ProductID: id, Kind: "ADJUSTMENT", Delta: req.Stock - current, ActorType: "admin", ActorID: adminID, Reason: "product edit"})
+          if err != nil {
+            writeInventoryError(w, err)
+            return
+          }
+        }
+      }
+      if err := tx.Commit(); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
       writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
     case http.MethodDelete:
       _, err := db.Exec(`DELETE FROM products WHERE id = $1`, id)
@@ -1310,38 +1507,89 @@ func adminProductsHandler(db *sql.DB) http.HandlerFunc {
   }
 }
 
-func adminOrderStatusHandler(db *sql.DB) http.HandlerFunc {
+func adminOrderItemHandler(db *sql.DB) http.HandlerFunc {
   return func(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodPut {
-      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
-      return
-    }
-    if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
-      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
-      return
-    }
-    id := strings.TrimPrefix(r.URL.Path, "/admin/orders/")
-    id = strings.TrimSuffix(id, "/status")
-    if id == "" {
-      writeJSON(w, http.StatusBadRequest, errMsg("missing id"))
-      return
-    }
-    var req OrderStatusRequest
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-      writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
-      return
+    path := strings.TrimPrefix(r.URL.Path, "/admin/orders/")
+    switch {
+    case strings.HasSuffix(path, "/history"):
+      adminOrderHistoryHandler(db, strings.TrimSuffix(path, "/history"), w, r)
+    default:
+      adminOrderStatusHandler(db, strings.TrimSuffix(path, "/status"), w, r)
     }
-    if req.Status == "" {
-      writeJSON(w, http.StatusBadRequest, errMsg("status required"))
+  }
+}
+
+func adminOrderHistoryHandler(db *sql.DB, id string, w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet {
+    writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+    return
+  }
+  if _, err := requireRoles(db, r, "owner", "admin", "staff"); err != nil {
+    writeRoleError(w, err)
+    return
+  }
+  if id == "" {
+    writeJSON(w, http.StatusBadRequest, errMsg("missing id"))
+    return
+  }
+  history, err := loadOrderStatusHistory(db, id)
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  writeJSON(w, http.StatusOK, history)
+}
+
+func adminOrderStatusHandler(db *sql.DB, id string, w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPut {
+    writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+    return
+  }
+  adminID, err := requireRoles(db, r, "owner", "admin")
+  if err != nil {
+    writeRoleError(w, err)
+    return
+  }
+  if id == "" {
+    writeJSON(w, http.StatusBadRequest, errMsg("missing id"))
+    return
+  }
+  var req OrderStatusRequest
+  if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+    writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
+    return
+  }
+  if req.Status == "" {
+    writeJSON(w, http.StatusBadRequest, errMsg("status required"))
+    return
+  }
+  tx, err := db.Begin()
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg("db error"))
+    return
+  }
+  defer tx.Rollback()
+  from, short, err := transitionOrderTx(tx, id, req.Status, "admin", adminID, req.Note)
+  if err != nil {
+    if err == sql.ErrNoRows {
+      writeJSON(w, http.StatusNotFound, errMsg("not found"))
       return
     }
-    _, err := db.Exec(`UPDATE orders SET status = $1 WHERE id = $2`, strings.ToUpper(req.Status), id)
-    if err != nil {
-      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    if isInvalid(err) {
+      writeJSON(w, http.StatusConflict, errMsg(err.Error()))
       return
     }
-    writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  if err := tx.Commit(); err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg("db commit failed"))
+    return
+  }
+  if len(short) > 0 {
+    go sendOversoldAlert(db, id, short)
   }
+  writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "from_status": from, "to_status": strings.ToUpper(req.Status), "oversold": len(short) > 0})
 }
 
 func adminExpensesHandler(db *sql.DB) http.HandlerFunc {
@@ -1349,7 +1597,7 @@ func adminExpensesHandler(db *sql.DB) http.HandlerFunc {
     switch r.Method {
     case http.MethodGet:
       if _, err := requireRoles(db, r, "owner", "admin", "staff"); err != nil {
-        writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+        writeRoleError(w, err)
         return
       }
       rows, err := db.Query(`SELECT id, date, category, description, amount, created_at FROM expenses ORDER BY date DESC, created_at DESC`)
@@ -1378,7 +1626,7 @@ func adminExpensesHandler(db *sql.DB) http.HandlerFunc {
       writeJSON(w, http.StatusOK, out)
     case http.MethodPost:
       if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
-        writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+        writeRoleError(w, err)
         return
       }
       var req ExpenseRequest
@@ -1411,7 +1659,7 @@ func adminExpensesHandler(db *sql.DB) http.HandlerFunc {
 func adminExpenseItemHandler(db *sql.DB) http.HandlerFunc {
   return func(w http.ResponseWriter, r *http.Request) {
     if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
-      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+      writeRoleError(w, err)
       return
     }
     id := strings.TrimPrefix(r.URL.Path, "/admin/expenses/")
@@ -1463,7 +1711,7 @@ func adminSalesReportHandler(db *sql.DB) http.HandlerFunc {
       return
     }
     if _, err := requireRoles(db, r, "owner", "admin", "staff"); err != nil {
-      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+      writeRoleError(w, err)
       return
     }
     from := r.URL.Query().Get("from")
@@ -1543,7 +1791,7 @@ func adminFinanceSummaryHandler(db *sql.DB) http.HandlerFunc {
       return
     }
     if _, err := requireRoles(db, r, "owner", "admin", "staff"); err != nil {
-      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+      writeRoleError(w, err)
       return
     }
     from := r.URL.Query().Get("from")
@@ -1622,11 +1870,36 @@ func midtransWebhookHandler(db *sql.DB) http.HandlerFunc {
       return
     }
     mapped := mapMidtransStatus(status)
-    _, err := db.Exec(`UPDATE orders SET status = $1 WHERE id = $2`, mapped, orderID)
+    tx, err := db.Begin()
     if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("db error"))
+      return
+    }
+    defer tx.Rollback()
+    // a settlement is recorded even when a lapsed hold found no stock: the order is PAID and
+    // flagged oversold, since answering "ignored" would leave captured money unaccounted for
+    _, short, err := transitionOrderTx(tx, orderID, mapped, "midtrans", "", status)
+    if err != nil {
+      if err == sql.ErrNoRows {
+        writeJSON(w, http.StatusNotFound, errMsg("order not found"))
+        return
+      }
+      if isInvalid(err) {
+        log.Printf("midtrans webhook ignored for order %s: %v", orderID, err)
+        writeJSON(w, http.StatusOK, map[string]string{"status": "ignored"})
+        return
+      }
       writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
       return
     }
+    if err := tx.Commit(); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("db commit failed"))
+      return
+    }
+    if len(short) > 0 {
+      log.Printf("midtrans webhook: order %s paid without stock for %s", orderID, strings.Join(short, ", "))
+      go sendOversoldAlert(db, orderID, short)
+    }
     writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
   }
 }
@@ -1639,12 +1912,14 @@ func mapMidtransStatus(status string) string {
     return "PENDING"
   case "expire", "cancel", "deny":
     return "FAILED"
+  case "refund", "partial_refund":
+    return "REFUNDED"
   default:
     return strings.ToUpper(status)
   }
 }
 
-func getTierInfo(db *sql.DB, totalSpend int) (TierInfo, error) {
+func getTierInfo(db queryRower, totalSpend int) (TierInfo, error) {
   var t TierInfo
   err := db.QueryRow(`SELECT name, discount_pct, cashback_pct FROM loyalty_tiers WHERE min_spend <= $1 ORDER BY min_spend DESC LIMIT 1`, totalSpend).
     Scan(&t.Name, &t.DiscountPct, &t.CashbackPct)
@@ -1664,7 +1939,9 @@ func generateOTPCode() string {
   return fmt.Sprintf("%06d", n%1000000)
 }
 
-func consumeOtpToken(db *sql.DB, destination string, channel string, purpose string, token string) bool {
+// marks the token used in the same statement that checks it, so two requests racing with one
+// token cannot both get through; pass the caller's transaction to tie it to what it unlocks
+func consumeOtpToken(q queryRower, destination string, channel string, purpose string, token string) bool {
   destination = strings.TrimSpace(destination)
   channel = strings.ToLower(strings.TrimSpace(channel))
   purpose = strings.ToLower(strings.TrimSpace(purpose))
@@ -1672,13 +1949,10 @@ func consumeOtpToken(db *sql.DB, destination string, channel string, purpose str
   if destination == "" || channel == "" || purpose == "" || token == "" {
     return false
   }
-  var used bool
-  err := db.QueryRow(`SELECT used FROM otp_tokens WHERE token = $1 AND destination = $2 AND channel = $3 AND purpose = $4 AND expires_at > NOW()`,
-    token, destination, channel, purpose).Scan(&used)
-  if err != nil || used {
-    return false
-  }
-  _, err = db.Exec(`UPDATE otp_tokens SET used = TRUE WHERE token = $1`, token)
+  var consumed string
+  err := q.QueryRow(`UPDATE otp_tokens SET used = TRUE
+    WHERE token = $1 AND destination = $2 AND channel = $3 AND purpose = $4 AND used = FALSE AND expires_at > NOW()
+    RETURNING token`, token, destination, channel, purpose).Scan(&consumed)
   return err == nil
 }
 
@@ -1699,72 +1973,3 @@ func nullIfEmpty(v string) any {
   return v
 }
 
-func rewardCodeForTier(tier string) string {
-  switch strings.ToLower(tier) {
-  case "silver":
-    return "SILVER100"
-  case "gold":
-    return "GOLD200"
-  case "platinum":
-    return "PLAT300"
-  default:
-    return ""
-  }
-}
-
-func applyVoucherTx(tx *sql.Tx, code string, subtotal int, userID string) (int, error) {
-  if strings.TrimSpace(code) == "" {
-    return 0, nil
-  }
-  var vType string
-  var vVal, minSpend, maxUses, uses int
-  var active bool
-  var expiresAt sql.NullString
-  err := tx.QueryRow(`SELECT discount_type, discount_value, min_spend, max_uses, uses, expires_at, active FROM vouchers WHERE code = $1`, strings.ToUpper(code)).
-    Scan(&vType, &vVal, &minSpend, &maxUses, &uses, &expiresAt, &active)
-  if err != nil {
-    if err == sql.ErrNoRows {
-      return 0, errInvalid("voucher not found")
-    }
-    return 0, err
-  }
-  if !active {
-    return 0, errInvalid("voucher not active")
-  }
-  if expiresAt.Valid {
-    var ok int
-    err := tx.QueryRow(`SELECT CASE WHEN $1::date >= CURRENT_DATE THEN 1 ELSE 0 END`, expiresAt.String).Scan(&ok)
-    if err != nil || ok == 0 {
-      return 0, errInvalid("voucher expired")
-    }
-  }
-  if subtotal < minSpend {
-    return 0, errInvalid("min spend not met")
-  }
-  if maxUses > 0 && uses >= maxUses {
-    return 0, errInvalid("voucher quota used")
-  }
-
-  if userID != "" {
-    var used bool
-    err := tx.QueryRow(`SELECT used FROM user_vouchers WHERE user_id = $1 AND code = $2`, userID, strings.ToUpper(code)).Scan(&used)
-    if err == nil && used {
-      return 0, errInvalid("voucher already used")
-    }
-  }
-
-  discount := 0
-  if strings.ToLower(vType) == "percent" {
-    discount = subtotal * vVal / 100
-  } else {
-    discount = vVal
-  }
-  if discount < 0 {
-    discount = 0
-  }
-  if discount > subtotal {
-    discount = subtotal
-  }
-
-  return discount, nil
-}
@@ -0,0 +1,209 @@
+package main
+
+import (
+  "crypto/subtle"
+  "database/sql"
+  "errors"
+  "log"
+  "net/http"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+)
+
+var (
+  errCartNotFound   = errors.New("cart not found")
+  errCartForbidden  = errors.New("cart belongs to someone else")
+  errInvalidSession = errors.New("invalid session")
+)
+
+func writeCartError(w http.ResponseWriter, err error) {
+  switch {
+  case errors.Is(err, errCartNotFound):
+    writeJSON(w, http.StatusNotFound, errMsg(err.Error()))
+  case errors.Is(err, errCartForbidden):
+    writeJSON(w, http.StatusForbidden, errMsg(err.Error()))
+  case errors.Is(err, errInvalidSession):
+    writeJSON(w, http.StatusUnauthorized, errMsg(err.Error()))
+  default:
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+  }
+}
+
+func sessionUserID(db *sql.DB, r *http.Request) (string, error) {
+  if r.Header.Get("X-Auth-Token") == "" {
+    return "", nil
+  }
+  userID, err := getUserIDFromToken(db, r)
+  if err == sql.ErrNoRows {
+    return "", errInvalidSession
+  }
+  return userID, err
+}
+
+// member carts belong to their user; guest carts are bearer objects guarded by the
+// cart token handed out when the cart was created
+func authorizeCart(q queryRower, cartID string, userID string, cartToken string) (bool, error) {
+  var owner, secret sql.NullString
+  err := q.QueryRow(`SELECT user_id, secret FROM carts WHERE id = $1`, cartID).Scan(&owner, &secret)
+  if err == sql.ErrNoRows {
+    return false, errCartNotFound
+  }
+  if err != nil {
+    return false, err
+  }
+  if owner.Valid {
+    if owner.String != userID {
+      return false, errCartForbidden
+    }
+    return false, nil
+  }
+  if !secret.Valid || subtle.ConstantTimeCompare([]byte(secret.String), []byte(cartToken)) != 1 {
+    return true, errCartForbidden
+  }
+  return true, nil
+}
+
+func userCartID(db *sql.DB, userID string, create bool) (string, error) {
+  var id string
+  err := db.QueryRow(`SELECT id FROM carts WHERE user_id = $1`, userID).Scan(&id)
+  if err == sql.ErrNoRows && create {
+    err = db.QueryRow(`INSERT INTO carts (user_id) VALUES ($1)
+      ON CONFLICT (user_id) WHERE user_id IS NOT NULL DO UPDATE SET updated_at = NOW() RETURNING id`, userID).Scan(&id)
+  }
+  if err == sql.ErrNoRows {
+    return "", nil
+  }
+  return id, err
+}
+
+// returns the cart the request may use, plus the cart token when a guest cart was just created
+func resolveCart(db *sql.DB, r *http.Request, cartID string, create bool) (string, string, error) {
+  userID, err := sessionUserID(db, r)
+  if err != nil {
+    return "", "", err
+  }
+  cartID = strings.TrimSpace(cartID)
+  cartToken := r.Header.Get("X-Cart-Token")
+  if userID != "" {
+    if cartID == "" {
+      id, err := userCartID(db, userID, create)
+      return id, "", err
+    }
+    guest, err := authorizeCart(db, cartID, userID, cartToken)
+    if err != nil {
+      return "", "", err
+    }
+    if guest {
+      id, err := mergeGuestCart(db, userID, cartID)
+      return id, "", err
+    }
+    return cartID, "", nil
+  }
+  if cartID == "" {
+    if !create {
+      return "", "", errCartNotFound
+    }
+    token, err := randToken(16)
+    if err != nil {
+      return "", "", err
+    }
+    var id string
+    if err := db.QueryRow(`INSERT INTO carts (secret) VALUES ($1) RETURNING id`, token).Scan(&id); err != nil {
+      return "", "", err
+    }
+    return id, token, nil
+  }
+  if _, err := authorizeCart(db, cartID, "", cartToken); err != nil {
+    return "", "", err
+  }
+  return cartID, "", nil
+}
+
+func mergeGuestCart(db *sql.DB, userID string, guestCartID string) (string, error) {
+  tx, err := db.Begin()
+  if err != nil {
+    return "", err
+  }
+  defer tx.Rollback()
+  var userCart string
+  err = tx.QueryRow(`SELECT id FROM carts WHERE user_id = $1 FOR UPDATE`, userID).Scan(&userCart)
+  if err == sql.ErrNoRows {
+    if _, err := tx.Exec(`UPDATE carts SET user_id = $1, secret = NULL, updated_at = NOW() WHERE id = $2`, userID, guestCartID); err != nil {
+      return "", err
+    }
+    return guestCartID, tx.Commit()
+  }
+  if err != nil {
+    return "", err
+  }
+  if userCart == guestCartID {
+    return userCart, nil
+  }
+  _, err = tx.Exec(`UPDATE cart_items u SET qty = u.qty + g.qty
+    FROM cart_items g
+    WHERE u.cart_id = $1 AND g.cart_id = $2 AND u.product_id = g.product_id AND u.variant_id IS NOT DISTINCT FROM g.variant_id`, userCart, guestCartID)
+  if err != nil {
+    return "", err
+  }
+  _, err = tx.Exec(`INSERT INTO cart_items (cart_id, product_id, variant_id, qty, price_at_add)
+    SELECT $1, g.product_id, g.variant_id, g.qty, g.price_at_add FROM cart_items g
+    WHERE g.cart_id = $2 AND NOT EXISTS (
+      SELECT 1 FROM cart_items u WHERE u.cart_id = $1 AND u.product_id = g.product_id AND u.variant_id IS NOT DISTINCT FROM g.variant_id
+    )`, userCart, guestCartID)
+  if err != nil {
+    return "", err
+  }
+  if _, err := tx.Exec(`DELETE FROM carts WHERE id = $1`, guestCartID); err != nil {
+    return "", err
+  }
+  if _, err := tx.Exec(`UPDATE carts SET updated_at = NOW() WHERE id = $1`, userCart); err != nil {
+    return "", err
+  }
+  return userCart, tx.Commit()
+}
+
+func loginCart(db *sql.DB, userID string, guestCartID string, cartToken string) string {
+  guestCartID = strings.TrimSpace(guestCartID)
+  if guestCartID != "" {
+    if guest, err := authorizeCart(db, guestCartID, userID, cartToken); err == nil && guest {
+      merged, err := mergeGuestCart(db, userID, guestCartID)
+      if err == nil {
+        return merged
+      }
+      log.Printf("merge cart %s into user %s: %v", guestCartID, userID, err)
+    }
+  }
+  id, _ := userCartID(db, userID, false)
+  return id
+}
+
+func touchCart(db *sql.DB, cartID string) {
+  _, _ = db.Exec(`UPDATE carts SET updated_at = NOW() WHERE id = $1`, cartID)
+}
+
+func cartTTL() time.Duration {
+  ttl := 168
+  if v := strings.TrimSpace(os.Getenv("CART_TTL_HOURS")); v != "" {
+    if n, err := strconv.Atoi(v); err == nil && n > 0 {
+      ttl = n
+    }
+  }
+  return time.Duration(ttl) * time.Hour
+}
+
+func runCartPurger(db *sql.DB, every time.Duration) {
+  ticker := time.NewTicker(every)
+  defer ticker.Stop()
+  for range ticker.C {
+    res, err := db.Exec(`DELETE FROM carts WHERE updated_at < $1`, time.Now().Add(-cartTTL()))
+    if err != nil {
+      log.Printf("cart purger: %v", err)
+      continue
+    }
+    if n, _ := res.RowsAffected(); n > 0 {
+      log.Printf("cart purger: removed %d abandoned carts", n)
+    }
+  }
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+
+  "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestMergeGuestCartAdoptedWhenMemberHasNone(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT id FROM carts WHERE user_id = \$1 FOR UPDATE`).
+    WithArgs("user-1").
+    WillReturnRows(sqlmock.NewRows([]string{"id"}))
+  mock.ExpectExec(`UPDATE carts SET user_id = \$1, secret = NULL, updated_at = NOW\(\) WHERE id = \$2`).
+    WithArgs("user-1", "guest-cart").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectCommit()
+
+  id, err := mergeGuestCart(db, "user-1", "guest-cart")
+  if err != nil || id != "guest-cart" {
+    t.Fatalf("expected guest-cart, got %q (%v)", id, err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestMergeGuestCartFoldsIntoMemberCart(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT id FROM carts WHERE user_id = \$1 FOR UPDATE`).
+    WithArgs("user-1").
+    WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("member-cart"))
+  mock.ExpectExec(`UPDATE cart_items u SET qty = u\.qty \+ g\.qty`).
+    WithArgs("member-cart", "guest-cart").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectExec(`INSERT INTO cart_items \(cart_id, product_id, variant_id, qty, price_at_add\)\s+SELECT \$1, g\.product_id`).
+    WithArgs("member-cart", "guest-cart").
+    WillReturnResult(sqlmock.NewResult(0, 2))
+  mock.ExpectExec(`DELETE FROM carts WHERE id = \$1`).
+    WithArgs("guest-cart").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectExec(`UPDATE carts SET updated_at = NOW\(\) WHERE id = \$1`).
+    WithArgs("member-cart").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectCommit()
+
+  id, err := mergeGuestCart(db, "user-1", "guest-cart")
+  if err != nil || id != "member-cart" {
+    t.Fatalf("expected member-cart, got %q (%v)", id, err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestResolveCartGuestNeedsCartToken(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectQuery(`SELECT user_id, secret FROM carts WHERE id = \$1`).
+    WithArgs("guest-cart").
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "secret"}).AddRow(nil, "cart-secret"))
+
+  req := httptest.NewRequest(http.MethodGet, "/cart?cart_id=guest-cart", nil)
+  req.Header.Set("X-Cart-Token", "guessed")
+  if _, _, err := resolveCart(db, req, "guest-cart", false); !errors.Is(err, errCartForbidden) {
+    t.Fatalf("expected errCartForbidden, got %v", err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestResolveCartMemberTakesOverGuestCart(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectQuery(`SELECT user_id, id, last_seen_at < NOW\(\) - interval '5 minutes' FROM sessions`).
+    WithArgs(hashSessionToken("member-token")).
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "id", "stale"}).AddRow("user-1", "session-1", false))
+  mock.ExpectQuery(`SELECT user_id, secret FROM carts WHERE id = \$1`).
+    WithArgs("guest-cart").
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "secret"}).AddRow(nil, "cart-secret"))
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT id FROM carts WHERE user_id = \$1 FOR UPDATE`).
+    WithArgs("user-1").
+    WillReturnRows(sqlmock.NewRows([]string{"id"}))
+  mock.ExpectExec(`UPDATE carts SET user_id = \$1, secret = NULL`).
+    WithArgs("user-1", "guest-cart").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectCommit()
+
+  req := httptest.NewRequest(http.MethodGet, "/cart?cart_id=guest-cart", nil)
+  req.Header.Set("X-Auth-Token", "member-token")
+  req.Header.Set("X-Cart-Token", "cart-secret")
+  id, token, err := resolveCart(db, req, "guest-cart", false)
+  if err != nil || id != "guest-cart" || token != "" {
+    t.Fatalf("expected guest-cart adopted, got %q %q (%v)", id, token, err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestResolveCartRejectsAnotherMembersCart(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectQuery(`SELECT user_id, id, last_seen_at < NOW\(\) - interval '5 minutes' FROM sessions`).
+    WithArgs(hashSessionToken("member-token")).
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "id", "stale"}).AddRow("user-1", "session-1", false))
+  mock.ExpectQuery(`SELECT user_id, secret FROM carts WHERE id = \$1`).
+    WithArgs("other-cart").
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "secret"}).AddRow("user-2", nil))
+
+  req := httptest.NewRequest(http.MethodGet, "/cart?cart_id=other-cart", nil)
+  req.Header.Set("X-Auth-Token", "member-token")
+  if _, _, err := resolveCart(db, req, "other-cart", false); !errors.Is(err, errCartForbidden) {
+    t.Fatalf("expected errCartForbidden, got %v", err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestCartItemUpdateNeedsProductID(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  body, _ := json.Marshal(map[string]any{"cart_id": "guest-cart", "qty": 2})
+  req := httptest.NewRequest(http.MethodPut, "/cart/items", bytes.NewReader(body))
+  rec := httptest.NewRecorder()
+
+  cartItemHandler(db).ServeHTTP(rec, req)
+
+  var resp map[string]string
+  _ = json.Unmarshal(rec.Body.Bytes(), &resp)
+  if rec.Code != http.StatusBadRequest || resp["error"] != "product_id required" {
+    t.Fatalf("expected 400 product_id required, got %d: %s", rec.Code, rec.Body.String())
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+  "database/sql"
+  "os"
+  "strings"
+)
+
+// how far an order has progressed towards delivery; statuses off the happy path are absent
+var orderProgress = map[string]int{
+  "PENDING":   0,
+  "PAID":      1,
+  "PACKED":    2,
+  "SHIPPED":   3,
+  "DELIVERED": 4,
+}
+
+// cashback is held as pending on the order until it reaches this status
+func cashbackReleaseStatus() string {
+  switch strings.ToUpper(strings.TrimSpace(os.Getenv("CASHBACK_RELEASE_ON"))) {
+  case "PAID":
+    return "PAID"
+  default:
+    return "DELIVERED"
+  }
+}
+
+// credits the order's pending cashback once the order has reached the release status.
+// The conditional update makes it safe to call on every transition.
+func releaseOrderCashbackTx(tx *sql.Tx, orderID string, status string, actorType string, actorID string) error {
+  reached, ok := orderProgress[status]
+  if !ok || reached < orderProgress[cashbackReleaseStatus()] {
+    return nil
+  }
+  var userID string
+  var cashback int
+  err := tx.QueryRow(`UPDATE orders SET cashback_status = 'CREDITED', cashback_released_at = NOW()
+    WHERE id = $1 AND cashback_status = 'PENDING' AND user_id IS NOT NULL RETURNING user_id, cashback`, orderID).Scan(&userID, &cashback)
+  if err == sql.ErrNoRows {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  if cashback <= 0 {
+    return nil
+  }
+  _, err = postWalletEntryTx(tx, walletEntry{UserID: userID, Kind: "CASHBACK", Amount: cashback, OrderID: orderID, ActorType: actorType, ActorID: actorID, Reason: "order " + strings.ToLower(status)})
+  return err
+}
+
+// takes back the cashback of a cancelled, failed or refunded order: pending cashback is
+// forfeited, credited cashback is debited from the wallet. Cashback that was already spent
+// cannot be taken back; only what is left is debited.
+func reverseOrderCashbackTx(tx *sql.Tx, orderID string, actorType string, actorID string) error {
+  var userID sql.NullString
+  var status string
+  var cashback int
+  if err := tx.QueryRow(`SELECT user_id, cashback_status, cashback FROM orders WHERE id = $1`, orderID).Scan(&userID, &status, &cashback); err != nil {
+    return err
+  }
+  if status == "PENDING" {
+    _, err := tx.Exec(`UPDATE orders SET cashback_status = 'FORFEITED' WHERE id = $1 AND cashback_status = 'PENDING'`, orderID)
+    return err
+  }
+  if status != "CREDITED" || !userID.Valid || cashback <= 0 {
+    return nil
+  }
+  var balance int
+  if err := tx.QueryRow(`SELECT wallet_balance FROM users WHERE id = $1 FOR UPDATE`, userID.String).Scan(&balance); err != nil {
+    return err
+  }
+  if clawback := min(cashback, balance); clawback > 0 {
+    if _, err := postWalletEntryTx(tx, walletEntry{UserID: userID.String, Kind: "CASHBACK_REVERSAL", Amount: clawback, OrderID: orderID, ActorType: actorType, ActorID: actorID}); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func pendingCashback(db queryRower, userID string) (int, error) {
+  var pending int
+  err := db.QueryRow(`SELECT COALESCE(SUM(cashback), 0) FROM orders WHERE user_id = $1 AND cashback_status = 'PENDING'`, userID).Scan(&pending)
+  return pending, err
+}
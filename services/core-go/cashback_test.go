@@ -0,0 +1,95 @@
+package main
+
+import (
+  "testing"
+
+  "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestReleaseOrderCashbackFollowsPolicy(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  t.Setenv("CASHBACK_RELEASE_ON", "")
+  mock.ExpectBegin()
+  tx, _ := db.Begin()
+  // PAID is before the default release point, so nothing is touched
+  if err := releaseOrderCashbackTx(tx, "order-1", "PAID", "system", ""); err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+
+  mock.ExpectQuery(`UPDATE orders SET cashback_status = 'CREDITED'`).
+    WithArgs("order-1").
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "cashback"}).AddRow("user-1", 12000))
+  mock.ExpectQuery(`UPDATE users SET wallet_balance = wallet_balance \+ \$1`).
+    WithArgs(12000, "user-1").
+    WillReturnRows(sqlmock.NewRows([]string{"wallet_balance"}).AddRow(12000))
+  mock.ExpectExec(`INSERT INTO wallet_transactions`).
+    WithArgs("user-1", "CASHBACK", walletCredit, 12000, 12000, "order-1", "admin", "admin-1", "order delivered").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  if err := releaseOrderCashbackTx(tx, "order-1", "DELIVERED", "admin", "admin-1"); err != nil {
+    t.Fatalf("release: %v", err)
+  }
+
+  // already credited (or forfeited): the conditional update matches nothing
+  mock.ExpectQuery(`UPDATE orders SET cashback_status = 'CREDITED'`).
+    WithArgs("order-1").
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "cashback"}))
+  if err := releaseOrderCashbackTx(tx, "order-1", "DELIVERED", "admin", "admin-1"); err != nil {
+    t.Fatalf("second release: %v", err)
+  }
+
+  t.Setenv("CASHBACK_RELEASE_ON", "paid")
+  mock.ExpectQuery(`UPDATE orders SET cashback_status = 'CREDITED'`).
+    WithArgs("order-2").
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "cashback"}))
+  if err := releaseOrderCashbackTx(tx, "order-2", "PAID", "system", ""); err != nil {
+    t.Fatalf("release on paid: %v", err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("unmet expectations: %v", err)
+  }
+}
+
+// a delivered order is refunded after its cashback was credited and partly spent
+func TestRefundReversesCreditedCashback(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT status FROM orders WHERE id = \$1 FOR UPDATE`).
+    WithArgs("order-1").
+    WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("DELIVERED"))
+  mock.ExpectExec(`UPDATE orders SET status = \$1`).
+    WithArgs("REFUNDED", "order-1").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectQuery(`SELECT user_id, cashback_status, cashback FROM orders WHERE id = \$1`).
+    WithArgs("order-1").
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "cashback_status", "cashback"}).AddRow("user-1", "CREDITED", 12000))
+  mock.ExpectQuery(`SELECT wallet_balance FROM users WHERE id = \$1 FOR UPDATE`).
+    WithArgs("user-1").
+    WillReturnRows(sqlmock.NewRows([]string{"wallet_balance"}).AddRow(5000))
+  mock.ExpectQuery(`UPDATE users SET wallet_balance = wallet_balance \+ \$1`).
+    WithArgs(-5000, "user-1").
+    WillReturnRows(sqlmock.NewRows([]string{"wallet_balance"}).AddRow(0))
+  mock.ExpectExec(`INSERT INTO wallet_transactions`).
+    WithArgs("user-1", "CASHBACK_REVERSAL", walletDebit, 5000, 0, "order-1", "admin", "admin-1", nil).
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectExec(`INSERT INTO order_status_history`).
+    WithArgs("order-1", "DELIVERED", "REFUNDED", "admin", "admin-1", nil).
+    WillReturnResult(sqlmock.NewResult(0, 1))
+
+  tx, _ := db.Begin()
+  if _, _, err := transitionOrderTx(tx, "order-1", "REFUNDED", "admin", "admin-1", ""); err != nil {
+    t.Fatalf("refund: %v", err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("unmet expectations: %v", err)
+  }
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/base64"
+  "errors"
+  "fmt"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const (
+  defaultProductLimit = 24
+  maxProductLimit     = 100
+)
+
+type productQuery struct {
+  Search   string
+  Category string
+  MinPrice int
+  MaxPrice int
+  InStock  bool
+  Sort     string
+  Limit    int
+  Cursor   *productCursor
+}
+
+type productCursor struct {
+  Key string
+  ID  string
+}
+
+type productRow struct {
+  Product
+  createdAt time.Time
+  soldCount int
+}
+
+var productSorts = map[string]bool{
+  "newest":       true,
+  "price_asc":    true,
+  "price_desc":   true,
+  "best_selling": true,
+}
+
+func parseProductQuery(v url.Values) (productQuery, error) {
+  q := productQuery{
+    Search:   strings.TrimSpace(v.Get("q")),
+    Category: strings.TrimSpace(v.Get("category")),
+    Sort:     strings.ToLower(strings.TrimSpace(v.Get("sort"))),
+    Limit:    defaultProductLimit,
+  }
+  if q.Sort == "" {
+    q.Sort = "newest"
+  }
+  if !productSorts[q.Sort] {
+    return q, errors.New("invalid sort")
+  }
+  if s := strings.TrimSpace(v.Get("min_price")); s != "" {
+    n, err := strconv.Atoi(s)
+    if err != nil || n < 0 {
+      return q, errors.New("invalid min_price")
+    }
+    q.MinPrice = n
+  }
+  if s := strings.TrimSpace(v.Get("max_price")); s != "" {
+    n, err := strconv.Atoi(s)
+    if err != nil || n < 0 {
+      return q, errors.New("invalid max_price")
+    }
+    q.MaxPrice = n
+  }
+  if q.MaxPrice > 0 && q.MinPrice > q.MaxPrice {
+    return q, errors.New("min_price greater than max_price")
+  }
+  switch strings.ToLower(strings.TrimSpace(v.Get("in_stock"))) {
+  case "", "0", "false", "no":
+  case "1", "true", "yes":
+    q.InStock = true
+  default:
+    return q, errors.New("invalid in_stock")
+  }
+  if s := strings.TrimSpace(v.Get("limit")); s != "" {
+    n, err := strconv.Atoi(s)
+    if err != nil || n <= 0 {
+      return q, errors.New("invalid limit")
+    }
+    if n > maxProductLimit {
+      n = maxProductLimit
+    }
+    q.Limit = n
+  }
+  if s := strings.TrimSpace(v.Get("cursor")); s != "" {
+    c, err := decodeProductCursor(s)
+    if err != nil {
+      return q, errors.New("invalid cursor")
+    }
+    q.Cursor = &c
+  }
+  return q, nil
+}
+
+func encodeProductCursor(c productCursor) string {
+  return base64.RawURLEncoding.EncodeToString([]byte(c.Key + "|" + c.ID))
+}
+
+func decodeProductCursor(s string) (productCursor, error) {
+  raw, err := base64.RawURLEncoding.DecodeString(s)
+  if err != nil {
+    return productCursor{}, err
+  }
+  parts := strings.SplitN(string(raw), "|", 2)
+  if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+    return productCursor{}, errors.New("malformed cursor")
+  }
+  return productCursor{Key: parts[0], ID: parts[1]}, nil
+}
+
+func (q productQuery) sortColumn() (string, string) {
+  switch q.Sort {
+  case "price_asc":
+    return "p.price", "ASC"
+  case "price_desc":
+    return "p.price", "DESC"
+  case "best_selling":
+    return "p.sold_count", "DESC"
+  default:
+    return "p.created_at", "DESC"
+  }
+}
+
+func (q productQuery) cursorKey(row productRow) string {
+  switch q.Sort {
+  case "price_asc", "price_desc":
+    return strconv.Itoa(row.Price)
+  case "best_selling":
+    return strconv.Itoa(row.soldCount)
+  default:
+    return row.createdAt.Format(time.RFC3339Nano)
+  }
+}
+
+func (q productQuery) cursorValue() (any, error) {
+  switch q.Sort {
+  case "price_asc", "price_desc", "best_selling":
+    return strconv.Atoi(q.Cursor.Key)
+  default:
+    return time.Parse(time.RFC3339Nano, q.Cursor.Key)
+  }
+}
+
+func (q productQuery) build() (string, []any, error) {
+  where := []string{}
+  args := []any{}
+  arg := func(v any) string {
+    args = append(args, v)
+    return fmt.Sprintf("$%d", len(args))
+  }
+  if q.Search != "" {
+    where = append(where, "p.search_vector @@ websearch_to_tsquery('simple', "+arg(q.Search)+")")
+  }
+  if q.Category != "" {
+    where = append(where, "p.category_id IN ("+fmt.Sprintf(categorySubtreeSQL, arg(q.Category))+")")
+  }
+  if q.MinPrice > 0 {
+    where = append(where, "p.price >= "+arg(q.MinPrice))
+  }
+  if q.MaxPrice > 0 {
+    where = append(where, "p.price <= "+arg(q.MaxPrice))
+  }
+  if q.InStock {
+    where = append(where, "p.stock - "+productHeldSQL+" > 0")
+  }
+  col, dir := q.sortColumn()
+  if q.Cursor != nil {
+    key, err := q.cursorValue()
+    if err != nil {
+      return "", nil, errors.New("invalid cursor")
+    }
+    op := "<"
+    if dir == "ASC" {
+      op = ">"
+    }
+    where = append(where, fmt.Sprintf("(%s, p.id) %s (%s, %s::uuid)", col, op, arg(key), arg(q.Cursor.ID)))
+  }
+
+  query := `SELECT p.id, p.name, p.description, p.price, p.stock - `+productHeldSQL+`, p.stock, p.image_url, c.name, p.created_at, p.sold_count FROM products p LEFT JOIN categories c ON p.category_id = c.id`
+  if len(where) > 0 {
+    query += " WHERE " + strings.Join(where, " AND ")
+  }
+  query += fmt.Sprintf(" ORDER BY %s %s, p.id %s LIMIT %s", col, dir, dir, arg(q.Limit+1))
+  return query, args, nil
+}
+
+func listProducts(db *sql.DB, r *http.Request) (map[string]any, error) {
+  q, err := parseProductQuery(r.URL.Query())
+  if err != nil {
+    return nil, errInvalid(err.Error())
+  }
+  query, args, err := q.build()
+  if err != nil {
+    return nil, errInvalid(err.Error())
+  }
+  rows, err := db.Query(query, args...)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  page := []productRow{}
+  for rows.Next() {
+    var row productRow
+    var category sql.NullString
+    if err := rows.Scan(&row.ID, &row.Name, &row.Description, &row.Price, &row.Stock, &row.OnHand, &row.ImageURL, &category, &row.createdAt, &row.soldCount); err != nil {
+      return nil, err
+    }
+    row.Category = category.String
+    page = append(page, row)
+  }
+  if err := rows.Err(); err != nil {
+    return nil, err
+  }
+
+  var nextCursor any = nil
+  if len(page) > q.Limit {
+    page = page[:q.Limit]
+    last := page[len(page)-1]
+    nextCursor = encodeProductCursor(productCursor{Key: q.cursorKey(last), ID: last.ID})
+  }
+  items := make([]Product, 0, len(page))
+  for _, row := range page {
+    items = append(items, row.Product)
+  }
+  return map[string]any{"items": items, "next_cursor": nextCursor}, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+  "net/url"
+  "strings"
+  "testing"
+)
+
+func TestProductCursorRoundTrip(t *testing.T) {
+  in := productCursor{Key: "2026-01-29T10:00:00.123456Z", ID: "prod-1"}
+  out, err := decodeProductCursor(encodeProductCursor(in))
+  if err != nil {
+    t.Fatalf("decode: %v", err)
+  }
+  if out != in {
+    t.Fatalf("expected %+v, got %+v", in, out)
+  }
+  if _, err := decodeProductCursor("not-a-cursor"); err == nil {
+    t.Fatalf("expected error for malformed cursor")
+  }
+}
+
+func TestProductQueryBuild(t *testing.T) {
+  cursor := encodeProductCursor(productCursor{Key: "68000", ID: "prod-1"})
+  q, err := parseProductQuery(url.Values{
+    "q":         {"whiskas tuna"},
+    "category":  {"Makanan Kucing"},
+    "min_price": {"10000"},
+    "max_price": {"100000"},
+    "in_stock":  {"true"},
+    "sort":      {"price_asc"},
+    "limit":     {"500"},
+    "cursor":    {cursor},
+  })
+  if err != nil {
+    t.Fatalf("parse: %v", err)
+  }
+  if q.Limit != maxProductLimit {
+    t.Fatalf("expected limit capped at %d, got %d", maxProductLimit, q.Limit)
+  }
+  query, args, err := q.build()
+  if err != nil {
+    t.Fatalf("build: %v", err)
+  }
+  for _, want := range []string{
+    "p.search_vector @@ websearch_to_tsquery('simple', $1)",
+    "WHERE slug = LOWER($2) OR LOWER(name) = LOWER($2)",
+    "p.price >= $3",
+    "p.price <= $4",
+    "p.stock - "+productHeldSQL+" > 0",
+    "(p.price, p.id) > ($5, $6::uuid)",
+    "ORDER BY p.price ASC, p.id ASC LIMIT $7",
+  } {
+    if !strings.Contains(query, want) {
+      t.Fatalf("query missing %q: %s", want, query)
+    }
+  }
+  if len(args) != 7 || args[4] != 68000 || args[6] != maxProductLimit+1 {
+    t.Fatalf("unexpected args: %v", args)
+  }
+}
+
+func TestProductQueryRejectsInvalidParams(t *testing.T) {
+  cases := []url.Values{
+    {"sort": {"cheapest"}},
+    {"min_price": {"-1"}},
+    {"min_price": {"5000"}, "max_price": {"1000"}},
+    {"in_stock": {"maybe"}},
+    {"limit": {"0"}},
+    {"cursor": {"%%%"}},
+  }
+  for _, v := range cases {
+    if _, err := parseProductQuery(v); err == nil {
+      t.Fatalf("expected error for %v", v)
+    }
+  }
+}
+
+func TestSlugify(t *testing.T) {
+  cases := map[string]string{
+    "Obat & Vitamin":      "obat-vitamin",
+    "  Makanan Kucing  ":  "makanan-kucing",
+    "Pasir--Kucing (5L)": "pasir-kucing-5l",
+    "":                    "",
+  }
+  for in, want := range cases {
+    if got := slugify(in); got != want {
+      t.Fatalf("slugify(%q) = %q, want %q", in, got, want)
+    }
+  }
+}
+
+func TestBuildCategoryTreeCountsSubtree(t *testing.T) {
+  tree := buildCategoryTree([]*Category{
+    {ID: "food", Name: "Makanan Kucing", ProductCount: 1},
+    {ID: "dry", Name: "Dry Food", ParentID: "food", ProductCount: 3},
+    {ID: "kibble", Name: "Kibble", ParentID: "dry", ProductCount: 2},
+    {ID: "tools", Name: "Peralatan Kucing", ProductCount: 4},
+  })
+  if len(tree) != 2 {
+    t.Fatalf("expected 2 roots, got %d", len(tree))
+  }
+  if tree[0].ProductCount != 6 || tree[0].Children[0].ProductCount != 5 {
+    t.Fatalf("unexpected subtree counts: %d, %d", tree[0].ProductCount, tree[0].Children[0].ProductCount)
+  }
+  if tree[1].ProductCount != 4 {
+    t.Fatalf("expected 4 products in tools, got %d", tree[1].ProductCount)
+  }
+}
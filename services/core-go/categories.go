@@ -0,0 +1,313 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "net/http"
+  "strings"
+  "unicode"
+)
+
+type Category struct {
+  ID           string      `json:"id"`
+  Name         string      `json:"name"`
+  Slug         string      `json:"slug"`
+  ParentID     string      `json:"parent_id"`
+  SortOrder    int         `json:"sort_order"`
+  ProductCount int         `json:"product_count"`
+  Children     []*Category `json:"children,omitempty"`
+}
+
+type CategoryRequest struct {
+  Name      string `json:"name"`
+  Slug      string `json:"slug"`
+  ParentID  string `json:"parent_id"`
+  SortOrder int    `json:"sort_order"`
+}
+
+const categorySubtreeSQL = `WITH RECURSIVE tree AS (
+    SELECT id FROM categories WHERE slug = LOWER(%[1]s) OR LOWER(name) = LOWER(%[1]s)
+    UNION ALL
+    SELECT c.id FROM categories c JOIN tree t ON c.parent_id = t.id
+  ) SELECT id FROM tree`
+
+func slugify(v string) string {
+  b := strings.Builder{}
+  dash := false
+  for _, r := range strings.ToLower(strings.TrimSpace(v)) {
+    if r == '&' {
+      r = ' '
+    }
+    if unicode.IsLetter(r) || unicode.IsDigit(r) {
+      if r > unicode.MaxASCII {
+        continue
+      }
+      b.WriteRune(r)
+      dash = false
+      continue
+    }
+    if !dash && b.Len() > 0 {
+      b.WriteRune('-')
+      dash = true
+    }
+  }
+  return strings.TrimRight(b.String(), "-")
+}
+
+func uniqueCategorySlug(db *sql.DB, base string, excludeID string) (string, error) {
+  if base == "" {
+    base = "kategori"
+  }
+  candidate := base
+  for i := 0; i < 20; i++ {
+    if i > 0 {
+      suffix, err := randToken(2)
+      if err != nil {
+        return "", err
+      }
+      candidate = base + "-" + suffix
+    }
+    var exists int
+    err := db.QueryRow(`SELECT 1 FROM categories WHERE slug = $1 AND id::text <> $2`, candidate, excludeID).Scan(&exists)
+    if err == sql.ErrNoRows {
+      return candidate, nil
+    }
+    if err != nil {
+      return "", err
+    }
+  }
+  return "", errInvalid("slug unavailable")
+}
+
+func loadCategories(db *sql.DB) ([]*Category, error) {
+  rows, err := db.Query(`SELECT c.id, c.name, c.slug, c.parent_id, c.sort_order, COUNT(p.id)
+    FROM categories c LEFT JOIN products p ON p.category_id = c.id
+    GROUP BY c.id ORDER BY c.sort_order, c.name`)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  out := []*Category{}
+  for rows.Next() {
+    c := &Category{}
+    var parentID sql.NullString
+    if err := rows.Scan(&c.ID, &c.Name, &c.Slug, &parentID, &c.SortOrder, &c.ProductCount); err != nil {
+      return nil, err
+    }
+    c.ParentID = parentID.String
+    out = append(out, c)
+  }
+  return out, rows.Err()
+}
+
+func buildCategoryTree(list []*Category) []*Category {
+  byID := map[string]*Category{}
+  for _, c := range list {
+    byID[c.ID] = c
+  }
+  roots := []*Category{}
+  for _, c := range list {
+    if parent, ok := byID[c.ParentID]; ok && c.ParentID != "" {
+      parent.Children = append(parent.Children, c)
+      continue
+    }
+    roots = append(roots, c)
+  }
+  var total func(c *Category) int
+  total = func(c *Category) int {
+    for _, child := range c.Children {
+      c.ProductCount += total(child)
+    }
+    return c.ProductCount
+  }
+  for _, c := range roots {
+    total(c)
+  }
+  return roots
+}
+
+func categoriesHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+      return
+    }
+    list, err := loadCategories(db)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    writeJSON(w, http.StatusOK, buildCategoryTree(list))
+  }
+}
+
+func validateCategoryParent(db *sql.DB, id string, parentID string) error {
+  if parentID == "" {
+    return nil
+  }
+  if parentID == id {
+    return errInvalid("category cannot be its own parent")
+  }
+  var exists int
+  if err := db.QueryRow(`SELECT 1 FROM categories WHERE id = $1`, parentID).Scan(&exists); err != nil {
+    if err == sql.ErrNoRows {
+      return errInvalid("parent not found")
+    }
+    return err
+  }
+  if id == "" {
+    return nil
+  }
+  var cycle bool
+  err := db.QueryRow(`WITH RECURSIVE tree AS (
+      SELECT id FROM categories WHERE parent_id = $1
+      UNION ALL
+      SELECT c.id FROM categories c JOIN tree t ON c.parent_id = t.id
+    ) SELECT EXISTS (SELECT 1 FROM tree WHERE id = $2)`, id, parentID).Scan(&cycle)
+  if err != nil {
+    return err
+  }
+  if cycle {
+    return errInvalid("parent cannot be a descendant")
+  }
+  return nil
+}
+
+func adminCategoriesHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+      if _, err := requireRoles(db, r, "owner", "admin", "staff"); err != nil {
+        writeRoleError(w, err)
+        return
+      }
+      list, err := loadCategories(db)
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      writeJSON(w, http.StatusOK, list)
+    case http.MethodPost:
+      if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
+        writeRoleError(w, err)
+        return
+      }
+      var req CategoryRequest
+      if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
+        return
+      }
+      name := strings.TrimSpace(req.Name)
+      if name == "" {
+        writeJSON(w, http.StatusBadRequest, errMsg("name required"))
+        return
+      }
+      parentID := strings.TrimSpace(req.ParentID)
+      if err := validateCategoryParent(db, "", parentID); err != nil {
+        if isInvalid(err) {
+          writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+          return
+        }
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      slug, err := uniqueCategorySlug(db, slugify(firstNonEmpty(req.Slug, name)), "")
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      var id string
+      err = db.QueryRow(`INSERT INTO categories (name, slug, parent_id, sort_order) VALUES ($1,$2,$3,$4) RETURNING id`,
+        name, slug, nullIfEmpty(parentID), req.SortOrder).Scan(&id)
+      if err != nil {
+        writeJSON(w, http.StatusBadRequest, errMsg("create category failed"))
+        return
+      }
+      writeJSON(w, http.StatusOK, map[string]string{"category_id": id, "slug": slug})
+    default:
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+    }
+  }
+}
+
+func adminCategoryItemHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
+      writeRoleError(w, err)
+      return
+    }
+    id := strings.TrimPrefix(r.URL.Path, "/admin/categories/")
+    id = strings.TrimSpace(id)
+    if id == "" {
+      writeJSON(w, http.StatusBadRequest, errMsg("missing id"))
+      return
+    }
+    switch r.Method {
+    case http.MethodPut:
+      var req CategoryRequest
+      if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
+        return
+      }
+      name := strings.TrimSpace(req.Name)
+      if name == "" {
+        writeJSON(w, http.StatusBadRequest, errMsg("name required"))
+        return
+      }
+      parentID := strings.TrimSpace(req.ParentID)
+      if err := validateCategoryParent(db, id, parentID); err != nil {
+        if isInvalid(err) {
+          writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+          return
+        }
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      slug, err := uniqueCategorySlug(db, slugify(firstNonEmpty(req.Slug, name)), id)
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      res, err := db.Exec(`UPDATE categories SET name = $1, slug = $2, parent_id = $3, sort_order = $4 WHERE id = $5`,
+        name, slug, nullIfEmpty(parentID), req.SortOrder, id)
+      if err != nil {
+        writeJSON(w, http.StatusBadRequest, errMsg("update category failed"))
+        return
+      }
+      if n, _ := res.RowsAffected(); n == 0 {
+        writeJSON(w, http.StatusNotFound, errMsg("not found"))
+        return
+      }
+      writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "slug": slug})
+    case http.MethodDelete:
+      var products, children int
+      err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM products WHERE category_id = $1), (SELECT COUNT(*) FROM categories WHERE parent_id = $1)`, id).
+        Scan(&products, &children)
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      if products > 0 || children > 0 {
+        writeJSON(w, http.StatusBadRequest, errMsg("category still has products or subcategories"))
+        return
+      }
+      _, err = db.Exec(`DELETE FROM categories WHERE id = $1`, id)
+      if err != nil {
+        writeJSON(w, http.StatusBadRequest, errMsg("delete category failed"))
+        return
+      }
+      writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+    default:
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+    }
+  }
+}
+
+func firstNonEmpty(values ...string) string {
+  for _, v := range values {
+    if strings.TrimSpace(v) != "" {
+      return strings.TrimSpace(v)
+    }
+  }
+  return ""
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "net/http"
+
+  "petshop-bento-core/pricing"
+)
+
+type checkoutLine struct {
+  ProductID  string
+  VariantID  string
+  CategoryID string
+  Name       string
+  SKU        string
+  Options    []byte
+  UnitPrice  int
+  PriceAtAdd sql.NullInt64
+  Qty        int
+  Available  int
+}
+
+type checkoutBuyer struct {
+  UserID        string
+  CurrentTier   string
+  TotalSpend    int
+  WalletBalance int
+  Tier          TierInfo
+}
+
+type checkoutWarning struct {
+  Code      string `json:"code"`
+  ProductID string `json:"product_id,omitempty"`
+  VariantID string `json:"variant_id,omitempty"`
+  Message   string `json:"message"`
+}
+
+type checkoutQuote struct {
+  pricing.Breakdown
+  Warnings []checkoutWarning
+}
+
+func loadCheckoutBuyerTx(db *sql.DB, tx *sql.Tx, r *http.Request) (checkoutBuyer, error) {
+  b := checkoutBuyer{CurrentTier: "Bronze", Tier: TierInfo{Name: "Bronze", DiscountPct: 0, CashbackPct: 0}}
+  if r.Header.Get("X-Auth-Token") == "" {
+    return b, nil
+  }
+  uid, err := getUserIDFromTokenTx(tx, r)
+  if err != nil {
+    return b, errInvalidSession
+  }
+  b.UserID = uid
+  _ = tx.QueryRow(`SELECT total_spend, tier, wallet_balance FROM users WHERE id = $1`, uid).Scan(&b.TotalSpend, &b.CurrentTier, &b.WalletBalance)
+  // the stored tier decides the discount; it can sit below what total_spend suggests
+  // once a rolling window or a downgrade applies
+  if t, err := getTierInfoByName(tx, b.CurrentTier); err == nil {
+    b.Tier = t
+  } else if t, err := getTierInfo(db, b.TotalSpend); err == nil {
+    b.Tier = t
+  }
+  return b, nil
+}
+
+// with lock set the product rows are locked first and availability is read by a separate
+// statement afterwards: under read committed that statement sees the holds a concurrent
+// checkout committed while this one waited for the lock, which a single SELECT ... FOR UPDATE
+// would not (its subqueries keep the snapshot taken before the wait)
+func loadCheckoutLinesTx(tx *sql.Tx, cartID string, lock bool) ([]checkoutLine, error) {
+  if lock {
+    if _, err := tx.Exec(`SELECT p.id FROM cart_items ci JOIN products p ON ci.product_id = p.id WHERE ci.cart_id = $1 ORDER BY p.id FOR UPDATE OF p`, cartID); err != nil {
+      return nil, err
+    }
+  }
+  query := `SELECT p.id, v.id, COALESCE(v.stock - ` + variantHeldSQL + `, p.stock - ` + productHeldSQL + `), ci.qty, p.name, COALESCE(v.price, p.price), v.sku, v.options, ci.price_at_add, p.category_id
+    FROM cart_items ci JOIN products p ON ci.product_id = p.id LEFT JOIN product_variants v ON ci.variant_id = v.id
+    WHERE ci.cart_id = $1 ORDER BY p.name, v.sku`
+  rows, err := tx.Query(query, cartID)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  out := []checkoutLine{}
+  for rows.Next() {
+    var it checkoutLine
+    var vid, sku, categoryID sql.NullString
+    if err := rows.Scan(&it.ProductID, &vid, &it.Available, &it.Qty, &it.Name, &it.UnitPrice, &sku, &it.Options, &it.PriceAtAdd, &categoryID); err != nil {
+      return nil, err
+    }
+    it.VariantID = vid.String
+    it.CategoryID = categoryID.String
+    it.SKU = sku.String
+    out = append(out, it)
+  }
+  return out, rows.Err()
+}
+
+func lineWarnings(lines []checkoutLine) []checkoutWarning {
+  out := []checkoutWarning{}
+  if len(lines) == 0 {
+    out = append(out, checkoutWarning{Code: "cart_empty", Message: "cart is empty"})
+  }
+  for _, it := range lines {
+    if it.Available < it.Qty {
+      msg := fmt.Sprintf("%s: only %d left", it.Name, it.Available)
+      if it.Available <= 0 {
+        msg = it.Name + ": out of stock"
+      }
+      out = append(out, checkoutWarning{Code: "out_of_stock", ProductID: it.ProductID, VariantID: it.VariantID, Message: msg})
+    }
+    if it.PriceAtAdd.Valid && int(it.PriceAtAdd.Int64) != it.UnitPrice {
+      out = append(out, checkoutWarning{
+        Code:      "price_changed",
+        ProductID: it.ProductID,
+        VariantID: it.VariantID,
+        Message:   fmt.Sprintf("%s: price changed from %d to %d", it.Name, it.PriceAtAdd.Int64, it.UnitPrice),
+      })
+    }
+  }
+  return out
+}
+
+func (b checkoutBuyer) customer(walletUse int) pricing.Customer {
+  return pricing.Customer{
+    Member:        b.UserID != "",
+    Tier:          b.Tier.Name,
+    DiscountPct:   b.Tier.DiscountPct,
+    CashbackPct:   b.Tier.CashbackPct,
+    WalletBalance: b.WalletBalance,
+    WalletUse:     walletUse,
+  }
+}
+
+func pricingCart(lines []checkoutLine) pricing.Cart {
+  cart := pricing.Cart{Lines: make([]pricing.Line, 0, len(lines))}
+  for _, it := range lines {
+    cart.Lines = append(cart.Lines, pricing.Line{ProductID: it.ProductID, VariantID: it.VariantID, CategoryID: it.CategoryID, UnitPrice: it.UnitPrice, Qty: it.Qty})
+  }
+  return cart
+}
+
+// strict mode is checkout: the first voucher or shipping problem is returned as an error.
+// Otherwise the problem becomes a warning and that component is priced at zero.
+func quoteCheckoutTx(db *sql.DB, tx *sql.Tx, req OrderRequest, buyer checkoutBuyer, lines []checkoutLine, strict bool) (checkoutQuote, error) {
+  q := checkoutQuote{Warnings: []checkoutWarning{}}
+  voucher, err := loadVoucherTx(tx, req.VoucherCode, buyer.UserID, strict)
+  if err != nil {
+    if strict || !isInvalid(err) {
+      return q, err
+    }
+    q.Warnings = append(q.Warnings, checkoutWarning{Code: "voucher_invalid", Message: err.Error()})
+  }
+
+  deliveryReq := DeliveryQuoteRequest{
+    Type:     req.DeliveryType,
+    ZoneID:   req.ZoneID,
+    Lat:      req.Lat,
+    Lng:      req.Lng,
+    Distance: req.DistanceKm,
+  }
+  delivery, err := quoteShippingFee(db, deliveryReq)
+  if err != nil {
+    if strict {
+      return q, errInvalid(err.Error())
+    }
+    q.Warnings = append(q.Warnings, checkoutWarning{Code: "shipping_unavailable", Message: err.Error()})
+    delivery.Fee = 0
+  }
+
+  q.Breakdown, err = pricing.Price(pricingCart(lines), buyer.customer(req.WalletUse), voucher, delivery)
+  if pricing.IsVoucherError(err) {
+    if strict {
+      return q, errInvalid(err.Error())
+    }
+    q.Warnings = append(q.Warnings, checkoutWarning{Code: "voucher_invalid", Message: err.Error()})
+    err = nil
+  }
+  return q, err
+}
+
+func cartPreviewHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+      return
+    }
+    var req OrderRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
+      return
+    }
+    // nothing done here is kept: the transaction only gives the pricing path the same view as checkout
+    tx, err := db.Begin()
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("db error"))
+      return
+    }
+    defer tx.Rollback()
+
+    buyer, err := loadCheckoutBuyerTx(db, tx, r)
+    if err != nil {
+      writeCartError(w, err)
+      return
+    }
+    if err := applySavedAddressTx(tx, buyer.UserID, &req); err != nil {
+      writeAddressError(w, err)
+      return
+    }
+    cartID := req.CartID
+    if cartID == "" && buyer.UserID != "" {
+      cartID, err = userCartID(db, buyer.UserID, false)
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+    }
+    lines := []checkoutLine{}
+    if cartID != "" {
+      if _, err := authorizeCart(tx, cartID, buyer.UserID, r.Header.Get("X-Cart-Token")); err != nil {
+        writeCartError(w, err)
+        return
+      }
+      lines, err = loadCheckoutLinesTx(tx, cartID, false)
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+    }
+    q, err := quoteCheckoutTx(db, tx, req, buyer, lines, false)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+
+    items := make([]map[string]any, 0, len(lines))
+    for i, it := range lines {
+      var options map[string]string
+      if len(it.Options) > 0 {
+        _ = json.Unmarshal(it.Options, &options)
+      }
+      item := map[string]any{
+        "product_id":   it.ProductID,
+        "variant_id":   it.VariantID,
+        "product_name": it.Name,
+        "variant_sku":  it.SKU,
+        "options":      options,
+        "unit_price":   it.UnitPrice,
+        "qty":          it.Qty,
+        "line_total":   q.Lines[i].Total,
+        "available":    it.Available,
+      }
+      if it.PriceAtAdd.Valid {
+        item["price_at_add"] = it.PriceAtAdd.Int64
+      }
+      items = append(items, item)
+    }
+    writeJSON(w, http.StatusOK, map[string]any{
+      "cart_id":          cartID,
+      "items":            items,
+      "subtotal":         q.Subtotal,
+      "tier":             buyer.Tier.Name,
+      "tier_discount":    q.TierDiscount,
+      "voucher_code":     q.VoucherCode,
+      "voucher_discount": q.VoucherDiscount,
+      "discount":         q.Discount,
+      "shipping_fee":     q.ShippingFee,
+      "wallet_used":      q.WalletUsed,
+      "cashback":         q.Cashback,
+      "total":            q.Total,
+      "warnings":         append(lineWarnings(lines), q.Warnings...),
+    })
+  }
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+  "database/sql"
+  "testing"
+)
+
+func TestLineWarnings(t *testing.T) {
+  lines := []checkoutLine{
+    {ProductID: "prod-1", Name: "Whiskas", UnitPrice: 10000, PriceAtAdd: sql.NullInt64{Int64: 10000, Valid: true}, Qty: 2, Available: 5},
+    {ProductID: "prod-2", Name: "Royal Canin", UnitPrice: 12000, PriceAtAdd: sql.NullInt64{Int64: 11000, Valid: true}, Qty: 1, Available: 3},
+    {ProductID: "prod-3", Name: "Pasir", UnitPrice: 5000, Qty: 2, Available: 0},
+  }
+  got := lineWarnings(lines)
+  if len(got) != 2 {
+    t.Fatalf("expected 2 warnings, got %d: %+v", len(got), got)
+  }
+  if got[0].Code != "price_changed" || got[0].ProductID != "prod-2" {
+    t.Fatalf("unexpected first warning: %+v", got[0])
+  }
+  if got[1].Code != "out_of_stock" || got[1].ProductID != "prod-3" {
+    t.Fatalf("unexpected second warning: %+v", got[1])
+  }
+  if empty := lineWarnings(nil); len(empty) != 1 || empty[0].Code != "cart_empty" {
+    t.Fatalf("expected cart_empty warning, got %+v", empty)
+  }
+}
@@ -8,6 +8,8 @@ import (
   "net/http"
   "os"
   "strings"
+
+  "petshop-bento-core/pricing"
 )
 
 func deliveryZonesHandler(db *sql.DB) http.HandlerFunc {
@@ -48,84 +50,75 @@ func deliveryQuoteHandler(db *sql.DB) http.HandlerFunc {
       writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
       return
     }
-    mode := strings.ToLower(strings.TrimSpace(req.Type))
-    switch mode {
-    case "zone":
-      var fee int
-      err := db.QueryRow(`SELECT flat_fee FROM delivery_zones WHERE id = $1 AND active = TRUE`, req.ZoneID).Scan(&fee)
-      if err != nil {
-        writeJSON(w, http.StatusBadRequest, errMsg("zone not found"))
-        return
-      }
-      writeJSON(w, http.StatusOK, map[string]any{"fee": fee, "type": "zone"})
-    case "per_km":
-      var baseLat, baseLng float64
-      var perKm, minFee int
-      err := db.QueryRow(`SELECT base_lat, base_lng, per_km_rate, min_fee FROM delivery_settings WHERE id = 1`).Scan(&baseLat, &baseLng, &perKm, &minFee)
-      if err != nil {
-        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
-        return
-      }
-      dist := req.Distance
-      if dist <= 0 && req.Lat != 0 && req.Lng != 0 {
-        dist = haversineKm(baseLat, baseLng, req.Lat, req.Lng)
-      }
-      if dist <= 0 {
-        writeJSON(w, http.StatusBadRequest, errMsg("distance_km or lat/lng required"))
+    quote, err := resolveDeliveryQuote(db, req)
+    if err != nil {
+      if isInvalid(err) {
+        writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
         return
       }
-      fee := int(math.Ceil(dist * float64(perKm)))
-      if fee < minFee {
-        fee = minFee
-      }
-      writeJSON(w, http.StatusOK, map[string]any{"fee": fee, "distance_km": dist, "type": "per_km"})
-    case "external":
-      fee, msg := externalShippingQuote(req)
-      writeJSON(w, http.StatusOK, map[string]any{"fee": fee, "message": msg, "type": "external"})
-    default:
-      writeJSON(w, http.StatusBadRequest, errMsg("invalid type"))
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
     }
+    resp := map[string]any{"fee": quote.Fee, "type": quote.Type}
+    if quote.Type == "per_km" {
+      resp["distance_km"] = quote.DistanceKm
+    }
+    if quote.Type == "external" {
+      resp["message"] = quote.Message
+    }
+    writeJSON(w, http.StatusOK, resp)
   }
 }
 
-func quoteShippingFee(db *sql.DB, req DeliveryQuoteRequest) (int, error) {
+type deliveryQuote struct {
+  pricing.Delivery
+  DistanceKm float64
+  Message    string
+}
+
+// an external quote with no fee is not an error here, the quote endpoint shows its message
+func resolveDeliveryQuote(db *sql.DB, req DeliveryQuoteRequest) (deliveryQuote, error) {
   mode := strings.ToLower(strings.TrimSpace(req.Type))
+  q := deliveryQuote{Delivery: pricing.Delivery{Type: mode}}
   switch mode {
   case "zone":
-    var fee int
-    err := db.QueryRow(`SELECT flat_fee FROM delivery_zones WHERE id = $1 AND active = TRUE`, req.ZoneID).Scan(&fee)
+    err := db.QueryRow(`SELECT flat_fee FROM delivery_zones WHERE id = $1 AND active = TRUE`, req.ZoneID).Scan(&q.Fee)
     if err != nil {
-      return 0, errors.New("zone not found")
+      return q, errInvalid("zone not found")
     }
-    return fee, nil
   case "per_km":
     var baseLat, baseLng float64
     var perKm, minFee int
     err := db.QueryRow(`SELECT base_lat, base_lng, per_km_rate, min_fee FROM delivery_settings WHERE id = 1`).Scan(&baseLat, &baseLng, &perKm, &minFee)
     if err != nil {
-      return 0, errors.New("delivery settings not found")
+      return q, errors.New("delivery settings not found")
     }
     dist := req.Distance
     if dist <= 0 && req.Lat != 0 && req.Lng != 0 {
       dist = haversineKm(baseLat, baseLng, req.Lat, req.Lng)
     }
     if dist <= 0 {
-      return 0, errors.New("distance_km or lat/lng required")
-    }
-    fee := int(math.Ceil(dist * float64(perKm)))
-    if fee < minFee {
-      fee = minFee
+      return q, errInvalid("distance_km or lat/lng required")
     }
-    return fee, nil
+    q.DistanceKm = dist
+    q.Fee = pricing.PerKmFee(dist, perKm, minFee)
   case "external":
-    fee, _ := externalShippingQuote(req)
-    if fee <= 0 {
-      return 0, errors.New("external shipping not configured")
-    }
-    return fee, nil
+    q.Fee, q.Message = externalShippingQuote(req)
   default:
-    return 0, errors.New("invalid delivery type")
+    return q, errInvalid("invalid delivery type")
+  }
+  return q, nil
+}
+
+func quoteShippingFee(db *sql.DB, req DeliveryQuoteRequest) (pricing.Delivery, error) {
+  q, err := resolveDeliveryQuote(db, req)
+  if err != nil {
+    return q.Delivery, err
+  }
+  if q.Type == "external" && q.Fee <= 0 {
+    return q.Delivery, errInvalid("external shipping not configured")
   }
+  return q.Delivery, nil
 }
 
 func adminDeliveryZonesHandler(db *sql.DB) http.HandlerFunc {
@@ -133,7 +126,7 @@ func adminDeliveryZonesHandler(db *sql.DB) http.HandlerFunc {
     switch r.Method {
     case http.MethodGet:
       if _, err := requireRoles(db, r, "owner", "admin", "staff"); err != nil {
-        writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+        writeRoleError(w, err)
         return
       }
       rows, err := db.Query(`SELECT id, name, flat_fee, active FROM delivery_zones ORDER BY name`)
@@ -156,7 +149,7 @@ func adminDeliveryZonesHandler(db *sql.DB) http.HandlerFunc {
       writeJSON(w, http.StatusOK, out)
     case http.MethodPost:
       if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
-        writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+        writeRoleError(w, err)
         return
       }
       var req DeliveryZoneRequest
@@ -189,7 +182,7 @@ func adminDeliverySettingsHandler(db *sql.DB) http.HandlerFunc {
     switch r.Method {
     case http.MethodGet:
       if _, err := requireRoles(db, r, "owner", "admin", "staff"); err != nil {
-        writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+        writeRoleError(w, err)
         return
       }
       var baseLat, baseLng float64
@@ -202,7 +195,7 @@ func adminDeliverySettingsHandler(db *sql.DB) http.HandlerFunc {
       writeJSON(w, http.StatusOK, map[string]any{"base_lat": baseLat, "base_lng": baseLng, "per_km_rate": perKm, "min_fee": minFee})
     case http.MethodPut:
       if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
-        writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+        writeRoleError(w, err)
         return
       }
       var req DeliverySettingsRequest
@@ -248,19 +248,67 @@ func driverAuthorized(r *http.Request) bool {
   return subtle.ConstantTimeCompare([]byte(token), []byte(plain)) == 1
 }
 
+// the peer address is the client unless it is one of TRUSTED_PROXIES. Only then is
+// X-Forwarded-For read, right to left, and the first hop that is not a trusted proxy is
+// the client; entries further left are whatever the client chose to send.
 func clientIP(r *http.Request) string {
-  forwarded := r.Header.Get("X-Forwarded-For")
-  if forwarded != "" {
-    parts := strings.Split(forwarded, ",")
-    return strings.TrimSpace(parts[0])
-  }
   host, _, err := net.SplitHostPort(r.RemoteAddr)
   if err != nil {
-    return r.RemoteAddr
+    host = r.RemoteAddr
+  }
+  trusted := trustedProxies()
+  if len(trusted) == 0 || !isTrustedProxy(host, trusted) {
+    return host
+  }
+  hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+  for i := len(hops) - 1; i >= 0; i-- {
+    hop := strings.TrimSpace(hops[i])
+    if net.ParseIP(hop) == nil {
+      break
+    }
+    host = hop
+    if !isTrustedProxy(hop, trusted) {
+      break
+    }
   }
   return host
 }
 
+// TRUSTED_PROXIES is a comma-separated list of IPs or CIDR ranges
+func trustedProxies() []*net.IPNet {
+  out := []*net.IPNet{}
+  for _, part := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+    part = strings.TrimSpace(part)
+    if part == "" {
+      continue
+    }
+    if !strings.Contains(part, "/") {
+      if strings.Contains(part, ":") {
+        part += "/128"
+      } else {
+        part += "/32"
+      }
+    }
+    if _, n, err := net.ParseCIDR(part); err == nil {
+      out = append(out, n)
+    }
+  }
+  return out
+}
+
+func isTrustedProxy(addr string, trusted []*net.IPNet) bool {
+  ip := net.ParseIP(addr)
+  if ip == nil {
+    return false
+  }
+  for _, n := range trusted {
+    if n.Contains(ip) {
+      return true
+    }
+  }
+  return false
+}
+
 func checkTrackingToken(db *sql.DB, orderID, token string) bool {
   var expected sql.NullString
   err := db.QueryRow(`SELECT tracking_token FROM orders WHERE id = $1`, orderID).Scan(&expected)
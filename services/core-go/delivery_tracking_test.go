@@ -0,0 +1,36 @@
+package main
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+func TestClientIPTrustsForwardedOnlyFromProxies(t *testing.T) {
+  cases := []struct {
+    name      string
+    proxies   string
+    peer      string
+    forwarded string
+    want      string
+  }{
+    {"no proxies configured", "", "203.0.113.7:5100", "198.51.100.1", "203.0.113.7"},
+    {"peer is not a proxy", "10.0.0.0/8", "203.0.113.7:5100", "198.51.100.1", "203.0.113.7"},
+    {"behind one proxy", "10.0.0.0/8", "10.0.0.2:5100", "198.51.100.1", "198.51.100.1"},
+    {"spoofed entry on the left", "10.0.0.0/8", "10.0.0.2:5100", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+    {"chain of proxies", "10.0.0.0/8, 192.168.1.5", "10.0.0.2:5100", "198.51.100.1, 192.168.1.5, 10.0.0.9", "198.51.100.1"},
+    {"garbage hop", "10.0.0.2", "10.0.0.2:5100", "not-an-ip", "10.0.0.2"},
+    {"proxy without header", "10.0.0.2", "10.0.0.2:5100", "", "10.0.0.2"},
+  }
+  for _, tc := range cases {
+    t.Setenv("TRUSTED_PROXIES", tc.proxies)
+    req := httptest.NewRequest(http.MethodPost, "/auth/login", nil)
+    req.RemoteAddr = tc.peer
+    if tc.forwarded != "" {
+      req.Header.Set("X-Forwarded-For", tc.forwarded)
+    }
+    if got := clientIP(req); got != tc.want {
+      t.Fatalf("%s: want %s, got %s", tc.name, tc.want, got)
+    }
+  }
+}
@@ -28,13 +28,15 @@ func smtpEnabled() bool {
 }
 
 func sendOtpEmail(to string, code string) error {
+  return sendEmail(to, "Kode OTP Petshop Bento", fmt.Sprintf("Kode OTP kamu: %s\nBerlaku 5 menit.\n", code))
+}
+
+func sendEmail(to string, subject string, body string) error {
   host, port, user, pass, from := smtpConfig()
   if host == "" || user == "" || pass == "" || from == "" {
     return fmt.Errorf("smtp not configured")
   }
   auth := smtp.PlainAuth("", user, pass, host)
-  subject := "Kode OTP Petshop Bento"
-  body := fmt.Sprintf("Kode OTP kamu: %s\nBerlaku 5 menit.\n", code)
   msg := strings.Join([]string{
     "From: " + from,
     "To: " + to,
@@ -59,14 +59,7 @@ func reverseGeoHandler(w http.ResponseWriter, r *http.Request) {
     return
   }
 
-  if key := os.Getenv("GOOGLE_MAPS_KEY"); key != "" {
-    out, err := reverseGeoGoogle(lat, lng, key)
-    if err == nil && (out.Address != "" || out.Locality != "") {
-      writeJSON(w, http.StatusOK, out)
-      return
-    }
-  }
-  out, err := reverseGeoNominatim(lat, lng)
+  out, err := reverseGeocode(lat, lng)
   if err != nil {
     writeJSON(w, http.StatusBadGateway, errMsg("reverse geocode failed"))
     return
@@ -74,6 +67,18 @@ func reverseGeoHandler(w http.ResponseWriter, r *http.Request) {
   writeJSON(w, http.StatusOK, out)
 }
 
+// Google when GOOGLE_MAPS_KEY is set and it finds something, Nominatim otherwise.
+// A variable so tests can run without the network.
+var reverseGeocode = func(lat, lng float64) (reverseGeoResponse, error) {
+  if key := os.Getenv("GOOGLE_MAPS_KEY"); key != "" {
+    out, err := reverseGeoGoogle(lat, lng, key)
+    if err == nil && (out.Address != "" || out.Locality != "") {
+      return out, nil
+    }
+  }
+  return reverseGeoNominatim(lat, lng)
+}
+
 func reverseGeoGoogle(lat, lng float64, key string) (reverseGeoResponse, error) {
   url := fmt.Sprintf("https://maps.googleapis.com/maps/api/geocode/json?latlng=%f,%f&key=%s", lat, lng, key)
   client := &http.Client{Timeout: 8 * time.Second}
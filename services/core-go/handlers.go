@@ -3,6 +3,8 @@ package main
 import (
   "database/sql"
   "encoding/json"
+  "errors"
+  "io"
   "net/http"
   "os"
   "strings"
@@ -12,26 +14,20 @@ func productsHandler(db *sql.DB) http.HandlerFunc {
   return func(w http.ResponseWriter, r *http.Request) {
     switch r.Method {
     case http.MethodGet:
-      rows, err := db.Query(`SELECT p.id, p.name, p.description, p.price, p.stock, p.image_url, c.name FROM products p LEFT JOIN categories c ON p.category_id = c.id ORDER BY p.created_at DESC`)
+      out, err := listProducts(db, r)
       if err != nil {
-        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
-        return
-      }
-      defer rows.Close()
-
-      items := []Product{}
-      for rows.Next() {
-        var p Product
-        if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Stock, &p.ImageURL, &p.Category); err != nil {
-          writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        if isInvalid(err) {
+          writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
           return
         }
-        items = append(items, p)
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
       }
-      writeJSON(w, http.StatusOK, items)
+      writeJSON(w, http.StatusOK, out)
     case http.MethodPost:
-      if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
-        writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+      adminID, err := requireRoles(db, r, "owner", "admin")
+      if err != nil {
+        writeRoleError(w, err)
         return
       }
       var req ProductCreateRequest
@@ -39,7 +35,7 @@ func productsHandler(db *sql.DB) http.HandlerFunc {
         writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
         return
       }
-      if req.Name == "" || req.Price <= 0 || req.Stock < 0 {
+      if req.Name == "" || req.Price <= 0 || req.Stock < 0 || (req.ReorderThreshold != nil && *req.ReorderThreshold < 0) {
         writeJSON(w, http.StatusBadRequest, errMsg("name, price, stock required"))
         return
       }
@@ -53,13 +49,34 @@ func productsHandler(db *sql.DB) http.HandlerFunc {
         categoryID = sql.NullString{String: id, Valid: true}
       }
 
+      tx, err := db.Begin()
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      defer tx.Rollback()
       var productID string
-      err := db.QueryRow(`INSERT INTO products (category_id, name, description, price, stock, image_url) VALUES ($1,$2,$3,$4,$5,$6) RETURNING id`,
-        categoryID, req.Name, req.Description, req.Price, req.Stock, req.ImageURL).Scan(&productID)
+      threshold := 0
+      if req.ReorderThreshold != nil {
+        threshold = *req.ReorderThreshold
+      }
+      err = tx.QueryRow(`INSERT INTO products (category_id, name, description, price, stock, image_url, reorder_threshold) VALUES ($1,$2,$3,$4,0,$5,$6) RETURNING id`,
+        categoryID, req.Name, req.Description, req.Price, req.ImageURL, threshold).Scan(&productID)
       if err != nil {
         writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
         return
       }
+      if req.Stock > 0 {
+        _, _, err = applyStockMovementTx(tx, inventoryMovement{ProductID: productID, Kind: "RESTOCK", Delta: req.Stock, ActorType: "admin", ActorID: adminID, Reason: "initial stock"})
+        if err != nil {
+          writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+          return
+        }
+      }
+      if err := tx.Commit(); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
       writeJSON(w, http.StatusOK, map[string]string{"product_id": productID})
     default:
       writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
@@ -79,8 +96,8 @@ func productHandler(db *sql.DB) http.HandlerFunc {
       return
     }
     var p Product
-    err := db.QueryRow(`SELECT p.id, p.name, p.description, p.price, p.stock, p.image_url, c.name FROM products p LEFT JOIN categories c ON p.category_id = c.id WHERE p.id = $1`, id).
-      Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Stock, &p.ImageURL, &p.Category)
+    err := db.QueryRow(`SELECT p.id, p.name, p.description, p.price, p.stock - `+productHeldSQL+`, p.stock, p.image_url, c.name FROM products p LEFT JOIN categories c ON p.category_id = c.id WHERE p.id = $1`, id).
+      Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Stock, &p.OnHand, &p.ImageURL, &p.Category)
     if err != nil {
       if err == sql.ErrNoRows {
         writeJSON(w, http.StatusNotFound, errMsg("not found"))
@@ -89,6 +106,12 @@ func productHandler(db *sql.DB) http.HandlerFunc {
       writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
       return
     }
+    variants, err := loadProductVariants(db, p.ID)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    p.Variants = variants
     writeJSON(w, http.StatusOK, p)
   }
 }
@@ -106,17 +129,23 @@ func cartItemHandler(db *sql.DB) http.HandlerFunc {
         writeJSON(w, http.StatusBadRequest, errMsg("product_id and qty required"))
         return
       }
-
-      cartID := req.CartID
-      if cartID == "" {
-        if err := db.QueryRow(`INSERT INTO carts DEFAULT VALUES RETURNING id`).Scan(&cartID); err != nil {
-          writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      if err := resolveCartVariant(db, req.ProductID, req.VariantID); err != nil {
+        if isInvalid(err) {
+          writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
           return
         }
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+
+      cartID, cartToken, err := resolveCart(db, r, req.CartID, true)
+      if err != nil {
+        writeCartError(w, err)
+        return
       }
 
       var existingID string
-      err := db.QueryRow(`SELECT id FROM cart_items WHERE cart_id = $1 AND product_id = $2`, cartID, req.ProductID).Scan(&existingID)
+      err = db.QueryRow(`SELECT id FROM cart_items WHERE cart_id = $1 AND product_id = $2 AND variant_id IS NOT DISTINCT FROM $3`, cartID, req.ProductID, nullIfEmpty(req.VariantID)).Scan(&existingID)
       if err == nil {
         _, err = db.Exec(`UPDATE cart_items SET qty = qty + $1 WHERE id = $2`, req.Qty, existingID)
         if err != nil {
@@ -124,7 +153,10 @@ func cartItemHandler(db *sql.DB) http.HandlerFunc {
           return
         }
       } else if err == sql.ErrNoRows {
-        _, err = db.Exec(`INSERT INTO cart_items (cart_id, product_id, qty) VALUES ($1, $2, $3)`, cartID, req.ProductID, req.Qty)
+        _, err = db.Exec(`INSERT INTO cart_items (cart_id, product_id, variant_id, qty, price_at_add)
+          SELECT $1, p.id, v.id, $4, COALESCE(v.price, p.price)
+            FROM products p LEFT JOIN product_variants v ON v.id = $3 AND v.product_id = p.id
+           WHERE p.id = $2`, cartID, req.ProductID, nullIfEmpty(req.VariantID), req.Qty)
         if err != nil {
           writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
           return
@@ -133,31 +165,43 @@ func cartItemHandler(db *sql.DB) http.HandlerFunc {
         writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
         return
       }
-      writeJSON(w, http.StatusOK, map[string]string{"cart_id": cartID})
+      touchCart(db, cartID)
+      resp := map[string]string{"cart_id": cartID}
+      if cartToken != "" {
+        resp["cart_token"] = cartToken
+      }
+      writeJSON(w, http.StatusOK, resp)
     case http.MethodPut:
       var req CartItemRequest
       if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
         writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
         return
       }
-      if req.CartID == "" || req.ProductID == "" {
-        writeJSON(w, http.StatusBadRequest, errMsg("cart_id and product_id required"))
+      if req.ProductID == "" {
+        writeJSON(w, http.StatusBadRequest, errMsg("product_id required"))
+        return
+      }
+      cartID, _, err := resolveCart(db, r, req.CartID, false)
+      if err != nil {
+        writeCartError(w, err)
         return
       }
       if req.Qty <= 0 {
-        _, err := db.Exec(`DELETE FROM cart_items WHERE cart_id = $1 AND product_id = $2`, req.CartID, req.ProductID)
+        _, err := db.Exec(`DELETE FROM cart_items WHERE cart_id = $1 AND product_id = $2 AND variant_id IS NOT DISTINCT FROM $3`, cartID, req.ProductID, nullIfEmpty(req.VariantID))
         if err != nil {
           writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
           return
         }
+        touchCart(db, cartID)
         writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
         return
       }
-      _, err := db.Exec(`UPDATE cart_items SET qty = $1 WHERE cart_id = $2 AND product_id = $3`, req.Qty, req.CartID, req.ProductID)
+      _, err = db.Exec(`UPDATE cart_items SET qty = $1 WHERE cart_id = $2 AND product_id = $3 AND variant_id IS NOT DISTINCT FROM $4`, req.Qty, cartID, req.ProductID, nullIfEmpty(req.VariantID))
       if err != nil {
         writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
         return
       }
+      touchCart(db, cartID)
       writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
     case http.MethodDelete:
       var req CartItemRequest
@@ -165,15 +209,21 @@ func cartItemHandler(db *sql.DB) http.HandlerFunc {
         writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
         return
       }
-      if req.CartID == "" || req.ProductID == "" {
-        writeJSON(w, http.StatusBadRequest, errMsg("cart_id and product_id required"))
+      if req.ProductID == "" {
+        writeJSON(w, http.StatusBadRequest, errMsg("product_id required"))
         return
       }
-      _, err := db.Exec(`DELETE FROM cart_items WHERE cart_id = $1 AND product_id = $2`, req.CartID, req.ProductID)
+      cartID, _, err := resolveCart(db, r, req.CartID, false)
+      if err != nil {
+        writeCartError(w, err)
+        return
+      }
+      _, err = db.Exec(`DELETE FROM cart_items WHERE cart_id = $1 AND product_id = $2 AND variant_id IS NOT DISTINCT FROM $3`, cartID, req.ProductID, nullIfEmpty(req.VariantID))
       if err != nil {
         writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
         return
       }
+      touchCart(db, cartID)
       writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
     default:
       writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
@@ -187,12 +237,20 @@ func cartHandler(db *sql.DB) http.HandlerFunc {
       writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
       return
     }
-    cartID := r.URL.Query().Get("cart_id")
+    cartID, _, err := resolveCart(db, r, r.URL.Query().Get("cart_id"), false)
+    if err != nil {
+      if errors.Is(err, errCartNotFound) && r.URL.Query().Get("cart_id") == "" {
+        writeJSON(w, http.StatusBadRequest, errMsg("cart_id required"))
+        return
+      }
+      writeCartError(w, err)
+      return
+    }
     if cartID == "" {
-      writeJSON(w, http.StatusBadRequest, errMsg("cart_id required"))
+      writeJSON(w, http.StatusOK, []CartItem{})
       return
     }
-    rows, err := db.Query(`SELECT ci.id, ci.qty, p.id, p.name, p.price FROM cart_items ci JOIN products p ON ci.product_id = p.id WHERE ci.cart_id = $1`, cartID)
+    rows, err := db.Query(`SELECT ci.id, ci.qty, p.id, p.name, COALESCE(v.price, p.price), v.id, v.sku, v.options FROM cart_items ci JOIN products p ON ci.product_id = p.id LEFT JOIN product_variants v ON ci.variant_id = v.id WHERE ci.cart_id = $1`, cartID)
     if err != nil {
       writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
       return
@@ -202,10 +260,17 @@ func cartHandler(db *sql.DB) http.HandlerFunc {
     items := []CartItem{}
     for rows.Next() {
       var item CartItem
-      if err := rows.Scan(&item.ID, &item.Qty, &item.ProductID, &item.ProductName, &item.Price); err != nil {
+      var variantID, sku sql.NullString
+      var options []byte
+      if err := rows.Scan(&item.ID, &item.Qty, &item.ProductID, &item.ProductName, &item.Price, &variantID, &sku, &options); err != nil {
         writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
         return
       }
+      item.VariantID = variantID.String
+      item.VariantSKU = sku.String
+      if len(options) > 0 {
+        _ = json.Unmarshal(options, &item.Options)
+      }
       items = append(items, item)
     }
     writeJSON(w, http.StatusOK, items)
@@ -218,12 +283,22 @@ func orderHandler(db *sql.DB) http.HandlerFunc {
       writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
       return
     }
+    idemKey, err := idempotencyKey(r)
+    if err != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+      return
+    }
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg("invalid body"))
+      return
+    }
     var req OrderRequest
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+    if err := json.Unmarshal(body, &req); err != nil {
       writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
       return
     }
-    if req.CartID == "" || req.CustomerName == "" || req.Phone == "" || req.Address == "" {
+    if req.CartID == "" || (req.AddressID == "" && (req.CustomerName == "" || req.Phone == "" || req.Address == "")) {
       writeJSON(w, http.StatusBadRequest, errMsg("cart_id, customer_name, phone, address required"))
       return
     }
@@ -235,34 +310,58 @@ func orderHandler(db *sql.DB) http.HandlerFunc {
     }
     defer tx.Rollback()
 
-    token := r.Header.Get("X-Auth-Token")
-    userID := ""
-    currentTier := "Bronze"
-    totalSpend := 0
-    walletBalance := 0
-    tierInfo := TierInfo{Name: "Bronze", DiscountPct: 0, CashbackPct: 0}
-    if token != "" {
-      uid, err := getUserIDFromTokenTx(tx, r)
+    buyer, err := loadCheckoutBuyerTx(db, tx, r)
+    if err != nil {
+      writeJSON(w, http.StatusUnauthorized, errMsg("invalid session"))
+      return
+    }
+    userID := buyer.UserID
+    if err := applySavedAddressTx(tx, userID, &req); err != nil {
+      writeAddressError(w, err)
+      return
+    }
+    if req.CustomerName == "" || req.Phone == "" || req.Address == "" {
+      writeJSON(w, http.StatusBadRequest, errMsg("cart_id, customer_name, phone, address required"))
+      return
+    }
+
+    if idemKey != "" {
+      replay, err := claimIdempotencyKeyTx(tx, idemKey, userID, requestHash(body))
       if err != nil {
-        writeJSON(w, http.StatusUnauthorized, errMsg("invalid session"))
+        if isInvalid(err) {
+          writeJSON(w, http.StatusUnprocessableEntity, errMsg(err.Error()))
+          return
+        }
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
         return
       }
-      userID = uid
-      _ = tx.QueryRow(`SELECT total_spend, tier, wallet_balance FROM users WHERE id = $1`, userID).Scan(&totalSpend, &currentTier, &walletBalance)
-      if t, err := getTierInfo(db, totalSpend); err == nil {
-        tierInfo = t
+      if replay != nil {
+        writeReplayedJSON(w, replay)
+        return
       }
     }
+    if _, err := authorizeCart(tx, req.CartID, userID, r.Header.Get("X-Cart-Token")); err != nil {
+      writeCartError(w, err)
+      return
+    }
 
-    var subtotal int
-    err = tx.QueryRow(`SELECT COALESCE(SUM(p.price * ci.qty), 0) FROM cart_items ci JOIN products p ON ci.product_id = p.id WHERE ci.cart_id = $1`, req.CartID).Scan(&subtotal)
+    lines, err := loadCheckoutLinesTx(tx, req.CartID, true)
     if err != nil {
       writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
       return
     }
-    discount := subtotal * tierInfo.DiscountPct / 100
+    if len(lines) == 0 {
+      writeJSON(w, http.StatusBadRequest, errMsg("cart is empty"))
+      return
+    }
+    for _, it := range lines {
+      if it.Available < it.Qty {
+        writeJSON(w, http.StatusBadRequest, errMsg("stock not enough"))
+        return
+      }
+    }
 
-    voucherDiscount, err := applyVoucherTx(tx, req.VoucherCode, subtotal, userID)
+    quote, err := quoteCheckoutTx(db, tx, req, buyer, lines, true)
     if err != nil {
       if isInvalid(err) {
         writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
@@ -271,36 +370,11 @@ func orderHandler(db *sql.DB) http.HandlerFunc {
       writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
       return
     }
-
-    deliveryReq := DeliveryQuoteRequest{
-      Type:     req.DeliveryType,
-      ZoneID:   req.ZoneID,
-      Lat:      req.Lat,
-      Lng:      req.Lng,
-      Distance: req.DistanceKm,
-    }
-    shippingFee, err := quoteShippingFee(db, deliveryReq)
-    if err != nil {
-      writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
-      return
-    }
-
-    total := subtotal - discount - voucherDiscount + shippingFee
-    if total < 0 {
-      total = 0
-    }
-    cashback := total * tierInfo.CashbackPct / 100
-    walletUsed := 0
-    if userID != "" && req.WalletUse > 0 {
-      walletUsed = req.WalletUse
-      if walletUsed > walletBalance {
-        walletUsed = walletBalance
-      }
-      if walletUsed > total {
-        walletUsed = total
-      }
-      total = total - walletUsed
-    }
+    subtotal := quote.Subtotal
+    discount := quote.Discount
+    cashback := quote.Cashback
+    walletUsed := quote.WalletUsed
+    total := quote.Total
 
     trackingToken, err := randToken(16)
     if err != nil {
@@ -308,48 +382,54 @@ func orderHandler(db *sql.DB) http.HandlerFunc {
       return
     }
     var orderID string
-    err = tx.QueryRow(`INSERT INTO orders (cart_id, user_id, customer_name, phone, address, shipping_fee, subtotal, discount, voucher_code, cashback, wallet_used, total, tracking_token) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13) RETURNING id`,
-      req.CartID, nullIfEmpty(userID), req.CustomerName, req.Phone, req.Address, shippingFee, subtotal, discount+voucherDiscount, nullIfEmpty(req.VoucherCode), cashback, walletUsed, total, trackingToken).
+    // cashback stays pending on the order until it reaches CASHBACK_RELEASE_ON
+    cashbackStatus := "NONE"
+    if userID != "" && cashback > 0 {
+      cashbackStatus = "PENDING"
+    }
+    err = tx.QueryRow(`INSERT INTO orders (cart_id, user_id, customer_name, phone, address, address_id, shipping_fee, subtotal, tier_discount, voucher_discount, discount, voucher_code, cashback, cashback_status, wallet_used, total, tracking_token) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17) RETURNING id`,
+      req.CartID, nullIfEmpty(userID), req.CustomerName, req.Phone, req.Address, nullIfEmpty(req.AddressID), quote.ShippingFee, subtotal, quote.TierDiscount, quote.VoucherDiscount, discount, nullIfEmpty(quote.VoucherCode), cashback, cashbackStatus, walletUsed, total, trackingToken).
       Scan(&orderID)
     if err != nil {
       writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
       return
     }
 
-    if strings.TrimSpace(req.VoucherCode) != "" {
-      _, _ = tx.Exec(`UPDATE vouchers SET uses = uses + 1 WHERE code = $1`, strings.ToUpper(req.VoucherCode))
-      if userID != "" {
-        _, _ = tx.Exec(`UPDATE user_vouchers SET used = TRUE WHERE user_id = $1 AND code = $2`, userID, strings.ToUpper(req.VoucherCode))
-      }
-    }
-
-    items, err := tx.Query(`SELECT p.id, p.stock, ci.qty FROM cart_items ci JOIN products p ON ci.product_id = p.id WHERE ci.cart_id = $1 FOR UPDATE`, req.CartID)
-    if err != nil {
+    if err := recordOrderStatusTx(tx, orderID, "", "PENDING", "customer", userID, ""); err != nil {
       writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
       return
     }
-    defer items.Close()
-    type stockItem struct {
-      id  string
-      qty int
-      stk int
-    }
-    batch := []stockItem{}
-    for items.Next() {
-      var pid string
-      var stock, qty int
-      if err := items.Scan(&pid, &stock, &qty); err != nil {
+
+    // a best-of-tier voucher that lost to the tier discount is not consumed
+    if quote.VoucherCode != "" {
+      if err := redeemVoucherTx(tx, quote.VoucherCode, userID, orderID, quote.VoucherDiscount); err != nil {
+        if isInvalid(err) {
+          writeJSON(w, http.StatusConflict, errMsg(err.Error()))
+          return
+        }
         writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
         return
       }
-      if stock < qty {
-        writeJSON(w, http.StatusBadRequest, errMsg("stock not enough"))
+    }
+
+    holdUntil := stockHoldExpiry()
+    for _, it := range lines {
+      _, err = tx.Exec(`INSERT INTO stock_reservations (order_id, product_id, variant_id, qty, expires_at) VALUES ($1,$2,$3,$4,$5)`,
+        orderID, it.ProductID, nullIfEmpty(it.VariantID), it.Qty, holdUntil)
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
         return
       }
-      batch = append(batch, stockItem{id: pid, qty: qty, stk: stock})
-    }
-    for _, it := range batch {
-      _, err = tx.Exec(`UPDATE products SET stock = stock - $1 WHERE id = $2`, it.qty, it.id)
+      if err := queueLowStockAlertTx(tx, it.ProductID, it.Qty); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      var options any = nil
+      if len(it.Options) > 0 {
+        options = string(it.Options)
+      }
+      _, err = tx.Exec(`INSERT INTO order_items (order_id, product_id, variant_id, product_name, variant_sku, options, unit_price, qty) VALUES ($1,$2,$3,$4,$5,$6,$7,$8)`,
+        orderID, it.ProductID, nullIfEmpty(it.VariantID), it.Name, nullIfEmpty(it.SKU), options, it.UnitPrice, it.Qty)
       if err != nil {
         writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
         return
@@ -360,37 +440,54 @@ func orderHandler(db *sql.DB) http.HandlerFunc {
       return
     }
 
-    responseTier := tierInfo.Name
+    responseTier := buyer.Tier.Name
     if userID != "" {
       grossTotal := total + walletUsed
-      newTotal := totalSpend + grossTotal
-      newTier := currentTier
-      if t, err := getTierInfo(db, newTotal); err == nil {
-        newTier = t.Name
-      }
-      _, _ = tx.Exec(`UPDATE users SET total_spend = $1, tier = $2, wallet_balance = wallet_balance + $3 - $4 WHERE id = $5`, newTotal, newTier, cashback, walletUsed, userID)
-      if newTier != currentTier {
-        code := rewardCodeForTier(newTier)
-        if code != "" {
-          _, _ = tx.Exec(`INSERT INTO user_vouchers (user_id, code) VALUES ($1,$2)`, userID, code)
+      newTotal := buyer.TotalSpend + grossTotal
+      if _, err := tx.Exec(`UPDATE users SET total_spend = $1 WHERE id = $2`, newTotal, userID); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      if walletUsed > 0 {
+        _, err := postWalletEntryTx(tx, walletEntry{UserID: userID, Kind: "SPEND", Amount: walletUsed, OrderID: orderID, ActorType: "customer", ActorID: userID})
+        if isInvalid(err) {
+          writeJSON(w, http.StatusConflict, errMsg(err.Error()))
+          return
+        }
+        if err != nil {
+          writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+          return
         }
       }
+      newTier, err := reevaluateTierTx(tx, userID, tierReasonOrder, false)
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
       responseTier = newTier
     }
-    if err := tx.Commit(); err != nil {
-      writeJSON(w, http.StatusInternalServerError, errMsg("db commit failed"))
-      return
-    }
-    writeJSON(w, http.StatusOK, map[string]any{
+    resp := map[string]any{
       "order_id": orderID,
       "tracking_token": trackingToken,
       "subtotal": subtotal,
-      "discount": discount + voucherDiscount,
+      "discount": discount,
       "cashback": cashback,
+      "cashback_status": cashbackStatus,
       "wallet_used": walletUsed,
       "total": total,
       "tier": responseTier,
-    })
+    }
+    if idemKey != "" {
+      if err := saveIdempotentResponseTx(tx, idemKey, orderID, resp); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+    }
+    if err := tx.Commit(); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("db commit failed"))
+      return
+    }
+    writeJSON(w, http.StatusOK, resp)
   }
 }
 
@@ -416,7 +513,7 @@ func withCORS(next http.Handler) http.Handler {
         w.Header().Set("Access-Control-Allow-Origin", strings.TrimSpace(allowedList[0]))
       }
     }
-    w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Auth-Token, X-Service-Secret, X-Admin-Secret, X-Driver-Token, X-Session-Id")
+    w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Auth-Token, X-Service-Secret, X-Admin-Secret, X-Driver-Token, X-Session-Id, X-Cart-Token, Idempotency-Key")
     w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE,OPTIONS")
     if r.Method == http.MethodOptions {
       w.WriteHeader(http.StatusNoContent)
@@ -435,6 +532,10 @@ func ensureCategory(db *sql.DB, name string) (string, error) {
   if err != sql.ErrNoRows {
     return "", err
   }
-  err = db.QueryRow(`INSERT INTO categories (name) VALUES ($1) RETURNING id`, name).Scan(&id)
+  slug, err := uniqueCategorySlug(db, slugify(name), "")
+  if err != nil {
+    return "", err
+  }
+  err = db.QueryRow(`INSERT INTO categories (name, slug) VALUES ($1,$2) RETURNING id`, name, slug).Scan(&id)
   return id, err
 }
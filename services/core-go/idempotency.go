@@ -0,0 +1,63 @@
+package main
+
+import (
+  "crypto/sha256"
+  "database/sql"
+  "encoding/hex"
+  "encoding/json"
+  "net/http"
+  "strings"
+)
+
+const maxIdempotencyKeyLength = 255
+
+func idempotencyKey(r *http.Request) (string, error) {
+  key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+  if len(key) > maxIdempotencyKeyLength {
+    return "", errInvalid("Idempotency-Key too long")
+  }
+  return key, nil
+}
+
+func requestHash(body []byte) string {
+  sum := sha256.Sum256(body)
+  return hex.EncodeToString(sum[:])
+}
+
+// a concurrent request holding the same key makes the insert wait for its commit or rollback
+func claimIdempotencyKeyTx(tx *sql.Tx, key string, userID string, hash string) (json.RawMessage, error) {
+  res, err := tx.Exec(`INSERT INTO idempotency_keys (key, user_id, request_hash) VALUES ($1,$2,$3)
+    ON CONFLICT (key) DO UPDATE SET user_id = EXCLUDED.user_id, request_hash = EXCLUDED.request_hash, order_id = NULL, response = NULL, created_at = NOW()
+    WHERE idempotency_keys.created_at < NOW() - INTERVAL '24 hours'`, key, nullIfEmpty(userID), hash)
+  if err != nil {
+    return nil, err
+  }
+  if n, _ := res.RowsAffected(); n > 0 {
+    return nil, nil
+  }
+  var storedUser sql.NullString
+  var storedHash string
+  var response []byte
+  err = tx.QueryRow(`SELECT user_id, request_hash, response FROM idempotency_keys WHERE key = $1`, key).Scan(&storedUser, &storedHash, &response)
+  if err != nil {
+    return nil, err
+  }
+  if storedUser.String != userID || storedHash != hash {
+    return nil, errInvalid("Idempotency-Key already used for a different request")
+  }
+  return json.RawMessage(response), nil
+}
+
+func saveIdempotentResponseTx(tx *sql.Tx, key string, orderID string, response any) error {
+  body, err := json.Marshal(response)
+  if err != nil {
+    return err
+  }
+  _, err = tx.Exec(`UPDATE idempotency_keys SET order_id = $1, response = $2 WHERE key = $3`, orderID, string(body), key)
+  return err
+}
+
+func writeReplayedJSON(w http.ResponseWriter, body json.RawMessage) {
+  w.Header().Set("Idempotent-Replayed", "true")
+  writeJSON(w, http.StatusOK, body)
+}
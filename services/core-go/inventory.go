@@ -0,0 +1,325 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+var inventoryKinds = map[string]bool{
+  "SALE":       true,
+  "RESTOCK":    true,
+  "ADJUSTMENT": true,
+  "RETURN":     true,
+  "DAMAGE":     true,
+}
+
+type inventoryMovement struct {
+  ProductID string
+  VariantID string
+  Kind      string
+  Delta     int
+  OrderID   string
+  ActorType string
+  ActorID   string
+  Reason    string
+}
+
+type InventoryAdjustmentRequest struct {
+  ProductID string `json:"product_id"`
+  VariantID string `json:"variant_id"`
+  Kind      string `json:"kind"`
+  Qty       int    `json:"qty"`
+  Counted   *int   `json:"counted"`
+  Reason    string `json:"reason"`
+}
+
+func applyStockMovementTx(tx *sql.Tx, m inventoryMovement) (string, int, error) {
+  if !inventoryKinds[m.Kind] {
+    return "", 0, errInvalid("invalid kind")
+  }
+  // sales are committed against holds taken at checkout (lapsed ones are re-checked before
+  // they get here), so they may not be refused here
+  guard := " AND stock + $1 >= 0"
+  if m.Kind == "SALE" {
+    guard = ""
+  }
+  var after int
+  if m.VariantID != "" {
+    err := tx.QueryRow(`UPDATE product_variants SET stock = stock + $1 WHERE id = $2 AND product_id = $3`+guard+` RETURNING stock`,
+      m.Delta, m.VariantID, m.ProductID).Scan(&after)
+    if err == sql.ErrNoRows {
+      return "", 0, errInvalid("variant not found or stock not enough")
+    }
+    if err != nil {
+      return "", 0, err
+    }
+    if _, err := tx.Exec(`UPDATE products SET stock = stock + $1 WHERE id = $2`, m.Delta, m.ProductID); err != nil {
+      return "", 0, err
+    }
+  } else {
+    err := tx.QueryRow(`UPDATE products SET stock = stock + $1 WHERE id = $2`+guard+` RETURNING stock`, m.Delta, m.ProductID).Scan(&after)
+    if err == sql.ErrNoRows {
+      return "", 0, errInvalid("product not found or stock not enough")
+    }
+    if err != nil {
+      return "", 0, err
+    }
+  }
+  if m.Delta < 0 && m.Kind != "SALE" {
+    if err := queueLowStockAlertTx(tx, m.ProductID, -m.Delta); err != nil {
+      return "", 0, err
+    }
+  }
+  var id string
+  err := tx.QueryRow(`INSERT INTO inventory_movements (product_id, variant_id, kind, qty_delta, stock_after, order_id, actor_type, actor_id, reason)
+    VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING id`,
+    m.ProductID, nullIfEmpty(m.VariantID), m.Kind, m.Delta, after, nullIfEmpty(m.OrderID), m.ActorType, nullIfEmpty(m.ActorID), nullIfEmpty(m.Reason)).Scan(&id)
+  return id, after, err
+}
+
+func currentStockTx(tx *sql.Tx, productID string, variantID string) (int, error) {
+  var stock int
+  var err error
+  if variantID != "" {
+    err = tx.QueryRow(`SELECT stock FROM product_variants WHERE id = $1 AND product_id = $2 FOR UPDATE`, variantID, productID).Scan(&stock)
+  } else {
+    err = tx.QueryRow(`SELECT stock FROM products WHERE id = $1 FOR UPDATE`, productID).Scan(&stock)
+  }
+  if err == sql.ErrNoRows {
+    return 0, errInvalid("product not found")
+  }
+  return stock, err
+}
+
+func adjustmentMovement(req InventoryAdjustmentRequest, current int) (inventoryMovement, error) {
+  m := inventoryMovement{
+    ProductID: strings.TrimSpace(req.ProductID),
+    VariantID: strings.TrimSpace(req.VariantID),
+    Kind:      strings.ToUpper(strings.TrimSpace(req.Kind)),
+    Reason:    strings.TrimSpace(req.Reason),
+  }
+  switch m.Kind {
+  case "RESTOCK":
+    if req.Qty <= 0 {
+      return m, errInvalid("qty must be positive")
+    }
+    m.Delta = req.Qty
+  case "DAMAGE":
+    if req.Qty <= 0 {
+      return m, errInvalid("qty must be positive")
+    }
+    m.Delta = -req.Qty
+  case "ADJUSTMENT":
+    if req.Counted != nil {
+      if *req.Counted < 0 {
+        return m, errInvalid("counted must not be negative")
+      }
+      m.Delta = *req.Counted - current
+    } else {
+      m.Delta = req.Qty
+    }
+  default:
+    return m, errInvalid("kind must be restock, adjustment or damage")
+  }
+  if m.Kind != "RESTOCK" && m.Reason == "" {
+    return m, errInvalid("reason required")
+  }
+  return m, nil
+}
+
+func adminInventoryAdjustmentsHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+      return
+    }
+    actorID, err := requireRoles(db, r, "owner", "admin", "staff")
+    if err != nil {
+      writeRoleError(w, err)
+      return
+    }
+    var req InventoryAdjustmentRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
+      return
+    }
+    if strings.TrimSpace(req.ProductID) == "" {
+      writeJSON(w, http.StatusBadRequest, errMsg("product_id required"))
+      return
+    }
+    tx, err := db.Begin()
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    defer tx.Rollback()
+
+    var hasVariants bool
+    if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM product_variants WHERE product_id = $1)`, req.ProductID).Scan(&hasVariants); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    if hasVariants && strings.TrimSpace(req.VariantID) == "" {
+      writeJSON(w, http.StatusBadRequest, errMsg("variant_id required"))
+      return
+    }
+    current, err := currentStockTx(tx, req.ProductID, strings.TrimSpace(req.VariantID))
+    if err != nil {
+      writeInventoryError(w, err)
+      return
+    }
+    m, err := adjustmentMovement(req, current)
+    if err != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+      return
+    }
+    if m.Delta == 0 {
+      writeJSON(w, http.StatusOK, map[string]any{"movement_id": nil, "stock": current})
+      return
+    }
+    m.ActorType = "admin"
+    m.ActorID = actorID
+    id, after, err := applyStockMovementTx(tx, m)
+    if err != nil {
+      writeInventoryError(w, err)
+      return
+    }
+    if err := tx.Commit(); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{"movement_id": id, "stock": after})
+  }
+}
+
+func writeInventoryError(w http.ResponseWriter, err error) {
+  if isInvalid(err) {
+    writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+    return
+  }
+  writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+}
+
+func adminInventoryProductHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+      return
+    }
+    if _, err := requireRoles(db, r, "owner", "admin", "staff"); err != nil {
+      writeRoleError(w, err)
+      return
+    }
+    path := strings.TrimPrefix(r.URL.Path, "/admin/inventory/products/")
+    if !strings.HasSuffix(path, "/movements") {
+      writeJSON(w, http.StatusNotFound, errMsg("not found"))
+      return
+    }
+    productID := strings.Trim(strings.TrimSuffix(path, "/movements"), "/")
+    if productID == "" {
+      writeJSON(w, http.StatusBadRequest, errMsg("missing id"))
+      return
+    }
+    limit := 100
+    if s := r.URL.Query().Get("limit"); s != "" {
+      if n, err := strconv.Atoi(s); err == nil && n > 0 && n <= 500 {
+        limit = n
+      }
+    }
+    rows, err := db.Query(`SELECT m.id, m.variant_id, v.sku, m.kind, m.qty_delta, m.stock_after, m.order_id, m.actor_type, m.actor_id, u.name, m.reason, m.created_at
+      FROM inventory_movements m
+      LEFT JOIN product_variants v ON m.variant_id = v.id
+      LEFT JOIN users u ON m.actor_id = u.id
+      WHERE m.product_id = $1
+      ORDER BY m.created_at DESC
+      LIMIT $2`, productID, limit)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    defer rows.Close()
+    out := []map[string]any{}
+    for rows.Next() {
+      var id, kind, actorType string
+      var variantID, sku, orderID, actorID, actorName, reason sql.NullString
+      var delta, after int
+      var createdAt time.Time
+      if err := rows.Scan(&id, &variantID, &sku, &kind, &delta, &after, &orderID, &actorType, &actorID, &actorName, &reason, &createdAt); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      out = append(out, map[string]any{
+        "id":          id,
+        "variant_id":  variantID.String,
+        "variant_sku": sku.String,
+        "kind":        kind,
+        "qty_delta":   delta,
+        "stock_after": after,
+        "order_id":    orderID.String,
+        "actor_type":  actorType,
+        "actor_id":    actorID.String,
+        "actor_name":  actorName.String,
+        "reason":      reason.String,
+        "created_at":  createdAt,
+      })
+    }
+    if err := rows.Err(); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    writeJSON(w, http.StatusOK, out)
+  }
+}
+
+func adminInventoryReconcileHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+      return
+    }
+    if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
+      writeRoleError(w, err)
+      return
+    }
+    rows, err := db.Query(`SELECT p.id, NULL::uuid, p.name, p.stock, COALESCE(SUM(m.qty_delta), 0)
+        FROM products p LEFT JOIN inventory_movements m ON m.product_id = p.id
+        GROUP BY p.id HAVING p.stock <> COALESCE(SUM(m.qty_delta), 0)
+      UNION ALL
+      SELECT v.product_id, v.id, v.sku, v.stock, COALESCE(SUM(m.qty_delta), 0)
+        FROM product_variants v LEFT JOIN inventory_movements m ON m.variant_id = v.id
+        GROUP BY v.id HAVING v.stock <> COALESCE(SUM(m.qty_delta), 0)`)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    defer rows.Close()
+    out := []map[string]any{}
+    for rows.Next() {
+      var productID, name string
+      var variantID sql.NullString
+      var stock, ledger int
+      if err := rows.Scan(&productID, &variantID, &name, &stock, &ledger); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      out = append(out, map[string]any{
+        "product_id": productID,
+        "variant_id": variantID.String,
+        "name":       name,
+        "stock":      stock,
+        "ledger":     ledger,
+        "difference": stock - ledger,
+      })
+    }
+    // a partial report would read as "everything else matches"
+    if err := rows.Err(); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    writeJSON(w, http.StatusOK, out)
+  }
+}
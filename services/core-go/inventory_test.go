@@ -0,0 +1,79 @@
+package main
+
+import (
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+
+  "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAdjustmentMovement(t *testing.T) {
+  counted := 7
+  zero := 0
+  cases := []struct {
+    name    string
+    req     InventoryAdjustmentRequest
+    current int
+    delta   int
+    invalid bool
+  }{
+    {"restock", InventoryAdjustmentRequest{Kind: "restock", Qty: 5}, 10, 5, false},
+    {"restock needs qty", InventoryAdjustmentRequest{Kind: "restock"}, 10, 0, true},
+    {"damage subtracts", InventoryAdjustmentRequest{Kind: "damage", Qty: 2, Reason: "bag torn"}, 10, -2, false},
+    {"damage needs reason", InventoryAdjustmentRequest{Kind: "damage", Qty: 2}, 10, 0, true},
+    {"stock take", InventoryAdjustmentRequest{Kind: "adjustment", Counted: &counted, Reason: "monthly count"}, 10, -3, false},
+    {"stock take to zero", InventoryAdjustmentRequest{Kind: "adjustment", Counted: &zero, Reason: "expired"}, 4, -4, false},
+    {"signed adjustment", InventoryAdjustmentRequest{Kind: "adjustment", Qty: 3, Reason: "found in back room"}, 10, 3, false},
+    {"sale not allowed", InventoryAdjustmentRequest{Kind: "sale", Qty: 1, Reason: "x"}, 10, 0, true},
+  }
+  for _, tc := range cases {
+    m, err := adjustmentMovement(tc.req, tc.current)
+    if tc.invalid {
+      if !isInvalid(err) {
+        t.Fatalf("%s: expected invalid error, got %v", tc.name, err)
+      }
+      continue
+    }
+    if err != nil {
+      t.Fatalf("%s: unexpected error: %v", tc.name, err)
+    }
+    if m.Delta != tc.delta {
+      t.Fatalf("%s: expected delta %d, got %d", tc.name, tc.delta, m.Delta)
+    }
+  }
+}
+
+func TestReconcileFailsOnRowError(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectQuery(`SELECT user_id, id, last_seen_at < NOW\(\) - interval '5 minutes' FROM sessions`).
+    WithArgs(hashSessionToken("owner-token")).
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "id", "stale"}).AddRow("owner-1", "session-1", false))
+  mock.ExpectQuery(`SELECT is_admin, role, totp_enabled_at IS NOT NULL FROM users WHERE id = \$1`).
+    WithArgs("owner-1").
+    WillReturnRows(sqlmock.NewRows([]string{"is_admin", "role", "totp_on"}).AddRow(true, "owner", true))
+  mock.ExpectQuery(`FROM products p LEFT JOIN inventory_movements m`).
+    WillReturnRows(sqlmock.NewRows([]string{"product_id", "variant_id", "name", "stock", "ledger"}).
+      AddRow("prod-1", nil, "Whiskas Adult 1.2kg", 10, 8).
+      AddRow("prod-2", nil, "Royal Canin Kitten 2kg", 4, 4).
+      RowError(1, errors.New("connection reset")))
+
+  req := httptest.NewRequest(http.MethodGet, "/admin/inventory/reconcile", nil)
+  req.Header.Set("X-Auth-Token", "owner-token")
+  rec := httptest.NewRecorder()
+
+  adminInventoryReconcileHandler(db).ServeHTTP(rec, req)
+
+  if rec.Code != http.StatusInternalServerError {
+    t.Fatalf("expected 500 instead of a partial report, got %d: %s", rec.Code, rec.Body.String())
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
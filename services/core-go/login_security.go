@@ -0,0 +1,354 @@
+package main
+
+import (
+  "database/sql"
+  "errors"
+  "fmt"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+
+  "golang.org/x/crypto/bcrypt"
+)
+
+type loginLimits struct {
+  DelayAfter   int
+  LockAfter    int
+  LockFor      time.Duration
+  Window       time.Duration
+  IPMaxFailure int
+}
+
+type loginUsage struct {
+  Failures   int
+  SinceLast  sql.NullInt64
+  IPFailures int
+}
+
+func loadLoginLimits() loginLimits {
+  return loginLimits{
+    DelayAfter:   envPositiveInt("LOGIN_DELAY_AFTER_FAILURES", 3),
+    LockAfter:    envPositiveInt("LOGIN_LOCK_AFTER_FAILURES", 10),
+    LockFor:      time.Duration(envPositiveInt("LOGIN_LOCK_MINUTES", 15)) * time.Minute,
+    Window:       time.Duration(envPositiveInt("LOGIN_FAILURE_WINDOW_MINUTES", 15)) * time.Minute,
+    IPMaxFailure: envPositiveInt("LOGIN_IP_MAX_FAILURES", 30),
+  }
+}
+
+// failures past DelayAfter make the next try wait 1s, 2s, 4s ... up to a minute after the
+// previous failure; a client IP over its failure budget waits until the window moves on
+func loginDelay(l loginLimits, u loginUsage) (time.Duration, string) {
+  if u.IPFailures >= l.IPMaxFailure {
+    return l.Window, "too many failed logins from this network, try again later"
+  }
+  if u.Failures < l.DelayAfter || !u.SinceLast.Valid {
+    return 0, ""
+  }
+  delay := time.Minute
+  if n := u.Failures - l.DelayAfter; n < 6 {
+    delay = time.Duration(1<<n) * time.Second
+  }
+  if left := delay - time.Duration(u.SinceLast.Int64)*time.Second; left > 0 {
+    return left, "too many failed logins, try again later"
+  }
+  return 0, ""
+}
+
+// failures are counted per account (the user id, or the identifier as typed when no
+// account matches) since its last successful login, and per client IP, within the window
+func loadLoginUsage(db queryRower, l loginLimits, key string, ip string) (loginUsage, error) {
+  var u loginUsage
+  err := db.QueryRow(`WITH last_ok AS (
+      SELECT COALESCE(MAX(created_at), '-infinity'::timestamp) AS at FROM login_attempts WHERE account_key = $1 AND success
+    )
+    SELECT
+      COUNT(*) FILTER (WHERE a.account_key = $1 AND a.created_at > last_ok.at),
+      EXTRACT(EPOCH FROM NOW() - MAX(a.created_at) FILTER (WHERE a.account_key = $1))::bigint,
+      COUNT(*) FILTER (WHERE a.ip = $2)
+    FROM login_attempts a, last_ok
+    WHERE NOT a.success AND a.created_at > NOW() - make_interval(secs => $3) AND (a.account_key = $1 OR a.ip = $2)`,
+    key, ip, int(l.Window/time.Second)).Scan(&u.Failures, &u.SinceLast, &u.IPFailures)
+  return u, err
+}
+
+func loginLockedFor(db queryRower, userID string) (time.Duration, error) {
+  var secs int64
+  err := db.QueryRow(`SELECT CEIL(EXTRACT(EPOCH FROM login_locked_until - NOW()))::bigint FROM users WHERE id = $1 AND login_locked_until > NOW()`, userID).Scan(&secs)
+  if err == sql.ErrNoRows {
+    return 0, nil
+  }
+  return time.Duration(secs) * time.Second, err
+}
+
+func recordLoginAttempt(db *sql.DB, scope string, key string, identifier string, userID string, ip string, success bool) error {
+  _, err := db.Exec(`INSERT INTO login_attempts (scope, account_key, identifier, user_id, ip, success) VALUES ($1,$2,$3,$4,$5,$6)`,
+    scope, key, identifier, nullIfEmpty(userID), nullIfEmpty(ip), success)
+  return err
+}
+
+// takes one of the account's LockAfter guesses before the credentials are checked, so a burst
+// of parallel requests cannot all get past the lock check before any failure is counted.
+// The counter starts over after a window without failures, on a successful login and when
+// the lock is set.
+func claimLoginGuess(db *sql.DB, l loginLimits, userID string) (int, error) {
+  var n int
+  err := db.QueryRow(`UPDATE users SET
+      login_failures = CASE WHEN login_failed_at > NOW() - make_interval(secs => $2) THEN login_failures + 1 ELSE 1 END,
+      login_failed_at = NOW()
+    WHERE id = $1 RETURNING login_failures`, userID, int(l.Window/time.Second)).Scan(&n)
+  return n, err
+}
+
+// gives back a claimed guess that turned out not to be a failure: the right password on a
+// two-factor account, which is the normal first step of its login
+func refundLoginGuess(db *sql.DB, userID string) error {
+  _, err := db.Exec(`UPDATE users SET login_failures = GREATEST(login_failures - 1, 0) WHERE id = $1`, userID)
+  return err
+}
+
+// locks the account once it reaches LockAfter failures; the owner is told only when this
+// call is the one that set the lock, not on every failure made while it is locked
+func lockLoginIfNeeded(db *sql.DB, l loginLimits, userID string, failures int) error {
+  if userID == "" || failures < l.LockAfter {
+    return nil
+  }
+  var name string
+  var email, phone sql.NullString
+  err := db.QueryRow(`UPDATE users SET login_locked_until = NOW() + make_interval(secs => $2), login_failures = 0
+    WHERE id = $1 AND (login_locked_until IS NULL OR login_locked_until <= NOW())
+    RETURNING name, email, phone`, userID, int(l.LockFor/time.Second)).Scan(&name, &email, &phone)
+  if err == sql.ErrNoRows {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  go sendLoginLockAlert(name, email.String, phone.String, l.LockFor)
+  return nil
+}
+
+func sendLoginLockAlert(name string, email string, phone string, lockFor time.Duration) {
+  msg := fmt.Sprintf("Halo %s, akun Petshop Bento kamu dikunci sementara selama %d menit karena terlalu banyak percobaan login yang gagal. Jika ini bukan kamu, segera ganti password lewat menu lupa password.",
+    name, int(lockFor/time.Minute))
+  if email != "" && smtpEnabled() {
+    if err := deliverNotice("email", email, "Akun Petshop Bento dikunci sementara", msg); err == nil {
+      return
+    }
+  }
+  if phone != "" && fonnteEnabled() {
+    _ = deliverNotice("whatsapp", phone, "", msg)
+  }
+}
+
+func writeLoginThrottled(w http.ResponseWriter, wait time.Duration, msg string) {
+  secs := int((wait + time.Second - 1) / time.Second)
+  w.Header().Set("Retry-After", strconv.Itoa(secs))
+  writeJSON(w, http.StatusTooManyRequests, map[string]any{"error": msg, "retry_after": secs})
+}
+
+var errBadCredentials = errors.New("invalid credentials")
+
+const loginLockedMsg = "account temporarily locked after too many failed logins"
+
+// runs the credential check of a login behind the lockout and delays. verify is only called
+// when an account matched (userID is empty otherwise, which still counts as a failure for the
+// identifier) and returns errBadCredentials, errTotpRequired or errTotpInvalid on refusal.
+// An identifier without an account is "locked" on the same schedule, so the 429 does not tell
+// which accounts exist. Returns false once it has written the error response.
+func guardLogin(db *sql.DB, w http.ResponseWriter, r *http.Request, scope string, identifier string, userID string, verify func() error) bool {
+  l := loadLoginLimits()
+  ip := clientIP(r)
+  key := userID
+  if key == "" {
+    key = strings.ToLower(strings.TrimSpace(identifier))
+  }
+  if userID != "" {
+    wait, err := loginLockedFor(db, userID)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("login failed"))
+      return false
+    }
+    if wait > 0 {
+      writeLoginThrottled(w, wait, loginLockedMsg)
+      return false
+    }
+  }
+  u, err := loadLoginUsage(db, l, key, ip)
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg("login failed"))
+    return false
+  }
+  if userID == "" && u.Failures >= l.LockAfter && u.SinceLast.Valid {
+    // nothing is recorded while locked, so the last failure is the one that set the lock
+    if wait := l.LockFor - time.Duration(u.SinceLast.Int64)*time.Second; wait > 0 {
+      writeLoginThrottled(w, wait, loginLockedMsg)
+      return false
+    }
+  }
+  if wait, msg := loginDelay(l, u); wait > 0 {
+    writeLoginThrottled(w, wait, msg)
+    return false
+  }
+  verr := errBadCredentials
+  guesses := 0
+  if userID != "" {
+    guesses, err = claimLoginGuess(db, l, userID)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("login failed"))
+      return false
+    }
+    if guesses > l.LockAfter {
+      // requests already in flight have used up the guesses; one of them sets the lock
+      writeLoginThrottled(w, l.LockFor, loginLockedMsg)
+      return false
+    }
+    verr = verify()
+  }
+  switch verr {
+  case nil:
+    if err := recordLoginAttempt(db, scope, key, identifier, userID, ip, true); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("login failed"))
+      return false
+    }
+    if _, err := db.Exec(`UPDATE users SET login_failures = 0 WHERE id = $1`, userID); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("login failed"))
+      return false
+    }
+    return true
+  case errTotpRequired:
+    // the password was right; nothing is recorded until the code comes back
+    if err := refundLoginGuess(db, userID); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("login failed"))
+      return false
+    }
+    writeSecondFactorError(w, verr)
+    return false
+  case errBadCredentials, errTotpInvalid:
+  default:
+    _ = refundLoginGuess(db, userID)
+    writeJSON(w, http.StatusInternalServerError, errMsg("login failed"))
+    return false
+  }
+  if err := recordLoginAttempt(db, scope, key, identifier, userID, ip, false); err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg("login failed"))
+    return false
+  }
+  if err := lockLoginIfNeeded(db, l, userID, guesses); err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg("login failed"))
+    return false
+  }
+  if verr == errTotpInvalid {
+    writeSecondFactorError(w, verr)
+    return false
+  }
+  writeJSON(w, http.StatusUnauthorized, errMsg("invalid credentials"))
+  return false
+}
+
+// the usual verify for a password login: bcrypt first, then TOTP when the account has it on
+func passwordAndTotp(db *sql.DB, userID string, hash string, password string, code string, recovery string, totpOn *bool) func() error {
+  return func() error {
+    if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+      return errBadCredentials
+    }
+    on, err := checkLoginTotp(db, userID, code, recovery)
+    *totpOn = on
+    return err
+  }
+}
+
+func adminLoginAttemptsHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+      return
+    }
+    if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
+      writeRoleError(w, err)
+      return
+    }
+    q := r.URL.Query()
+    where := []string{"TRUE"}
+    args := []any{}
+    add := func(cond string, v any) {
+      args = append(args, v)
+      where = append(where, fmt.Sprintf(cond, len(args)))
+    }
+    if v := strings.TrimSpace(q.Get("identifier")); v != "" {
+      add("a.identifier ILIKE '%%' || $%d || '%%'", v)
+    }
+    if v := strings.TrimSpace(q.Get("ip")); v != "" {
+      add("a.ip = $%d", v)
+    }
+    if v := strings.TrimSpace(q.Get("user_id")); v != "" {
+      add("a.user_id::text = $%d", v)
+    }
+    if q.Get("failed") == "true" {
+      where = append(where, "NOT a.success")
+    }
+    limit := 100
+    if s := q.Get("limit"); s != "" {
+      if n, err := strconv.Atoi(s); err == nil && n > 0 && n <= 500 {
+        limit = n
+      }
+    }
+    args = append(args, limit)
+    rows, err := db.Query(`SELECT a.id, a.scope, a.identifier, a.user_id, u.name, a.ip, a.success, a.created_at
+      FROM login_attempts a LEFT JOIN users u ON a.user_id = u.id
+      WHERE `+strings.Join(where, " AND ")+`
+      ORDER BY a.created_at DESC
+      LIMIT $`+strconv.Itoa(len(args)), args...)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    defer rows.Close()
+    attempts := []map[string]any{}
+    for rows.Next() {
+      var id, scope, identifier, createdAt string
+      var userID, name, ip sql.NullString
+      var success bool
+      if err := rows.Scan(&id, &scope, &identifier, &userID, &name, &ip, &success, &createdAt); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      attempts = append(attempts, map[string]any{
+        "id":         id,
+        "scope":      scope,
+        "identifier": identifier,
+        "user_id":    userID.String,
+        "name":       name.String,
+        "ip":         ip.String,
+        "success":    success,
+        "created_at": createdAt,
+      })
+    }
+    if err := rows.Err(); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+
+    lrows, err := db.Query(`SELECT id, name, email, phone, login_locked_until FROM users WHERE login_locked_until > NOW() ORDER BY login_locked_until DESC`)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    defer lrows.Close()
+    locked := []map[string]any{}
+    for lrows.Next() {
+      var id, name, until string
+      var email, phone sql.NullString
+      if err := lrows.Scan(&id, &name, &email, &phone, &until); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      locked = append(locked, map[string]any{"user_id": id, "name": name, "email": email.String, "phone": phone.String, "locked_until": until})
+    }
+    if err := lrows.Err(); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{"attempts": attempts, "locked": locked})
+  }
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+  "bytes"
+  "database/sql"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+
+  "github.com/DATA-DOG/go-sqlmock"
+  "golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginDelay(t *testing.T) {
+  l := loginLimits{DelayAfter: 3, LockAfter: 10, Window: 15 * time.Minute, IPMaxFailure: 30}
+  n := func(v int64) sql.NullInt64 { return sql.NullInt64{Int64: v, Valid: true} }
+  cases := []struct {
+    name string
+    u    loginUsage
+    want time.Duration
+  }{
+    {"below threshold", loginUsage{Failures: 2, SinceLast: n(0)}, 0},
+    {"first delay", loginUsage{Failures: 3, SinceLast: n(0)}, time.Second},
+    {"doubling", loginUsage{Failures: 5, SinceLast: n(1)}, 3 * time.Second},
+    {"capped at a minute", loginUsage{Failures: 20, SinceLast: n(10)}, 50 * time.Second},
+    {"delay already served", loginUsage{Failures: 4, SinceLast: n(5)}, 0},
+    {"ip budget spent", loginUsage{IPFailures: 30}, 15 * time.Minute},
+  }
+  for _, tc := range cases {
+    if got, _ := loginDelay(l, tc.u); got != tc.want {
+      t.Fatalf("%s: want %v, got %v", tc.name, tc.want, got)
+    }
+  }
+}
+
+func expectLoginUser(mock sqlmock.Sqlmock, hash string) {
+  mock.ExpectQuery(`SELECT id, password_hash, name, phone, tier, total_spend, wallet_balance, is_admin, role, email, username, avatar_url FROM users`).
+    WithArgs("sari@example.com", "").
+    WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash", "name", "phone", "tier", "total_spend", "wallet_balance", "is_admin", "role", "email", "username", "avatar_url"}).
+      AddRow("user-1", hash, "Sari", "628123456789", "Bronze", 0, 0, false, "member", "sari@example.com", "sari", nil))
+}
+
+func TestLoginLocksAccountAtThreshold(t *testing.T) {
+  t.Setenv("SMTP_HOST", "")
+  t.Setenv("FONNTE_API_KEY", "")
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  hash, _ := bcrypt.GenerateFromPassword([]byte("benar"), bcrypt.MinCost)
+  expectLoginUser(mock, string(hash))
+  mock.ExpectQuery(`SELECT CEIL\(EXTRACT\(EPOCH FROM login_locked_until - NOW\(\)\)\)::bigint FROM users`).
+    WithArgs("user-1").
+    WillReturnRows(sqlmock.NewRows([]string{"secs"}))
+  mock.ExpectQuery(`FROM login_attempts a, last_ok`).
+    WithArgs("user-1", "192.0.2.1", 900).
+    WillReturnRows(sqlmock.NewRows([]string{"failures", "since_last", "ip_failures"}).AddRow(9, 120, 9))
+  mock.ExpectQuery(`UPDATE users SET\s+login_failures = CASE`).
+    WithArgs("user-1", 900).
+    WillReturnRows(sqlmock.NewRows([]string{"login_failures"}).AddRow(10))
+  mock.ExpectExec(`INSERT INTO login_attempts`).
+    WithArgs("member", "user-1", "sari@example.com", "user-1", "192.0.2.1", false).
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectQuery(`UPDATE users SET login_locked_until = NOW\(\) \+ make_interval\(secs => \$2\), login_failures = 0`).
+    WithArgs("user-1", 900).
+    WillReturnRows(sqlmock.NewRows([]string{"name", "email", "phone"}).AddRow("Sari", "sari@example.com", "628123456789"))
+
+  body, _ := json.Marshal(map[string]any{"email": "sari@example.com", "password": "salah"})
+  req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewReader(body))
+  req.RemoteAddr = "192.0.2.1:5555"
+  rec := httptest.NewRecorder()
+
+  loginHandler(db).ServeHTTP(rec, req)
+
+  if rec.Code != http.StatusUnauthorized {
+    t.Fatalf("expected 401, got %d: %s", rec.Code, rec.Body.String())
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestLoginRefusedWhileLocked(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  hash, _ := bcrypt.GenerateFromPassword([]byte("benar"), bcrypt.MinCost)
+  expectLoginUser(mock, string(hash))
+  mock.ExpectQuery(`SELECT CEIL\(EXTRACT\(EPOCH FROM login_locked_until - NOW\(\)\)\)::bigint FROM users`).
+    WithArgs("user-1").
+    WillReturnRows(sqlmock.NewRows([]string{"secs"}).AddRow(300))
+
+  // even the right password is refused until the lock runs out
+  body, _ := json.Marshal(map[string]any{"email": "sari@example.com", "password": "benar"})
+  req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewReader(body))
+  rec := httptest.NewRecorder()
+
+  loginHandler(db).ServeHTTP(rec, req)
+
+  if rec.Code != http.StatusTooManyRequests {
+    t.Fatalf("expected 429, got %d: %s", rec.Code, rec.Body.String())
+  }
+  if got := rec.Header().Get("Retry-After"); got != "300" {
+    t.Fatalf("expected Retry-After 300, got %q", got)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+// a parallel burst: the other requests already claimed every guess the account has left,
+// so this one is refused before the password is even looked at
+func TestLoginBurstCannotOutrunLock(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  hash, _ := bcrypt.GenerateFromPassword([]byte("benar"), bcrypt.MinCost)
+  expectLoginUser(mock, string(hash))
+  mock.ExpectQuery(`SELECT CEIL\(EXTRACT\(EPOCH FROM login_locked_until - NOW\(\)\)\)::bigint FROM users`).
+    WithArgs("user-1").
+    WillReturnRows(sqlmock.NewRows([]string{"secs"}))
+  mock.ExpectQuery(`FROM login_attempts a, last_ok`).
+    WillReturnRows(sqlmock.NewRows([]string{"failures", "since_last", "ip_failures"}).AddRow(0, nil, 0))
+  mock.ExpectQuery(`UPDATE users SET\s+login_failures = CASE`).
+    WithArgs("user-1", 900).
+    WillReturnRows(sqlmock.NewRows([]string{"login_failures"}).AddRow(11))
+
+  body, _ := json.Marshal(map[string]any{"email": "sari@example.com", "password": "benar"})
+  req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewReader(body))
+  rec := httptest.NewRecorder()
+
+  loginHandler(db).ServeHTTP(rec, req)
+
+  if rec.Code != http.StatusTooManyRequests {
+    t.Fatalf("expected 429, got %d: %s", rec.Code, rec.Body.String())
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestLoginUnknownIdentifierLocksLikeAccount(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectQuery(`SELECT id, password_hash, name, phone, tier, total_spend, wallet_balance, is_admin, role, email, username, avatar_url FROM users`).
+    WithArgs("nobody@example.com", "").
+    WillReturnError(sql.ErrNoRows)
+  mock.ExpectQuery(`FROM login_attempts a, last_ok`).
+    WithArgs("nobody@example.com", "192.0.2.1", 900).
+    WillReturnRows(sqlmock.NewRows([]string{"failures", "since_last", "ip_failures"}).AddRow(10, 600, 10))
+
+  body, _ := json.Marshal(map[string]any{"email": "nobody@example.com", "password": "salah"})
+  req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewReader(body))
+  req.RemoteAddr = "192.0.2.1:5555"
+  rec := httptest.NewRecorder()
+
+  loginHandler(db).ServeHTTP(rec, req)
+
+  if rec.Code != http.StatusTooManyRequests {
+    t.Fatalf("expected 429, got %d: %s", rec.Code, rec.Body.String())
+  }
+  var resp map[string]any
+  _ = json.Unmarshal(rec.Body.Bytes(), &resp)
+  if resp["error"] != loginLockedMsg {
+    t.Fatalf("expected the account lock message, got %v", resp["error"])
+  }
+  if got := rec.Header().Get("Retry-After"); got != "300" {
+    t.Fatalf("expected Retry-After 300, got %q", got)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
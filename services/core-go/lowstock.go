@@ -0,0 +1,170 @@
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "log"
+  "net/http"
+  "strings"
+  "time"
+)
+
+// queues an alert when a drop of `drop` units took the product's available stock
+// from above its reorder threshold to at or below it
+func queueLowStockAlertTx(tx *sql.Tx, productID string, drop int) error {
+  _, err := tx.Exec(`INSERT INTO low_stock_alerts (product_id, available, threshold)
+    SELECT p.id, a.available, p.reorder_threshold
+      FROM products p, LATERAL (SELECT p.stock - `+productHeldSQL+` AS available) a
+     WHERE p.id = $1 AND p.reorder_threshold > 0
+       AND a.available <= p.reorder_threshold AND a.available + $2 > p.reorder_threshold`, productID, drop)
+  return err
+}
+
+func adminLowStockHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+      return
+    }
+    if _, err := requireRoles(db, r, "owner", "admin", "staff"); err != nil {
+      writeRoleError(w, err)
+      return
+    }
+    rows, err := db.Query(`SELECT p.id, p.name, c.name, p.stock, a.available, p.reorder_threshold
+      FROM products p
+      LEFT JOIN categories c ON p.category_id = c.id,
+      LATERAL (SELECT p.stock - ` + productHeldSQL + ` AS available) a
+      WHERE p.reorder_threshold > 0 AND a.available <= p.reorder_threshold
+      ORDER BY a.available - p.reorder_threshold, p.name`)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    defer rows.Close()
+    out := []map[string]any{}
+    for rows.Next() {
+      var id, name string
+      var category sql.NullString
+      var onHand, available, threshold int
+      if err := rows.Scan(&id, &name, &category, &onHand, &available, &threshold); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      out = append(out, map[string]any{
+        "product_id":        id,
+        "name":              name,
+        "category":          category.String,
+        "stock":             available,
+        "on_hand":           onHand,
+        "reorder_threshold": threshold,
+      })
+    }
+    writeJSON(w, http.StatusOK, out)
+  }
+}
+
+func runLowStockNotifier(db *sql.DB, every time.Duration) {
+  ticker := time.NewTicker(every)
+  defer ticker.Stop()
+  for range ticker.C {
+    if err := sendLowStockAlerts(db); err != nil {
+      log.Printf("low stock notifier: %v", err)
+    }
+  }
+}
+
+// alerts stay queued until a channel actually delivered them: with no channel configured, or
+// no staff to send to, they are left unsent and go out once that is fixed
+func sendLowStockAlerts(db *sql.DB) error {
+  if !smtpEnabled() && !fonnteEnabled() {
+    return nil
+  }
+  rows, err := db.Query(`SELECT a.id, p.name, a.available, a.threshold
+    FROM low_stock_alerts a JOIN products p ON a.product_id = p.id
+    WHERE a.sent_at IS NULL AND a.attempts < 5
+    ORDER BY a.created_at LIMIT 50`)
+  if err != nil {
+    return err
+  }
+  type alert struct {
+    id        string
+    name      string
+    available int
+    threshold int
+  }
+  alerts := []alert{}
+  for rows.Next() {
+    var a alert
+    if err := rows.Scan(&a.id, &a.name, &a.available, &a.threshold); err != nil {
+      rows.Close()
+      return err
+    }
+    alerts = append(alerts, a)
+  }
+  rows.Close()
+  if len(alerts) == 0 {
+    return nil
+  }
+
+  emails, phones, err := lowStockRecipients(db)
+  if err != nil {
+    return err
+  }
+  for _, a := range alerts {
+    message := fmt.Sprintf("Stok menipis: %s tinggal %d (batas restock %d).", a.name, a.available, a.threshold)
+    failures := []string{}
+    delivered := 0
+    if smtpEnabled() {
+      for _, to := range emails {
+        if err := sendEmail(to, "Stok menipis: "+a.name, message+"\n"); err != nil {
+          failures = append(failures, to+": "+err.Error())
+          continue
+        }
+        delivered++
+      }
+    }
+    if fonnteEnabled() {
+      for _, to := range phones {
+        if err := sendWhatsApp(to, message); err != nil {
+          failures = append(failures, to+": "+err.Error())
+          continue
+        }
+        delivered++
+      }
+    }
+    if delivered == 0 && len(failures) == 0 {
+      // not an attempt: nobody was reachable on the configured channels
+      _, _ = db.Exec(`UPDATE low_stock_alerts SET last_error = $1 WHERE id = $2`, "no recipients on the configured channels", a.id)
+      continue
+    }
+    if delivered == 0 {
+      _, _ = db.Exec(`UPDATE low_stock_alerts SET attempts = attempts + 1, last_error = $1 WHERE id = $2`, strings.Join(failures, "; "), a.id)
+      continue
+    }
+    _, _ = db.Exec(`UPDATE low_stock_alerts SET sent_at = NOW(), attempts = attempts + 1, last_error = $1 WHERE id = $2`, nullIfEmpty(strings.Join(failures, "; ")), a.id)
+  }
+  return nil
+}
+
+func lowStockRecipients(db *sql.DB) ([]string, []string, error) {
+  rows, err := db.Query(`SELECT email, phone FROM users WHERE is_admin = TRUE AND role IN ('owner','admin','staff')`)
+  if err != nil {
+    return nil, nil, err
+  }
+  defer rows.Close()
+  emails := []string{}
+  phones := []string{}
+  for rows.Next() {
+    var email, phone sql.NullString
+    if err := rows.Scan(&email, &phone); err != nil {
+      return nil, nil, err
+    }
+    if strings.TrimSpace(email.String) != "" {
+      emails = append(emails, strings.TrimSpace(email.String))
+    }
+    if p := normalizePhone(phone.String); p != "" {
+      phones = append(phones, p)
+    }
+  }
+  return emails, phones, rows.Err()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+  "testing"
+
+  "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestQueueLowStockAlertOnlyOnCrossing(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectExec(`INSERT INTO low_stock_alerts \(product_id, available, threshold\).+a\.available <= p\.reorder_threshold AND a\.available \+ \$2 > p\.reorder_threshold`).
+    WithArgs("prod-1", 3).
+    WillReturnResult(sqlmock.NewResult(0, 1))
+
+  tx, _ := db.Begin()
+  if err := queueLowStockAlertTx(tx, "prod-1", 3); err != nil {
+    t.Fatalf("queue: %v", err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestLowStockAlertsWaitForAChannel(t *testing.T) {
+  t.Setenv("SMTP_HOST", "")
+  t.Setenv("FONNTE_API_KEY", "")
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  // nothing is read or stamped while no channel is configured
+  if err := sendLowStockAlerts(db); err != nil {
+    t.Fatalf("send: %v", err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestLowStockAlertsWithoutRecipientsStayQueued(t *testing.T) {
+  t.Setenv("SMTP_HOST", "")
+  t.Setenv("FONNTE_API_KEY", "test-key")
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectQuery(`SELECT a\.id, p\.name, a\.available, a\.threshold\s+FROM low_stock_alerts a`).
+    WillReturnRows(sqlmock.NewRows([]string{"id", "name", "available", "threshold"}).AddRow("alert-1", "Whiskas Adult 1.2kg", 2, 5))
+  mock.ExpectQuery(`SELECT email, phone FROM users WHERE is_admin = TRUE`).
+    WillReturnRows(sqlmock.NewRows([]string{"email", "phone"}).AddRow("owner@example.com", nil))
+  mock.ExpectExec(`UPDATE low_stock_alerts SET last_error = \$1 WHERE id = \$2`).
+    WithArgs("no recipients on the configured channels", "alert-1").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+
+  if err := sendLowStockAlerts(db); err != nil {
+    t.Fatalf("send: %v", err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "errors"
+  "log"
+  "net/http"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+
+  "github.com/lib/pq"
+)
+
+const (
+  tierReasonOrder        = "order"
+  tierReasonOrderReverse = "order_reversed"
+  tierReasonReevaluation = "reevaluation"
+  tierReasonTierDeleted  = "tier_deleted"
+)
+
+type loyaltyTier struct {
+  Name              string `json:"name"`
+  MinSpend          int    `json:"min_spend"`
+  DiscountPct       int    `json:"discount_pct"`
+  CashbackPct       int    `json:"cashback_pct"`
+  RewardVoucherCode string `json:"reward_voucher_code"`
+}
+
+type LoyaltyTierRequest struct {
+  Name              string `json:"name"`
+  MinSpend          int    `json:"min_spend"`
+  DiscountPct       int    `json:"discount_pct"`
+  CashbackPct       int    `json:"cashback_pct"`
+  RewardVoucherCode string `json:"reward_voucher_code"`
+}
+
+// 0 keeps the lifetime total_spend as the qualifying spend
+func loyaltyWindowMonths() int {
+  if v := strings.TrimSpace(os.Getenv("LOYALTY_WINDOW_MONTHS")); v != "" {
+    if n, err := strconv.Atoi(v); err == nil && n > 0 {
+      return n
+    }
+  }
+  return 0
+}
+
+func tierReevaluationInterval() time.Duration {
+  hours := 24
+  if v := strings.TrimSpace(os.Getenv("LOYALTY_REEVALUATE_HOURS")); v != "" {
+    if n, err := strconv.Atoi(v); err == nil && n > 0 {
+      hours = n
+    }
+  }
+  return time.Duration(hours) * time.Hour
+}
+
+func getTierInfoByName(db queryRower, name string) (TierInfo, error) {
+  var t TierInfo
+  err := db.QueryRow(`SELECT name, discount_pct, cashback_pct FROM loyalty_tiers WHERE name = $1`, name).
+    Scan(&t.Name, &t.DiscountPct, &t.CashbackPct)
+  return t, err
+}
+
+type rowsQueryer interface {
+  Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func loadLoyaltyTiers(db rowsQueryer) ([]loyaltyTier, error) {
+  rows, err := db.Query(`SELECT name, min_spend, discount_pct, cashback_pct, reward_voucher_code FROM loyalty_tiers ORDER BY min_spend`)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  out := []loyaltyTier{}
+  for rows.Next() {
+    var t loyaltyTier
+    var reward sql.NullString
+    if err := rows.Scan(&t.Name, &t.MinSpend, &t.DiscountPct, &t.CashbackPct, &reward); err != nil {
+      return nil, err
+    }
+    t.RewardVoucherCode = reward.String
+    out = append(out, t)
+  }
+  return out, rows.Err()
+}
+
+// tiers must be sorted by min_spend; returns -1 when no tier qualifies
+func tierIndexForSpend(tiers []loyaltyTier, spend int) int {
+  idx := -1
+  for i, t := range tiers {
+    if t.MinSpend <= spend {
+      idx = i
+    }
+  }
+  return idx
+}
+
+func tierIndexByName(tiers []loyaltyTier, name string) int {
+  for i, t := range tiers {
+    if strings.EqualFold(t.Name, name) {
+      return i
+    }
+  }
+  return -1
+}
+
+// spend that counts towards a tier: lifetime total_spend, or the gross total of
+// non-cancelled orders inside the rolling window when LOYALTY_WINDOW_MONTHS is set
+func qualifyingSpendTx(tx *sql.Tx, userID string, totalSpend int) (int, error) {
+  months := loyaltyWindowMonths()
+  if months == 0 {
+    return totalSpend, nil
+  }
+  var spend int
+  err := tx.QueryRow(`SELECT COALESCE(SUM(total + wallet_used), 0) FROM orders
+    WHERE user_id = $1 AND status NOT IN ('CANCELLED','FAILED') AND created_at >= NOW() - make_interval(months => $2)`,
+    userID, months).Scan(&spend)
+  return spend, err
+}
+
+// moves the member to the tier their qualifying spend earns and records the change.
+// Checkout only ever upgrades; downgrades come from reversed orders and the
+// re-evaluation job. An upgrade grants the new tier's reward voucher unless an unused
+// one is still assigned; a reversed order takes back unused rewards of the tiers lost.
+func reevaluateTierTx(tx *sql.Tx, userID string, reason string, allowDowngrade bool) (string, error) {
+  var totalSpend int
+  var current string
+  if err := tx.QueryRow(`SELECT total_spend, tier FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&totalSpend, &current); err != nil {
+    return "", err
+  }
+  tiers, err := loadLoyaltyTiers(tx)
+  if err != nil {
+    return current, err
+  }
+  spend, err := qualifyingSpendTx(tx, userID, totalSpend)
+  if err != nil {
+    return current, err
+  }
+  target := tierIndexForSpend(tiers, spend)
+  from := tierIndexByName(tiers, current)
+  if target < 0 || target == from {
+    return current, nil
+  }
+  // a current tier that no longer exists (it was just deleted) counts as a downgrade: the
+  // member is moved without a reward, even though -1 sorts below every tier
+  upgrade := from >= 0 && target > from
+  if from >= 0 && !upgrade && !allowDowngrade {
+    return current, nil
+  }
+  next := tiers[target].Name
+  if _, err := tx.Exec(`UPDATE users SET tier = $1 WHERE id = $2`, next, userID); err != nil {
+    return current, err
+  }
+  if _, err := tx.Exec(`INSERT INTO user_tier_history (user_id, from_tier, to_tier, qualifying_spend, reason) VALUES ($1,$2,$3,$4,$5)`,
+    userID, current, next, spend, reason); err != nil {
+    return current, err
+  }
+  if upgrade {
+    if code := tiers[target].RewardVoucherCode; code != "" {
+      _, err := tx.Exec(`INSERT INTO user_vouchers (user_id, code)
+        SELECT $1, $2 WHERE NOT EXISTS (SELECT 1 FROM user_vouchers WHERE user_id = $1 AND code = $2 AND used = FALSE)`, userID, code)
+      if err != nil {
+        return current, err
+      }
+    }
+    return next, nil
+  }
+  if reason == tierReasonOrderReverse && from > target {
+    lost := []string{}
+    for _, t := range tiers[target+1 : from+1] {
+      if t.RewardVoucherCode != "" {
+        lost = append(lost, t.RewardVoucherCode)
+      }
+    }
+    if len(lost) > 0 {
+      if _, err := tx.Exec(`DELETE FROM user_vouchers WHERE user_id = $1 AND used = FALSE AND code = ANY($2)`, userID, pq.Array(lost)); err != nil {
+        return current, err
+      }
+    }
+  }
+  return next, nil
+}
+
+func reevaluateTiersForUsers(db *sql.DB, userIDs []string, reason string) (int, error) {
+  changed := 0
+  for _, id := range userIDs {
+    tx, err := db.Begin()
+    if err != nil {
+      return changed, err
+    }
+    var before string
+    if err := tx.QueryRow(`SELECT tier FROM users WHERE id = $1`, id).Scan(&before); err != nil {
+      tx.Rollback()
+      if errors.Is(err, sql.ErrNoRows) {
+        continue
+      }
+      return changed, err
+    }
+    after, err := reevaluateTierTx(tx, id, reason, true)
+    if err != nil {
+      tx.Rollback()
+      return changed, err
+    }
+    if err := tx.Commit(); err != nil {
+      return changed, err
+    }
+    if after != before {
+      changed++
+    }
+  }
+  return changed, nil
+}
+
+func reevaluateAllTiers(db *sql.DB) (int, int, error) {
+  rows, err := db.Query(`SELECT id FROM users ORDER BY created_at`)
+  if err != nil {
+    return 0, 0, err
+  }
+  ids := []string{}
+  for rows.Next() {
+    var id string
+    if err := rows.Scan(&id); err != nil {
+      rows.Close()
+      return 0, 0, err
+    }
+    ids = append(ids, id)
+  }
+  rows.Close()
+  if err := rows.Err(); err != nil {
+    return 0, 0, err
+  }
+  changed, err := reevaluateTiersForUsers(db, ids, tierReasonReevaluation)
+  return len(ids), changed, err
+}
+
+func runTierReevaluator(db *sql.DB, every time.Duration) {
+  ticker := time.NewTicker(every)
+  defer ticker.Stop()
+  for range ticker.C {
+    checked, changed, err := reevaluateAllTiers(db)
+    if err != nil {
+      log.Printf("tier reevaluator: %v", err)
+      continue
+    }
+    if changed > 0 {
+      log.Printf("tier reevaluator: %d of %d members changed tier", changed, checked)
+    }
+  }
+}
+
+func validateLoyaltyTierRequest(req *LoyaltyTierRequest) error {
+  req.Name = strings.TrimSpace(req.Name)
+  req.RewardVoucherCode = strings.ToUpper(strings.TrimSpace(req.RewardVoucherCode))
+  if req.Name == "" {
+    return errInvalid("name required")
+  }
+  if req.MinSpend < 0 {
+    return errInvalid("min_spend must not be negative")
+  }
+  if req.DiscountPct < 0 || req.DiscountPct > 100 || req.CashbackPct < 0 || req.CashbackPct > 100 {
+    return errInvalid("discount_pct and cashback_pct must be between 0 and 100")
+  }
+  return nil
+}
+
+// checks the rules that span rows once the change has been applied inside tx
+func checkLoyaltyTiersTx(tx *sql.Tx, req LoyaltyTierRequest) error {
+  if req.RewardVoucherCode != "" {
+    var exists bool
+    if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM vouchers WHERE code = $1)`, req.RewardVoucherCode).Scan(&exists); err != nil {
+      return err
+    }
+    if !exists {
+      return errInvalid("reward voucher not found")
+    }
+  }
+  var base bool
+  if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM loyalty_tiers WHERE min_spend = 0)`).Scan(&base); err != nil {
+    return err
+  }
+  if !base {
+    return errInvalid("a tier with min_spend 0 is required")
+  }
+  return nil
+}
+
+func isUniqueViolation(err error) bool {
+  var pqErr *pq.Error
+  return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func adminLoyaltyTiersHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+      if _, err := requireRoles(db, r, "owner", "admin", "staff"); err != nil {
+        writeRoleError(w, err)
+        return
+      }
+      tiers, err := loadLoyaltyTiers(db)
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      counts := map[string]int{}
+      rows, err := db.Query(`SELECT tier, COUNT(*) FROM users GROUP BY tier`)
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      defer rows.Close()
+      for rows.Next() {
+        var tier string
+        var n int
+        if err := rows.Scan(&tier, &n); err != nil {
+          writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+          return
+        }
+        counts[tier] = n
+      }
+      out := []map[string]any{}
+      for _, t := range tiers {
+        out = append(out, map[string]any{
+          "name": t.Name,
+          "min_spend": t.MinSpend,
+          "discount_pct": t.DiscountPct,
+          "cashback_pct": t.CashbackPct,
+          "reward_voucher_code": t.RewardVoucherCode,
+          "members": counts[t.Name],
+        })
+      }
+      writeJSON(w, http.StatusOK, map[string]any{"window_months": loyaltyWindowMonths(), "tiers": out})
+    case http.MethodPost:
+      if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
+        writeRoleError(w, err)
+        return
+      }
+      var req LoyaltyTierRequest
+      if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
+        return
+      }
+      if err := validateLoyaltyTierRequest(&req); err != nil {
+        writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+        return
+      }
+      tx, err := db.Begin()
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg("db error"))
+        return
+      }
+      defer tx.Rollback()
+      _, err = tx.Exec(`INSERT INTO loyalty_tiers (name, min_spend, discount_pct, cashback_pct, reward_voucher_code) VALUES ($1,$2,$3,$4,$5)`,
+        req.Name, req.MinSpend, req.DiscountPct, req.CashbackPct, nullIfEmpty(req.RewardVoucherCode))
+      if err != nil {
+        if isUniqueViolation(err) {
+          writeJSON(w, http.StatusConflict, errMsg("tier name or min_spend already exists"))
+          return
+        }
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      if err := checkLoyaltyTiersTx(tx, req); err != nil {
+        if isInvalid(err) {
+          writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+          return
+        }
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      if err := tx.Commit(); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg("db commit failed"))
+        return
+      }
+      writeJSON(w, http.StatusCreated, map[string]string{"name": req.Name})
+    default:
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+    }
+  }
+}
+
+func adminLoyaltyTierItemHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
+      writeRoleError(w, err)
+      return
+    }
+    name := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, "/admin/loyalty/tiers/"))
+    if name == "" {
+      writeJSON(w, http.StatusBadRequest, errMsg("missing tier"))
+      return
+    }
+    switch r.Method {
+    case http.MethodPut:
+      var req LoyaltyTierRequest
+      if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
+        return
+      }
+      req.Name = name
+      if err := validateLoyaltyTierRequest(&req); err != nil {
+        writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+        return
+      }
+      tx, err := db.Begin()
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg("db error"))
+        return
+      }
+      defer tx.Rollback()
+      res, err := tx.Exec(`UPDATE loyalty_tiers SET min_spend = $1, discount_pct = $2, cashback_pct = $3, reward_voucher_code = $4 WHERE name = $5`,
+        req.MinSpend, req.DiscountPct, req.CashbackPct, nullIfEmpty(req.RewardVoucherCode), name)
+      if err != nil {
+        if isUniqueViolation(err) {
+          writeJSON(w, http.StatusConflict, errMsg("another tier already uses this min_spend"))
+          return
+        }
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      if n, _ := res.RowsAffected(); n == 0 {
+        writeJSON(w, http.StatusNotFound, errMsg("tier not found"))
+        return
+      }
+      if err := checkLoyaltyTiersTx(tx, req); err != nil {
+        if isInvalid(err) {
+          writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+          return
+        }
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      if err := tx.Commit(); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg("db commit failed"))
+        return
+      }
+      writeJSON(w, http.StatusOK, map[string]string{"status": "updated"})
+    case http.MethodDelete:
+      tx, err := db.Begin()
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg("db error"))
+        return
+      }
+      defer tx.Rollback()
+      res, err := tx.Exec(`DELETE FROM loyalty_tiers WHERE name = $1`, name)
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      if n, _ := res.RowsAffected(); n == 0 {
+        writeJSON(w, http.StatusNotFound, errMsg("tier not found"))
+        return
+      }
+      if err := checkLoyaltyTiersTx(tx, LoyaltyTierRequest{}); err != nil {
+        if isInvalid(err) {
+          writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+          return
+        }
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      rows, err := tx.Query(`SELECT id FROM users WHERE tier = $1`, name)
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      members := []string{}
+      for rows.Next() {
+        var id string
+        if err := rows.Scan(&id); err != nil {
+          rows.Close()
+          writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+          return
+        }
+        members = append(members, id)
+      }
+      rows.Close()
+      for _, id := range members {
+        if _, err := reevaluateTierTx(tx, id, tierReasonTierDeleted, true); err != nil {
+          writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+          return
+        }
+      }
+      if err := tx.Commit(); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg("db commit failed"))
+        return
+      }
+      writeJSON(w, http.StatusOK, map[string]any{"status": "deleted", "members_moved": len(members)})
+    default:
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+    }
+  }
+}
+
+func adminLoyaltyReevaluateHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+      return
+    }
+    if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
+      writeRoleError(w, err)
+      return
+    }
+    checked, changed, err := reevaluateAllTiers(db)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    writeJSON(w, http.StatusOK, map[string]int{"checked": checked, "changed": changed})
+  }
+}
+
+func loadTierHistory(db *sql.DB, userID string) ([]map[string]any, error) {
+  rows, err := db.Query(`SELECT from_tier, to_tier, qualifying_spend, reason, created_at FROM user_tier_history
+    WHERE user_id = $1 ORDER BY created_at DESC, id`, userID)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  out := []map[string]any{}
+  for rows.Next() {
+    var from, to, reason, createdAt string
+    var spend int
+    if err := rows.Scan(&from, &to, &spend, &reason, &createdAt); err != nil {
+      return nil, err
+    }
+    out = append(out, map[string]any{
+      "from_tier": from,
+      "to_tier": to,
+      "qualifying_spend": spend,
+      "reason": reason,
+      "created_at": createdAt,
+    })
+  }
+  return out, rows.Err()
+}
+
+func adminMemberTierHistoryHandler(db *sql.DB, userID string, w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet {
+    writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+    return
+  }
+  history, err := loadTierHistory(db, userID)
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  writeJSON(w, http.StatusOK, history)
+}
+
+func meTierHistoryHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+      return
+    }
+    userID, err := getUserIDFromToken(db, r)
+    if err != nil {
+      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+      return
+    }
+    history, err := loadTierHistory(db, userID)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    writeJSON(w, http.StatusOK, history)
+  }
+}
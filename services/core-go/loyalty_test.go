@@ -0,0 +1,139 @@
+package main
+
+import (
+  "testing"
+
+  "github.com/DATA-DOG/go-sqlmock"
+)
+
+func tierRows() *sqlmock.Rows {
+  return sqlmock.NewRows([]string{"name", "min_spend", "discount_pct", "cashback_pct", "reward_voucher_code"}).
+    AddRow("Bronze", 0, 0, 0, nil).
+    AddRow("Silver", 1000000, 2, 1, "SILVER100").
+    AddRow("Gold", 3000000, 4, 2, "GOLD200").
+    AddRow("Platinum", 6000000, 7, 3, "PLAT300")
+}
+
+func TestReevaluateTierUpgradeGrantsReward(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT total_spend, tier FROM users WHERE id = \$1 FOR UPDATE`).
+    WithArgs("user-1").
+    WillReturnRows(sqlmock.NewRows([]string{"total_spend", "tier"}).AddRow(3200000, "Silver"))
+  mock.ExpectQuery(`SELECT name, min_spend, discount_pct, cashback_pct, reward_voucher_code FROM loyalty_tiers`).
+    WillReturnRows(tierRows())
+  mock.ExpectExec(`UPDATE users SET tier = \$1 WHERE id = \$2`).
+    WithArgs("Gold", "user-1").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectExec(`INSERT INTO user_tier_history`).
+    WithArgs("user-1", "Silver", "Gold", 3200000, tierReasonOrder).
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectExec(`INSERT INTO user_vouchers`).
+    WithArgs("user-1", "GOLD200").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+
+  tx, _ := db.Begin()
+  tier, err := reevaluateTierTx(tx, "user-1", tierReasonOrder, false)
+  if err != nil || tier != "Gold" {
+    t.Fatalf("expected Gold, got %q (%v)", tier, err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("unmet expectations: %v", err)
+  }
+}
+
+func TestReevaluateTierCheckoutNeverDowngrades(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT total_spend, tier FROM users WHERE id = \$1 FOR UPDATE`).
+    WithArgs("user-1").
+    WillReturnRows(sqlmock.NewRows([]string{"total_spend", "tier"}).AddRow(1200000, "Gold"))
+  mock.ExpectQuery(`SELECT name, min_spend, discount_pct, cashback_pct, reward_voucher_code FROM loyalty_tiers`).
+    WillReturnRows(tierRows())
+
+  tx, _ := db.Begin()
+  tier, err := reevaluateTierTx(tx, "user-1", tierReasonOrder, false)
+  if err != nil || tier != "Gold" {
+    t.Fatalf("expected Gold kept, got %q (%v)", tier, err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("unmet expectations: %v", err)
+  }
+}
+
+func TestReevaluateTierReversalRevokesLostRewards(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT total_spend, tier FROM users WHERE id = \$1 FOR UPDATE`).
+    WithArgs("user-1").
+    WillReturnRows(sqlmock.NewRows([]string{"total_spend", "tier"}).AddRow(500000, "Gold"))
+  mock.ExpectQuery(`SELECT name, min_spend, discount_pct, cashback_pct, reward_voucher_code FROM loyalty_tiers`).
+    WillReturnRows(tierRows())
+  mock.ExpectExec(`UPDATE users SET tier = \$1 WHERE id = \$2`).
+    WithArgs("Bronze", "user-1").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectExec(`INSERT INTO user_tier_history`).
+    WithArgs("user-1", "Gold", "Bronze", 500000, tierReasonOrderReverse).
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectExec(`DELETE FROM user_vouchers WHERE user_id = \$1 AND used = FALSE AND code = ANY\(\$2\)`).
+    WithArgs("user-1", `{"SILVER100","GOLD200"}`).
+    WillReturnResult(sqlmock.NewResult(0, 1))
+
+  tx, _ := db.Begin()
+  tier, err := reevaluateTierTx(tx, "user-1", tierReasonOrderReverse, true)
+  if err != nil || tier != "Bronze" {
+    t.Fatalf("expected Bronze, got %q (%v)", tier, err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("unmet expectations: %v", err)
+  }
+}
+
+// Gold was just deleted; its members land on Silver without Silver's reward voucher
+func TestReevaluateTierAfterDeleteGrantsNoReward(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT total_spend, tier FROM users WHERE id = \$1 FOR UPDATE`).
+    WithArgs("user-1").
+    WillReturnRows(sqlmock.NewRows([]string{"total_spend", "tier"}).AddRow(3200000, "Gold"))
+  mock.ExpectQuery(`SELECT name, min_spend, discount_pct, cashback_pct, reward_voucher_code FROM loyalty_tiers`).
+    WillReturnRows(sqlmock.NewRows([]string{"name", "min_spend", "discount_pct", "cashback_pct", "reward_voucher_code"}).
+      AddRow("Bronze", 0, 0, 0, nil).
+      AddRow("Silver", 1000000, 2, 1, "SILVER100").
+      AddRow("Platinum", 6000000, 7, 3, "PLAT300"))
+  mock.ExpectExec(`UPDATE users SET tier = \$1 WHERE id = \$2`).
+    WithArgs("Silver", "user-1").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectExec(`INSERT INTO user_tier_history`).
+    WithArgs("user-1", "Gold", "Silver", 3200000, tierReasonTierDeleted).
+    WillReturnResult(sqlmock.NewResult(0, 1))
+
+  tx, _ := db.Begin()
+  tier, err := reevaluateTierTx(tx, "user-1", tierReasonTierDeleted, true)
+  if err != nil || tier != "Silver" {
+    t.Fatalf("expected Silver, got %q (%v)", tier, err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("unmet expectations: %v", err)
+  }
+}
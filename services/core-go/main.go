@@ -5,6 +5,7 @@ import (
   "log"
   "net/http"
   "os"
+  "time"
 
   _ "github.com/lib/pq"
 )
@@ -13,6 +14,19 @@ func main() {
   db := mustDB()
   defer db.Close()
 
+  if len(os.Args) > 1 && os.Args[1] == "check-wallets" {
+    code := runWalletCheck(db)
+    db.Close()
+    os.Exit(code)
+  }
+
+  // owner and admin logins need the key, so the server does not start without one
+  if n, err := sealPlainTotpSecrets(db); err != nil {
+    log.Fatalf("totp secrets: %v", err)
+  } else if n > 0 {
+    log.Printf("totp secrets: sealed %d stored in plain text", n)
+  }
+
   mux := http.NewServeMux()
   _ = os.MkdirAll("uploads", 0755)
   mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -21,11 +35,14 @@ func main() {
 
   mux.HandleFunc("/products", productsHandler(db))
   mux.HandleFunc("/products/", productHandler(db))
+  mux.HandleFunc("/categories", categoriesHandler(db))
   mux.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir("uploads"))))
   mux.HandleFunc("/uploads/avatar", avatarUploadHandler())
   mux.HandleFunc("/cart/items", cartItemHandler(db))
   mux.HandleFunc("/cart", cartHandler(db))
+  mux.HandleFunc("/cart/preview", cartPreviewHandler(db))
   mux.HandleFunc("/orders", orderHandler(db))
+  mux.HandleFunc("/orders/", orderDetailHandler(db))
   mux.HandleFunc("/events", eventsHandler(db))
   mux.HandleFunc("/delivery/zones", deliveryZonesHandler(db))
   mux.HandleFunc("/delivery/quote", deliveryQuoteHandler(db))
@@ -37,6 +54,7 @@ func main() {
   mux.HandleFunc("/auth/logout", logoutHandler(db))
   mux.HandleFunc("/auth/otp/request", otpRequestHandler(db))
   mux.HandleFunc("/auth/otp/verify", otpVerifyHandler(db))
+  mux.HandleFunc("/auth/password/reset", passwordResetHandler(db))
   mux.HandleFunc("/auth/google/login", googleLoginHandler(db))
   mux.HandleFunc("/admin/login", adminLoginHandler(db))
   mux.HandleFunc("/admin/bootstrap", adminBootstrapHandler(db))
@@ -50,23 +68,49 @@ func main() {
   mux.HandleFunc("/me/password", passwordChangeHandler(db))
   mux.HandleFunc("/me/vouchers", meVouchersHandler(db))
   mux.HandleFunc("/me/orders", meOrdersHandler(db))
+  mux.HandleFunc("/me/tier-history", meTierHistoryHandler(db))
+  mux.HandleFunc("/me/wallet", meWalletHandler(db))
+  mux.HandleFunc("/me/sessions", meSessionsHandler(db))
+  mux.HandleFunc("/me/sessions/", meSessionItemHandler(db))
+  mux.HandleFunc("/me/2fa", meTotpHandler(db))
+  mux.HandleFunc("/me/2fa/", meTotpHandler(db))
+  mux.HandleFunc("/me/addresses", meAddressesHandler(db))
+  mux.HandleFunc("/me/addresses/", meAddressItemHandler(db))
   mux.HandleFunc("/me/appointments", meAppointmentsHandler(db))
   mux.HandleFunc("/me/service-bookings", meServiceBookingsHandler(db))
   mux.HandleFunc("/vouchers", vouchersHandler(db))
   mux.HandleFunc("/admin/members", membersHandler(db))
+  mux.HandleFunc("/admin/members/", adminMemberItemHandler(db))
+  mux.HandleFunc("/admin/loyalty/tiers", adminLoyaltyTiersHandler(db))
+  mux.HandleFunc("/admin/loyalty/tiers/", adminLoyaltyTierItemHandler(db))
+  mux.HandleFunc("/admin/loyalty/reevaluate", adminLoyaltyReevaluateHandler(db))
   mux.HandleFunc("/admin/vouchers", adminVouchersHandler(db))
   mux.HandleFunc("/admin/vouchers/", adminVoucherItemHandler(db))
   mux.HandleFunc("/admin/orders", adminOrdersHandler(db))
-  mux.HandleFunc("/admin/orders/", adminOrderStatusHandler(db))
+  mux.HandleFunc("/admin/orders/", adminOrderItemHandler(db))
   mux.HandleFunc("/admin/expenses", adminExpensesHandler(db))
   mux.HandleFunc("/admin/expenses/", adminExpenseItemHandler(db))
   mux.HandleFunc("/admin/reports/sales", adminSalesReportHandler(db))
   mux.HandleFunc("/admin/reports/finance", adminFinanceSummaryHandler(db))
   mux.HandleFunc("/admin/products/", adminProductsHandler(db))
+  mux.HandleFunc("/admin/categories", adminCategoriesHandler(db))
+  mux.HandleFunc("/admin/categories/", adminCategoryItemHandler(db))
+  mux.HandleFunc("/admin/inventory/adjustments", adminInventoryAdjustmentsHandler(db))
+  mux.HandleFunc("/admin/inventory/products/", adminInventoryProductHandler(db))
+  mux.HandleFunc("/admin/inventory/reconcile", adminInventoryReconcileHandler(db))
+  mux.HandleFunc("/admin/inventory/low-stock", adminLowStockHandler(db))
+  mux.HandleFunc("/admin/wallet/reconcile", adminWalletReconcileHandler(db))
+  mux.HandleFunc("/admin/security/login-attempts", adminLoginAttemptsHandler(db))
   mux.HandleFunc("/webhooks/midtrans", midtransWebhookHandler(db))
   mux.HandleFunc("/payments/midtrans/snap", midtransSnapProxyHandler())
   mux.HandleFunc("/payments/midtrans/status/", midtransStatusProxyHandler())
 
+  go runStockReservationReaper(db, time.Minute)
+  go runLowStockNotifier(db, time.Minute)
+  go runCartPurger(db, time.Hour)
+  go runSessionJanitor(db, time.Hour)
+  go runTierReevaluator(db, tierReevaluationInterval())
+
   handler := withCORS(mux)
 
   port := getenv("CORE_PORT", "8081")
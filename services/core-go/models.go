@@ -6,22 +6,45 @@ type Product struct {
   Description string `json:"description"`
   Price       int    `json:"price"`
   Stock       int    `json:"stock"`
+  OnHand      int    `json:"on_hand"`
   ImageURL    string `json:"image_url"`
   Category    string `json:"category"`
+  Variants    []ProductVariant `json:"variants,omitempty"`
+}
+
+type ProductVariant struct {
+  ID        string            `json:"id"`
+  ProductID string            `json:"product_id"`
+  SKU       string            `json:"sku"`
+  Options   map[string]string `json:"options"`
+  Price     int               `json:"price"`
+  Stock     int               `json:"stock"`
+  OnHand    int               `json:"on_hand"`
+  ImageURL  string            `json:"image_url"`
+}
+
+type ProductVariantRequest struct {
+  SKU      string            `json:"sku"`
+  Options  map[string]string `json:"options"`
+  Price    int               `json:"price"`
+  Stock    int               `json:"stock"`
+  ImageURL string            `json:"image_url"`
 }
 
 type ProductCreateRequest struct {
-  Name        string `json:"name"`
-  Description string `json:"description"`
-  Price       int    `json:"price"`
-  Stock       int    `json:"stock"`
-  ImageURL    string `json:"image_url"`
-  Category    string `json:"category"`
+  Name             string `json:"name"`
+  Description      string `json:"description"`
+  Price            int    `json:"price"`
+  Stock            int    `json:"stock"`
+  ImageURL         string `json:"image_url"`
+  Category         string `json:"category"`
+  ReorderThreshold *int   `json:"reorder_threshold"`
 }
 
 type CartItemRequest struct {
   CartID    string `json:"cart_id"`
   ProductID string `json:"product_id"`
+  VariantID string `json:"variant_id"`
   Qty       int    `json:"qty"`
 }
 
@@ -35,14 +58,30 @@ type CartItem struct {
   Qty         int    `json:"qty"`
   ProductID   string `json:"product_id"`
   ProductName string `json:"product_name"`
+  VariantID   string `json:"variant_id"`
+  VariantSKU  string `json:"variant_sku"`
+  Options     map[string]string `json:"options,omitempty"`
   Price       int    `json:"price"`
 }
 
+type OrderItem struct {
+  ID          string            `json:"id"`
+  ProductID   string            `json:"product_id"`
+  VariantID   string            `json:"variant_id"`
+  ProductName string            `json:"product_name"`
+  VariantSKU  string            `json:"variant_sku"`
+  Options     map[string]string `json:"options,omitempty"`
+  UnitPrice   int               `json:"unit_price"`
+  Qty         int               `json:"qty"`
+  LineTotal   int               `json:"line_total"`
+}
+
 type OrderRequest struct {
   CartID       string `json:"cart_id"`
   CustomerName string `json:"customer_name"`
   Phone        string `json:"phone"`
   Address      string `json:"address"`
+  AddressID    string `json:"address_id"`
   ShippingFee  int    `json:"shipping_fee"`
   DeliveryType string `json:"delivery_type"`
   ZoneID       string `json:"zone_id"`
@@ -65,8 +104,26 @@ type AuthRegisterRequest struct {
 }
 
 type AuthLoginRequest struct {
-  Email    string `json:"email"`
-  Password string `json:"password"`
+  Email        string `json:"email"`
+  Password     string `json:"password"`
+  CartID       string `json:"cart_id"`
+  CartToken    string `json:"cart_token"`
+  TotpCode     string `json:"totp_code"`
+  RecoveryCode string `json:"recovery_code"`
+}
+
+type TotpCodeRequest struct {
+  Code         string `json:"code"`
+  RecoveryCode string `json:"recovery_code"`
+  Password     string `json:"password"`
+}
+
+type PasswordResetRequest struct {
+  Email       string `json:"email"`
+  Phone       string `json:"phone"`
+  Channel     string `json:"channel"`
+  OtpToken    string `json:"otp_token"`
+  NewPassword string `json:"new_password"`
 }
 
 type OtpRequest struct {
@@ -85,8 +142,10 @@ type OtpVerifyRequest struct {
 }
 
 type GoogleLoginRequest struct {
-  IDToken  string `json:"id_token"`
-  Phone    string `json:"phone"`
+  IDToken      string `json:"id_token"`
+  Phone        string `json:"phone"`
+  TotpCode     string `json:"totp_code"`
+  RecoveryCode string `json:"recovery_code"`
 }
 
 type ProfileUpdateRequest struct {
@@ -121,6 +180,7 @@ type AdminUserUpdateRequest struct {
 
 type OrderStatusRequest struct {
   Status string `json:"status"`
+  Note   string `json:"note"`
 }
 
 type DeliveryQuoteRequest struct {
@@ -145,14 +205,23 @@ type DeliverySettingsRequest struct {
 }
 
 type VoucherCreateRequest struct {
-  Code          string `json:"code"`
-  Title         string `json:"title"`
-  DiscountType  string `json:"discount_type"`
-  DiscountValue int    `json:"discount_value"`
-  MinSpend      int    `json:"min_spend"`
-  MaxUses       int    `json:"max_uses"`
-  ExpiresAt     string `json:"expires_at"`
-  Active        bool   `json:"active"`
+  Code           string   `json:"code"`
+  Title          string   `json:"title"`
+  DiscountType   string   `json:"discount_type"`
+  DiscountValue  int      `json:"discount_value"`
+  MinSpend       int      `json:"min_spend"`
+  MaxDiscount    int      `json:"max_discount"`
+  MaxUses        int      `json:"max_uses"`
+  PerUserLimit   int      `json:"per_user_limit"`
+  ProductIDs     []string `json:"product_ids"`
+  CategoryIDs    []string `json:"category_ids"`
+  Tiers          []string `json:"tiers"`
+  FirstOrderOnly bool     `json:"first_order_only"`
+  Stacking       string   `json:"stacking"`
+  BatchOnly      bool     `json:"batch_only"`
+  StartsAt       string   `json:"starts_at"`
+  ExpiresAt      string   `json:"expires_at"`
+  Active         bool     `json:"active"`
 }
 
 type ExpenseRequest struct {
@@ -5,6 +5,7 @@ import (
   "encoding/json"
   "net/http"
   "net/http/httptest"
+  "strings"
   "testing"
 
   "github.com/DATA-DOG/go-sqlmock"
@@ -18,9 +19,16 @@ func TestOrderHandlerRequiresDelivery(t *testing.T) {
   defer db.Close()
 
   mock.ExpectBegin()
-  mock.ExpectQuery(`SELECT COALESCE\(SUM\(p\.price \* ci\.qty\), 0\) FROM cart_items`).
+  mock.ExpectQuery(`SELECT user_id, secret FROM carts`).
     WithArgs("cart-1").
-    WillReturnRows(sqlmock.NewRows([]string{"subtotal"}).AddRow(10000))
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "secret"}).AddRow(nil, "cart-secret"))
+  mock.ExpectExec(`SELECT p\.id FROM cart_items ci JOIN products p .+ FOR UPDATE OF p`).
+    WithArgs("cart-1").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectQuery(`SELECT p\.id, v\.id, COALESCE\(v\.stock - .+, p\.stock - .+\), ci\.qty, p\.name, COALESCE\(v\.price, p\.price\)`).
+    WithArgs("cart-1").
+    WillReturnRows(sqlmock.NewRows([]string{"id", "variant_id", "stock", "qty", "name", "price", "sku", "options", "price_at_add", "category_id"}).
+      AddRow("prod-1", nil, 5, 1, "Whiskas Adult 1.2kg", 10000, nil, nil, 10000, nil))
   mock.ExpectRollback()
 
   body, _ := json.Marshal(map[string]any{
@@ -32,6 +40,7 @@ func TestOrderHandlerRequiresDelivery(t *testing.T) {
     "wallet_use": 0,
   })
   req := httptest.NewRequest(http.MethodPost, "/orders", bytes.NewReader(body))
+  req.Header.Set("X-Cart-Token", "cart-secret")
   rec := httptest.NewRecorder()
 
   orderHandler(db).ServeHTTP(rec, req)
@@ -52,25 +61,37 @@ func TestOrderHandlerClearsCartItems(t *testing.T) {
   defer db.Close()
 
   mock.ExpectBegin()
-  mock.ExpectQuery(`SELECT COALESCE\(SUM\(p\.price \* ci\.qty\), 0\) FROM cart_items`).
+  mock.ExpectQuery(`SELECT user_id, secret FROM carts`).
+    WithArgs("cart-2").
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "secret"}).AddRow(nil, "cart-secret"))
+  mock.ExpectExec(`SELECT p\.id FROM cart_items ci JOIN products p .+ FOR UPDATE OF p`).
+    WithArgs("cart-2").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectQuery(`SELECT p\.id, v\.id, COALESCE\(v\.stock - .+, p\.stock - .+\), ci\.qty, p\.name, COALESCE\(v\.price, p\.price\)`).
     WithArgs("cart-2").
-    WillReturnRows(sqlmock.NewRows([]string{"subtotal"}).AddRow(20000))
+    WillReturnRows(sqlmock.NewRows([]string{"id", "variant_id", "stock", "qty", "name", "price", "sku", "options", "price_at_add", "category_id"}).
+      AddRow("prod-1", nil, 10, 2, "Whiskas Adult 1.2kg", 10000, nil, nil, 10000, nil))
   mock.ExpectQuery(`SELECT flat_fee FROM delivery_zones`).
     WithArgs("zone-1").
     WillReturnRows(sqlmock.NewRows([]string{"flat_fee"}).AddRow(5000))
   mock.ExpectQuery(`INSERT INTO orders`).
     WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("order-1"))
-  mock.ExpectQuery(`SELECT p\.id, p\.stock, ci\.qty FROM cart_items`).
-    WithArgs("cart-2").
-    WillReturnRows(sqlmock.NewRows([]string{"id", "stock", "qty"}).AddRow("prod-1", 10, 2))
-  mock.ExpectExec(`UPDATE products SET stock = stock -`).
-    WithArgs(2, "prod-1").
+  mock.ExpectExec(`INSERT INTO order_status_history`).
+    WithArgs("order-1", nil, "PENDING", "customer", nil, nil).
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectExec(`INSERT INTO stock_reservations`).
+    WithArgs("order-1", "prod-1", nil, 2, sqlmock.AnyArg()).
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectExec(`INSERT INTO low_stock_alerts`).
+    WithArgs("prod-1", 2).
+    WillReturnResult(sqlmock.NewResult(0, 0))
+  mock.ExpectExec(`INSERT INTO order_items`).
+    WithArgs("order-1", "prod-1", nil, "Whiskas Adult 1.2kg", nil, nil, 10000, 2).
     WillReturnResult(sqlmock.NewResult(1, 1))
   mock.ExpectExec(`DELETE FROM cart_items WHERE cart_id =`).
     WithArgs("cart-2").
     WillReturnResult(sqlmock.NewResult(1, 1))
   mock.ExpectCommit()
-  mock.ExpectRollback()
 
   body, _ := json.Marshal(map[string]any{
     "cart_id": "cart-2",
@@ -83,6 +104,7 @@ func TestOrderHandlerClearsCartItems(t *testing.T) {
     "wallet_use": 0,
   })
   req := httptest.NewRequest(http.MethodPost, "/orders", bytes.NewReader(body))
+  req.Header.Set("X-Cart-Token", "cart-secret")
   rec := httptest.NewRecorder()
 
   orderHandler(db).ServeHTTP(rec, req)
@@ -94,3 +116,470 @@ func TestOrderHandlerClearsCartItems(t *testing.T) {
     t.Fatalf("mock expectations: %v", err)
   }
 }
+
+// two carts race for the last three units of a product: the second checkout takes the product
+// lock after the first committed its hold, and its availability read must count that hold
+func TestSequentialCheckoutsSeeEarlierHolds(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  linesQuery := `SELECT p\.id, v\.id, COALESCE\(v\.stock - .+, p\.stock - .+\), ci\.qty, p\.name, COALESCE\(v\.price, p\.price\)`
+  lineCols := []string{"id", "variant_id", "stock", "qty", "name", "price", "sku", "options", "price_at_add", "category_id"}
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT user_id, secret FROM carts`).
+    WithArgs("cart-a").
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "secret"}).AddRow(nil, "secret-a"))
+  mock.ExpectExec(`FOR UPDATE OF p`).
+    WithArgs("cart-a").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectQuery(linesQuery).
+    WithArgs("cart-a").
+    WillReturnRows(sqlmock.NewRows(lineCols).AddRow("prod-1", nil, 3, 2, "Whiskas Adult 1.2kg", 10000, nil, nil, 10000, nil))
+  mock.ExpectQuery(`SELECT flat_fee FROM delivery_zones`).
+    WithArgs("zone-1").
+    WillReturnRows(sqlmock.NewRows([]string{"flat_fee"}).AddRow(5000))
+  mock.ExpectQuery(`INSERT INTO orders`).
+    WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("order-a"))
+  mock.ExpectExec(`INSERT INTO order_status_history`).
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectExec(`INSERT INTO stock_reservations`).
+    WithArgs("order-a", "prod-1", nil, 2, sqlmock.AnyArg()).
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectExec(`INSERT INTO low_stock_alerts`).
+    WillReturnResult(sqlmock.NewResult(0, 0))
+  mock.ExpectExec(`INSERT INTO order_items`).
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectExec(`DELETE FROM cart_items WHERE cart_id =`).
+    WithArgs("cart-a").
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectCommit()
+
+  // stock is still 3 but 2 of it is now held by order-a
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT user_id, secret FROM carts`).
+    WithArgs("cart-b").
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "secret"}).AddRow(nil, "secret-b"))
+  mock.ExpectExec(`FOR UPDATE OF p`).
+    WithArgs("cart-b").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectQuery(linesQuery).
+    WithArgs("cart-b").
+    WillReturnRows(sqlmock.NewRows(lineCols).AddRow("prod-1", nil, 1, 2, "Whiskas Adult 1.2kg", 10000, nil, nil, 10000, nil))
+  mock.ExpectRollback()
+
+  checkout := func(cartID string, secret string) *httptest.ResponseRecorder {
+    body, _ := json.Marshal(map[string]any{
+      "cart_id": cartID,
+      "customer_name": "Rina",
+      "phone": "081234",
+      "address": "Jl. Mawar",
+      "delivery_type": "zone",
+      "zone_id": "zone-1",
+    })
+    req := httptest.NewRequest(http.MethodPost, "/orders", bytes.NewReader(body))
+    req.Header.Set("X-Cart-Token", secret)
+    rec := httptest.NewRecorder()
+    orderHandler(db).ServeHTTP(rec, req)
+    return rec
+  }
+
+  if rec := checkout("cart-a", "secret-a"); rec.Code != http.StatusOK {
+    t.Fatalf("first checkout: expected 200, got %d: %s", rec.Code, rec.Body.String())
+  }
+  rec := checkout("cart-b", "secret-b")
+  if rec.Code != http.StatusBadRequest || !bytes.Contains(rec.Body.Bytes(), []byte("stock not enough")) {
+    t.Fatalf("second checkout: expected 400 stock not enough, got %d: %s", rec.Code, rec.Body.String())
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestOrderStatusTransitions(t *testing.T) {
+  cases := []struct {
+    from string
+    to   string
+    ok   bool
+  }{
+    {"PENDING", "PAID", true},
+    {"PENDING", "FAILED", true},
+    {"PENDING", "SHIPPED", false},
+    {"PAID", "PACKED", true},
+    {"PACKED", "SHIPPED", true},
+    {"SHIPPED", "DELIVERED", true},
+    {"DELIVERED", "REFUNDED", true},
+    {"DELIVERED", "PENDING", false},
+    {"FAILED", "PAID", false},
+    {"CANCELLED", "PAID", false},
+  }
+  for _, c := range cases {
+    if got := canTransitionOrder(c.from, c.to); got != c.ok {
+      t.Fatalf("%s -> %s: expected %v, got %v", c.from, c.to, c.ok, got)
+    }
+  }
+}
+
+func TestAdminOrderStatusRejectsIllegalTransition(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectQuery(`SELECT user_id, id, last_seen_at < NOW\(\) - interval '5 minutes' FROM sessions WHERE token_hash = \$1`).
+    WithArgs(hashSessionToken("admin-token")).
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "id", "stale"}).AddRow("admin-1", "session-1", false))
+  mock.ExpectQuery(`SELECT is_admin, role, totp_enabled_at IS NOT NULL FROM users`).
+    WithArgs("admin-1").
+    WillReturnRows(sqlmock.NewRows([]string{"is_admin", "role", "totp_on"}).AddRow(true, "owner", true))
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT status FROM orders WHERE id = \$1 FOR UPDATE`).
+    WithArgs("order-1").
+    WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("PENDING"))
+  mock.ExpectRollback()
+
+  body, _ := json.Marshal(map[string]any{"status": "shipped"})
+  req := httptest.NewRequest(http.MethodPut, "/admin/orders/order-1/status", bytes.NewReader(body))
+  req.Header.Set("X-Auth-Token", "admin-token")
+  rec := httptest.NewRecorder()
+
+  adminOrderItemHandler(db).ServeHTTP(rec, req)
+
+  if rec.Code != http.StatusConflict {
+    t.Fatalf("expected 409, got %d", rec.Code)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestGuestCancelReleasesPendingHolds(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT status, user_id, tracking_token FROM orders`).
+    WithArgs("order-1").
+    WillReturnRows(sqlmock.NewRows([]string{"status", "user_id", "tracking_token"}).AddRow("PENDING", nil, "track-1"))
+  mock.ExpectQuery(`SELECT status FROM orders WHERE id = \$1 FOR UPDATE`).
+    WithArgs("order-1").
+    WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("PENDING"))
+  mock.ExpectExec(`UPDATE orders SET status = \$1`).
+    WithArgs("CANCELLED", "order-1").
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectQuery(`SELECT user_id, voucher_code, wallet_used, total FROM orders`).
+    WithArgs("order-1").
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "voucher_code", "wallet_used", "total"}).AddRow(nil, nil, 0, 25000))
+  mock.ExpectExec(`UPDATE stock_reservations SET status = 'RELEASED'`).
+    WithArgs("order-1").
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectQuery(`SELECT id, product_id, variant_id, qty FROM stock_reservations`).
+    WithArgs("order-1", "COMMITTED").
+    WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "variant_id", "qty"}))
+  mock.ExpectQuery(`SELECT NOT EXISTS \(SELECT 1 FROM stock_reservations`).
+    WithArgs("order-1").
+    WillReturnRows(sqlmock.NewRows([]string{"legacy"}).AddRow(false))
+  mock.ExpectExec(`INSERT INTO order_status_history`).
+    WithArgs("order-1", "PENDING", "CANCELLED", "customer", nil, nil).
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectCommit()
+
+  req := httptest.NewRequest(http.MethodPost, "/orders/order-1/cancel?token=track-1", nil)
+  rec := httptest.NewRecorder()
+
+  orderDetailHandler(db).ServeHTTP(rec, req)
+
+  if rec.Code != http.StatusOK {
+    t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestPaidTransitionCommitsStockHolds(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT status FROM orders WHERE id = \$1 FOR UPDATE`).
+    WithArgs("order-1").
+    WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("PENDING"))
+  mock.ExpectExec(`UPDATE orders SET status = \$1`).
+    WithArgs("PAID", "order-1").
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectQuery(`SELECT id, product_id, variant_id, qty, status = 'EXPIRED' OR expires_at <= NOW\(\) FROM stock_reservations`).
+    WithArgs("order-1").
+    WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "variant_id", "qty", "lapsed"}).AddRow("hold-1", "prod-1", "var-1", 2, false))
+  mock.ExpectQuery(`UPDATE product_variants SET stock = stock \+ \$1 WHERE id = \$2 AND product_id = \$3 RETURNING stock`).
+    WithArgs(-2, "var-1", "prod-1").
+    WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(3))
+  mock.ExpectExec(`UPDATE products SET stock = stock \+ \$1 WHERE id = \$2`).
+    WithArgs(-2, "prod-1").
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectQuery(`INSERT INTO inventory_movements`).
+    WithArgs("prod-1", "var-1", "SALE", -2, 3, "order-1", "midtrans", nil, nil).
+    WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("move-1"))
+  mock.ExpectExec(`UPDATE products SET sold_count = sold_count \+ \$1`).
+    WithArgs(2, "prod-1").
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectExec(`UPDATE stock_reservations SET status = 'COMMITTED'`).
+    WithArgs("hold-1").
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectExec(`INSERT INTO order_status_history`).
+    WithArgs("order-1", "PENDING", "PAID", "midtrans", nil, "settlement").
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectCommit()
+
+  tx, err := db.Begin()
+  if err != nil {
+    t.Fatalf("begin: %v", err)
+  }
+  if _, _, err := transitionOrderTx(tx, "order-1", "PAID", "midtrans", "", "settlement"); err != nil {
+    t.Fatalf("transition: %v", err)
+  }
+  if err := tx.Commit(); err != nil {
+    t.Fatalf("commit: %v", err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+// the hold expired before Midtrans settled and another order took the stock in between:
+// the payment is still recorded, the order is flagged and nothing is sold for the short line
+func TestSettlementOnLapsedHoldWithoutStockMarksOrderOversold(t *testing.T) {
+  t.Setenv("CORE_WEBHOOK_SECRET", "hook-secret")
+  t.Setenv("SMTP_HOST", "")
+  t.Setenv("FONNTE_API_KEY", "")
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT status FROM orders WHERE id = \$1 FOR UPDATE`).
+    WithArgs("order-1").
+    WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("PENDING"))
+  mock.ExpectExec(`UPDATE orders SET status = \$1`).
+    WithArgs("PAID", "order-1").
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectQuery(`SELECT id, product_id, variant_id, qty, status = 'EXPIRED' OR expires_at <= NOW\(\) FROM stock_reservations`).
+    WithArgs("order-1").
+    WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "variant_id", "qty", "lapsed"}).AddRow("hold-1", "prod-1", nil, 2, true))
+  mock.ExpectExec(`SELECT id FROM products WHERE id = \$1 FOR UPDATE`).
+    WithArgs("prod-1").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectQuery(`SELECT p\.name, p\.stock - .+ FROM products p WHERE p\.id = \$1`).
+    WithArgs("prod-1").
+    WillReturnRows(sqlmock.NewRows([]string{"name", "available"}).AddRow("Whiskas Adult 1.2kg", 1))
+  mock.ExpectExec(`UPDATE orders SET oversold = TRUE WHERE id = \$1`).
+    WithArgs("order-1").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectExec(`INSERT INTO order_status_history`).
+    WithArgs("order-1", "PENDING", "PAID", "midtrans", nil, "settlement; stock ran out while the payment was pending: 2x Whiskas Adult 1.2kg (available 1)").
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectCommit()
+
+  body, _ := json.Marshal(map[string]any{"order_id": "order-1", "transaction_status": "settlement"})
+  req := httptest.NewRequest(http.MethodPost, "/payments/midtrans/webhook", bytes.NewReader(body))
+  req.Header.Set("X-Service-Secret", "hook-secret")
+  rec := httptest.NewRecorder()
+
+  midtransWebhookHandler(db).ServeHTTP(rec, req)
+
+  if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"ok"`) {
+    t.Fatalf("expected the settlement to be recorded, got %d: %s", rec.Code, rec.Body.String())
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+// the hold is past its expiry but still ACTIVE because the reaper has not run yet
+func TestPaidTransitionRechecksUnreapedExpiredHold(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT status FROM orders WHERE id = \$1 FOR UPDATE`).
+    WithArgs("order-1").
+    WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("PENDING"))
+  mock.ExpectExec(`UPDATE orders SET status = \$1`).
+    WithArgs("PAID", "order-1").
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectQuery(`status = 'EXPIRED' OR expires_at <= NOW\(\) FROM stock_reservations`).
+    WithArgs("order-1").
+    WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "variant_id", "qty", "lapsed"}).AddRow("hold-1", "prod-1", "var-1", 2, true))
+  mock.ExpectExec(`SELECT id FROM products WHERE id = \$1 FOR UPDATE`).
+    WithArgs("prod-1").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectQuery(`SELECT p\.name, v\.stock - .+ FROM product_variants v JOIN products p`).
+    WithArgs("var-1").
+    WillReturnRows(sqlmock.NewRows([]string{"name", "available"}).AddRow("Whiskas Adult 1.2kg", 2))
+  mock.ExpectQuery(`UPDATE product_variants SET stock = stock \+ \$1 WHERE id = \$2 AND product_id = \$3 RETURNING stock`).
+    WithArgs(-2, "var-1", "prod-1").
+    WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(0))
+  mock.ExpectExec(`UPDATE products SET stock = stock \+ \$1 WHERE id = \$2`).
+    WithArgs(-2, "prod-1").
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectQuery(`INSERT INTO inventory_movements`).
+    WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("move-1"))
+  mock.ExpectExec(`UPDATE products SET sold_count = sold_count \+ \$1`).
+    WithArgs(2, "prod-1").
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectExec(`UPDATE stock_reservations SET status = 'COMMITTED'`).
+    WithArgs("hold-1").
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectExec(`INSERT INTO order_status_history`).
+    WillReturnResult(sqlmock.NewResult(1, 1))
+  mock.ExpectCommit()
+
+  tx, err := db.Begin()
+  if err != nil {
+    t.Fatalf("begin: %v", err)
+  }
+  if _, _, err := transitionOrderTx(tx, "order-1", "PAID", "midtrans", "", "settlement"); err != nil {
+    t.Fatalf("transition: %v", err)
+  }
+  if err := tx.Commit(); err != nil {
+    t.Fatalf("commit: %v", err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestReaperLeavesOrdersPending(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectExec(`UPDATE stock_reservations SET status = 'EXPIRED', resolved_at = NOW\(\) WHERE status = 'ACTIVE' AND expires_at <= NOW\(\)`).
+    WillReturnResult(sqlmock.NewResult(0, 3))
+
+  n, err := reapExpiredReservations(db)
+  if err != nil || n != 3 {
+    t.Fatalf("expected 3 holds released, got %d (%v)", n, err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestOrderHandlerReplaysIdempotentRequest(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  body, _ := json.Marshal(map[string]any{
+    "cart_id": "cart-2",
+    "customer_name": "Rina",
+    "phone": "081234",
+    "address": "Jl. Mawar",
+    "delivery_type": "zone",
+    "zone_id": "zone-1",
+  })
+  mock.ExpectBegin()
+  mock.ExpectExec(`INSERT INTO idempotency_keys`).
+    WithArgs("tap-1", nil, requestHash(body)).
+    WillReturnResult(sqlmock.NewResult(0, 0))
+  mock.ExpectQuery(`SELECT user_id, request_hash, response FROM idempotency_keys`).
+    WithArgs("tap-1").
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "request_hash", "response"}).
+      AddRow(nil, requestHash(body), []byte(`{"order_id":"order-1","tracking_token":"track-1","total":25000}`)))
+  mock.ExpectRollback()
+
+  req := httptest.NewRequest(http.MethodPost, "/orders", bytes.NewReader(body))
+  req.Header.Set("Idempotency-Key", "tap-1")
+  rec := httptest.NewRecorder()
+
+  orderHandler(db).ServeHTTP(rec, req)
+
+  if rec.Code != http.StatusOK {
+    t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+  }
+  if rec.Header().Get("Idempotent-Replayed") != "true" {
+    t.Fatalf("expected replay header")
+  }
+  var resp map[string]any
+  if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+    t.Fatalf("decode: %v", err)
+  }
+  if resp["order_id"] != "order-1" || resp["tracking_token"] != "track-1" {
+    t.Fatalf("unexpected response: %v", resp)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestOrderHandlerRejectsForeignCart(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT user_id, secret FROM carts`).
+    WithArgs("cart-3").
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "secret"}).AddRow(nil, "cart-secret"))
+  mock.ExpectRollback()
+
+  body, _ := json.Marshal(map[string]any{
+    "cart_id": "cart-3",
+    "customer_name": "Rina",
+    "phone": "081234",
+    "address": "Jl. Mawar",
+  })
+  req := httptest.NewRequest(http.MethodPost, "/orders", bytes.NewReader(body))
+  req.Header.Set("X-Cart-Token", "guessed")
+  rec := httptest.NewRecorder()
+
+  orderHandler(db).ServeHTTP(rec, req)
+
+  if rec.Code != http.StatusForbidden {
+    t.Fatalf("expected 403, got %d", rec.Code)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestStoredOrderBreakdownChecksDiscountParts(t *testing.T) {
+  items := []OrderItem{{ProductID: "prod-1", UnitPrice: 50000, Qty: 2}}
+  stored := orderTotals{Subtotal: 100000, TierDiscount: 2000, VoucherDiscount: 10000, Discount: 12000, ShippingFee: 8000, WalletUsed: 5000, Total: 91000, VoucherCode: "HEMAT10"}
+
+  b := storedOrderBreakdown(items, stored)
+  if b.TierDiscount != 2000 || b.VoucherDiscount != 10000 || b.VoucherCode != "HEMAT10" || b.Total != 91000 {
+    t.Fatalf("unexpected breakdown: %+v", b)
+  }
+  if !totalsConsistent(b, stored) {
+    t.Fatalf("expected stored totals to be consistent")
+  }
+
+  // same subtotal and total, but the discount parts do not add up to the stored discount
+  stored.VoucherDiscount = 8000
+  if totalsConsistent(storedOrderBreakdown(items, stored), stored) {
+    t.Fatalf("expected a mismatched discount split to be flagged")
+  }
+}
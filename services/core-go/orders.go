@@ -0,0 +1,439 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "log"
+  "net/http"
+  "strings"
+
+  "github.com/lib/pq"
+
+  "petshop-bento-core/pricing"
+)
+
+func loadOrderItems(db *sql.DB, orderIDs []string) (map[string][]OrderItem, error) {
+  out := map[string][]OrderItem{}
+  if len(orderIDs) == 0 {
+    return out, nil
+  }
+  rows, err := db.Query(`SELECT id, order_id, product_id, variant_id, product_name, variant_sku, options, unit_price, qty FROM order_items WHERE order_id = ANY($1) ORDER BY created_at, product_name`, pq.Array(orderIDs))
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var item OrderItem
+    var orderID string
+    var productID, variantID, sku sql.NullString
+    var options []byte
+    if err := rows.Scan(&item.ID, &orderID, &productID, &variantID, &item.ProductName, &sku, &options, &item.UnitPrice, &item.Qty); err != nil {
+      return nil, err
+    }
+    item.ProductID = productID.String
+    item.VariantID = variantID.String
+    item.VariantSKU = sku.String
+    if len(options) > 0 {
+      _ = json.Unmarshal(options, &item.Options)
+    }
+    item.LineTotal = item.UnitPrice * item.Qty
+    out[orderID] = append(out[orderID], item)
+  }
+  return out, rows.Err()
+}
+
+func orderItemsOrEmpty(items map[string][]OrderItem, orderID string) []OrderItem {
+  if list, ok := items[orderID]; ok {
+    return list
+  }
+  return []OrderItem{}
+}
+
+// the amounts stored on an order at checkout
+type orderTotals struct {
+  Subtotal        int
+  TierDiscount    int
+  VoucherDiscount int
+  Discount        int
+  ShippingFee     int
+  WalletUsed      int
+  Cashback        int
+  Total           int
+  VoucherCode     string
+}
+
+// rebuilds the checkout breakdown of a stored order from its lines and the discount parts
+// stored with it, applying them the way pricing.Price does, so admin views can show the
+// arithmetic and tell when the stored amounts do not add up
+func storedOrderBreakdown(items []OrderItem, t orderTotals) pricing.Breakdown {
+  b := pricing.Breakdown{
+    Lines:           make([]pricing.LineTotal, 0, len(items)),
+    TierDiscount:    t.TierDiscount,
+    VoucherDiscount: t.VoucherDiscount,
+    ShippingFee:     t.ShippingFee,
+    Cashback:        t.Cashback,
+    WalletUsed:      t.WalletUsed,
+  }
+  if t.VoucherDiscount > 0 {
+    b.VoucherCode = t.VoucherCode
+  }
+  for _, it := range items {
+    b.Lines = append(b.Lines, pricing.LineTotal{ProductID: it.ProductID, VariantID: it.VariantID, UnitPrice: it.UnitPrice, Qty: it.Qty, Total: it.UnitPrice * it.Qty})
+    b.Subtotal += it.UnitPrice * it.Qty
+  }
+  b.Discount = min(b.TierDiscount+b.VoucherDiscount, b.Subtotal)
+  b.Total = max(b.Subtotal-b.Discount+b.ShippingFee, 0) - b.WalletUsed
+  return b
+}
+
+// orders placed before order_items existed have no lines to re-price
+func totalsConsistent(b pricing.Breakdown, t orderTotals) bool {
+  return len(b.Lines) == 0 || (b.Subtotal == t.Subtotal && b.Discount == t.Discount && b.Total == t.Total)
+}
+
+func attachOrderItems(db *sql.DB, orders []map[string]any) error {
+  ids := make([]string, 0, len(orders))
+  for _, o := range orders {
+    ids = append(ids, o["id"].(string))
+  }
+  items, err := loadOrderItems(db, ids)
+  if err != nil {
+    return err
+  }
+  for _, o := range orders {
+    o["items"] = orderItemsOrEmpty(items, o["id"].(string))
+  }
+  return nil
+}
+
+func orderCancelHandler(db *sql.DB, id string, w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+    return
+  }
+  if id == "" {
+    writeJSON(w, http.StatusBadRequest, errMsg("missing id"))
+    return
+  }
+  var req OrderStatusRequest
+  if r.ContentLength != 0 {
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
+      return
+    }
+  }
+
+  actorType := "customer"
+  actorID := ""
+  if adminID, err := requireRoles(db, r, "owner", "admin"); err == nil {
+    actorType = "admin"
+    actorID = adminID
+  }
+
+  tx, err := db.Begin()
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg("db error"))
+    return
+  }
+  defer tx.Rollback()
+
+  var status string
+  var ownerID, trackingToken sql.NullString
+  err = tx.QueryRow(`SELECT status, user_id, tracking_token FROM orders WHERE id = $1 FOR UPDATE`, id).Scan(&status, &ownerID, &trackingToken)
+  if err != nil {
+    if err == sql.ErrNoRows {
+      writeJSON(w, http.StatusNotFound, errMsg("not found"))
+      return
+    }
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  if actorType == "customer" {
+    if !isOrderOwner(db, r, ownerID, trackingToken) {
+      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+      return
+    }
+    if status != "PENDING" {
+      writeJSON(w, http.StatusConflict, errMsg("only pending orders can be cancelled"))
+      return
+    }
+    actorID = ownerID.String
+  }
+
+  if _, _, err := transitionOrderTx(tx, id, "CANCELLED", actorType, actorID, req.Note); err != nil {
+    if isInvalid(err) {
+      writeJSON(w, http.StatusConflict, errMsg(err.Error()))
+      return
+    }
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  if err := tx.Commit(); err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg("db commit failed"))
+    return
+  }
+  writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "order_status": "CANCELLED"})
+}
+
+func isOrderOwner(db *sql.DB, r *http.Request, ownerID sql.NullString, trackingToken sql.NullString) bool {
+  if r.Header.Get("X-Auth-Token") != "" {
+    if userID, err := getUserIDFromToken(db, r); err == nil && ownerID.Valid && ownerID.String == userID {
+      return true
+    }
+  }
+  token := r.URL.Query().Get("token")
+  return token != "" && trackingToken.Valid && token == trackingToken.String
+}
+
+func canViewOrder(db *sql.DB, r *http.Request, ownerID sql.NullString, trackingToken sql.NullString) bool {
+  if isOrderOwner(db, r, ownerID, trackingToken) {
+    return true
+  }
+  if r.Header.Get("X-Auth-Token") == "" {
+    return false
+  }
+  _, err := requireRoles(db, r, "owner", "admin", "staff")
+  return err == nil
+}
+
+func orderDetailHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    id := strings.TrimPrefix(r.URL.Path, "/orders/")
+    id = strings.TrimSpace(id)
+    if strings.HasSuffix(id, "/cancel") {
+      orderCancelHandler(db, strings.TrimSuffix(id, "/cancel"), w, r)
+      return
+    }
+    if id == "" {
+      writeJSON(w, http.StatusBadRequest, errMsg("missing id"))
+      return
+    }
+    if r.Method != http.MethodGet {
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+      return
+    }
+    var customerName, phone, address, status, createdAt string
+    var userID, voucher, trackingToken sql.NullString
+    var t orderTotals
+    err := db.QueryRow(`SELECT user_id, customer_name, phone, address, status, subtotal, tier_discount, voucher_discount, discount, voucher_code, cashback, wallet_used, shipping_fee, total, tracking_token, created_at FROM orders WHERE id = $1`, id).
+      Scan(&userID, &customerName, &phone, &address, &status, &t.Subtotal, &t.TierDiscount, &t.VoucherDiscount, &t.Discount, &voucher, &t.Cashback, &t.WalletUsed, &t.ShippingFee, &t.Total, &trackingToken, &createdAt)
+    if err != nil {
+      if err == sql.ErrNoRows {
+        writeJSON(w, http.StatusNotFound, errMsg("not found"))
+        return
+      }
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    if !canViewOrder(db, r, userID, trackingToken) {
+      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+      return
+    }
+    items, err := loadOrderItems(db, []string{id})
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    orderItems := orderItemsOrEmpty(items, id)
+    t.VoucherCode = voucher.String
+    writeJSON(w, http.StatusOK, map[string]any{
+      "id": id,
+      "customer_name": customerName,
+      "phone": phone,
+      "address": address,
+      "status": status,
+      "subtotal": t.Subtotal,
+      "tier_discount": t.TierDiscount,
+      "voucher_discount": t.VoucherDiscount,
+      "discount": t.Discount,
+      "voucher_code": voucher.String,
+      "cashback": t.Cashback,
+      "wallet_used": t.WalletUsed,
+      "shipping_fee": t.ShippingFee,
+      "total": t.Total,
+      "created_at": createdAt,
+      "items": orderItems,
+      "breakdown": storedOrderBreakdown(orderItems, t),
+    })
+  }
+}
+
+var orderTransitions = map[string][]string{
+  "PENDING":   {"PAID", "CANCELLED", "FAILED"},
+  "PAID":      {"PACKED", "CANCELLED", "REFUNDED"},
+  "PACKED":    {"SHIPPED", "CANCELLED", "REFUNDED"},
+  "SHIPPED":   {"DELIVERED", "REFUNDED"},
+  "DELIVERED": {"REFUNDED"},
+  "CANCELLED": {},
+  "FAILED":    {},
+  "REFUNDED":  {},
+}
+
+func isOrderStatus(status string) bool {
+  _, ok := orderTransitions[status]
+  return ok
+}
+
+func canTransitionOrder(from string, to string) bool {
+  for _, next := range orderTransitions[from] {
+    if next == to {
+      return true
+    }
+  }
+  return false
+}
+
+func recordOrderStatusTx(tx *sql.Tx, orderID string, from string, to string, actorType string, actorID string, note string) error {
+  _, err := tx.Exec(`INSERT INTO order_status_history (order_id, from_status, to_status, actor_type, actor_id, note) VALUES ($1,$2,$3,$4,$5,$6)`,
+    orderID, nullIfEmpty(from), to, actorType, nullIfEmpty(actorID), nullIfEmpty(note))
+  return err
+}
+
+// short is only set on a move to PAID: it lists the lines whose hold lapsed before the
+// payment arrived and whose stock was gone by then. The order is still marked PAID and
+// flagged oversold, since the customer's money has been taken; staff refund or restock.
+func transitionOrderTx(tx *sql.Tx, orderID string, to string, actorType string, actorID string, note string) (string, []string, error) {
+  to = strings.ToUpper(strings.TrimSpace(to))
+  if !isOrderStatus(to) {
+    return "", nil, errInvalid("invalid status")
+  }
+  var from string
+  if err := tx.QueryRow(`SELECT status FROM orders WHERE id = $1 FOR UPDATE`, orderID).Scan(&from); err != nil {
+    return "", nil, err
+  }
+  if from == to {
+    return from, nil, nil
+  }
+  if !canTransitionOrder(from, to) {
+    return from, nil, errInvalid("cannot change status from " + from + " to " + to)
+  }
+  if _, err := tx.Exec(`UPDATE orders SET status = $1 WHERE id = $2`, to, orderID); err != nil {
+    return from, nil, err
+  }
+  var short []string
+  if to == "PAID" {
+    var err error
+    short, err = commitOrderReservationsTx(tx, orderID, actorType, actorID)
+    if err != nil {
+      return from, nil, err
+    }
+    if len(short) > 0 {
+      if _, err := tx.Exec(`UPDATE orders SET oversold = TRUE WHERE id = $1`, orderID); err != nil {
+        return from, nil, err
+      }
+      if note != "" {
+        note += "; "
+      }
+      note += "stock ran out while the payment was pending: " + strings.Join(short, ", ")
+    }
+  }
+  if err := releaseOrderCashbackTx(tx, orderID, to, actorType, actorID); err != nil {
+    return from, nil, err
+  }
+  if to == "REFUNDED" {
+    if err := reverseOrderCashbackTx(tx, orderID, actorType, actorID); err != nil {
+      return from, nil, err
+    }
+  }
+  if to == "CANCELLED" || to == "FAILED" {
+    if err := reverseOrderEffectsTx(tx, orderID, actorType, actorID); err != nil {
+      return from, nil, err
+    }
+  }
+  return from, short, recordOrderStatusTx(tx, orderID, from, to, actorType, actorID, note)
+}
+
+// tells staff about a paid order that could not be covered from stock. Sent after commit
+// and best effort: the oversold flag on the order is what keeps it on the admin list.
+func sendOversoldAlert(db *sql.DB, orderID string, short []string) {
+  if !smtpEnabled() && !fonnteEnabled() {
+    return
+  }
+  emails, phones, err := lowStockRecipients(db)
+  if err != nil {
+    log.Printf("oversold alert for order %s: %v", orderID, err)
+    return
+  }
+  msg := fmt.Sprintf("Pesanan %s sudah dibayar tapi stoknya habis: %s. Hubungi pelanggan untuk restock atau refund.", orderID, strings.Join(short, ", "))
+  if smtpEnabled() {
+    for _, to := range emails {
+      if err := sendEmail(to, "Pesanan dibayar tanpa stok", msg+"\n"); err != nil {
+        log.Printf("oversold alert to %s: %v", to, err)
+      }
+    }
+  }
+  if fonnteEnabled() {
+    for _, to := range phones {
+      if err := sendWhatsApp(to, msg); err != nil {
+        log.Printf("oversold alert to %s: %v", to, err)
+      }
+    }
+  }
+}
+
+func reverseOrderEffectsTx(tx *sql.Tx, orderID string, actorType string, actorID string) error {
+  var userID, voucherCode sql.NullString
+  var walletUsed, total int
+  err := tx.QueryRow(`SELECT user_id, voucher_code, wallet_used, total FROM orders WHERE id = $1`, orderID).
+    Scan(&userID, &voucherCode, &walletUsed, &total)
+  if err != nil {
+    return err
+  }
+
+  if err := releaseOrderStockTx(tx, orderID, actorType, actorID); err != nil {
+    return err
+  }
+
+  code := strings.ToUpper(strings.TrimSpace(voucherCode.String))
+  if code != "" {
+    if err := releaseVoucherRedemptionTx(tx, orderID, code, userID.String); err != nil {
+      return err
+    }
+  }
+
+  if !userID.Valid {
+    return nil
+  }
+  if _, err := tx.Exec(`UPDATE users SET total_spend = GREATEST(total_spend - $1, 0) WHERE id = $2`, total+walletUsed, userID.String); err != nil {
+    return err
+  }
+  if walletUsed > 0 {
+    if _, err := postWalletEntryTx(tx, walletEntry{UserID: userID.String, Kind: "SPEND_REFUND", Amount: walletUsed, OrderID: orderID, ActorType: actorType, ActorID: actorID}); err != nil {
+      return err
+    }
+  }
+  if err := reverseOrderCashbackTx(tx, orderID, actorType, actorID); err != nil {
+    return err
+  }
+  _, err = reevaluateTierTx(tx, userID.String, tierReasonOrderReverse, true)
+  return err
+}
+
+func loadOrderStatusHistory(db *sql.DB, orderID string) ([]map[string]any, error) {
+  rows, err := db.Query(`SELECT h.from_status, h.to_status, h.actor_type, h.actor_id, u.name, h.note, h.created_at
+    FROM order_status_history h LEFT JOIN users u ON h.actor_id = u.id
+    WHERE h.order_id = $1 ORDER BY h.created_at, h.id`, orderID)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  out := []map[string]any{}
+  for rows.Next() {
+    var to, actorType, createdAt string
+    var from, actorID, actorName, note sql.NullString
+    if err := rows.Scan(&from, &to, &actorType, &actorID, &actorName, &note, &createdAt); err != nil {
+      return nil, err
+    }
+    out = append(out, map[string]any{
+      "from_status": from.String,
+      "to_status": to,
+      "actor_type": actorType,
+      "actor_id": actorID.String,
+      "actor_name": actorName.String,
+      "note": note.String,
+      "created_at": createdAt,
+    })
+  }
+  return out, rows.Err()
+}
@@ -38,11 +38,33 @@ func deliverOtp(channel string, destination string, code string) error {
   }
 }
 
+// sends a plain account notice over the same channels as OTP codes; subject is only used for email
+func deliverNotice(channel string, destination string, subject string, message string) error {
+  switch strings.ToLower(strings.TrimSpace(channel)) {
+  case "email":
+    if !smtpEnabled() {
+      return errOtpDeliveryNotConfigured
+    }
+    return sendEmail(destination, subject, message+"\n")
+  case "whatsapp":
+    if !fonnteEnabled() {
+      return errOtpDeliveryNotConfigured
+    }
+    return sendWhatsApp(destination, message)
+  default:
+    return errors.New("invalid channel")
+  }
+}
+
 func fonnteEnabled() bool {
   return strings.TrimSpace(os.Getenv("FONNTE_API_KEY")) != ""
 }
 
 func sendOtpWhatsApp(phone string, code string) error {
+  return sendWhatsApp(phone, "Kode OTP kamu: "+code+". Berlaku 5 menit.")
+}
+
+func sendWhatsApp(phone string, message string) error {
   baseURL := strings.TrimSpace(os.Getenv("FONNTE_BASE_URL"))
   if baseURL == "" {
     baseURL = "https://api.fonnte.com/send"
@@ -51,7 +73,6 @@ func sendOtpWhatsApp(phone string, code string) error {
   if apiKey == "" {
     return errOtpDeliveryNotConfigured
   }
-  message := "Kode OTP kamu: " + code + ". Berlaku 5 menit."
   body := &bytes.Buffer{}
   writer := multipart.NewWriter(body)
   _ = writer.WriteField("target", phone)
@@ -20,6 +20,22 @@ func normalizePhone(v string) string {
   return b.String()
 }
 
+var otpPurposes = map[string]bool{
+  "register":       true,
+  "reset_password": true,
+}
+
+func otpPurpose(v string) (string, error) {
+  purpose := strings.ToLower(strings.TrimSpace(v))
+  if purpose == "" {
+    purpose = "register"
+  }
+  if !otpPurposes[purpose] {
+    return "", errors.New("invalid purpose")
+  }
+  return purpose, nil
+}
+
 func otpDestination(email string, phone string, channel string) (string, string, error) {
   email = strings.ToLower(strings.TrimSpace(email))
   phone = normalizePhone(phone)
@@ -0,0 +1,145 @@
+package main
+
+import (
+  "crypto/subtle"
+  "database/sql"
+  "errors"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+var (
+  errOtpInvalid = errors.New("invalid otp")
+  errOtpLocked  = errors.New("too many attempts, request a new code")
+)
+
+type otpLimits struct {
+  MaxAttempts int
+  Cooldown    time.Duration
+  PerHour     int
+  IPPerHour   int
+}
+
+// what otp_requests already holds for this destination and IP over the last hour
+type otpUsage struct {
+  SinceLast   sql.NullInt64
+  DestCount   int
+  DestResetIn sql.NullInt64
+  IPCount     int
+  IPResetIn   sql.NullInt64
+}
+
+type otpThrottledError struct {
+  RetryAfter time.Duration
+}
+
+func (e otpThrottledError) Error() string {
+  return "too many otp requests, try again later"
+}
+
+func loadOtpLimits() otpLimits {
+  return otpLimits{
+    MaxAttempts: envPositiveInt("OTP_MAX_ATTEMPTS", 5),
+    Cooldown:    time.Duration(envPositiveInt("OTP_RESEND_COOLDOWN_SECONDS", 60)) * time.Second,
+    PerHour:     envPositiveInt("OTP_MAX_PER_HOUR", 5),
+    IPPerHour:   envPositiveInt("OTP_IP_MAX_PER_HOUR", 20),
+  }
+}
+
+// how long the caller has to wait before another code may be sent; 0 means go ahead
+func otpRetryAfter(l otpLimits, u otpUsage) time.Duration {
+  wait := time.Duration(0)
+  if u.SinceLast.Valid {
+    if left := l.Cooldown - time.Duration(u.SinceLast.Int64)*time.Second; left > wait {
+      wait = left
+    }
+  }
+  if u.DestCount >= l.PerHour && u.DestResetIn.Valid {
+    if left := time.Duration(u.DestResetIn.Int64) * time.Second; left > wait {
+      wait = left
+    }
+  }
+  if u.IPCount >= l.IPPerHour && u.IPResetIn.Valid {
+    if left := time.Duration(u.IPResetIn.Int64) * time.Second; left > wait {
+      wait = left
+    }
+  }
+  if wait > 0 && wait < time.Second {
+    wait = time.Second
+  }
+  return wait
+}
+
+// issues a new code unless a limit is hit. The limits are read from otp_requests itself,
+// under an advisory lock on the destination, so they hold across restarts and instances.
+// Codes still pending for the same destination and purpose stop working.
+func issueOtpTx(tx *sql.Tx, l otpLimits, dest string, channel string, purpose string, ip string) (string, error) {
+  if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('otp:' || $1))`, dest); err != nil {
+    return "", err
+  }
+  var u otpUsage
+  err := tx.QueryRow(`SELECT
+      EXTRACT(EPOCH FROM NOW() - MAX(created_at) FILTER (WHERE destination = $1))::bigint,
+      COUNT(*) FILTER (WHERE destination = $1),
+      EXTRACT(EPOCH FROM MIN(created_at) FILTER (WHERE destination = $1) + INTERVAL '1 hour' - NOW())::bigint,
+      COUNT(*) FILTER (WHERE request_ip = $2),
+      EXTRACT(EPOCH FROM MIN(created_at) FILTER (WHERE request_ip = $2) + INTERVAL '1 hour' - NOW())::bigint
+    FROM otp_requests
+    WHERE created_at > NOW() - INTERVAL '1 hour' AND (destination = $1 OR request_ip = $2)`, dest, ip).
+    Scan(&u.SinceLast, &u.DestCount, &u.DestResetIn, &u.IPCount, &u.IPResetIn)
+  if err != nil {
+    return "", err
+  }
+  if wait := otpRetryAfter(l, u); wait > 0 {
+    return "", otpThrottledError{RetryAfter: wait}
+  }
+  if _, err := tx.Exec(`UPDATE otp_requests SET invalidated_at = NOW()
+    WHERE destination = $1 AND channel = $2 AND purpose = $3 AND verified_at IS NULL AND invalidated_at IS NULL`, dest, channel, purpose); err != nil {
+    return "", err
+  }
+  code := generateOTPCode()
+  _, err = tx.Exec(`INSERT INTO otp_requests (destination, channel, purpose, code, expires_at, request_ip) VALUES ($1,$2,$3,$4,$5,$6)`,
+    dest, channel, purpose, code, time.Now().Add(5*time.Minute), nullIfEmpty(ip))
+  return code, err
+}
+
+// checks a guess against the newest live code. A wrong guess is counted and the code is
+// locked once MaxAttempts is reached; the caller must commit tx on errOtpInvalid too so
+// the counter sticks. Returns the attempts left after a wrong guess.
+func verifyOtpCodeTx(tx *sql.Tx, l otpLimits, dest string, channel string, purpose string, code string) (int, error) {
+  var id, expected string
+  var attempts int
+  var locked bool
+  err := tx.QueryRow(`SELECT id, code, attempts, locked_at IS NOT NULL FROM otp_requests
+    WHERE destination = $1 AND channel = $2 AND purpose = $3 AND verified_at IS NULL AND invalidated_at IS NULL AND expires_at > NOW()
+    ORDER BY created_at DESC LIMIT 1 FOR UPDATE`, dest, channel, purpose).Scan(&id, &expected, &attempts, &locked)
+  if err == sql.ErrNoRows {
+    return 0, errOtpInvalid
+  }
+  if err != nil {
+    return 0, err
+  }
+  if locked {
+    return 0, errOtpLocked
+  }
+  if subtle.ConstantTimeCompare([]byte(code), []byte(expected)) != 1 {
+    attempts++
+    if _, err := tx.Exec(`UPDATE otp_requests SET attempts = $1, locked_at = CASE WHEN $1 >= $2 THEN NOW() END WHERE id = $3`,
+      attempts, l.MaxAttempts, id); err != nil {
+      return 0, err
+    }
+    if attempts >= l.MaxAttempts {
+      return 0, errOtpLocked
+    }
+    return l.MaxAttempts - attempts, errOtpInvalid
+  }
+  _, err = tx.Exec(`UPDATE otp_requests SET verified_at = NOW() WHERE id = $1`, id)
+  return 0, err
+}
+
+func writeOtpThrottled(w http.ResponseWriter, e otpThrottledError) {
+  secs := int((e.RetryAfter + time.Second - 1) / time.Second)
+  w.Header().Set("Retry-After", strconv.Itoa(secs))
+  writeJSON(w, http.StatusTooManyRequests, map[string]any{"error": e.Error(), "retry_after": secs})
+}
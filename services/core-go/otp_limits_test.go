@@ -0,0 +1,72 @@
+package main
+
+import (
+  "database/sql"
+  "testing"
+  "time"
+
+  "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestOtpRetryAfter(t *testing.T) {
+  l := otpLimits{MaxAttempts: 5, Cooldown: 60 * time.Second, PerHour: 5, IPPerHour: 20}
+  n := func(v int64) sql.NullInt64 { return sql.NullInt64{Int64: v, Valid: true} }
+  cases := []struct {
+    name string
+    u    otpUsage
+    want time.Duration
+  }{
+    {"first code", otpUsage{}, 0},
+    {"inside cooldown", otpUsage{SinceLast: n(15), DestCount: 1, DestResetIn: n(3585)}, 45 * time.Second},
+    {"cooldown passed", otpUsage{SinceLast: n(90), DestCount: 2, DestResetIn: n(3000)}, 0},
+    {"destination hourly cap", otpUsage{SinceLast: n(600), DestCount: 5, DestResetIn: n(1200)}, 1200 * time.Second},
+    {"ip hourly cap", otpUsage{IPCount: 20, IPResetIn: n(30)}, 30 * time.Second},
+  }
+  for _, tc := range cases {
+    if got := otpRetryAfter(l, tc.u); got != tc.want {
+      t.Fatalf("%s: want %v, got %v", tc.name, tc.want, got)
+    }
+  }
+}
+
+func TestVerifyOtpCodeLocksAfterMaxAttempts(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  l := otpLimits{MaxAttempts: 3}
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT id, code, attempts, locked_at IS NOT NULL FROM otp_requests`).
+    WithArgs("628123456789", "whatsapp", "register").
+    WillReturnRows(sqlmock.NewRows([]string{"id", "code", "attempts", "locked"}).AddRow("otp-1", "123456", 1, false))
+  mock.ExpectExec(`UPDATE otp_requests SET attempts = \$1`).
+    WithArgs(2, 3, "otp-1").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectQuery(`SELECT id, code, attempts, locked_at IS NOT NULL FROM otp_requests`).
+    WithArgs("628123456789", "whatsapp", "register").
+    WillReturnRows(sqlmock.NewRows([]string{"id", "code", "attempts", "locked"}).AddRow("otp-1", "123456", 2, false))
+  mock.ExpectExec(`UPDATE otp_requests SET attempts = \$1`).
+    WithArgs(3, 3, "otp-1").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectQuery(`SELECT id, code, attempts, locked_at IS NOT NULL FROM otp_requests`).
+    WithArgs("628123456789", "whatsapp", "register").
+    WillReturnRows(sqlmock.NewRows([]string{"id", "code", "attempts", "locked"}).AddRow("otp-1", "123456", 3, true))
+
+  tx, _ := db.Begin()
+  left, err := verifyOtpCodeTx(tx, l, "628123456789", "whatsapp", "register", "000000")
+  if err != errOtpInvalid || left != 1 {
+    t.Fatalf("expected invalid with 1 attempt left, got %d (%v)", left, err)
+  }
+  if _, err := verifyOtpCodeTx(tx, l, "628123456789", "whatsapp", "register", "111111"); err != errOtpLocked {
+    t.Fatalf("expected the last wrong guess to lock the code, got %v", err)
+  }
+  // the right code is refused too once locked
+  if _, err := verifyOtpCodeTx(tx, l, "628123456789", "whatsapp", "register", "123456"); err != errOtpLocked {
+    t.Fatalf("expected locked code to stay locked, got %v", err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("unmet expectations: %v", err)
+  }
+}
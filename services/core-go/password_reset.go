@@ -0,0 +1,85 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "net/http"
+  "strings"
+
+  "golang.org/x/crypto/bcrypt"
+)
+
+func userIDForOtpDestination(db queryRower, dest string, channel string) (string, error) {
+  column := "phone"
+  if channel == "email" {
+    column = "email"
+  }
+  var userID string
+  err := db.QueryRow(`SELECT id FROM users WHERE `+column+` = $1`, dest).Scan(&userID)
+  return userID, err
+}
+
+// sets a new password from a reset_password otp_token and signs the user out everywhere
+func passwordResetHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+      return
+    }
+    var req PasswordResetRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
+      return
+    }
+    if strings.TrimSpace(req.OtpToken) == "" || strings.TrimSpace(req.NewPassword) == "" {
+      writeJSON(w, http.StatusBadRequest, errMsg("otp_token and new_password required"))
+      return
+    }
+    dest, channel, derr := otpDestination(req.Email, req.Phone, req.Channel)
+    if derr != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg(derr.Error()))
+      return
+    }
+    userID, err := userIDForOtpDestination(db, dest, channel)
+    if err == sql.ErrNoRows {
+      writeJSON(w, http.StatusUnauthorized, errMsg("invalid otp token"))
+      return
+    }
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("hash failed"))
+      return
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("db error"))
+      return
+    }
+    defer tx.Rollback()
+    // the token is only spent if the password change commits with it
+    if !consumeOtpToken(tx, dest, channel, "reset_password", req.OtpToken) {
+      writeJSON(w, http.StatusUnauthorized, errMsg("invalid otp token"))
+      return
+    }
+    if _, err := tx.Exec(`UPDATE users SET password_hash = $1, login_locked_until = NULL, login_failures = 0 WHERE id = $2`, string(hash), userID); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("update failed"))
+      return
+    }
+    res, err := tx.Exec(`DELETE FROM sessions WHERE user_id = $1`, userID)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    if err := tx.Commit(); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("db commit failed"))
+      return
+    }
+    revoked, _ := res.RowsAffected()
+    writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "sessions_revoked": revoked})
+  }
+}
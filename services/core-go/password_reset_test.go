@@ -0,0 +1,83 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+
+  "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPasswordResetRevokesSessions(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectQuery(`SELECT id FROM users WHERE email = \$1`).
+    WithArgs("sari@example.com").
+    WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+  mock.ExpectBegin()
+  mock.ExpectQuery(`UPDATE otp_tokens SET used = TRUE\s+WHERE token = \$1 AND destination = \$2 AND channel = \$3 AND purpose = \$4 AND used = FALSE AND expires_at > NOW\(\)\s+RETURNING token`).
+    WithArgs("reset-token", "sari@example.com", "email", "reset_password").
+    WillReturnRows(sqlmock.NewRows([]string{"token"}).AddRow("reset-token"))
+  mock.ExpectExec(`UPDATE users SET password_hash = \$1, login_locked_until = NULL, login_failures = 0 WHERE id = \$2`).
+    WithArgs(sqlmock.AnyArg(), "user-1").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectExec(`DELETE FROM sessions WHERE user_id = \$1`).
+    WithArgs("user-1").
+    WillReturnResult(sqlmock.NewResult(0, 3))
+  mock.ExpectCommit()
+
+  body, _ := json.Marshal(map[string]any{"email": "Sari@Example.com", "otp_token": "reset-token", "new_password": "rahasia-baru"})
+  req := httptest.NewRequest(http.MethodPost, "/auth/password/reset", bytes.NewReader(body))
+  rec := httptest.NewRecorder()
+
+  passwordResetHandler(db).ServeHTTP(rec, req)
+
+  if rec.Code != http.StatusOK {
+    t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+  }
+  var resp map[string]any
+  _ = json.Unmarshal(rec.Body.Bytes(), &resp)
+  if resp["sessions_revoked"] != float64(3) {
+    t.Fatalf("expected 3 sessions revoked, got %v", resp["sessions_revoked"])
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestPasswordResetRejectsUsedToken(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectQuery(`SELECT id FROM users WHERE phone = \$1`).
+    WithArgs("628123456789").
+    WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+  // already used, or spent by a concurrent reset a moment ago: the update matches nothing
+  mock.ExpectBegin()
+  mock.ExpectQuery(`UPDATE otp_tokens SET used = TRUE`).
+    WithArgs("reset-token", "628123456789", "whatsapp", "reset_password").
+    WillReturnRows(sqlmock.NewRows([]string{"token"}))
+  mock.ExpectRollback()
+
+  body, _ := json.Marshal(map[string]any{"phone": "+62 812-3456-789", "otp_token": "reset-token", "new_password": "rahasia-baru"})
+  req := httptest.NewRequest(http.MethodPost, "/auth/password/reset", bytes.NewReader(body))
+  rec := httptest.NewRecorder()
+
+  passwordResetHandler(db).ServeHTTP(rec, req)
+
+  if rec.Code != http.StatusUnauthorized {
+    t.Fatalf("expected 401, got %d", rec.Code)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
@@ -0,0 +1,232 @@
+// Package pricing computes order totals. It does no I/O: callers load the cart,
+// the buyer's tier and wallet, the voucher and the delivery fee, and Price turns
+// them into an itemized breakdown.
+package pricing
+
+import (
+  "errors"
+  "math"
+  "strings"
+)
+
+var (
+  ErrMinSpend       = errors.New("min spend not met")
+  ErrNotEligible    = errors.New("voucher does not apply to any item in the cart")
+  ErrTierNotAllowed = errors.New("voucher not available for your tier")
+)
+
+// IsVoucherError reports whether Price dropped the voucher because of one of its rules.
+func IsVoucherError(err error) bool {
+  return errors.Is(err, ErrMinSpend) || errors.Is(err, ErrNotEligible) || errors.Is(err, ErrTierNotAllowed)
+}
+
+// Stacking policies decide how a voucher combines with the tier discount.
+const (
+  StackWithTier = "stack"
+  ExclusiveTier = "exclusive"
+  BestOfTier    = "best"
+)
+
+type Line struct {
+  ProductID  string
+  VariantID  string
+  CategoryID string
+  UnitPrice  int
+  Qty        int
+}
+
+type Cart struct {
+  Lines []Line
+}
+
+// Customer is the zero value for guests.
+type Customer struct {
+  Member        bool
+  Tier          string
+  DiscountPct   int
+  CashbackPct   int
+  WalletBalance int
+  WalletUse     int
+}
+
+// Voucher has already passed the checks that need the database (dates, quota, per-user
+// limits, first order). CategoryIDs must already include subcategories. Empty
+// ProductIDs, CategoryIDs and Tiers mean no restriction.
+type Voucher struct {
+  Code        string
+  Type        string
+  Value       int
+  MinSpend    int
+  MaxDiscount int
+  ProductIDs  []string
+  CategoryIDs []string
+  Tiers       []string
+  Stacking    string
+}
+
+func (v Voucher) covers(l Line) bool {
+  if len(v.ProductIDs) == 0 && len(v.CategoryIDs) == 0 {
+    return true
+  }
+  for _, id := range v.ProductIDs {
+    if id == l.ProductID {
+      return true
+    }
+  }
+  for _, id := range v.CategoryIDs {
+    if l.CategoryID != "" && id == l.CategoryID {
+      return true
+    }
+  }
+  return false
+}
+
+func (v Voucher) allowsTier(tier string) bool {
+  if len(v.Tiers) == 0 {
+    return true
+  }
+  for _, t := range v.Tiers {
+    if strings.EqualFold(t, tier) {
+      return true
+    }
+  }
+  return false
+}
+
+type Delivery struct {
+  Type string
+  Fee  int
+}
+
+type LineTotal struct {
+  ProductID string `json:"product_id"`
+  VariantID string `json:"variant_id,omitempty"`
+  UnitPrice int    `json:"unit_price"`
+  Qty       int    `json:"qty"`
+  Total     int    `json:"line_total"`
+}
+
+type Breakdown struct {
+  Lines           []LineTotal `json:"lines"`
+  Subtotal        int         `json:"subtotal"`
+  Tier            string      `json:"tier,omitempty"`
+  TierDiscount    int         `json:"tier_discount"`
+  VoucherCode     string      `json:"voucher_code,omitempty"`
+  VoucherDiscount int         `json:"voucher_discount"`
+  Discount        int         `json:"discount"`
+  ShippingFee     int         `json:"shipping_fee"`
+  Cashback        int         `json:"cashback"`
+  WalletUsed      int         `json:"wallet_used"`
+  Total           int         `json:"total"`
+}
+
+// Price applies, in order: tier discount and voucher on the subtotal (combined as the
+// voucher's stacking policy says), the shipping fee, cashback on what is owed before the
+// wallet, then the wallet deduction. voucher may be nil. When the voucher's rules reject
+// the cart the error is one of the voucher errors and the breakdown is priced without it;
+// VoucherCode is only set when the voucher was actually applied.
+func Price(cart Cart, customer Customer, voucher *Voucher, delivery Delivery) (Breakdown, error) {
+  b := Breakdown{Lines: make([]LineTotal, 0, len(cart.Lines)), Tier: customer.Tier}
+  for _, l := range cart.Lines {
+    total := l.UnitPrice * l.Qty
+    b.Lines = append(b.Lines, LineTotal{ProductID: l.ProductID, VariantID: l.VariantID, UnitPrice: l.UnitPrice, Qty: l.Qty, Total: total})
+    b.Subtotal += total
+  }
+  b.TierDiscount = percentOf(b.Subtotal, customer.DiscountPct)
+
+  var err error
+  if voucher != nil {
+    var discount int
+    discount, err = voucherDiscountFor(*voucher, cart, customer)
+    if err == nil {
+      b.VoucherCode = voucher.Code
+      b.VoucherDiscount = discount
+      switch voucher.Stacking {
+      case ExclusiveTier:
+        b.TierDiscount = 0
+      case BestOfTier:
+        if b.TierDiscount > b.VoucherDiscount {
+          b.VoucherCode = ""
+          b.VoucherDiscount = 0
+        } else {
+          b.TierDiscount = 0
+        }
+      }
+    }
+  }
+  b.Discount = b.TierDiscount + b.VoucherDiscount
+  if b.Discount > b.Subtotal {
+    b.Discount = b.Subtotal
+  }
+  if delivery.Fee > 0 {
+    b.ShippingFee = delivery.Fee
+  }
+
+  b.Total = b.Subtotal - b.Discount + b.ShippingFee
+  if b.Total < 0 {
+    b.Total = 0
+  }
+  b.Cashback = percentOf(b.Total, customer.CashbackPct)
+  if customer.Member && customer.WalletUse > 0 {
+    b.WalletUsed = min(customer.WalletUse, customer.WalletBalance, b.Total)
+    if b.WalletUsed < 0 {
+      b.WalletUsed = 0
+    }
+    b.Total -= b.WalletUsed
+  }
+  return b, err
+}
+
+func voucherDiscountFor(v Voucher, cart Cart, customer Customer) (int, error) {
+  if !v.allowsTier(customer.Tier) || (len(v.Tiers) > 0 && !customer.Member) {
+    return 0, ErrTierNotAllowed
+  }
+  eligible := 0
+  matched := false
+  for _, l := range cart.Lines {
+    if v.covers(l) {
+      matched = true
+      eligible += l.UnitPrice * l.Qty
+    }
+  }
+  if !matched {
+    return 0, ErrNotEligible
+  }
+  return VoucherDiscount(v, eligible)
+}
+
+// VoucherDiscount works on the subtotal of the lines the voucher covers: min spend is
+// checked against it and the discount never exceeds it. "percent" vouchers take Value
+// percent, capped at MaxDiscount when that is set; anything else is a fixed amount.
+func VoucherDiscount(v Voucher, subtotal int) (int, error) {
+  if subtotal < v.MinSpend {
+    return 0, ErrMinSpend
+  }
+  discount := v.Value
+  if strings.EqualFold(v.Type, "percent") {
+    discount = percentOf(subtotal, v.Value)
+  }
+  if v.MaxDiscount > 0 && discount > v.MaxDiscount {
+    discount = v.MaxDiscount
+  }
+  if discount < 0 {
+    discount = 0
+  }
+  if discount > subtotal {
+    discount = subtotal
+  }
+  return discount, nil
+}
+
+// PerKmFee rounds the distance fee up to the next rupiah and applies the minimum fee.
+func PerKmFee(distanceKm float64, perKm int, minFee int) int {
+  fee := int(math.Ceil(distanceKm * float64(perKm)))
+  if fee < minFee {
+    fee = minFee
+  }
+  return fee
+}
+
+func percentOf(amount int, pct int) int {
+  return amount * pct / 100
+}
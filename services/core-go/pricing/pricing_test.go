@@ -0,0 +1,151 @@
+package pricing
+
+import (
+  "reflect"
+  "testing"
+)
+
+func TestPrice(t *testing.T) {
+  cart := Cart{Lines: []Line{
+    {ProductID: "prod-1", CategoryID: "cat-food", UnitPrice: 10000, Qty: 2},
+    {ProductID: "prod-2", VariantID: "var-1", CategoryID: "cat-vitamin", UnitPrice: 15000, Qty: 1},
+  }}
+  gold := Customer{Member: true, Tier: "Gold", DiscountPct: 5, CashbackPct: 2, WalletBalance: 3000}
+  cases := []struct {
+    name     string
+    customer Customer
+    voucher  *Voucher
+    delivery Delivery
+    want     Breakdown
+    err      error
+  }{
+    {
+      name:     "guest, no extras",
+      delivery: Delivery{Type: "zone", Fee: 5000},
+      want:     Breakdown{Subtotal: 35000, ShippingFee: 5000, Total: 40000},
+    },
+    {
+      name:     "tier discount and cashback",
+      customer: gold,
+      delivery: Delivery{Type: "zone", Fee: 5000},
+      want:     Breakdown{Tier: "Gold", Subtotal: 35000, TierDiscount: 1750, Discount: 1750, ShippingFee: 5000, Cashback: 765, Total: 38250},
+    },
+    {
+      name:     "percent voucher stacks with tier",
+      customer: gold,
+      voucher:  &Voucher{Code: "HEMAT10", Type: "percent", Value: 10},
+      want:     Breakdown{Tier: "Gold", Subtotal: 35000, TierDiscount: 1750, VoucherCode: "HEMAT10", VoucherDiscount: 3500, Discount: 5250, Cashback: 595, Total: 29750},
+    },
+    {
+      name:    "fixed voucher capped at subtotal",
+      voucher: &Voucher{Code: "BIG", Type: "fixed", Value: 50000},
+      want:    Breakdown{Subtotal: 35000, VoucherCode: "BIG", VoucherDiscount: 35000, Discount: 35000, Total: 0},
+    },
+    {
+      name:     "min spend not met prices without voucher",
+      voucher:  &Voucher{Code: "MIN50", Type: "fixed", Value: 5000, MinSpend: 50000},
+      delivery: Delivery{Fee: 5000},
+      want:     Breakdown{Subtotal: 35000, ShippingFee: 5000, Total: 40000},
+      err:      ErrMinSpend,
+    },
+    {
+      name:    "percent voucher capped at max discount",
+      voucher: &Voucher{Code: "CAP", Type: "percent", Value: 50, MaxDiscount: 5000},
+      want:    Breakdown{Subtotal: 35000, VoucherCode: "CAP", VoucherDiscount: 5000, Discount: 5000, Total: 30000},
+    },
+    {
+      name:    "category scoped voucher only discounts its lines",
+      voucher: &Voucher{Code: "VIT20", Type: "percent", Value: 20, CategoryIDs: []string{"cat-vitamin"}},
+      want:    Breakdown{Subtotal: 35000, VoucherCode: "VIT20", VoucherDiscount: 3000, Discount: 3000, Total: 32000},
+    },
+    {
+      name:    "min spend counts only eligible lines",
+      voucher: &Voucher{Code: "VIT", Type: "fixed", Value: 2000, MinSpend: 20000, CategoryIDs: []string{"cat-vitamin"}},
+      want:    Breakdown{Subtotal: 35000, Total: 35000},
+      err:     ErrMinSpend,
+    },
+    {
+      name:    "product scoped fixed voucher capped at eligible lines",
+      voucher: &Voucher{Code: "P1", Type: "fixed", Value: 25000, ProductIDs: []string{"prod-1"}},
+      want:    Breakdown{Subtotal: 35000, VoucherCode: "P1", VoucherDiscount: 20000, Discount: 20000, Total: 15000},
+    },
+    {
+      name:    "no eligible lines",
+      voucher: &Voucher{Code: "TOYS", Type: "fixed", Value: 5000, CategoryIDs: []string{"cat-toys"}},
+      want:    Breakdown{Subtotal: 35000, Total: 35000},
+      err:     ErrNotEligible,
+    },
+    {
+      name:     "tier restricted voucher",
+      customer: Customer{Member: true, Tier: "Silver"},
+      voucher:  &Voucher{Code: "GOLDONLY", Type: "fixed", Value: 5000, Tiers: []string{"Gold", "Platinum"}},
+      want:     Breakdown{Tier: "Silver", Subtotal: 35000, Total: 35000},
+      err:      ErrTierNotAllowed,
+    },
+    {
+      name:     "exclusive voucher replaces tier discount",
+      customer: gold,
+      voucher:  &Voucher{Code: "EXCL", Type: "fixed", Value: 1000, Stacking: ExclusiveTier},
+      want:     Breakdown{Tier: "Gold", Subtotal: 35000, VoucherCode: "EXCL", VoucherDiscount: 1000, Discount: 1000, Cashback: 680, Total: 34000},
+    },
+    {
+      name:     "best of tier keeps the tier discount when it is larger",
+      customer: gold,
+      voucher:  &Voucher{Code: "BEST", Type: "fixed", Value: 1000, Stacking: BestOfTier},
+      want:     Breakdown{Tier: "Gold", Subtotal: 35000, TierDiscount: 1750, Discount: 1750, Cashback: 665, Total: 33250},
+    },
+    {
+      name:     "best of tier takes the voucher when it is larger",
+      customer: gold,
+      voucher:  &Voucher{Code: "BEST", Type: "fixed", Value: 2000, Stacking: BestOfTier},
+      want:     Breakdown{Tier: "Gold", Subtotal: 35000, VoucherCode: "BEST", VoucherDiscount: 2000, Discount: 2000, Cashback: 660, Total: 33000},
+    },
+    {
+      name:     "wallet capped at balance",
+      customer: Customer{Member: true, WalletBalance: 3000, WalletUse: 10000},
+      want:     Breakdown{Subtotal: 35000, WalletUsed: 3000, Total: 32000},
+    },
+    {
+      name:     "wallet capped at total",
+      customer: Customer{Member: true, WalletBalance: 100000, WalletUse: 100000},
+      voucher:  &Voucher{Code: "HALF", Type: "percent", Value: 50},
+      want:     Breakdown{Subtotal: 35000, VoucherCode: "HALF", VoucherDiscount: 17500, Discount: 17500, WalletUsed: 17500, Total: 0},
+    },
+    {
+      name:     "guests cannot use the wallet",
+      customer: Customer{WalletBalance: 5000, WalletUse: 5000},
+      want:     Breakdown{Subtotal: 35000, Total: 35000},
+    },
+  }
+  for _, tc := range cases {
+    got, err := Price(cart, tc.customer, tc.voucher, tc.delivery)
+    if err != tc.err {
+      t.Fatalf("%s: expected error %v, got %v", tc.name, tc.err, err)
+    }
+    if len(got.Lines) != 2 || got.Lines[0].Total != 20000 || got.Lines[1].Total != 15000 {
+      t.Fatalf("%s: unexpected lines %+v", tc.name, got.Lines)
+    }
+    got.Lines = nil
+    if !reflect.DeepEqual(got, tc.want) {
+      t.Fatalf("%s:\n got  %+v\n want %+v", tc.name, got, tc.want)
+    }
+  }
+}
+
+func TestPerKmFee(t *testing.T) {
+  cases := []struct {
+    dist   float64
+    perKm  int
+    minFee int
+    want   int
+  }{
+    {1.2, 3000, 5000, 5000},
+    {2.5, 3000, 5000, 7500},
+    {2.0001, 3000, 0, 6001},
+  }
+  for _, tc := range cases {
+    if got := PerKmFee(tc.dist, tc.perKm, tc.minFee); got != tc.want {
+      t.Fatalf("PerKmFee(%v, %d, %d) = %d, want %d", tc.dist, tc.perKm, tc.minFee, got, tc.want)
+    }
+  }
+}
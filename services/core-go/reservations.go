@@ -0,0 +1,232 @@
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "log"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const productHeldSQL = `COALESCE((SELECT SUM(sr.qty) FROM stock_reservations sr WHERE sr.product_id = p.id AND sr.status = 'ACTIVE' AND sr.expires_at > NOW()), 0)`
+
+const variantHeldSQL = `COALESCE((SELECT SUM(sr.qty) FROM stock_reservations sr WHERE sr.variant_id = v.id AND sr.status = 'ACTIVE' AND sr.expires_at > NOW()), 0)`
+
+func stockHoldExpiry() time.Time {
+  ttl := 30
+  if v := strings.TrimSpace(os.Getenv("STOCK_HOLD_MINUTES")); v != "" {
+    if n, err := strconv.Atoi(v); err == nil && n > 0 {
+      ttl = n
+    }
+  }
+  return time.Now().Add(time.Duration(ttl) * time.Minute)
+}
+
+type reservedLine struct {
+  id        string
+  productID string
+  variantID string
+  qty       int
+  lapsed    bool
+}
+
+func orderReservationsTx(tx *sql.Tx, orderID string, status string) ([]reservedLine, error) {
+  rows, err := tx.Query(`SELECT id, product_id, variant_id, qty FROM stock_reservations WHERE order_id = $1 AND status = $2 FOR UPDATE`, orderID, status)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  out := []reservedLine{}
+  for rows.Next() {
+    var it reservedLine
+    var variantID sql.NullString
+    if err := rows.Scan(&it.id, &it.productID, &variantID, &it.qty); err != nil {
+      return nil, err
+    }
+    it.variantID = variantID.String
+    out = append(out, it)
+  }
+  return out, rows.Err()
+}
+
+// holds of an unpaid order, including the ones the reaper let go; lapsed marks those whose
+// quantity is no longer counted out of available stock, which is also true of an ACTIVE
+// hold past its expiry that the reaper has not reached yet
+func payableReservationsTx(tx *sql.Tx, orderID string) ([]reservedLine, error) {
+  rows, err := tx.Query(`SELECT id, product_id, variant_id, qty, status = 'EXPIRED' OR expires_at <= NOW() FROM stock_reservations
+    WHERE order_id = $1 AND status IN ('ACTIVE','EXPIRED') ORDER BY product_id FOR UPDATE`, orderID)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  out := []reservedLine{}
+  for rows.Next() {
+    var it reservedLine
+    var variantID sql.NullString
+    if err := rows.Scan(&it.id, &it.productID, &variantID, &it.qty, &it.lapsed); err != nil {
+      return nil, err
+    }
+    it.variantID = variantID.String
+    out = append(out, it)
+  }
+  return out, rows.Err()
+}
+
+// a lapsed hold has to find its stock again before it can be sold. The product row is locked
+// the way checkout locks it, and availability is read by a fresh statement after the lock.
+// A line that cannot be covered any more is returned as a short description, not an error:
+// the money has been taken by then, so the payment is recorded either way.
+func reclaimLapsedHoldTx(tx *sql.Tx, it reservedLine) (string, error) {
+  if _, err := tx.Exec(`SELECT id FROM products WHERE id = $1 FOR UPDATE`, it.productID); err != nil {
+    return "", err
+  }
+  var name string
+  var available int
+  var err error
+  if it.variantID != "" {
+    err = tx.QueryRow(`SELECT p.name, v.stock - `+variantHeldSQL+` FROM product_variants v JOIN products p ON v.product_id = p.id WHERE v.id = $1`, it.variantID).
+      Scan(&name, &available)
+  } else {
+    err = tx.QueryRow(`SELECT p.name, p.stock - `+productHeldSQL+` FROM products p WHERE p.id = $1`, it.productID).
+      Scan(&name, &available)
+  }
+  if err == sql.ErrNoRows {
+    return fmt.Sprintf("%dx product %s (deleted)", it.qty, it.productID), nil
+  }
+  if err != nil {
+    return "", err
+  }
+  if available < it.qty {
+    return fmt.Sprintf("%dx %s (available %d)", it.qty, name, max(available, 0)), nil
+  }
+  return "", nil
+}
+
+// sells the order's holds. Lines whose lapsed hold found no stock again are left EXPIRED,
+// so nothing is sold or later returned for them, and are listed in the result.
+func commitOrderReservationsTx(tx *sql.Tx, orderID string, actorType string, actorID string) ([]string, error) {
+  lines, err := payableReservationsTx(tx, orderID)
+  if err != nil {
+    return nil, err
+  }
+  short := []string{}
+  for _, it := range lines {
+    if it.lapsed {
+      missing, err := reclaimLapsedHoldTx(tx, it)
+      if err != nil {
+        return nil, err
+      }
+      if missing != "" {
+        short = append(short, missing)
+        continue
+      }
+    }
+    _, _, err := applyStockMovementTx(tx, inventoryMovement{
+      ProductID: it.productID,
+      VariantID: it.variantID,
+      Kind:      "SALE",
+      Delta:     -it.qty,
+      OrderID:   orderID,
+      ActorType: actorType,
+      ActorID:   actorID,
+    })
+    if err != nil {
+      return nil, err
+    }
+    if _, err := tx.Exec(`UPDATE products SET sold_count = sold_count + $1 WHERE id = $2`, it.qty, it.productID); err != nil {
+      return nil, err
+    }
+    if _, err := tx.Exec(`UPDATE stock_reservations SET status = 'COMMITTED', resolved_at = NOW() WHERE id = $1`, it.id); err != nil {
+      return nil, err
+    }
+  }
+  return short, nil
+}
+
+func releaseOrderStockTx(tx *sql.Tx, orderID string, actorType string, actorID string) error {
+  if _, err := tx.Exec(`UPDATE stock_reservations SET status = 'RELEASED', resolved_at = NOW() WHERE order_id = $1 AND status = 'ACTIVE'`, orderID); err != nil {
+    return err
+  }
+  lines, err := orderReservationsTx(tx, orderID, "COMMITTED")
+  if err != nil {
+    return err
+  }
+  var legacy bool
+  if err := tx.QueryRow(`SELECT NOT EXISTS (SELECT 1 FROM stock_reservations WHERE order_id = $1)`, orderID).Scan(&legacy); err != nil {
+    return err
+  }
+  if legacy {
+    lines, err = legacyOrderLinesTx(tx, orderID)
+    if err != nil {
+      return err
+    }
+  }
+  for _, it := range lines {
+    _, _, err := applyStockMovementTx(tx, inventoryMovement{
+      ProductID: it.productID,
+      VariantID: it.variantID,
+      Kind:      "RETURN",
+      Delta:     it.qty,
+      OrderID:   orderID,
+      ActorType: actorType,
+      ActorID:   actorID,
+    })
+    if err != nil {
+      return err
+    }
+    if _, err := tx.Exec(`UPDATE products SET sold_count = GREATEST(sold_count - $1, 0) WHERE id = $2`, it.qty, it.productID); err != nil {
+      return err
+    }
+    if it.id != "" {
+      if _, err := tx.Exec(`UPDATE stock_reservations SET status = 'RETURNED', resolved_at = NOW() WHERE id = $1`, it.id); err != nil {
+        return err
+      }
+    }
+  }
+  return nil
+}
+
+func legacyOrderLinesTx(tx *sql.Tx, orderID string) ([]reservedLine, error) {
+  rows, err := tx.Query(`SELECT product_id, variant_id, qty FROM order_items WHERE order_id = $1 AND product_id IS NOT NULL`, orderID)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  out := []reservedLine{}
+  for rows.Next() {
+    var it reservedLine
+    var variantID sql.NullString
+    if err := rows.Scan(&it.productID, &variantID, &it.qty); err != nil {
+      return nil, err
+    }
+    it.variantID = variantID.String
+    out = append(out, it)
+  }
+  return out, rows.Err()
+}
+
+func runStockReservationReaper(db *sql.DB, every time.Duration) {
+  ticker := time.NewTicker(every)
+  defer ticker.Stop()
+  for range ticker.C {
+    if n, err := reapExpiredReservations(db); err != nil {
+      log.Printf("stock reservation reaper: %v", err)
+    } else if n > 0 {
+      log.Printf("stock reservation reaper: released %d expired holds", n)
+    }
+  }
+}
+
+// expired holds give their stock back to the shelf but the order stays PENDING: the payment
+// window at Midtrans is usually longer than the hold, and its own expiry fails the order.
+// A payment that still arrives reclaims the stock in commitOrderReservationsTx.
+func reapExpiredReservations(db *sql.DB) (int, error) {
+  res, err := db.Exec(`UPDATE stock_reservations SET status = 'EXPIRED', resolved_at = NOW() WHERE status = 'ACTIVE' AND expires_at <= NOW()`)
+  if err != nil {
+    return 0, err
+  }
+  n, err := res.RowsAffected()
+  return int(n), err
+}
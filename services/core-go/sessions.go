@@ -0,0 +1,219 @@
+package main
+
+import (
+  "crypto/sha256"
+  "database/sql"
+  "encoding/hex"
+  "log"
+  "net/http"
+  "strings"
+  "time"
+)
+
+// only a digest of the token is stored, so a leaked sessions table cannot be replayed.
+// Tokens are 32 random bytes, which is why a plain hash is enough here.
+func hashSessionToken(token string) string {
+  sum := sha256.Sum256([]byte(token))
+  return hex.EncodeToString(sum[:])
+}
+
+// a short "Browser on OS" label for the session list
+func deviceLabel(ua string) string {
+  s := strings.ToLower(ua)
+  if s == "" {
+    return "Unknown device"
+  }
+  osName := ""
+  switch {
+  case strings.Contains(s, "iphone"):
+    osName = "iPhone"
+  case strings.Contains(s, "ipad"):
+    osName = "iPad"
+  case strings.Contains(s, "android"):
+    osName = "Android"
+  case strings.Contains(s, "windows"):
+    osName = "Windows"
+  case strings.Contains(s, "mac os"):
+    osName = "macOS"
+  case strings.Contains(s, "linux"):
+    osName = "Linux"
+  }
+  browser := ""
+  switch {
+  case strings.Contains(s, "edg/"):
+    browser = "Edge"
+  case strings.Contains(s, "opr/"):
+    browser = "Opera"
+  case strings.Contains(s, "samsungbrowser"):
+    browser = "Samsung Internet"
+  case strings.Contains(s, "firefox/"), strings.Contains(s, "fxios/"):
+    browser = "Firefox"
+  case strings.Contains(s, "chrome/"), strings.Contains(s, "crios/"):
+    browser = "Chrome"
+  case strings.Contains(s, "safari/"):
+    browser = "Safari"
+  }
+  switch {
+  case browser != "" && osName != "":
+    return browser + " on " + osName
+  case browser != "":
+    return browser
+  case osName != "":
+    return osName
+  }
+  return "Unknown device"
+}
+
+// starts a session for userID and returns the token to hand to the client
+func createSession(db *sql.DB, userID string, r *http.Request) (string, error) {
+  token := generateToken()
+  ua := r.UserAgent()
+  _, err := db.Exec(`INSERT INTO sessions (token_hash, user_id, device, ip, user_agent, expires_at) VALUES ($1,$2,$3,$4,$5,$6)`,
+    hashSessionToken(token), userID, deviceLabel(ua), nullIfEmpty(clientIP(r)), nullIfEmpty(ua), sessionExpiry())
+  if err != nil {
+    return "", err
+  }
+  return token, nil
+}
+
+func currentSession(db *sql.DB, r *http.Request) (string, string, error) {
+  token := r.Header.Get("X-Auth-Token")
+  if token == "" {
+    return "", "", sql.ErrNoRows
+  }
+  var userID, sessionID string
+  err := db.QueryRow(`SELECT user_id, id FROM sessions WHERE token_hash = $1 AND expires_at > NOW()`, hashSessionToken(token)).
+    Scan(&userID, &sessionID)
+  return userID, sessionID, err
+}
+
+func meSessionsHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    userID, sessionID, err := currentSession(db, r)
+    if err != nil {
+      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+      return
+    }
+    switch r.Method {
+    case http.MethodGet:
+      rows, err := db.Query(`SELECT id, device, ip, user_agent, last_seen_at, expires_at, created_at FROM sessions
+        WHERE user_id = $1 AND expires_at > NOW()
+        ORDER BY last_seen_at DESC`, userID)
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      defer rows.Close()
+      out := []map[string]any{}
+      for rows.Next() {
+        var id, lastSeen, expiresAt, createdAt string
+        var device, ip, ua sql.NullString
+        if err := rows.Scan(&id, &device, &ip, &ua, &lastSeen, &expiresAt, &createdAt); err != nil {
+          writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+          return
+        }
+        out = append(out, map[string]any{
+          "id":           id,
+          "device":       device.String,
+          "ip":           ip.String,
+          "user_agent":   ua.String,
+          "last_seen_at": lastSeen,
+          "expires_at":   expiresAt,
+          "created_at":   createdAt,
+          "current":      id == sessionID,
+        })
+      }
+      if err := rows.Err(); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      writeJSON(w, http.StatusOK, out)
+    case http.MethodDelete:
+      // log out everywhere; ?keep_current=true spares the session making the call
+      query := `DELETE FROM sessions WHERE user_id = $1`
+      args := []any{userID}
+      if r.URL.Query().Get("keep_current") == "true" {
+        query += ` AND id <> $2`
+        args = append(args, sessionID)
+      }
+      res, err := db.Exec(query, args...)
+      if err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      revoked, _ := res.RowsAffected()
+      writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "sessions_revoked": revoked})
+    default:
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+    }
+  }
+}
+
+func meSessionItemHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    userID, sessionID, err := currentSession(db, r)
+    if err != nil {
+      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+      return
+    }
+    id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/me/sessions/"), "/")
+    if id == "" {
+      writeJSON(w, http.StatusBadRequest, errMsg("missing id"))
+      return
+    }
+    if id == "rotate" {
+      rotateSessionHandler(db, sessionID, w, r)
+      return
+    }
+    if r.Method != http.MethodDelete {
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+      return
+    }
+    res, err := db.Exec(`DELETE FROM sessions WHERE id::text = $1 AND user_id = $2`, id, userID)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+      writeJSON(w, http.StatusNotFound, errMsg("session not found"))
+      return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "current": id == sessionID})
+  }
+}
+
+// swaps the token of the calling session for a fresh one; the old token stops working at once
+func rotateSessionHandler(db *sql.DB, sessionID string, w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+    return
+  }
+  token := generateToken()
+  expiresAt := sessionExpiry()
+  res, err := db.Exec(`UPDATE sessions SET token_hash = $1, expires_at = $2, last_seen_at = NOW() WHERE id = $3`,
+    hashSessionToken(token), expiresAt, sessionID)
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  if n, _ := res.RowsAffected(); n == 0 {
+    writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+    return
+  }
+  writeJSON(w, http.StatusOK, map[string]any{"token": token, "expires_at": expiresAt})
+}
+
+func runSessionJanitor(db *sql.DB, every time.Duration) {
+  ticker := time.NewTicker(every)
+  defer ticker.Stop()
+  for range ticker.C {
+    res, err := db.Exec(`DELETE FROM sessions WHERE expires_at <= NOW()`)
+    if err != nil {
+      log.Printf("session janitor: %v", err)
+      continue
+    }
+    if n, _ := res.RowsAffected(); n > 0 {
+      log.Printf("session janitor: removed %d expired sessions", n)
+    }
+  }
+}
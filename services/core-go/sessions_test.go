@@ -0,0 +1,91 @@
+package main
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+
+  "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestDeviceLabel(t *testing.T) {
+  cases := map[string]string{
+    "Mozilla/5.0 (Linux; Android 13; SM-A536E) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Mobile Safari/537.36": "Chrome on Android",
+    "Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1": "Safari on iPhone",
+    "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36 Edg/120.0":           "Edge on Windows",
+    "curl/8.4.0": "Unknown device",
+    "":           "Unknown device",
+  }
+  for ua, want := range cases {
+    if got := deviceLabel(ua); got != want {
+      t.Fatalf("%q: want %q, got %q", ua, want, got)
+    }
+  }
+}
+
+func TestLogoutEverywhereKeepsCurrent(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectQuery(`SELECT user_id, id FROM sessions WHERE token_hash = \$1`).
+    WithArgs(hashSessionToken("member-token")).
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "id"}).AddRow("user-1", "session-1"))
+  mock.ExpectExec(`DELETE FROM sessions WHERE user_id = \$1 AND id <> \$2`).
+    WithArgs("user-1", "session-1").
+    WillReturnResult(sqlmock.NewResult(0, 2))
+
+  req := httptest.NewRequest(http.MethodDelete, "/me/sessions?keep_current=true", nil)
+  req.Header.Set("X-Auth-Token", "member-token")
+  rec := httptest.NewRecorder()
+
+  meSessionsHandler(db).ServeHTTP(rec, req)
+
+  if rec.Code != http.StatusOK {
+    t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+  }
+  var resp map[string]any
+  _ = json.Unmarshal(rec.Body.Bytes(), &resp)
+  if resp["sessions_revoked"] != float64(2) {
+    t.Fatalf("expected 2 sessions revoked, got %v", resp["sessions_revoked"])
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestSessionSlidesOnlyWhenStale(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  req := httptest.NewRequest(http.MethodGet, "/me", nil)
+  req.Header.Set("X-Auth-Token", "member-token")
+
+  // seen a minute ago: read only
+  mock.ExpectQuery(`SELECT user_id, id, last_seen_at < NOW\(\) - interval '5 minutes' FROM sessions`).
+    WithArgs(hashSessionToken("member-token")).
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "id", "stale"}).AddRow("user-1", "session-1", false))
+  if id, err := getUserIDFromToken(db, req); err != nil || id != "user-1" {
+    t.Fatalf("expected user-1, got %q (%v)", id, err)
+  }
+
+  // seen ten minutes ago: the expiry is pushed out again
+  mock.ExpectQuery(`SELECT user_id, id, last_seen_at < NOW\(\) - interval '5 minutes' FROM sessions`).
+    WithArgs(hashSessionToken("member-token")).
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "id", "stale"}).AddRow("user-1", "session-1", true))
+  mock.ExpectExec(`UPDATE sessions SET last_seen_at = NOW\(\), expires_at = GREATEST\(expires_at, \$2\)\s+WHERE id = \$1 AND last_seen_at < NOW\(\) - interval '5 minutes'`).
+    WithArgs("session-1", sqlmock.AnyArg()).
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  if id, err := getUserIDFromToken(db, req); err != nil || id != "user-1" {
+    t.Fatalf("expected user-1, got %q (%v)", id, err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha1"
+  "crypto/sha256"
+  "database/sql"
+  "encoding/base32"
+  "encoding/base64"
+  "encoding/binary"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+  "net/url"
+  "os"
+  "strings"
+  "time"
+
+  "golang.org/x/crypto/bcrypt"
+)
+
+const (
+  totpIssuer        = "Petshop Bento"
+  totpPeriod        = 30
+  totpDigits        = 6
+  totpRecoveryCount = 10
+)
+
+var (
+  errTotpRequired      = errors.New("two-factor code required")
+  errTotpInvalid       = errors.New("invalid two-factor code")
+  errTotpSetupRequired = errors.New("two-factor setup required")
+  errTotpKeyMissing    = errors.New("TOTP_ENCRYPTION_KEY is not set")
+  errTotpKeyWeak       = errors.New("TOTP_ENCRYPTION_KEY must be at least 16 characters and not the example value")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// owner and admin accounts cannot use the admin API until they have TOTP turned on;
+// everyone else may opt in
+func totpRequiredRole(isAdmin bool, role string) bool {
+  return isAdmin && (strings.EqualFold(role, "owner") || strings.EqualFold(role, "admin"))
+}
+
+func generateTotpSecret() string {
+  b := make([]byte, 20)
+  _, _ = rand.Read(b)
+  return totpEncoding.EncodeToString(b)
+}
+
+const totpSealPrefix = "v1:"
+
+// secrets are stored sealed with AES-256-GCM under a key derived from TOTP_ENCRYPTION_KEY, so
+// a copy of the users table alone does not hand out working second factors
+func totpCipher() (cipher.AEAD, error) {
+  key := strings.TrimSpace(os.Getenv("TOTP_ENCRYPTION_KEY"))
+  if key == "" {
+    return nil, errTotpKeyMissing
+  }
+  if len(key) < 16 || strings.HasPrefix(key, "CHANGE_ME") {
+    return nil, errTotpKeyWeak
+  }
+  sum := sha256.Sum256([]byte(key))
+  block, err := aes.NewCipher(sum[:])
+  if err != nil {
+    return nil, err
+  }
+  return cipher.NewGCM(block)
+}
+
+// the user id is the additional data, so a sealed secret copied onto another account fails to open
+func sealTotpSecret(userID string, secret string) (string, error) {
+  aead, err := totpCipher()
+  if err != nil {
+    return "", err
+  }
+  nonce := make([]byte, aead.NonceSize())
+  if _, err := rand.Read(nonce); err != nil {
+    return "", err
+  }
+  return totpSealPrefix + base64.RawStdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(secret), []byte(userID))), nil
+}
+
+// values without the prefix were stored before secrets were sealed and are returned as they
+// are; sealPlainTotpSecrets converts them at startup
+func openTotpSecret(userID string, stored string) (string, error) {
+  if !strings.HasPrefix(stored, totpSealPrefix) {
+    return stored, nil
+  }
+  aead, err := totpCipher()
+  if err != nil {
+    return "", err
+  }
+  raw, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(stored, totpSealPrefix))
+  if err != nil || len(raw) < aead.NonceSize() {
+    return "", errors.New("stored two-factor secret is malformed")
+  }
+  n := aead.NonceSize()
+  plain, err := aead.Open(nil, raw[:n], raw[n:], []byte(userID))
+  if err != nil {
+    return "", errors.New("stored two-factor secret does not open with TOTP_ENCRYPTION_KEY")
+  }
+  return string(plain), nil
+}
+
+func sealPlainTotpSecrets(db *sql.DB) (int, error) {
+  if _, err := totpCipher(); err != nil {
+    return 0, err
+  }
+  rows, err := db.Query(`SELECT id, totp_secret FROM users WHERE totp_secret IS NOT NULL AND totp_secret NOT LIKE 'v1:%'`)
+  if err != nil {
+    return 0, err
+  }
+  type plain struct{ userID, secret string }
+  found := []plain{}
+  for rows.Next() {
+    var p plain
+    if err := rows.Scan(&p.userID, &p.secret); err != nil {
+      rows.Close()
+      return 0, err
+    }
+    found = append(found, p)
+  }
+  rows.Close()
+  if err := rows.Err(); err != nil {
+    return 0, err
+  }
+  sealed := 0
+  for _, p := range found {
+    v, err := sealTotpSecret(p.userID, p.secret)
+    if err != nil {
+      return sealed, err
+    }
+    if _, err := db.Exec(`UPDATE users SET totp_secret = $1 WHERE id = $2 AND totp_secret = $3`, v, p.userID, p.secret); err != nil {
+      return sealed, err
+    }
+    sealed++
+  }
+  return sealed, nil
+}
+
+// RFC 6238 with the RFC 4226 truncation: HMAC-SHA1 over the 30 second step counter
+func totpCode(secret string, step int64) (string, error) {
+  key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+  if err != nil {
+    return "", err
+  }
+  var msg [8]byte
+  binary.BigEndian.PutUint64(msg[:], uint64(step))
+  mac := hmac.New(sha1.New, key)
+  mac.Write(msg[:])
+  sum := mac.Sum(nil)
+  offset := sum[len(sum)-1] & 0x0f
+  n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+  return fmt.Sprintf("%0*d", totpDigits, n%1000000), nil
+}
+
+// accepts the current step and one either side for clock drift. A step at or before
+// lastStep was already used and is refused, so a code cannot be replayed.
+func verifyTotp(secret string, code string, now time.Time, lastStep int64) (int64, bool) {
+  code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+  if len(code) != totpDigits {
+    return 0, false
+  }
+  current := now.Unix() / totpPeriod
+  for _, step := range []int64{current - 1, current, current + 1} {
+    if step <= lastStep {
+      continue
+    }
+    want, err := totpCode(secret, step)
+    if err != nil {
+      return 0, false
+    }
+    if hmac.Equal([]byte(want), []byte(code)) {
+      return step, true
+    }
+  }
+  return 0, false
+}
+
+func totpURI(secret string, account string) string {
+  label := url.PathEscape(totpIssuer + ":" + account)
+  q := url.Values{}
+  q.Set("secret", secret)
+  q.Set("issuer", totpIssuer)
+  q.Set("algorithm", "SHA1")
+  q.Set("digits", fmt.Sprint(totpDigits))
+  q.Set("period", fmt.Sprint(totpPeriod))
+  return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+func generateRecoveryCodes(n int) []string {
+  const alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+  out := make([]string, 0, n)
+  for i := 0; i < n; i++ {
+    b := make([]byte, 10)
+    _, _ = rand.Read(b)
+    for j := range b {
+      b[j] = alphabet[int(b[j])%len(alphabet)]
+    }
+    out = append(out, string(b[:5])+"-"+string(b[5:]))
+  }
+  return out
+}
+
+func hashRecoveryCode(code string) string {
+  code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+  sum := sha256.Sum256([]byte(code))
+  return hex.EncodeToString(sum[:])
+}
+
+// Secret is the opened secret; Stored is the column value, for conditional updates
+type totpState struct {
+  Secret   string
+  Stored   string
+  Enabled  bool
+  LastStep int64
+}
+
+func loadTotpState(db queryRower, userID string) (totpState, error) {
+  var st totpState
+  var secret sql.NullString
+  err := db.QueryRow(`SELECT totp_secret, totp_enabled_at IS NOT NULL, totp_last_step FROM users WHERE id = $1`, userID).
+    Scan(&secret, &st.Enabled, &st.LastStep)
+  if err != nil {
+    return st, err
+  }
+  st.Stored = secret.String
+  st.Secret, err = openTotpSecret(userID, st.Stored)
+  return st, err
+}
+
+// checks a TOTP code or, failing that, burns one recovery code. The last used step is
+// moved forward with a conditional update so two requests cannot both spend one code.
+func useSecondFactor(db *sql.DB, userID string, st totpState, code string, recovery string) error {
+  if strings.TrimSpace(code) != "" {
+    step, ok := verifyTotp(st.Secret, code, time.Now(), st.LastStep)
+    if !ok {
+      return errTotpInvalid
+    }
+    res, err := db.Exec(`UPDATE users SET totp_last_step = $2 WHERE id = $1 AND totp_last_step < $2`, userID, step)
+    if err != nil {
+      return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+      return errTotpInvalid
+    }
+    return nil
+  }
+  if strings.TrimSpace(recovery) != "" {
+    res, err := db.Exec(`UPDATE totp_recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+      userID, hashRecoveryCode(recovery))
+    if err != nil {
+      return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+      return errTotpInvalid
+    }
+    return nil
+  }
+  return errTotpRequired
+}
+
+// the second step of a login whose first factor already passed; reports whether the
+// account has TOTP on so callers can tell owners and admins to set it up
+func checkLoginTotp(db *sql.DB, userID string, code string, recovery string) (bool, error) {
+  st, err := loadTotpState(db, userID)
+  if err != nil {
+    return false, err
+  }
+  if !st.Enabled {
+    return false, nil
+  }
+  return true, useSecondFactor(db, userID, st, code, recovery)
+}
+
+func replaceRecoveryCodesTx(tx *sql.Tx, userID string) ([]string, error) {
+  if _, err := tx.Exec(`DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID); err != nil {
+    return nil, err
+  }
+  codes := generateRecoveryCodes(totpRecoveryCount)
+  for _, c := range codes {
+    if _, err := tx.Exec(`INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES ($1,$2)`, userID, hashRecoveryCode(c)); err != nil {
+      return nil, err
+    }
+  }
+  return codes, nil
+}
+
+func meTotpHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    userID, sessionID, err := currentSession(db, r)
+    if err != nil {
+      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+      return
+    }
+    action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/me/2fa"), "/")
+    if action == "" {
+      if r.Method != http.MethodGet {
+        writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+        return
+      }
+      totpStatusHandler(db, userID, w)
+      return
+    }
+    if r.Method != http.MethodPost {
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+      return
+    }
+    switch action {
+    case "setup":
+      totpSetupHandler(db, userID, w)
+    case "enable":
+      totpEnableHandler(db, userID, sessionID, w, r)
+    case "disable":
+      totpDisableHandler(db, userID, w, r)
+    case "recovery-codes":
+      totpRecoveryCodesHandler(db, userID, w, r)
+    default:
+      writeJSON(w, http.StatusNotFound, errMsg("not found"))
+    }
+  }
+}
+
+func totpStatusHandler(db *sql.DB, userID string, w http.ResponseWriter) {
+  var enabled, isAdmin bool
+  var role string
+  var left int
+  err := db.QueryRow(`SELECT u.totp_enabled_at IS NOT NULL, u.is_admin, u.role,
+      (SELECT COUNT(*) FROM totp_recovery_codes c WHERE c.user_id = u.id AND c.used_at IS NULL)
+    FROM users u WHERE u.id = $1`, userID).Scan(&enabled, &isAdmin, &role, &left)
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  writeJSON(w, http.StatusOK, map[string]any{"enabled": enabled, "required": totpRequiredRole(isAdmin, role), "recovery_codes_left": left})
+}
+
+// stores a fresh secret that only becomes active once a code from it is confirmed
+func totpSetupHandler(db *sql.DB, userID string, w http.ResponseWriter) {
+  var email sql.NullString
+  var username string
+  var enabled bool
+  err := db.QueryRow(`SELECT email, username, totp_enabled_at IS NOT NULL FROM users WHERE id = $1`, userID).Scan(&email, &username, &enabled)
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  if enabled {
+    writeJSON(w, http.StatusConflict, errMsg("two-factor already enabled"))
+    return
+  }
+  secret := generateTotpSecret()
+  sealed, err := sealTotpSecret(userID, secret)
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  if _, err := db.Exec(`UPDATE users SET totp_secret = $1, totp_last_step = 0 WHERE id = $2`, sealed, userID); err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  account := username
+  if email.String != "" {
+    account = email.String
+  }
+  writeJSON(w, http.StatusOK, map[string]any{"secret": secret, "otpauth_uri": totpURI(secret, account)})
+}
+
+func totpEnableHandler(db *sql.DB, userID string, sessionID string, w http.ResponseWriter, r *http.Request) {
+  var req TotpCodeRequest
+  if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+    writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
+    return
+  }
+  st, err := loadTotpState(db, userID)
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  if st.Enabled {
+    writeJSON(w, http.StatusConflict, errMsg("two-factor already enabled"))
+    return
+  }
+  if st.Secret == "" {
+    writeJSON(w, http.StatusBadRequest, errMsg("run setup first"))
+    return
+  }
+  step, ok := verifyTotp(st.Secret, req.Code, time.Now(), st.LastStep)
+  if !ok {
+    writeJSON(w, http.StatusUnauthorized, errMsg(errTotpInvalid.Error()))
+    return
+  }
+  tx, err := db.Begin()
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg("db error"))
+    return
+  }
+  defer tx.Rollback()
+  res, err := tx.Exec(`UPDATE users SET totp_enabled_at = NOW(), totp_last_step = $2 WHERE id = $1 AND totp_enabled_at IS NULL AND totp_secret = $3`,
+    userID, step, st.Stored)
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  if n, _ := res.RowsAffected(); n == 0 {
+    writeJSON(w, http.StatusConflict, errMsg("two-factor setup changed, try again"))
+    return
+  }
+  codes, err := replaceRecoveryCodesTx(tx, userID)
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  // sessions opened with the password alone are ended; this one just proved the second factor
+  revoked, err := tx.Exec(`DELETE FROM sessions WHERE user_id = $1 AND id <> $2`, userID, sessionID)
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  if err := tx.Commit(); err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg("db commit failed"))
+    return
+  }
+  n, _ := revoked.RowsAffected()
+  writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "recovery_codes": codes, "sessions_revoked": n})
+}
+
+func totpDisableHandler(db *sql.DB, userID string, w http.ResponseWriter, r *http.Request) {
+  var req TotpCodeRequest
+  if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+    writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
+    return
+  }
+  var hash string
+  if err := db.QueryRow(`SELECT password_hash FROM users WHERE id = $1`, userID).Scan(&hash); err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+    writeJSON(w, http.StatusUnauthorized, errMsg("invalid password"))
+    return
+  }
+  st, err := loadTotpState(db, userID)
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  if !st.Enabled {
+    writeJSON(w, http.StatusBadRequest, errMsg("two-factor not enabled"))
+    return
+  }
+  if !writeSecondFactorError(w, useSecondFactor(db, userID, st, req.Code, req.RecoveryCode)) {
+    return
+  }
+  tx, err := db.Begin()
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg("db error"))
+    return
+  }
+  defer tx.Rollback()
+  if _, err := tx.Exec(`UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0 WHERE id = $1`, userID); err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  if _, err := tx.Exec(`DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID); err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  if err := tx.Commit(); err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg("db commit failed"))
+    return
+  }
+  writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func totpRecoveryCodesHandler(db *sql.DB, userID string, w http.ResponseWriter, r *http.Request) {
+  var req TotpCodeRequest
+  if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+    writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
+    return
+  }
+  st, err := loadTotpState(db, userID)
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  if !st.Enabled {
+    writeJSON(w, http.StatusBadRequest, errMsg("two-factor not enabled"))
+    return
+  }
+  // a recovery code cannot be traded for a new set; that needs the authenticator
+  if !writeSecondFactorError(w, useSecondFactor(db, userID, st, req.Code, "")) {
+    return
+  }
+  tx, err := db.Begin()
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg("db error"))
+    return
+  }
+  defer tx.Rollback()
+  codes, err := replaceRecoveryCodesTx(tx, userID)
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  if err := tx.Commit(); err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg("db commit failed"))
+    return
+  }
+  writeJSON(w, http.StatusOK, map[string]any{"recovery_codes": codes})
+}
+
+// writes the response for a failed second factor; returns true when there was nothing to report
+func writeSecondFactorError(w http.ResponseWriter, err error) bool {
+  switch err {
+  case nil:
+    return true
+  case errTotpRequired, errTotpInvalid:
+    writeJSON(w, http.StatusUnauthorized, map[string]any{"error": err.Error(), "totp_required": true})
+  default:
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+  }
+  return false
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/DATA-DOG/go-sqlmock"
+  "golang.org/x/crypto/bcrypt"
+)
+
+// RFC 6238 appendix B, SHA1 rows, truncated to six digits
+func TestTotpCodeMatchesRFCVectors(t *testing.T) {
+  secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+  cases := map[int64]string{
+    59:         "287082",
+    1111111109: "081804",
+    1234567890: "005924",
+    2000000000: "279037",
+  }
+  for unix, want := range cases {
+    got, err := totpCode(secret, unix/totpPeriod)
+    if err != nil || got != want {
+      t.Fatalf("t=%d: want %s, got %s (%v)", unix, want, got, err)
+    }
+  }
+}
+
+func TestVerifyTotpRefusesReplay(t *testing.T) {
+  secret := generateTotpSecret()
+  now := time.Unix(1700000000, 0)
+  current := now.Unix() / totpPeriod
+  code, _ := totpCode(secret, current)
+
+  step, ok := verifyTotp(secret, code, now, 0)
+  if !ok || step != current {
+    t.Fatalf("expected the current code to pass at step %d, got %d %v", current, step, ok)
+  }
+  if _, ok := verifyTotp(secret, code, now, step); ok {
+    t.Fatalf("expected a used step to be refused")
+  }
+  prev, _ := totpCode(secret, current-1)
+  if _, ok := verifyTotp(secret, prev, now, 0); !ok {
+    t.Fatalf("expected one step of drift to be accepted")
+  }
+  old, _ := totpCode(secret, current-2)
+  if _, ok := verifyTotp(secret, old, now, 0); ok {
+    t.Fatalf("expected a code two steps old to be refused")
+  }
+}
+
+func TestAdminLoginAsksForTotpCode(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  hash, _ := bcrypt.GenerateFromPassword([]byte("rahasia"), bcrypt.MinCost)
+  mock.ExpectQuery(`SELECT id, password_hash, name, email, is_admin, role FROM users WHERE email = \$1`).
+    WithArgs("owner@example.com").
+    WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash", "name", "email", "is_admin", "role"}).
+      AddRow("owner-1", string(hash), "Owner", "owner@example.com", true, "owner"))
+  mock.ExpectQuery(`FROM users WHERE id = \$1 AND login_locked_until > NOW\(\)`).
+    WithArgs("owner-1").
+    WillReturnRows(sqlmock.NewRows([]string{"secs"}))
+  mock.ExpectQuery(`FROM login_attempts a, last_ok`).
+    WillReturnRows(sqlmock.NewRows([]string{"failures", "since_last", "ip_failures"}).AddRow(0, nil, 0))
+  mock.ExpectQuery(`UPDATE users SET\s+login_failures = CASE`).
+    WithArgs("owner-1", 900).
+    WillReturnRows(sqlmock.NewRows([]string{"login_failures"}).AddRow(1))
+  mock.ExpectQuery(`SELECT totp_secret, totp_enabled_at IS NOT NULL, totp_last_step FROM users`).
+    WithArgs("owner-1").
+    WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "enabled", "totp_last_step"}).AddRow(generateTotpSecret(), true, 0))
+  // the guess claimed before the password check is given back
+  mock.ExpectExec(`UPDATE users SET login_failures = GREATEST\(login_failures - 1, 0\) WHERE id = \$1`).
+    WithArgs("owner-1").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+
+  // right password, no code: nothing is recorded and no session is created
+  body, _ := json.Marshal(map[string]any{"email": "owner@example.com", "password": "rahasia"})
+  req := httptest.NewRequest(http.MethodPost, "/admin/login", bytes.NewReader(body))
+  rec := httptest.NewRecorder()
+
+  adminLoginHandler(db).ServeHTTP(rec, req)
+
+  if rec.Code != http.StatusUnauthorized {
+    t.Fatalf("expected 401, got %d: %s", rec.Code, rec.Body.String())
+  }
+  var resp map[string]any
+  _ = json.Unmarshal(rec.Body.Bytes(), &resp)
+  if resp["totp_required"] != true {
+    t.Fatalf("expected totp_required, got %v", resp)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestTotpSecretSealedPerUser(t *testing.T) {
+  t.Setenv("TOTP_ENCRYPTION_KEY", "test-key-for-totp-secrets")
+  secret := generateTotpSecret()
+  sealed, err := sealTotpSecret("user-1", secret)
+  if err != nil {
+    t.Fatalf("seal: %v", err)
+  }
+  if !strings.HasPrefix(sealed, totpSealPrefix) || strings.Contains(sealed, secret) {
+    t.Fatalf("expected a sealed value, got %q", sealed)
+  }
+  if got, err := openTotpSecret("user-1", sealed); err != nil || got != secret {
+    t.Fatalf("expected the secret back, got %q (%v)", got, err)
+  }
+  if _, err := openTotpSecret("user-2", sealed); err == nil {
+    t.Fatalf("expected a secret sealed for another user to be refused")
+  }
+  // secrets stored before sealing still open until the startup pass converts them
+  if got, _ := openTotpSecret("user-1", secret); got != secret {
+    t.Fatalf("expected a plain secret to pass through, got %q", got)
+  }
+
+  t.Setenv("TOTP_ENCRYPTION_KEY", "")
+  if _, err := sealTotpSecret("user-1", secret); err != errTotpKeyMissing {
+    t.Fatalf("expected errTotpKeyMissing, got %v", err)
+  }
+  for _, weak := range []string{"short", "CHANGE_ME"} {
+    t.Setenv("TOTP_ENCRYPTION_KEY", weak)
+    if _, err := sealTotpSecret("user-1", secret); err != errTotpKeyWeak {
+      t.Fatalf("%q: expected errTotpKeyWeak, got %v", weak, err)
+    }
+  }
+}
+
+func TestAdminEndpointRefusesOwnerWithoutTotp(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectQuery(`SELECT user_id, id, last_seen_at < NOW\(\) - interval '5 minutes' FROM sessions`).
+    WithArgs(hashSessionToken("owner-token")).
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "id", "stale"}).AddRow("owner-1", "session-1", false))
+  mock.ExpectQuery(`SELECT is_admin, role, totp_enabled_at IS NOT NULL FROM users WHERE id = \$1`).
+    WithArgs("owner-1").
+    WillReturnRows(sqlmock.NewRows([]string{"is_admin", "role", "totp_on"}).AddRow(true, "owner", false))
+
+  req := httptest.NewRequest(http.MethodGet, "/admin/security/login-attempts", nil)
+  req.Header.Set("X-Auth-Token", "owner-token")
+  rec := httptest.NewRecorder()
+
+  adminLoginAttemptsHandler(db).ServeHTTP(rec, req)
+
+  // any query past requireRoles would be unexpected and turn this into a 500
+  if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "two-factor setup required") {
+    t.Fatalf("expected 403 two-factor setup required, got %d: %s", rec.Code, rec.Body.String())
+  }
+
+  mock.ExpectQuery(`SELECT user_id, id, last_seen_at < NOW\(\) - interval '5 minutes' FROM sessions`).
+    WithArgs(hashSessionToken("owner-token")).
+    WillReturnRows(sqlmock.NewRows([]string{"user_id", "id", "stale"}).AddRow("owner-1", "session-1", false))
+  mock.ExpectQuery(`SELECT is_admin, role, totp_enabled_at IS NOT NULL FROM users WHERE id = \$1`).
+    WithArgs("owner-1").
+    WillReturnRows(sqlmock.NewRows([]string{"is_admin", "role", "totp_on"}).AddRow(true, "owner", false))
+  if _, err := requireRoles(db, req, "owner", "admin"); err != errTotpSetupRequired {
+    t.Fatalf("expected errTotpSetupRequired, got %v", err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
@@ -16,7 +16,7 @@ func productImageUploadHandler(db *sql.DB) http.HandlerFunc {
       return
     }
     if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
-      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+      writeRoleError(w, err)
       return
     }
     id := strings.TrimPrefix(r.URL.Path, "/admin/products/")
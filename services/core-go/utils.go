@@ -2,17 +2,35 @@ package main
 
 import (
   "crypto/rand"
+  "database/sql"
   "encoding/hex"
   "encoding/json"
   "net/http"
+  "os"
+  "strconv"
+  "strings"
 )
 
+type queryRower interface {
+  QueryRow(query string, args ...any) *sql.Row
+}
+
 func writeJSON(w http.ResponseWriter, status int, v any) {
   w.Header().Set("Content-Type", "application/json")
   w.WriteHeader(status)
   _ = json.NewEncoder(w).Encode(v)
 }
 
+// reads a positive integer setting, falling back to def when unset or invalid
+func envPositiveInt(key string, def int) int {
+  if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+    if n, err := strconv.Atoi(v); err == nil && n > 0 {
+      return n
+    }
+  }
+  return def
+}
+
 func errMsg(msg string) map[string]string {
   return map[string]string{"error": msg}
 }
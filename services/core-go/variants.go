@@ -0,0 +1,230 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "net/http"
+  "strings"
+)
+
+func loadProductVariants(db *sql.DB, productID string) ([]ProductVariant, error) {
+  rows, err := db.Query(`SELECT v.id, v.product_id, v.sku, v.options, v.price, v.stock - `+variantHeldSQL+`, v.stock, v.image_url FROM product_variants v WHERE v.product_id = $1 ORDER BY v.price, v.sku`, productID)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  out := []ProductVariant{}
+  for rows.Next() {
+    var v ProductVariant
+    var options []byte
+    var image sql.NullString
+    if err := rows.Scan(&v.ID, &v.ProductID, &v.SKU, &options, &v.Price, &v.Stock, &v.OnHand, &image); err != nil {
+      return nil, err
+    }
+    v.Options = map[string]string{}
+    if len(options) > 0 {
+      _ = json.Unmarshal(options, &v.Options)
+    }
+    v.ImageURL = image.String
+    out = append(out, v)
+  }
+  return out, rows.Err()
+}
+
+func resolveCartVariant(db *sql.DB, productID string, variantID string) error {
+  var hasVariants bool
+  err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM product_variants WHERE product_id = $1)`, productID).Scan(&hasVariants)
+  if err != nil {
+    return err
+  }
+  if variantID == "" {
+    if hasVariants {
+      return errInvalid("variant_id required")
+    }
+    return nil
+  }
+  var owner string
+  err = db.QueryRow(`SELECT product_id FROM product_variants WHERE id = $1`, variantID).Scan(&owner)
+  if err == sql.ErrNoRows || (err == nil && owner != productID) {
+    return errInvalid("variant not found")
+  }
+  return err
+}
+
+func validateVariantRequest(req ProductVariantRequest) error {
+  if strings.TrimSpace(req.SKU) == "" || req.Price <= 0 || req.Stock < 0 {
+    return errInvalid("sku, price, stock required")
+  }
+  if len(req.Options) == 0 {
+    return errInvalid("options required")
+  }
+  return nil
+}
+
+func adminProductVariantsHandler(db *sql.DB, w http.ResponseWriter, r *http.Request, productID string, variantID string, adminID string) {
+  switch {
+  case variantID == "" && r.Method == http.MethodGet:
+    items, err := loadProductVariants(db, productID)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    writeJSON(w, http.StatusOK, items)
+  case variantID == "" && r.Method == http.MethodPost:
+    var req ProductVariantRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
+      return
+    }
+    if err := validateVariantRequest(req); err != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+      return
+    }
+    tx, err := db.Begin()
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    defer tx.Rollback()
+    var hasVariants bool
+    if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM product_variants WHERE product_id = $1)`, productID).Scan(&hasVariants); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    if !hasVariants {
+      // the first variant takes over stock tracking; product-level stock is written off
+      current, err := currentStockTx(tx, productID, "")
+      if err != nil {
+        writeInventoryError(w, err)
+        return
+      }
+      // checked under the product lock checkout takes: a pending order's product-level hold
+      // would otherwise be sold later against the zero left here
+      var held bool
+      if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM stock_reservations WHERE product_id = $1 AND variant_id IS NULL AND status = 'ACTIVE')`, productID).Scan(&held); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      if held {
+        writeJSON(w, http.StatusConflict, errMsg("product has stock held by pending orders; add variants once they are paid or released"))
+        return
+      }
+      if current != 0 {
+        _, _, err = applyStockMovementTx(tx, inventoryMovement{ProductID: productID, Kind: "ADJUSTMENT", Delta: -current, ActorType: "admin", ActorID: adminID, Reason: "stock moved to variants"})
+        if err != nil {
+          writeInventoryError(w, err)
+          return
+        }
+      }
+    }
+    options, _ := json.Marshal(req.Options)
+    var id string
+    err = tx.QueryRow(`INSERT INTO product_variants (product_id, sku, options, price, stock, image_url) VALUES ($1,$2,$3,$4,0,$5) RETURNING id`,
+      productID, strings.ToUpper(strings.TrimSpace(req.SKU)), string(options), req.Price, nullIfEmpty(req.ImageURL)).Scan(&id)
+    if err != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg("create variant failed"))
+      return
+    }
+    if req.Stock > 0 {
+      _, _, err = applyStockMovementTx(tx, inventoryMovement{ProductID: productID, VariantID: id, Kind: "RESTOCK", Delta: req.Stock, ActorType: "admin", ActorID: adminID, Reason: "initial stock"})
+      if err != nil {
+        writeInventoryError(w, err)
+        return
+      }
+    }
+    if err := tx.Commit(); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    writeJSON(w, http.StatusOK, map[string]string{"variant_id": id})
+  case variantID != "" && r.Method == http.MethodPut:
+    var req ProductVariantRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
+      return
+    }
+    if err := validateVariantRequest(req); err != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+      return
+    }
+    tx, err := db.Begin()
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    defer tx.Rollback()
+    current, err := currentStockTx(tx, productID, variantID)
+    if err != nil {
+      if isInvalid(err) {
+        writeJSON(w, http.StatusNotFound, errMsg("not found"))
+        return
+      }
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    options, _ := json.Marshal(req.Options)
+    _, err = tx.Exec(`UPDATE product_variants SET sku = $1, options = $2, price = $3, image_url = $4 WHERE id = $5 AND product_id = $6`,
+      strings.ToUpper(strings.TrimSpace(req.SKU)), string(options), req.Price, nullIfEmpty(req.ImageURL), variantID, productID)
+    if err != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg("update variant failed"))
+      return
+    }
+    if req.Stock != current {
+      _, _, err = applyStockMovementTx(tx, inventoryMovement{ProductID: productID, VariantID: variantID, Kind: "ADJUSTMENT", Delta: req.Stock - current, ActorType: "admin", ActorID: adminID, Reason: "variant edit"})
+      if err != nil {
+        writeInventoryError(w, err)
+        return
+      }
+    }
+    if err := tx.Commit(); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+  case variantID != "" && r.Method == http.MethodDelete:
+    tx, err := db.Begin()
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    defer tx.Rollback()
+    current, err := currentStockTx(tx, productID, variantID)
+    if err != nil {
+      if isInvalid(err) {
+        writeJSON(w, http.StatusNotFound, errMsg("not found"))
+        return
+      }
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    // holds are what a later payment, cancel or refund settles against; the foreign key
+    // refuses the delete as well, this only gives the reason
+    var held bool
+    if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM stock_reservations WHERE variant_id = $1)`, variantID).Scan(&held); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    if held {
+      writeJSON(w, http.StatusConflict, errMsg("variant is on orders; set its stock to 0 instead of deleting it"))
+      return
+    }
+    if current != 0 {
+      _, _, err = applyStockMovementTx(tx, inventoryMovement{ProductID: productID, VariantID: variantID, Kind: "ADJUSTMENT", Delta: -current, ActorType: "admin", ActorID: adminID, Reason: "variant deleted"})
+      if err != nil {
+        writeInventoryError(w, err)
+        return
+      }
+    }
+    if _, err := tx.Exec(`DELETE FROM product_variants WHERE id = $1 AND product_id = $2`, variantID, productID); err != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg("delete variant failed"))
+      return
+    }
+    if err := tx.Commit(); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+  default:
+    writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+  }
+}
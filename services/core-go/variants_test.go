@@ -0,0 +1,228 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+
+  "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestResolveCartVariant(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  expectHasVariants := func(productID string, has bool) {
+    mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM product_variants WHERE product_id = \$1\)`).
+      WithArgs(productID).
+      WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(has))
+  }
+
+  // a product sold by size cannot go in the cart without picking one
+  expectHasVariants("prod-1", true)
+  if err := resolveCartVariant(db, "prod-1", ""); !isInvalid(err) || err.Error() != "variant_id required" {
+    t.Fatalf("expected variant_id required, got %v", err)
+  }
+
+  // a plain product needs no variant
+  expectHasVariants("prod-2", false)
+  if err := resolveCartVariant(db, "prod-2", ""); err != nil {
+    t.Fatalf("expected no error for a product without variants, got %v", err)
+  }
+
+  expectHasVariants("prod-1", true)
+  mock.ExpectQuery(`SELECT product_id FROM product_variants WHERE id = \$1`).
+    WithArgs("var-1").
+    WillReturnRows(sqlmock.NewRows([]string{"product_id"}).AddRow("prod-1"))
+  if err := resolveCartVariant(db, "prod-1", "var-1"); err != nil {
+    t.Fatalf("expected the product's own variant to pass, got %v", err)
+  }
+
+  // a variant id copied from another product
+  expectHasVariants("prod-1", true)
+  mock.ExpectQuery(`SELECT product_id FROM product_variants WHERE id = \$1`).
+    WithArgs("var-9").
+    WillReturnRows(sqlmock.NewRows([]string{"product_id"}).AddRow("prod-3"))
+  if err := resolveCartVariant(db, "prod-1", "var-9"); !isInvalid(err) || err.Error() != "variant not found" {
+    t.Fatalf("expected variant not found, got %v", err)
+  }
+
+  expectHasVariants("prod-1", true)
+  mock.ExpectQuery(`SELECT product_id FROM product_variants WHERE id = \$1`).
+    WithArgs("var-gone").
+    WillReturnRows(sqlmock.NewRows([]string{"product_id"}))
+  if err := resolveCartVariant(db, "prod-1", "var-gone"); !isInvalid(err) || err.Error() != "variant not found" {
+    t.Fatalf("expected variant not found, got %v", err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestLoadProductVariantsReportsAvailableStock(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectQuery(`SELECT v.id, v.product_id, v.sku, v.options, v.price, v.stock - COALESCE\(.+\), v.stock, v.image_url FROM product_variants v WHERE v.product_id = \$1 ORDER BY v.price, v.sku`).
+    WithArgs("prod-1").
+    WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "sku", "options", "price", "available", "stock", "image_url"}).
+      AddRow("var-1", "prod-1", "KIBBLE-1KG", []byte(`{"size":"1kg"}`), 85000, 3, 5, nil).
+      AddRow("var-2", "prod-1", "KIBBLE-5KG", nil, 390000, 0, 0, "https://cdn.example.com/5kg.jpg"))
+
+  items, err := loadProductVariants(db, "prod-1")
+  if err != nil {
+    t.Fatalf("load: %v", err)
+  }
+  if len(items) != 2 {
+    t.Fatalf("expected 2 variants, got %d", len(items))
+  }
+  // Stock is what can still be sold; OnHand includes units held by pending checkouts
+  if items[0].Stock != 3 || items[0].OnHand != 5 || items[0].Options["size"] != "1kg" || items[0].ImageURL != "" {
+    t.Fatalf("unexpected first variant: %+v", items[0])
+  }
+  if items[1].Options == nil || len(items[1].Options) != 0 || items[1].ImageURL == "" {
+    t.Fatalf("expected empty options and an image on the second variant, got %+v", items[1])
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestFirstVariantTakesOverProductStock(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM product_variants WHERE product_id = \$1\)`).
+    WithArgs("prod-1").
+    WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+  mock.ExpectQuery(`SELECT stock FROM products WHERE id = \$1 FOR UPDATE`).
+    WithArgs("prod-1").
+    WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(12))
+  mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM stock_reservations WHERE product_id = \$1 AND variant_id IS NULL AND status = 'ACTIVE'\)`).
+    WithArgs("prod-1").
+    WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+  // the product-level count is written off before the variant carries the stock
+  mock.ExpectQuery(`UPDATE products SET stock = stock \+ \$1 WHERE id = \$2 AND stock \+ \$1 >= 0 RETURNING stock`).
+    WithArgs(-12, "prod-1").
+    WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(0))
+  mock.ExpectExec(`INSERT INTO low_stock_alerts`).
+    WithArgs("prod-1", 12).
+    WillReturnResult(sqlmock.NewResult(0, 0))
+  mock.ExpectQuery(`INSERT INTO inventory_movements`).
+    WithArgs("prod-1", nil, "ADJUSTMENT", -12, 0, nil, "admin", "admin-1", "stock moved to variants").
+    WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("mv-1"))
+  mock.ExpectQuery(`INSERT INTO product_variants \(product_id, sku, options, price, stock, image_url\) VALUES \(\$1,\$2,\$3,\$4,0,\$5\) RETURNING id`).
+    WithArgs("prod-1", "KIBBLE-1KG", `{"size":"1kg"}`, 85000, nil).
+    WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("var-1"))
+  mock.ExpectQuery(`UPDATE product_variants SET stock = stock \+ \$1 WHERE id = \$2 AND product_id = \$3 AND stock \+ \$1 >= 0 RETURNING stock`).
+    WithArgs(12, "var-1", "prod-1").
+    WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(12))
+  mock.ExpectExec(`UPDATE products SET stock = stock \+ \$1 WHERE id = \$2`).
+    WithArgs(12, "prod-1").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectQuery(`INSERT INTO inventory_movements`).
+    WithArgs("prod-1", "var-1", "RESTOCK", 12, 12, nil, "admin", "admin-1", "initial stock").
+    WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("mv-2"))
+  mock.ExpectCommit()
+
+  body, _ := json.Marshal(map[string]any{"sku": "kibble-1kg", "options": map[string]string{"size": "1kg"}, "price": 85000, "stock": 12})
+  req := httptest.NewRequest(http.MethodPost, "/admin/products/prod-1/variants", bytes.NewReader(body))
+  rec := httptest.NewRecorder()
+
+  adminProductVariantsHandler(db, rec, req, "prod-1", "", "admin-1")
+
+  if rec.Code != http.StatusOK {
+    t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+  }
+  var resp map[string]string
+  _ = json.Unmarshal(rec.Body.Bytes(), &resp)
+  if resp["variant_id"] != "var-1" {
+    t.Fatalf("expected variant_id var-1, got %v", resp)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestAdminVariantRejectsIncompleteRequest(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  // no options: refused before any transaction is opened
+  body, _ := json.Marshal(map[string]any{"sku": "KIBBLE-1KG", "price": 85000, "stock": 3})
+  req := httptest.NewRequest(http.MethodPut, "/admin/products/prod-1/variants/var-1", bytes.NewReader(body))
+  rec := httptest.NewRecorder()
+
+  adminProductVariantsHandler(db, rec, req, "prod-1", "var-1", "admin-1")
+
+  if rec.Code != http.StatusBadRequest {
+    t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestVariantChangesRefusedWhileStockIsHeld(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  // a pending order holds product-level stock: the first variant would zero it under the hold
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM product_variants WHERE product_id = \$1\)`).
+    WithArgs("prod-1").
+    WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+  mock.ExpectQuery(`SELECT stock FROM products WHERE id = \$1 FOR UPDATE`).
+    WithArgs("prod-1").
+    WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(12))
+  mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM stock_reservations WHERE product_id = \$1 AND variant_id IS NULL AND status = 'ACTIVE'\)`).
+    WithArgs("prod-1").
+    WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+  mock.ExpectRollback()
+
+  body, _ := json.Marshal(map[string]any{"sku": "KIBBLE-1KG", "options": map[string]string{"size": "1kg"}, "price": 85000, "stock": 12})
+  req := httptest.NewRequest(http.MethodPost, "/admin/products/prod-1/variants", bytes.NewReader(body))
+  rec := httptest.NewRecorder()
+  adminProductVariantsHandler(db, rec, req, "prod-1", "", "admin-1")
+  if rec.Code != http.StatusConflict {
+    t.Fatalf("expected 409 for the first variant, got %d: %s", rec.Code, rec.Body.String())
+  }
+
+  // a variant that orders were placed against keeps its row
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT stock FROM product_variants WHERE id = \$1 AND product_id = \$2 FOR UPDATE`).
+    WithArgs("var-1", "prod-1").
+    WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(4))
+  mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM stock_reservations WHERE variant_id = \$1\)`).
+    WithArgs("var-1").
+    WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+  mock.ExpectRollback()
+
+  req = httptest.NewRequest(http.MethodDelete, "/admin/products/prod-1/variants/var-1", nil)
+  rec = httptest.NewRecorder()
+  adminProductVariantsHandler(db, rec, req, "prod-1", "var-1", "admin-1")
+  if rec.Code != http.StatusConflict {
+    t.Fatalf("expected 409 for the delete, got %d: %s", rec.Code, rec.Body.String())
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+  "crypto/rand"
+  "database/sql"
+  "encoding/csv"
+  "encoding/json"
+  "math/big"
+  "net/http"
+  "strconv"
+  "strings"
+
+  "github.com/lib/pq"
+)
+
+const (
+  maxVoucherBatchSize   = 10000
+  voucherCodeAlphabet   = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+  voucherCodeRandomPart = 8
+)
+
+type VoucherBatchRequest struct {
+  Count          int    `json:"count"`
+  Prefix         string `json:"prefix"`
+  KeepParentCode bool   `json:"keep_parent_code"`
+}
+
+// a batch code must not give away its parent: the parent code is redeemable by anyone who
+// knows it unless the voucher is batch_only, so it never doubles as the prefix
+func voucherBatchPrefix(prefix string, parentCode string) (string, error) {
+  p := cleanVoucherPrefix(prefix)
+  if p != "" && p == cleanVoucherPrefix(parentCode) {
+    return "", errInvalid("prefix must differ from the voucher code")
+  }
+  return p, nil
+}
+
+// prefixes keep only A-Z and 0-9 so codes survive being typed from a flyer
+func cleanVoucherPrefix(prefix string) string {
+  b := strings.Builder{}
+  for _, r := range strings.ToUpper(prefix) {
+    if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+      b.WriteRune(r)
+    }
+    if b.Len() == 12 {
+      break
+    }
+  }
+  return b.String()
+}
+
+func generateVoucherCode(prefix string) (string, error) {
+  b := make([]byte, voucherCodeRandomPart)
+  max := big.NewInt(int64(len(voucherCodeAlphabet)))
+  for i := range b {
+    n, err := rand.Int(rand.Reader, max)
+    if err != nil {
+      return "", err
+    }
+    b[i] = voucherCodeAlphabet[n.Int64()]
+  }
+  if prefix == "" {
+    return string(b), nil
+  }
+  return prefix + "-" + string(b), nil
+}
+
+// inserts codes until the batch has `count` of them; collisions with existing codes or
+// voucher definitions are skipped and regenerated
+func insertVoucherBatchCodesTx(tx *sql.Tx, parentCode string, batchID string, prefix string, count int) error {
+  created := 0
+  for attempt := 0; created < count; attempt++ {
+    if attempt > 20 {
+      return errInvalid("could not generate enough unique codes; use a longer prefix")
+    }
+    chunk := count - created
+    if chunk > 1000 {
+      chunk = 1000
+    }
+    codes := make([]string, 0, chunk)
+    seen := map[string]bool{}
+    for len(codes) < chunk {
+      code, err := generateVoucherCode(prefix)
+      if err != nil {
+        return err
+      }
+      if !seen[code] {
+        seen[code] = true
+        codes = append(codes, code)
+      }
+    }
+    res, err := tx.Exec(`INSERT INTO voucher_codes (code, parent_code, batch_id)
+      SELECT c, $2, $3 FROM unnest($1::text[]) AS c
+      WHERE NOT EXISTS (SELECT 1 FROM vouchers v WHERE v.code = c)
+      ON CONFLICT (code) DO NOTHING`, pq.Array(codes), parentCode, batchID)
+    if err != nil {
+      return err
+    }
+    n, _ := res.RowsAffected()
+    created += int(n)
+  }
+  return nil
+}
+
+func adminVoucherBatchHandler(db *sql.DB, code string, adminID string, w http.ResponseWriter, r *http.Request) {
+  code = strings.ToUpper(strings.TrimSpace(code))
+  var exists bool
+  if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM vouchers WHERE code = $1)`, code).Scan(&exists); err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  if !exists {
+    writeJSON(w, http.StatusNotFound, errMsg("voucher not found"))
+    return
+  }
+  switch r.Method {
+  case http.MethodGet:
+    if batchID := strings.TrimSpace(r.URL.Query().Get("batch_id")); batchID != "" {
+      writeVoucherBatchCSV(db, w, code, batchID)
+      return
+    }
+    rows, err := db.Query(`SELECT b.id, b.prefix, b.size, b.created_by, u.name, b.created_at,
+        (SELECT COUNT(*) FROM voucher_codes c WHERE c.batch_id = b.id AND c.used_at IS NOT NULL)
+      FROM voucher_code_batches b LEFT JOIN users u ON b.created_by = u.id
+      WHERE b.parent_code = $1 ORDER BY b.created_at DESC`, code)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    defer rows.Close()
+    out := []map[string]any{}
+    for rows.Next() {
+      var id, prefix, createdAt string
+      var createdBy, createdByName sql.NullString
+      var size, used int
+      if err := rows.Scan(&id, &prefix, &size, &createdBy, &createdByName, &createdAt, &used); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+      out = append(out, map[string]any{
+        "id": id,
+        "prefix": prefix,
+        "size": size,
+        "used": used,
+        "created_by": createdBy.String,
+        "created_by_name": createdByName.String,
+        "created_at": createdAt,
+      })
+    }
+    writeJSON(w, http.StatusOK, out)
+  case http.MethodPost:
+    var req VoucherBatchRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
+      return
+    }
+    if req.Count <= 0 || req.Count > maxVoucherBatchSize {
+      writeJSON(w, http.StatusBadRequest, errMsg("count must be between 1 and "+strconv.Itoa(maxVoucherBatchSize)))
+      return
+    }
+    prefix, err := voucherBatchPrefix(req.Prefix, code)
+    if err != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+      return
+    }
+    tx, err := db.Begin()
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("db error"))
+      return
+    }
+    defer tx.Rollback()
+    var batchID string
+    err = tx.QueryRow(`INSERT INTO voucher_code_batches (parent_code, prefix, size, created_by) VALUES ($1,$2,$3,$4) RETURNING id`,
+      code, prefix, req.Count, nullIfEmpty(adminID)).Scan(&batchID)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    if err := insertVoucherBatchCodesTx(tx, code, batchID, prefix, req.Count); err != nil {
+      if isInvalid(err) {
+        writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+        return
+      }
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    // single-use codes only mean something if the parent code stops working; keeping it
+    // redeemable (e.g. a tier reward that also goes out on flyers) is an explicit choice
+    if !req.KeepParentCode {
+      if _, err := tx.Exec(`UPDATE vouchers SET batch_only = TRUE WHERE code = $1`, code); err != nil {
+        writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+        return
+      }
+    }
+    if err := tx.Commit(); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("db commit failed"))
+      return
+    }
+    writeVoucherBatchCSV(db, w, code, batchID)
+  default:
+    writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+  }
+}
+
+func writeVoucherBatchCSV(db *sql.DB, w http.ResponseWriter, parentCode string, batchID string) {
+  rows, err := db.Query(`SELECT code, used_at, order_id FROM voucher_codes WHERE parent_code = $1 AND batch_id::text = $2 ORDER BY code`, parentCode, batchID)
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  defer rows.Close()
+  records := [][]string{{"code", "parent_code", "batch_id", "used_at", "order_id"}}
+  for rows.Next() {
+    var code string
+    var usedAt, orderID sql.NullString
+    if err := rows.Scan(&code, &usedAt, &orderID); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    records = append(records, []string{code, parentCode, batchID, usedAt.String, orderID.String})
+  }
+  if err := rows.Err(); err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  if len(records) == 1 {
+    writeJSON(w, http.StatusNotFound, errMsg("batch not found"))
+    return
+  }
+  w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+  w.Header().Set("Content-Disposition", `attachment; filename="`+parentCode+`-`+batchID+`.csv"`)
+  w.WriteHeader(http.StatusOK)
+  _ = csv.NewWriter(w).WriteAll(records)
+}
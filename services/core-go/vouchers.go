@@ -0,0 +1,421 @@
+package main
+
+import (
+  "database/sql"
+  "net/http"
+  "strings"
+  "time"
+
+  "github.com/lib/pq"
+
+  "petshop-bento-core/pricing"
+)
+
+const voucherSelectSQL = `SELECT code, title, discount_type, discount_value, min_spend, max_discount, max_uses, uses, per_user_limit,
+  product_ids, category_ids, tiers, first_order_only, stacking, batch_only, starts_at, expires_at, active FROM vouchers`
+
+func scanVoucherRow(rows *sql.Rows) (map[string]any, error) {
+  var code, title, dtype, stacking string
+  var dval, minSpend, maxDiscount, maxUses, uses, perUserLimit int
+  var productIDs, categoryIDs, tiers pq.StringArray
+  var firstOrderOnly, batchOnly, active bool
+  var startsAt, expiresAt sql.NullString
+  if err := rows.Scan(&code, &title, &dtype, &dval, &minSpend, &maxDiscount, &maxUses, &uses, &perUserLimit,
+    &productIDs, &categoryIDs, &tiers, &firstOrderOnly, &stacking, &batchOnly, &startsAt, &expiresAt, &active); err != nil {
+    return nil, err
+  }
+  return map[string]any{
+    "code": code,
+    "title": title,
+    "discount_type": dtype,
+    "discount_value": dval,
+    "min_spend": minSpend,
+    "max_discount": maxDiscount,
+    "max_uses": maxUses,
+    "uses": uses,
+    "per_user_limit": perUserLimit,
+    "product_ids": []string(productIDs),
+    "category_ids": []string(categoryIDs),
+    "tiers": []string(tiers),
+    "first_order_only": firstOrderOnly,
+    "stacking": stacking,
+    "batch_only": batchOnly,
+    "starts_at": dateOnly(startsAt.String),
+    "expires_at": dateOnly(expiresAt.String),
+    "active": active,
+  }, nil
+}
+
+func dateOnly(v string) string {
+  if len(v) > 10 {
+    return v[:10]
+  }
+  return v
+}
+
+// normalizes the request in place; create also needs the code
+func validateVoucherRequest(req *VoucherCreateRequest) error {
+  req.Title = strings.TrimSpace(req.Title)
+  req.DiscountType = strings.ToLower(strings.TrimSpace(req.DiscountType))
+  if req.Title == "" || req.DiscountType == "" || req.DiscountValue <= 0 {
+    return errInvalid("title, discount_type, discount_value required")
+  }
+  if req.DiscountType != "flat" && req.DiscountType != "percent" {
+    return errInvalid("discount_type must be flat or percent")
+  }
+  if req.DiscountType == "percent" && req.DiscountValue > 100 {
+    return errInvalid("percent discount_value must be at most 100")
+  }
+  if req.MinSpend < 0 || req.MaxDiscount < 0 || req.MaxUses < 0 || req.PerUserLimit < 0 {
+    return errInvalid("min_spend, max_discount, max_uses and per_user_limit cannot be negative")
+  }
+  req.Stacking = strings.ToLower(strings.TrimSpace(req.Stacking))
+  switch req.Stacking {
+  case "":
+    req.Stacking = pricing.StackWithTier
+  case pricing.StackWithTier, pricing.ExclusiveTier, pricing.BestOfTier:
+  default:
+    return errInvalid("stacking must be stack, exclusive or best")
+  }
+  req.StartsAt = strings.TrimSpace(req.StartsAt)
+  req.ExpiresAt = strings.TrimSpace(req.ExpiresAt)
+  var starts, expires time.Time
+  var err error
+  if req.StartsAt != "" {
+    if starts, err = time.Parse("2006-01-02", req.StartsAt); err != nil {
+      return errInvalid("starts_at must be YYYY-MM-DD")
+    }
+  }
+  if req.ExpiresAt != "" {
+    if expires, err = time.Parse("2006-01-02", req.ExpiresAt); err != nil {
+      return errInvalid("expires_at must be YYYY-MM-DD")
+    }
+  }
+  if req.StartsAt != "" && req.ExpiresAt != "" && expires.Before(starts) {
+    return errInvalid("expires_at is before starts_at")
+  }
+  req.ProductIDs = compactStrings(req.ProductIDs)
+  req.CategoryIDs = compactStrings(req.CategoryIDs)
+  req.Tiers = compactStrings(req.Tiers)
+  return nil
+}
+
+func compactStrings(in []string) []string {
+  out := []string{}
+  seen := map[string]bool{}
+  for _, v := range in {
+    v = strings.TrimSpace(v)
+    if v == "" || seen[v] {
+      continue
+    }
+    seen[v] = true
+    out = append(out, v)
+  }
+  return out
+}
+
+// the product, category and tier lists must name rows that exist
+func checkVoucherReferences(db *sql.DB, req VoucherCreateRequest) error {
+  checks := []struct {
+    query  string
+    values []string
+    label  string
+  }{
+    {`SELECT COUNT(*) FROM products WHERE id::text = ANY($1)`, req.ProductIDs, "product_ids"},
+    {`SELECT COUNT(*) FROM categories WHERE id::text = ANY($1)`, req.CategoryIDs, "category_ids"},
+    {`SELECT COUNT(*) FROM loyalty_tiers WHERE name = ANY($1)`, req.Tiers, "tiers"},
+  }
+  for _, c := range checks {
+    if len(c.values) == 0 {
+      continue
+    }
+    var n int
+    if err := db.QueryRow(c.query, pq.Array(c.values)).Scan(&n); err != nil {
+      return err
+    }
+    if n != len(c.values) {
+      return errInvalid(c.label + " contains unknown entries")
+    }
+  }
+  return nil
+}
+
+// checks everything about the voucher that needs the database; min spend, scope, tier
+// and the discount itself are left to pricing.Price. Checkout locks the voucher row so
+// the quota and per-user checks hold until redeemVoucherTx has written the redemption.
+func loadVoucherTx(tx *sql.Tx, code string, userID string, lock bool) (*pricing.Voucher, error) {
+  if strings.TrimSpace(code) == "" {
+    return nil, nil
+  }
+  v := pricing.Voucher{Code: strings.ToUpper(strings.TrimSpace(code))}
+  parentCode, isChild, err := resolveVoucherCodeTx(tx, v.Code, lock)
+  if err != nil {
+    return nil, err
+  }
+  var maxUses, uses, perUserLimit int
+  var productIDs, categoryIDs, tiers pq.StringArray
+  var firstOrderOnly, active, started, current, batchOnly bool
+  err = tx.QueryRow(`SELECT discount_type, discount_value, min_spend, max_discount, max_uses, uses, per_user_limit,
+      product_ids, category_ids, tiers, first_order_only, stacking, active,
+      (starts_at IS NULL OR starts_at <= CURRENT_DATE), (expires_at IS NULL OR expires_at >= CURRENT_DATE), batch_only
+    FROM vouchers WHERE code = $1`+forUpdate(lock), parentCode).
+    Scan(&v.Type, &v.Value, &v.MinSpend, &v.MaxDiscount, &maxUses, &uses, &perUserLimit,
+      &productIDs, &categoryIDs, &tiers, &firstOrderOnly, &v.Stacking, &active, &started, &current, &batchOnly)
+  if err != nil {
+    if err == sql.ErrNoRows {
+      return nil, errInvalid("voucher not found")
+    }
+    return nil, err
+  }
+  // a campaign marked batch_only is redeemed through its single-use codes alone; without
+  // the flag the parent code keeps working, e.g. as a tier reward held in user_vouchers
+  if batchOnly && !isChild {
+    return nil, errInvalid("voucher not found")
+  }
+  if !active {
+    return nil, errInvalid("voucher not active")
+  }
+  if !started {
+    return nil, errInvalid("voucher not yet valid")
+  }
+  if !current {
+    return nil, errInvalid("voucher expired")
+  }
+  if maxUses > 0 && uses >= maxUses {
+    return nil, errInvalid("voucher quota used")
+  }
+
+  if userID == "" {
+    if perUserLimit > 0 || firstOrderOnly {
+      return nil, errInvalid("login required to use this voucher")
+    }
+  } else {
+    var used bool
+    err := tx.QueryRow(`SELECT used FROM user_vouchers WHERE user_id = $1 AND code = $2`, userID, parentCode).Scan(&used)
+    if err == nil && used {
+      return nil, errInvalid("voucher already used")
+    }
+    if perUserLimit > 0 {
+      var n int
+      err := tx.QueryRow(`SELECT COUNT(*) FROM voucher_redemptions WHERE user_id = $1 AND voucher_code = $2 AND status = 'ACTIVE'`, userID, parentCode).Scan(&n)
+      if err != nil {
+        return nil, err
+      }
+      if n >= perUserLimit {
+        return nil, errInvalid("voucher usage limit reached")
+      }
+    }
+    if firstOrderOnly {
+      var ordered bool
+      err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM orders WHERE user_id = $1 AND status NOT IN ('CANCELLED','FAILED'))`, userID).Scan(&ordered)
+      if err != nil {
+        return nil, err
+      }
+      if ordered {
+        return nil, errInvalid("voucher is for first orders only")
+      }
+    }
+  }
+
+  v.ProductIDs = []string(productIDs)
+  v.Tiers = []string(tiers)
+  if len(categoryIDs) > 0 {
+    rows, err := tx.Query(`WITH RECURSIVE tree AS (
+        SELECT id FROM categories WHERE id::text = ANY($1)
+        UNION ALL
+        SELECT c.id FROM categories c JOIN tree t ON c.parent_id = t.id
+      ) SELECT id FROM tree`, pq.Array([]string(categoryIDs)))
+    if err != nil {
+      return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+      var id string
+      if err := rows.Scan(&id); err != nil {
+        return nil, err
+      }
+      v.CategoryIDs = append(v.CategoryIDs, id)
+    }
+    if err := rows.Err(); err != nil {
+      return nil, err
+    }
+    if len(v.CategoryIDs) == 0 {
+      // every scoped category was deleted; keep the voucher scoped rather than store-wide
+      v.CategoryIDs = []string(categoryIDs)
+    }
+  }
+  return &v, nil
+}
+
+func forUpdate(lock bool) string {
+  if lock {
+    return " FOR UPDATE"
+  }
+  return ""
+}
+
+// a batch code resolves to its parent voucher; a used batch code is rejected here so
+// the caller never sees the parent's rules for it
+func resolveVoucherCodeTx(tx *sql.Tx, code string, lock bool) (string, bool, error) {
+  var parent string
+  var used bool
+  err := tx.QueryRow(`SELECT parent_code, used_at IS NOT NULL FROM voucher_codes WHERE code = $1`+forUpdate(lock), code).Scan(&parent, &used)
+  if err == sql.ErrNoRows {
+    return code, false, nil
+  }
+  if err != nil {
+    return "", false, err
+  }
+  if used {
+    return "", true, errInvalid("voucher already used")
+  }
+  return parent, true, nil
+}
+
+// the conditional update is what enforces max_uses; the row lock taken by loadVoucherTx
+// only keeps the earlier checks valid until here. code is what the customer entered,
+// so it may be a batch code.
+func redeemVoucherTx(tx *sql.Tx, code string, userID string, orderID string, amount int) error {
+  parentCode, isChild, err := resolveVoucherCodeTx(tx, code, true)
+  if err != nil {
+    return err
+  }
+  res, err := tx.Exec(`UPDATE vouchers SET uses = uses + 1 WHERE code = $1 AND (max_uses = 0 OR uses < max_uses)`, parentCode)
+  if err != nil {
+    return err
+  }
+  if n, _ := res.RowsAffected(); n == 0 {
+    return errInvalid("voucher quota used")
+  }
+  childCode := ""
+  if isChild {
+    childCode = code
+    if _, err := tx.Exec(`UPDATE voucher_codes SET used_at = NOW(), order_id = $1 WHERE code = $2`, orderID, code); err != nil {
+      return err
+    }
+  }
+  _, err = tx.Exec(`INSERT INTO voucher_redemptions (voucher_code, child_code, user_id, order_id, amount) VALUES ($1,$2,$3,$4,$5)`,
+    parentCode, nullIfEmpty(childCode), nullIfEmpty(userID), orderID, amount)
+  if err != nil {
+    return err
+  }
+  if userID != "" {
+    if _, err := tx.Exec(`UPDATE user_vouchers SET used = TRUE WHERE user_id = $1 AND code = $2`, userID, parentCode); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// orders placed before the redemption ledger existed have no row; their use is given back
+// from the order's voucher_code alone
+func releaseVoucherRedemptionTx(tx *sql.Tx, orderID string, code string, userID string) error {
+  var status string
+  var parentCode, childCode sql.NullString
+  err := tx.QueryRow(`SELECT status, voucher_code, child_code FROM voucher_redemptions WHERE order_id = $1 FOR UPDATE`, orderID).Scan(&status, &parentCode, &childCode)
+  if err != nil && err != sql.ErrNoRows {
+    return err
+  }
+  if status == "RELEASED" {
+    return nil
+  }
+  if status == "ACTIVE" {
+    code = parentCode.String
+    if _, err := tx.Exec(`UPDATE voucher_redemptions SET status = 'RELEASED', released_at = NOW() WHERE order_id = $1`, orderID); err != nil {
+      return err
+    }
+    if childCode.Valid {
+      if _, err := tx.Exec(`UPDATE voucher_codes SET used_at = NULL, order_id = NULL WHERE code = $1 AND order_id = $2`, childCode.String, orderID); err != nil {
+        return err
+      }
+    }
+  }
+  if _, err := tx.Exec(`UPDATE vouchers SET uses = GREATEST(uses - 1, 0) WHERE code = $1`, code); err != nil {
+    return err
+  }
+  if userID != "" {
+    if _, err := tx.Exec(`UPDATE user_vouchers SET used = FALSE WHERE user_id = $1 AND code = $2`, userID, code); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func adminVoucherRedemptionsHandler(db *sql.DB, code string, w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet {
+    writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+    return
+  }
+  code = strings.ToUpper(strings.TrimSpace(code))
+  var title string
+  var maxUses, uses int
+  err := db.QueryRow(`SELECT title, max_uses, uses FROM vouchers WHERE code = $1`, code).Scan(&title, &maxUses, &uses)
+  if err == sql.ErrNoRows {
+    writeJSON(w, http.StatusNotFound, errMsg("voucher not found"))
+    return
+  }
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  status := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("status")))
+  if status != "" && status != "ACTIVE" && status != "RELEASED" {
+    writeJSON(w, http.StatusBadRequest, errMsg("status must be ACTIVE or RELEASED"))
+    return
+  }
+  rows, err := db.Query(`SELECT vr.id, vr.order_id, o.status, vr.child_code, vr.user_id, u.name, o.customer_name, vr.amount, vr.status, vr.created_at, vr.released_at
+    FROM voucher_redemptions vr
+    JOIN orders o ON vr.order_id = o.id
+    LEFT JOIN users u ON vr.user_id = u.id
+    WHERE vr.voucher_code = $1 AND ($2 = '' OR vr.status = $2)
+    ORDER BY vr.created_at DESC`, code, status)
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  defer rows.Close()
+  items := []map[string]any{}
+  active, released, discount := 0, 0, 0
+  for rows.Next() {
+    var id, orderID, orderStatus, customerName, redemptionStatus, createdAt string
+    var childCode, userID, userName, releasedAt sql.NullString
+    var amount int
+    if err := rows.Scan(&id, &orderID, &orderStatus, &childCode, &userID, &userName, &customerName, &amount, &redemptionStatus, &createdAt, &releasedAt); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    if redemptionStatus == "ACTIVE" {
+      active++
+      discount += amount
+    } else {
+      released++
+    }
+    items = append(items, map[string]any{
+      "id": id,
+      "order_id": orderID,
+      "order_status": orderStatus,
+      "code": childCode.String,
+      "user_id": userID.String,
+      "member_name": userName.String,
+      "customer_name": customerName,
+      "amount": amount,
+      "status": redemptionStatus,
+      "created_at": createdAt,
+      "released_at": releasedAt.String,
+    })
+  }
+  if err := rows.Err(); err != nil {
+    writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+    return
+  }
+  writeJSON(w, http.StatusOK, map[string]any{
+    "code": code,
+    "title": title,
+    "max_uses": maxUses,
+    "uses": uses,
+    "active_redemptions": active,
+    "released_redemptions": released,
+    "total_discount": discount,
+    "redemptions": items,
+  })
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+
+  "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestValidateVoucherRequest(t *testing.T) {
+  cases := []struct {
+    name    string
+    req     VoucherCreateRequest
+    invalid bool
+  }{
+    {"flat", VoucherCreateRequest{Title: "Hemat", DiscountType: "FLAT", DiscountValue: 10000}, false},
+    {"percent with cap", VoucherCreateRequest{Title: "Vitamin", DiscountType: "percent", DiscountValue: 20, MaxDiscount: 25000, CategoryIDs: []string{"cat-1", "cat-1", ""}}, false},
+    {"unknown type", VoucherCreateRequest{Title: "x", DiscountType: "bogo", DiscountValue: 1}, true},
+    {"percent over 100", VoucherCreateRequest{Title: "x", DiscountType: "percent", DiscountValue: 120}, true},
+    {"negative limit", VoucherCreateRequest{Title: "x", DiscountType: "flat", DiscountValue: 1, PerUserLimit: -1}, true},
+    {"bad stacking", VoucherCreateRequest{Title: "x", DiscountType: "flat", DiscountValue: 1, Stacking: "always"}, true},
+    {"bad date", VoucherCreateRequest{Title: "x", DiscountType: "flat", DiscountValue: 1, StartsAt: "01/10/2026"}, true},
+    {"ends before start", VoucherCreateRequest{Title: "x", DiscountType: "flat", DiscountValue: 1, StartsAt: "2026-11-01", ExpiresAt: "2026-10-01"}, true},
+  }
+  for _, tc := range cases {
+    req := tc.req
+    err := validateVoucherRequest(&req)
+    if tc.invalid {
+      if !isInvalid(err) {
+        t.Fatalf("%s: expected invalid error, got %v", tc.name, err)
+      }
+      continue
+    }
+    if err != nil {
+      t.Fatalf("%s: unexpected error: %v", tc.name, err)
+    }
+    if req.Stacking != "stack" {
+      t.Fatalf("%s: expected default stacking, got %q", tc.name, req.Stacking)
+    }
+  }
+
+  req := VoucherCreateRequest{Title: "Vitamin", DiscountType: "percent", DiscountValue: 20, CategoryIDs: []string{"cat-1", " cat-1 ", ""}}
+  if err := validateVoucherRequest(&req); err != nil || len(req.CategoryIDs) != 1 {
+    t.Fatalf("expected category ids deduplicated, got %v (%v)", req.CategoryIDs, err)
+  }
+}
+
+func TestRedeemVoucherRejectsExhaustedQuota(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT parent_code, used_at IS NOT NULL FROM voucher_codes WHERE code = \$1 FOR UPDATE`).
+    WithArgs("HEMAT10").
+    WillReturnRows(sqlmock.NewRows([]string{"parent_code", "used"}))
+  mock.ExpectExec(`UPDATE vouchers SET uses = uses \+ 1 WHERE code = \$1 AND \(max_uses = 0 OR uses < max_uses\)`).
+    WithArgs("HEMAT10").
+    WillReturnResult(sqlmock.NewResult(0, 0))
+  mock.ExpectRollback()
+
+  tx, err := db.Begin()
+  if err != nil {
+    t.Fatalf("begin: %v", err)
+  }
+  err = redeemVoucherTx(tx, "HEMAT10", "user-1", "order-1", 5000)
+  _ = tx.Rollback()
+  if !isInvalid(err) {
+    t.Fatalf("expected quota error, got %v", err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestParentCodeRedeemsUnlessBatchOnly(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  cols := []string{"discount_type", "discount_value", "min_spend", "max_discount", "max_uses", "uses", "per_user_limit",
+    "product_ids", "category_ids", "tiers", "first_order_only", "stacking", "active", "started", "current", "batch_only"}
+  expectParent := func(batchOnly bool) {
+    mock.ExpectQuery(`SELECT parent_code, used_at IS NOT NULL FROM voucher_codes WHERE code = \$1 FOR UPDATE`).
+      WithArgs("GOLDREWARD").
+      WillReturnRows(sqlmock.NewRows([]string{"parent_code", "used"}))
+    mock.ExpectQuery(`, batch_only\s+FROM vouchers WHERE code = \$1 FOR UPDATE`).
+      WithArgs("GOLDREWARD").
+      WillReturnRows(sqlmock.NewRows(cols).
+        AddRow("flat", 20000, 0, 0, 0, 0, 0, "{}", "{}", "{}", false, "stack", true, true, true, batchOnly))
+  }
+
+  mock.ExpectBegin()
+  // a tier reward that also has a flyer batch: the member's own code still works
+  expectParent(false)
+  mock.ExpectQuery(`SELECT used FROM user_vouchers WHERE user_id = \$1 AND code = \$2`).
+    WithArgs("user-1", "GOLDREWARD").
+    WillReturnRows(sqlmock.NewRows([]string{"used"}).AddRow(false))
+  expectParent(true)
+  mock.ExpectRollback()
+
+  tx, err := db.Begin()
+  if err != nil {
+    t.Fatalf("begin: %v", err)
+  }
+  defer tx.Rollback()
+  v, err := loadVoucherTx(tx, "goldreward", "user-1", true)
+  if err != nil || v == nil || v.Value != 20000 {
+    t.Fatalf("expected the parent code to load, got %v (%v)", v, err)
+  }
+  if _, err := loadVoucherTx(tx, "GOLDREWARD", "user-1", true); !isInvalid(err) || err.Error() != "voucher not found" {
+    t.Fatalf("expected a batch_only parent to be refused, got %v", err)
+  }
+  _ = tx.Rollback()
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestReleaseVoucherRedemptionOnce(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`SELECT status, voucher_code, child_code FROM voucher_redemptions WHERE order_id = \$1 FOR UPDATE`).
+    WithArgs("order-1").
+    WillReturnRows(sqlmock.NewRows([]string{"status", "voucher_code", "child_code"}).AddRow("ACTIVE", "HEMAT10", "HEMAT10-7KQ2XMPA"))
+  mock.ExpectExec(`UPDATE voucher_redemptions SET status = 'RELEASED'`).
+    WithArgs("order-1").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectExec(`UPDATE voucher_codes SET used_at = NULL, order_id = NULL`).
+    WithArgs("HEMAT10-7KQ2XMPA", "order-1").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectExec(`UPDATE vouchers SET uses = GREATEST\(uses - 1, 0\)`).
+    WithArgs("HEMAT10").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectExec(`UPDATE user_vouchers SET used = FALSE`).
+    WithArgs("user-1", "HEMAT10").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectQuery(`SELECT status, voucher_code, child_code FROM voucher_redemptions WHERE order_id = \$1 FOR UPDATE`).
+    WithArgs("order-1").
+    WillReturnRows(sqlmock.NewRows([]string{"status", "voucher_code", "child_code"}).AddRow("RELEASED", "HEMAT10", "HEMAT10-7KQ2XMPA"))
+  mock.ExpectCommit()
+
+  tx, err := db.Begin()
+  if err != nil {
+    t.Fatalf("begin: %v", err)
+  }
+  if err := releaseVoucherRedemptionTx(tx, "order-1", "HEMAT10-7KQ2XMPA", "user-1"); err != nil {
+    t.Fatalf("release: %v", err)
+  }
+  if err := releaseVoucherRedemptionTx(tx, "order-1", "HEMAT10-7KQ2XMPA", "user-1"); err != nil {
+    t.Fatalf("second release: %v", err)
+  }
+  if err := tx.Commit(); err != nil {
+    t.Fatalf("commit: %v", err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
+
+func TestGenerateVoucherCode(t *testing.T) {
+  if got, err := voucherBatchPrefix(" hemat-10 oktober!", "X"); err != nil || got != "HEMAT10OKTOB" {
+    t.Fatalf("unexpected prefix %q (%v)", got, err)
+  }
+  if got, err := voucherBatchPrefix("", "PROMO"); err != nil || got != "" {
+    t.Fatalf("expected no prefix by default, got %q (%v)", got, err)
+  }
+  // the parent code would be readable off every flyer code
+  if _, err := voucherBatchPrefix("promo-10", "PROMO10"); !isInvalid(err) {
+    t.Fatalf("expected the parent code to be refused as prefix, got %v", err)
+  }
+
+  seen := map[string]bool{}
+  for i := 0; i < 500; i++ {
+    code, err := generateVoucherCode("HEMAT10")
+    if err != nil {
+      t.Fatalf("generate: %v", err)
+    }
+    random, ok := strings.CutPrefix(code, "HEMAT10-")
+    if !ok || len(random) != voucherCodeRandomPart {
+      t.Fatalf("unexpected code format %q", code)
+    }
+    for _, c := range random {
+      if !strings.ContainsRune(voucherCodeAlphabet, c) {
+        t.Fatalf("code %q has character outside the alphabet", code)
+      }
+    }
+    if seen[code] {
+      t.Fatalf("duplicate code %q", code)
+    }
+    seen[code] = true
+  }
+}
+
+func TestVoucherBatchMakesParentBatchOnly(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM vouchers WHERE code = \$1\)`).
+    WithArgs("FLYER10").
+    WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+  mock.ExpectBegin()
+  mock.ExpectQuery(`INSERT INTO voucher_code_batches`).
+    WithArgs("FLYER10", "", 2, "admin-1").
+    WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("batch-1"))
+  mock.ExpectExec(`INSERT INTO voucher_codes`).
+    WithArgs(sqlmock.AnyArg(), "FLYER10", "batch-1").
+    WillReturnResult(sqlmock.NewResult(0, 2))
+  mock.ExpectExec(`UPDATE vouchers SET batch_only = TRUE WHERE code = \$1`).
+    WithArgs("FLYER10").
+    WillReturnResult(sqlmock.NewResult(0, 1))
+  mock.ExpectCommit()
+  mock.ExpectQuery(`SELECT code, used_at, order_id FROM voucher_codes`).
+    WithArgs("FLYER10", "batch-1").
+    WillReturnRows(sqlmock.NewRows([]string{"code", "used_at", "order_id"}).
+      AddRow("K7M2Q9XA", nil, nil).
+      AddRow("P3RT8WZC", nil, nil))
+
+  req := httptest.NewRequest(http.MethodPost, "/admin/vouchers/FLYER10/batch", strings.NewReader(`{"count":2}`))
+  rec := httptest.NewRecorder()
+
+  adminVoucherBatchHandler(db, "flyer10", "admin-1", rec, req)
+
+  if rec.Code != http.StatusOK {
+    t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+  }
+  // codes carry no prefix by default, so none of them reveals FLYER10
+  if strings.Contains(rec.Body.String(), "FLYER10-") {
+    t.Fatalf("expected unprefixed codes, got %s", rec.Body.String())
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("mock expectations: %v", err)
+  }
+}
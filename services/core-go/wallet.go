@@ -0,0 +1,306 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "strconv"
+  "strings"
+)
+
+const (
+  walletCredit = "CREDIT"
+  walletDebit  = "DEBIT"
+)
+
+var walletKinds = map[string]string{
+  "CASHBACK":          walletCredit,
+  "CASHBACK_REVERSAL": walletDebit,
+  "SPEND":             walletDebit,
+  "SPEND_REFUND":      walletCredit,
+  "ADJUSTMENT":        "",
+}
+
+type walletEntry struct {
+  UserID    string
+  Kind      string
+  Direction string
+  Amount    int
+  OrderID   string
+  ActorType string
+  ActorID   string
+  Reason    string
+}
+
+type WalletAdjustmentRequest struct {
+  Amount int    `json:"amount"`
+  Reason string `json:"reason"`
+}
+
+// the only place wallet_balance changes: the balance moves and the ledger row is written
+// in the same statement pair, so the balance always equals the ledger sum. Debits never
+// take the balance below zero.
+func postWalletEntryTx(tx *sql.Tx, e walletEntry) (int, error) {
+  direction, ok := walletKinds[e.Kind]
+  if !ok {
+    return 0, errInvalid("invalid wallet kind")
+  }
+  if direction == "" {
+    direction = e.Direction
+  }
+  if direction != walletCredit && direction != walletDebit {
+    return 0, errInvalid("invalid wallet direction")
+  }
+  if e.Amount <= 0 {
+    return 0, errInvalid("amount must be positive")
+  }
+  delta := e.Amount
+  if direction == walletDebit {
+    delta = -e.Amount
+  }
+  var after int
+  err := tx.QueryRow(`UPDATE users SET wallet_balance = wallet_balance + $1 WHERE id = $2 AND wallet_balance + $1 >= 0 RETURNING wallet_balance`,
+    delta, e.UserID).Scan(&after)
+  if err == sql.ErrNoRows {
+    return 0, errInvalid("wallet balance not enough")
+  }
+  if err != nil {
+    return 0, err
+  }
+  _, err = tx.Exec(`INSERT INTO wallet_transactions (user_id, kind, direction, amount, balance_after, order_id, actor_type, actor_id, reason)
+    VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)`,
+    e.UserID, e.Kind, direction, e.Amount, after, nullIfEmpty(e.OrderID), e.ActorType, nullIfEmpty(e.ActorID), nullIfEmpty(e.Reason))
+  return after, err
+}
+
+func loadWalletTransactions(db *sql.DB, userID string, limit int) ([]map[string]any, error) {
+  rows, err := db.Query(`SELECT t.id, t.kind, t.direction, t.amount, t.balance_after, t.order_id, t.actor_type, t.actor_id, u.name, t.reason, t.created_at
+    FROM wallet_transactions t LEFT JOIN users u ON t.actor_id = u.id
+    WHERE t.user_id = $1
+    ORDER BY t.created_at DESC, t.id
+    LIMIT $2`, userID, limit)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  out := []map[string]any{}
+  for rows.Next() {
+    var id, kind, direction, actorType, createdAt string
+    var orderID, actorID, actorName, reason sql.NullString
+    var amount, balanceAfter int
+    if err := rows.Scan(&id, &kind, &direction, &amount, &balanceAfter, &orderID, &actorType, &actorID, &actorName, &reason, &createdAt); err != nil {
+      return nil, err
+    }
+    out = append(out, map[string]any{
+      "id":            id,
+      "kind":          kind,
+      "direction":     direction,
+      "amount":        amount,
+      "balance_after": balanceAfter,
+      "order_id":      orderID.String,
+      "actor_type":    actorType,
+      "actor_id":      actorID.String,
+      "actor_name":    actorName.String,
+      "reason":        reason.String,
+      "created_at":    createdAt,
+    })
+  }
+  return out, rows.Err()
+}
+
+func walletLimit(r *http.Request) int {
+  limit := 50
+  if s := r.URL.Query().Get("limit"); s != "" {
+    if n, err := strconv.Atoi(s); err == nil && n > 0 && n <= 500 {
+      limit = n
+    }
+  }
+  return limit
+}
+
+func meWalletHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+      return
+    }
+    userID, err := getUserIDFromToken(db, r)
+    if err != nil {
+      writeJSON(w, http.StatusUnauthorized, errMsg("unauthorized"))
+      return
+    }
+    var balance int
+    if err := db.QueryRow(`SELECT wallet_balance FROM users WHERE id = $1`, userID).Scan(&balance); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    pending, err := pendingCashback(db, userID)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    txs, err := loadWalletTransactions(db, userID, walletLimit(r))
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{"balance": balance, "pending": pending, "transactions": txs})
+  }
+}
+
+func adminMemberWalletHandler(db *sql.DB, userID string, w http.ResponseWriter, r *http.Request) {
+  switch r.Method {
+  case http.MethodGet:
+    var balance int
+    err := db.QueryRow(`SELECT wallet_balance FROM users WHERE id = $1`, userID).Scan(&balance)
+    if err == sql.ErrNoRows {
+      writeJSON(w, http.StatusNotFound, errMsg("member not found"))
+      return
+    }
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    pending, err := pendingCashback(db, userID)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    txs, err := loadWalletTransactions(db, userID, walletLimit(r))
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{"user_id": userID, "balance": balance, "pending": pending, "transactions": txs})
+  case http.MethodPost:
+    adminID, err := requireRoles(db, r, "owner", "admin")
+    if err != nil {
+      writeRoleError(w, err)
+      return
+    }
+    var req WalletAdjustmentRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+      writeJSON(w, http.StatusBadRequest, errMsg("invalid json"))
+      return
+    }
+    req.Reason = strings.TrimSpace(req.Reason)
+    if req.Amount == 0 || req.Reason == "" {
+      writeJSON(w, http.StatusBadRequest, errMsg("non-zero amount and reason required"))
+      return
+    }
+    e := walletEntry{UserID: userID, Kind: "ADJUSTMENT", Direction: walletCredit, Amount: req.Amount, ActorType: "admin", ActorID: adminID, Reason: req.Reason}
+    if req.Amount < 0 {
+      e.Direction = walletDebit
+      e.Amount = -req.Amount
+    }
+    tx, err := db.Begin()
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("db error"))
+      return
+    }
+    defer tx.Rollback()
+    var exists bool
+    if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    if !exists {
+      writeJSON(w, http.StatusNotFound, errMsg("member not found"))
+      return
+    }
+    balance, err := postWalletEntryTx(tx, e)
+    if err != nil {
+      if isInvalid(err) {
+        writeJSON(w, http.StatusBadRequest, errMsg(err.Error()))
+        return
+      }
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    if err := tx.Commit(); err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg("db commit failed"))
+      return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{"user_id": userID, "balance": balance})
+  default:
+    writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+  }
+}
+
+type walletMismatch struct {
+  UserID  string
+  Name    string
+  Balance int
+  Ledger  int
+}
+
+func findWalletMismatches(db *sql.DB) ([]walletMismatch, error) {
+  rows, err := db.Query(`SELECT u.id, u.name, u.wallet_balance,
+      COALESCE(SUM(CASE t.direction WHEN 'CREDIT' THEN t.amount ELSE -t.amount END), 0)
+    FROM users u LEFT JOIN wallet_transactions t ON t.user_id = u.id
+    GROUP BY u.id
+    HAVING u.wallet_balance <> COALESCE(SUM(CASE t.direction WHEN 'CREDIT' THEN t.amount ELSE -t.amount END), 0)
+    ORDER BY u.name`)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  out := []walletMismatch{}
+  for rows.Next() {
+    var m walletMismatch
+    if err := rows.Scan(&m.UserID, &m.Name, &m.Balance, &m.Ledger); err != nil {
+      return nil, err
+    }
+    out = append(out, m)
+  }
+  return out, rows.Err()
+}
+
+func adminWalletReconcileHandler(db *sql.DB) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+      writeJSON(w, http.StatusMethodNotAllowed, errMsg("method not allowed"))
+      return
+    }
+    if _, err := requireRoles(db, r, "owner", "admin"); err != nil {
+      writeRoleError(w, err)
+      return
+    }
+    mismatches, err := findWalletMismatches(db)
+    if err != nil {
+      writeJSON(w, http.StatusInternalServerError, errMsg(err.Error()))
+      return
+    }
+    out := []map[string]any{}
+    for _, m := range mismatches {
+      out = append(out, map[string]any{
+        "user_id":    m.UserID,
+        "name":       m.Name,
+        "balance":    m.Balance,
+        "ledger":     m.Ledger,
+        "difference": m.Balance - m.Ledger,
+      })
+    }
+    writeJSON(w, http.StatusOK, out)
+  }
+}
+
+// `core-go check-wallets` prints every member whose balance disagrees with the ledger
+// and exits non-zero when there is any, so it can run from cron or CI
+func runWalletCheck(db *sql.DB) int {
+  mismatches, err := findWalletMismatches(db)
+  if err != nil {
+    fmt.Printf("wallet check failed: %v\n", err)
+    return 2
+  }
+  for _, m := range mismatches {
+    fmt.Printf("%s\t%s\tbalance=%d\tledger=%d\tdifference=%d\n", m.UserID, m.Name, m.Balance, m.Ledger, m.Balance-m.Ledger)
+  }
+  if len(mismatches) > 0 {
+    fmt.Printf("%d wallet(s) out of balance\n", len(mismatches))
+    return 1
+  }
+  fmt.Println("all wallets match the ledger")
+  return 0
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+  "testing"
+
+  "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPostWalletEntryWritesLedger(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`UPDATE users SET wallet_balance = wallet_balance \+ \$1 WHERE id = \$2 AND wallet_balance \+ \$1 >= 0 RETURNING wallet_balance`).
+    WithArgs(15000, "user-1").
+    WillReturnRows(sqlmock.NewRows([]string{"wallet_balance"}).AddRow(40000))
+  mock.ExpectExec(`INSERT INTO wallet_transactions`).
+    WithArgs("user-1", "CASHBACK", walletCredit, 15000, 40000, "order-1", "system", nil, nil).
+    WillReturnResult(sqlmock.NewResult(0, 1))
+
+  tx, _ := db.Begin()
+  balance, err := postWalletEntryTx(tx, walletEntry{UserID: "user-1", Kind: "CASHBACK", Amount: 15000, OrderID: "order-1", ActorType: "system"})
+  if err != nil || balance != 40000 {
+    t.Fatalf("expected balance 40000, got %d (%v)", balance, err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("unmet expectations: %v", err)
+  }
+}
+
+func TestPostWalletEntryRefusesOverdraft(t *testing.T) {
+  db, mock, err := sqlmock.New()
+  if err != nil {
+    t.Fatalf("sqlmock: %v", err)
+  }
+  defer db.Close()
+
+  mock.ExpectBegin()
+  mock.ExpectQuery(`UPDATE users SET wallet_balance = wallet_balance \+ \$1`).
+    WithArgs(-50000, "user-1").
+    WillReturnRows(sqlmock.NewRows([]string{"wallet_balance"}))
+
+  tx, _ := db.Begin()
+  _, err = postWalletEntryTx(tx, walletEntry{UserID: "user-1", Kind: "ADJUSTMENT", Direction: walletDebit, Amount: 50000, ActorType: "admin", Reason: "correction"})
+  if !isInvalid(err) {
+    t.Fatalf("expected invalid error, got %v", err)
+  }
+  if _, err := postWalletEntryTx(tx, walletEntry{UserID: "user-1", Kind: "BONUS", Amount: 1}); !isInvalid(err) {
+    t.Fatalf("expected unknown kind to be rejected, got %v", err)
+  }
+  if err := mock.ExpectationsWereMet(); err != nil {
+    t.Fatalf("unmet expectations: %v", err)
+  }
+}